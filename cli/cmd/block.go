@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+)
+
+func openBlockdagForNetwork(cmdCtx *cli.Context) (nakamoto.BlockDAG, error) {
+	dbPath := cmdCtx.String("db")
+	network := cmdCtx.String("network")
+
+	networks := getNetworks()
+	conf, ok := networks[network]
+	if !ok {
+		return nakamoto.BlockDAG{}, fmt.Errorf("Unknown network: %s", network)
+	}
+	dag, _, _, err := newBlockdag(dbPath, conf)
+	return dag, err
+}
+
+func parseBlockHash(hashStr string) ([32]byte, error) {
+	buf, err := hex.DecodeString(hashStr)
+	if err != nil || len(buf) != 32 {
+		return [32]byte{}, fmt.Errorf("Invalid block hash: %s", hashStr)
+	}
+	hash := [32]byte{}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+func RunInvalidateBlock(cmdCtx *cli.Context) error {
+	hash, err := parseBlockHash(cmdCtx.String("hash"))
+	if err != nil {
+		return err
+	}
+	dag, err := openBlockdagForNetwork(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer dag.GetDB().Close()
+
+	err = dag.InvalidateBlock(hash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Invalidated block %x\n", hash)
+	fmt.Printf("Full tip: height=%d hash=%s\n", dag.FullTip.Height, dag.FullTip.HashStr())
+	return nil
+}
+
+func RunReconsiderBlock(cmdCtx *cli.Context) error {
+	hash, err := parseBlockHash(cmdCtx.String("hash"))
+	if err != nil {
+		return err
+	}
+	dag, err := openBlockdagForNetwork(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer dag.GetDB().Close()
+
+	err = dag.ReconsiderBlock(hash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Reconsidered block %x\n", hash)
+	fmt.Printf("Full tip: height=%d hash=%s\n", dag.FullTip.Height, dag.FullTip.HashStr())
+	return nil
+}
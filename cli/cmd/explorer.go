@@ -16,7 +16,10 @@ func RunExplorer(cmdCtx *cli.Context) error {
 
 	// DAG.
 	networks := getNetworks()
-	dag, _, _ := newBlockdag(dbPath, networks["testnet1"])
+	dag, _, _, err := newBlockdag(dbPath, networks["testnet1"])
+	if err != nil {
+		return err
+	}
 
 	// Handle process signals.
 	c := make(chan os.Signal, 1)
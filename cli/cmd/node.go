@@ -9,6 +9,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"maps"
 	"math/big"
 	"net/url"
 	"os"
@@ -40,42 +41,67 @@ func getNetworks() map[string]nakamoto.ConsensusConfig {
 	genesisBlockHash := [32]byte{}
 	copy(genesisBlockHash[:], genesisBlockHash_)
 
+	// testnet1 upgrades at a height above its current tip, so its existing blocks remain valid under the old rules.
+	testnet1UpgradeHeight := uint64(100_000)
+
 	network_testnet1 := nakamoto.ConsensusConfig{
 		EpochLengthBlocks:       10,
 		TargetEpochLengthMillis: 1000 * 60, // 1min, 1 block every 10s
 		GenesisDifficulty:       *genesis_difficulty,
 		GenesisParentBlockHash:  genesisBlockHash,
 		MaxBlockSizeBytes:       2 * 1024 * 1024, // 2MB
+		CoinbaseMaturity:        100,
+		// The hash function is not upgraded, as that would change the hashes of its existing blocks.
+		Upgrades: map[string]uint64{
+			nakamoto.UpgradeCoinbaseHeight:      testnet1UpgradeHeight,
+			nakamoto.UpgradeCoinbaseMaturity:    testnet1UpgradeHeight,
+			nakamoto.UpgradeWitnessMerkleLeaves: testnet1UpgradeHeight,
+			nakamoto.UpgradeLowS:                testnet1UpgradeHeight,
+		},
 	}
 
+	// A ZK-friendly variant of testnet1, which hashes blocks with Poseidon.
+	// As it is a new network, all upgrades are active from genesis.
+	network_zktestnet1 := network_testnet1
+	network_zktestnet1.HashFunction = core.HashFunctionPoseidon
+	network_zktestnet1.Upgrades = maps.Clone(network_testnet1.Upgrades)
+	network_zktestnet1.Upgrades[nakamoto.UpgradeCoinbaseHeight] = 0
+	network_zktestnet1.Upgrades[nakamoto.UpgradeCoinbaseMaturity] = 0
+	network_zktestnet1.Upgrades[nakamoto.UpgradeWitnessMerkleLeaves] = 0
+	network_zktestnet1.Upgrades[nakamoto.UpgradeLowS] = 0
+	network_zktestnet1.Upgrades[nakamoto.UpgradeHashFunction] = 0
+
 	networks := map[string]nakamoto.ConsensusConfig{
 		"testnet1":   network_testnet1,
 		"terrydavis": network_testnet1,
+		"zktestnet1": network_zktestnet1,
 	}
 
 	return networks
 }
 
-func newBlockdag(dbPath string, conf nakamoto.ConsensusConfig) (nakamoto.BlockDAG, nakamoto.ConsensusConfig, *sql.DB) {
+func newBlockdag(dbPath string, conf nakamoto.ConsensusConfig) (nakamoto.BlockDAG, nakamoto.ConsensusConfig, *sql.DB, error) {
 	// TODO validate connection string.
 	fmt.Println("database path: ", dbPath)
 	db, err := nakamoto.OpenDB(dbPath)
 	if err != nil {
-		panic(err)
+		return nakamoto.BlockDAG{}, conf, nil, fmt.Errorf("Failed to open database %s: %w", dbPath, err)
 	}
 	_, err = db.Exec("PRAGMA journal_mode = WAL;")
 	if err != nil {
-		panic(err)
+		db.Close()
+		return nakamoto.BlockDAG{}, conf, nil, fmt.Errorf("Failed to open database %s: %w", dbPath, err)
 	}
 
 	stateMachine := newMockStateMachine()
 
 	blockdag, err := nakamoto.NewBlockDAGFromDB(db, stateMachine, conf)
 	if err != nil {
-		panic(err)
+		db.Close()
+		return nakamoto.BlockDAG{}, conf, nil, fmt.Errorf("Failed to load block DAG: %w", err)
 	}
 
-	return blockdag, conf, db
+	return blockdag, conf, db, nil
 }
 
 func getMinerWallet(db *sql.DB) (*core.Wallet, error) {
@@ -106,18 +132,73 @@ func getMinerWallet(db *sql.DB) (*core.Wallet, error) {
 	return minerWallet, nil
 }
 
+func getWalletAccounts(db *sql.DB) ([][65]byte, error) {
+	walletsStore, err := nakamoto.LoadDataStore[nakamoto.WalletsStore](db, "wallets")
+	if err != nil {
+		return nil, err
+	}
+	accounts := [][65]byte{}
+	for _, userWallet := range walletsStore.Wallets {
+		wallet, err := core.WalletFromPrivateKey(userWallet.PrivateKeyString)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, wallet.PubkeyBytes())
+	}
+	return accounts, nil
+}
+
 func RunNode(cmdCtx *cli.Context) error {
+	return runNode(cmdCtx, nil)
+}
+
+// Runs the node as a mining pool, serving work and paying out miners from the node's miner wallet.
+func RunPool(cmdCtx *cli.Context) error {
+	poolPort := cmdCtx.String("pool-port")
+	shareMultiplier := cmdCtx.Int64("share-multiplier")
+	pplnsWindow := cmdCtx.Int("pplns-window")
+	minPayout := cmdCtx.Uint64("min-payout")
+
+	if shareMultiplier < 1 {
+		return fmt.Errorf("Invalid share multiplier: %d", shareMultiplier)
+	}
+	if pplnsWindow < 1 {
+		return fmt.Errorf("Invalid PPLNS window: %d", pplnsWindow)
+	}
+
+	return runNode(cmdCtx, func(node *nakamoto.Node) {
+		pool := node.EnablePool("0.0.0.0", poolPort)
+		pool.ShareTargetMultiplier = shareMultiplier
+		pool.PPLNSWindow = pplnsWindow
+		pool.MinPayout = minPayout
+	})
+}
+
+// Runs the node. The optional setup func configures the node before it starts.
+func runNode(cmdCtx *cli.Context, setup func(node *nakamoto.Node)) error {
 	port := cmdCtx.String("port")
 	dbPath := cmdCtx.String("db")
 	bootstrapPeers := cmdCtx.String("peers")
 	runMiner := cmdCtx.Bool("miner")
+	runLight := cmdCtx.Bool("light")
 	runExplorer := cmdCtx.Bool("explorer")
 	network := cmdCtx.String("network")
 	graffitiTag := cmdCtx.String("miner-tag")
+	minerThreads := cmdCtx.Int("miner-threads")
+	miningRpcPort := cmdCtx.String("mining-rpc-port")
+	peerTransport := cmdCtx.String("peer-transport")
+	maxPeers := cmdCtx.Int("max-peers")
+	maxGetBlocks := cmdCtx.Int("max-get-blocks")
 
 	if network == "" {
 		network = "testnet1"
 	}
+	if runLight && runMiner {
+		return fmt.Errorf("Cannot run the miner in light mode.")
+	}
+	if peerTransport != "" && peerTransport != "http" && peerTransport != "stream" {
+		return fmt.Errorf("Unknown peer transport: %s", peerTransport)
+	}
 
 	// DAG.
 	networks := getNetworks()
@@ -130,7 +211,10 @@ func RunNode(cmdCtx *cli.Context) error {
 		fmt.Printf("Available networks: %s\n", strings.Join(availableNetworks, ", "))
 		return fmt.Errorf("Unknown network: %s", network)
 	}
-	dag, _, db := newBlockdag(dbPath, conf)
+	dag, _, db, err := newBlockdag(dbPath, conf)
+	if err != nil {
+		return err
+	}
 
 	// Miner.
 	minerWallet, err := getMinerWallet(db)
@@ -140,13 +224,40 @@ func RunNode(cmdCtx *cli.Context) error {
 	fmt.Printf("Miner wallet: %x\n", minerWallet.PubkeyBytes())
 	miner := nakamoto.NewMiner(dag, minerWallet)
 	miner.GraffitiTag = nakamoto.StringToBytes32(graffitiTag)
+	miner.NumWorkers = minerThreads
 
 	// Peer.
 	peer := nakamoto.NewPeerCore(nakamoto.NewPeerConfig("0.0.0.0", port, []string{}))
+	if peerTransport == "stream" {
+		peer.EnableStreamTransport()
+	}
+	peer.MaxPeers = maxPeers
+	peer.MaxGetBlocks = maxGetBlocks
 
 	// Create the node.
 	node := nakamoto.NewNode(&dag, miner, peer)
 
+	// Light mode tracks all of our wallets.
+	if runLight {
+		accounts, err := getWalletAccounts(db)
+		if err != nil {
+			return err
+		}
+		node.EnableLightMode(accounts)
+	}
+
+	// Serve work to external miners.
+	if miningRpcPort != "" {
+		if runLight {
+			return fmt.Errorf("Cannot run the mining RPC in light mode.")
+		}
+		node.EnableMiningServer("127.0.0.1", miningRpcPort)
+	}
+
+	if setup != nil {
+		setup(node)
+	}
+
 	// Handle process signals.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
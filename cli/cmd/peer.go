@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+)
+
+// Peers and bans are stored in the database's network store, which the node loads on startup. Edit bans while the node
+// is stopped, as the node saves its own bans on shutdown.
+
+func openNetworkStore(cmdCtx *cli.Context) (*sql.DB, *nakamoto.NetworkStore, error) {
+	db, err := nakamoto.OpenDB(cmdCtx.String("db"))
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := nakamoto.LoadDataStore[nakamoto.NetworkStore](db, "network")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, store, nil
+}
+
+func RunListPeers(cmdCtx *cli.Context) error {
+	db, store, err := openNetworkStore(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, peer := range store.PeerCache {
+		lastSeen := time.UnixMilli(int64(peer.LastSeen)).Format(time.RFC3339)
+		fmt.Printf("addr=%s peerId=%s version=%q wireProtocolVersion=%d tipHeight=%d lastSeen=%s\n", peer.Addr, peer.PeerId, peer.ClientVersion, peer.WireProtocolVersion, peer.TipHeight, lastSeen)
+	}
+	fmt.Printf("%d peers\n", len(store.PeerCache))
+	return nil
+}
+
+func RunListBans(cmdCtx *cli.Context) error {
+	db, store, err := openNetworkStore(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := uint64(time.Now().UnixMilli())
+	active := 0
+	for _, ban := range store.Bans {
+		if now < ban.Until {
+			fmt.Println(ban.String())
+			active++
+		}
+	}
+	fmt.Printf("%d banned peers\n", active)
+	return nil
+}
+
+func RunBanPeer(cmdCtx *cli.Context) error {
+	addr := cmdCtx.String("addr")
+	peerId := cmdCtx.String("peer-id")
+	if addr == "" && peerId == "" {
+		return fmt.Errorf("Either --addr or --peer-id is required.")
+	}
+
+	db, store, err := openNetworkStore(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ban := nakamoto.PeerBan{
+		Addr:   addr,
+		PeerId: peerId,
+		Reason: cmdCtx.String("reason"),
+		Until:  uint64(time.Now().Add(cmdCtx.Duration("duration")).UnixMilli()),
+	}
+	store.Bans = append(store.Bans, ban)
+	if err := nakamoto.SaveDataStore(db, "network", *store); err != nil {
+		return err
+	}
+
+	fmt.Printf("Banned peer: %s\n", ban)
+	return nil
+}
+
+func RunUnbanPeer(cmdCtx *cli.Context) error {
+	peer := cmdCtx.String("peer")
+
+	db, store, err := openNetworkStore(cmdCtx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	bans := []nakamoto.PeerBan{}
+	for _, ban := range store.Bans {
+		if ban.Addr != peer && ban.PeerId != peer {
+			bans = append(bans, ban)
+		}
+	}
+	if len(bans) == len(store.Bans) {
+		return fmt.Errorf("No bans found for peer: %s", peer)
+	}
+	removed := len(store.Bans) - len(bans)
+	store.Bans = bans
+	if err := nakamoto.SaveDataStore(db, "network", *store); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d bans for peer %s\n", removed, peer)
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/liamzebedee/tinychain-go/cli/cmd"
 	"github.com/urfave/cli/v2"
@@ -40,6 +41,21 @@ func main() {
 						Usage: "Run the miner",
 						Value: false,
 					},
+					&cli.BoolFlag{
+						Name:  "light",
+						Usage: "Run as a light client, syncing block headers only and tracking your wallets' transactions",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:  "miner-threads",
+						Usage: "The number of threads to mine with (default: the number of CPUs)",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "mining-rpc-port",
+						Usage: "Serve the getwork/submitwork mining RPC for external miners on this port (localhost only)",
+						Value: "",
+					},
 					&cli.StringFlag{
 						Name:  "miner-tag",
 						Usage: "Sets the graffiti tag you put into blocks you've mined",
@@ -55,6 +71,191 @@ func main() {
 						Usage: "The network to run on",
 						Value: "testnet1",
 					},
+					&cli.StringFlag{
+						Name:  "peer-transport",
+						Usage: "How messages are sent to peers: http (one request per message) or stream (persistent, encrypted connections)",
+						Value: "http",
+					},
+					&cli.IntFlag{
+						Name:  "max-peers",
+						Usage: "The maximum number of peers to connect to (0 for no limit)",
+						Value: 20,
+					},
+					&cli.IntFlag{
+						Name:  "max-get-blocks",
+						Usage: "The maximum number of blocks served to a peer in a single request (0 for no limit)",
+						Value: 10,
+					},
+				},
+			},
+			{
+				Name:   "pool",
+				Usage:  "runs the tinychain node as a mining pool",
+				Action: cmd.RunPool,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "port",
+						Usage: "The port to run the node on",
+						Value: "8080",
+					},
+					&cli.StringFlag{
+						Name:     "db",
+						Usage:    "The path to the tinychain database",
+						Value:    "tinychain.db",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "peers",
+						Usage: "A list of comma-separated peer URL's used to bootstrap connection to the network",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "network",
+						Usage: "The network to run on",
+						Value: "testnet1",
+					},
+					&cli.StringFlag{
+						Name:  "peer-transport",
+						Usage: "How messages are sent to peers: http (one request per message) or stream (persistent, encrypted connections)",
+						Value: "http",
+					},
+					&cli.IntFlag{
+						Name:  "max-peers",
+						Usage: "The maximum number of peers to connect to (0 for no limit)",
+						Value: 20,
+					},
+					&cli.IntFlag{
+						Name:  "max-get-blocks",
+						Usage: "The maximum number of blocks served to a peer in a single request (0 for no limit)",
+						Value: 10,
+					},
+					&cli.StringFlag{
+						Name:  "miner-tag",
+						Usage: "Sets the graffiti tag you put into blocks the pool has mined",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "pool-port",
+						Usage: "The port to serve the pool on",
+						Value: "3333",
+					},
+					&cli.Int64Flag{
+						Name:  "share-multiplier",
+						Usage: "How many times easier a share is to find than a block",
+						Value: 1024,
+					},
+					&cli.IntFlag{
+						Name:  "pplns-window",
+						Usage: "The number of recent shares a block reward is split over",
+						Value: 1000,
+					},
+					&cli.Uint64Flag{
+						Name:  "min-payout",
+						Usage: "The minimum balance owed to a miner before it is paid out",
+						Value: 1,
+					},
+				},
+			},
+			{
+				Name:  "block",
+				Usage: "manages the validity of blocks in the local block DAG",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "db",
+						Usage:    "The path to the tinychain database",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "network",
+						Usage: "The network the database belongs to",
+						Value: "testnet1",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:   "invalidate",
+						Usage:  "marks a block invalid, excluding it and its descendants from the chain tip",
+						Action: cmd.RunInvalidateBlock,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "hash",
+								Usage:    "The hash of the block",
+								Required: true,
+							},
+						},
+					},
+					{
+						Name:   "reconsider",
+						Usage:  "removes the invalid status from a block and its descendants",
+						Action: cmd.RunReconsiderBlock,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "hash",
+								Usage:    "The hash of the block",
+								Required: true,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "peer",
+				Usage: "manages the peers and banned peers in the local database",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "db",
+						Usage:    "The path to the tinychain database",
+						Required: true,
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "lists the peers the node was connected to when it last shut down",
+						Action: cmd.RunListPeers,
+					},
+					{
+						Name:   "bans",
+						Usage:  "lists banned peers",
+						Action: cmd.RunListBans,
+					},
+					{
+						Name:   "ban",
+						Usage:  "bans a peer by its address and/or peer ID",
+						Action: cmd.RunBanPeer,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "addr",
+								Usage: "The peer's address, e.g. http://1.2.3.4:8080",
+							},
+							&cli.StringFlag{
+								Name:  "peer-id",
+								Usage: "The peer's ID",
+							},
+							&cli.DurationFlag{
+								Name:  "duration",
+								Usage: "How long to ban the peer for",
+								Value: 24 * time.Hour,
+							},
+							&cli.StringFlag{
+								Name:  "reason",
+								Usage: "The reason for the ban",
+								Value: "Banned manually",
+							},
+						},
+					},
+					{
+						Name:   "unban",
+						Usage:  "removes the bans for a peer",
+						Action: cmd.RunUnbanPeer,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "peer",
+								Usage:    "The peer's address or ID",
+								Required: true,
+							},
+						},
+					},
 				},
 			},
 			{
@@ -2,8 +2,45 @@ package core
 
 import (
 	"crypto/sha256"
+	"fmt"
 )
 
+// A hash function used by consensus, for block hashes, the proof-of-work puzzle and merkle trees.
+type Hasher interface {
+	Hash(data []byte) [32]byte
+}
+
+// The names of the hash functions, as used in the consensus configuration.
+const (
+	HashFunctionSHA256   = "sha256"
+	HashFunctionPoseidon = "poseidon"
+)
+
+type SHA256Hasher struct{}
+
+func (h SHA256Hasher) Hash(data []byte) [32]byte {
+	return HashSHA2(data)
+}
+
+// Poseidon is a ZK-friendly hash function, which is much cheaper to prove inside a SNARK circuit than SHA256.
+type PoseidonHasher struct{}
+
+func (h PoseidonHasher) Hash(data []byte) [32]byte {
+	return HashPoseidon(data)
+}
+
+// Gets the hash function by name. The empty name selects SHA256.
+func GetHasher(name string) (Hasher, error) {
+	switch name {
+	case "", HashFunctionSHA256:
+		return SHA256Hasher{}, nil
+	case HashFunctionPoseidon:
+		return PoseidonHasher{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown hash function: %s", name)
+	}
+}
+
 func Hash(data []byte) [32]byte {
 	return HashSHA2(data)
 }
@@ -11,8 +48,3 @@ func Hash(data []byte) [32]byte {
 func HashSHA2(data []byte) [32]byte {
 	return sha256.Sum256(data)
 }
-
-func HashPoseidon(data []byte) [32]byte {
-	// TODO: implement.
-	return [32]byte{}
-}
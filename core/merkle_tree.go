@@ -1,19 +1,96 @@
 package core
 
 import (
-	"crypto/sha256"
+	"fmt"
 )
 
 // Builds a Merkle tree from a list of items and returns the root hash.
-func ComputeMerkleHash(items [][]byte) [32]byte {
+func ComputeMerkleHash(h Hasher, items [][]byte) [32]byte {
 	if len(items) == 0 {
 		return [32]byte{}
 	}
 	if len(items) == 1 {
-		return sha256.Sum256(items[0])
+		return h.Hash(items[0])
 	}
 	mid := len(items) / 2
-	left := ComputeMerkleHash(items[:mid])
-	right := ComputeMerkleHash(items[mid:])
-	return sha256.Sum256(append(left[:], right[:]...))
+	left := ComputeMerkleHash(h, items[:mid])
+	right := ComputeMerkleHash(h, items[mid:])
+	return h.Hash(append(left[:], right[:]...))
+}
+
+// A Merkle inclusion proof for a single item in a tree built by ComputeMerkleHash.
+// The siblings are ordered from the leaf up to the root.
+type MerkleProof struct {
+	Index     uint64     `json:"index"`
+	NumLeaves uint64     `json:"num_leaves"`
+	Siblings  [][32]byte `json:"siblings"`
+}
+
+// Computes the Merkle inclusion proof for the item at the given index.
+func ComputeMerkleProof(h Hasher, items [][]byte, index int) (MerkleProof, error) {
+	if index < 0 || len(items) <= index {
+		return MerkleProof{}, fmt.Errorf("Index %d out of bounds for %d items.", index, len(items))
+	}
+
+	// Descend from the root to the leaf, collecting the hash of the other branch at each level.
+	siblings := [][32]byte{}
+	lo, hi := 0, len(items)
+	for 1 < hi-lo {
+		mid := lo + (hi-lo)/2
+		if index < mid {
+			siblings = append(siblings, ComputeMerkleHash(h, items[mid:hi]))
+			hi = mid
+		} else {
+			siblings = append(siblings, ComputeMerkleHash(h, items[lo:mid]))
+			lo = mid
+		}
+	}
+
+	// Reverse the siblings so they are ordered from the leaf up.
+	for i, j := 0, len(siblings)-1; i < j; i, j = i+1, j-1 {
+		siblings[i], siblings[j] = siblings[j], siblings[i]
+	}
+
+	return MerkleProof{
+		Index:     uint64(index),
+		NumLeaves: uint64(len(items)),
+		Siblings:  siblings,
+	}, nil
+}
+
+// Verifies that the item is included in the Merkle tree with the given root.
+func VerifyMerkleProof(h Hasher, root [32]byte, item []byte, proof MerkleProof) bool {
+	if proof.NumLeaves <= proof.Index {
+		return false
+	}
+
+	// Recompute the path from the root to the leaf. At each level, record whether the item is in the left branch.
+	isLeft := []bool{}
+	index, n := proof.Index, proof.NumLeaves
+	for 1 < n {
+		mid := n / 2
+		if index < mid {
+			isLeft = append(isLeft, true)
+			n = mid
+		} else {
+			isLeft = append(isLeft, false)
+			index -= mid
+			n -= mid
+		}
+	}
+	if len(isLeft) != len(proof.Siblings) {
+		return false
+	}
+
+	// Hash up from the leaf to the root.
+	hash := h.Hash(item)
+	for i, sibling := range proof.Siblings {
+		if isLeft[len(isLeft)-1-i] {
+			hash = h.Hash(append(hash[:], sibling[:]...))
+		} else {
+			hash = h.Hash(append(sibling[:], hash[:]...))
+		}
+	}
+
+	return hash == root
 }
@@ -20,9 +20,60 @@ func TestMerkleTreeAccumulate(t *testing.T) {
 	}
 
 	// Compute the expected root hash.
-	expected := ComputeMerkleHash(items)
+	expected := ComputeMerkleHash(SHA256Hasher{}, items)
 	t.Logf("Expected root hash: %x", expected)
 
 	expectedStr := hex.EncodeToString(expected[:])
 	assert.Equal(expectedStr, "9d88c165d938bbc80c02fc856ddca3028f30b11fabff4cce14280742b031d5b6")
 }
+
+func TestMerkleProof(t *testing.T) {
+	assert := assert.New(t)
+
+	// Check proofs for every leaf, for trees of different sizes (including unbalanced trees).
+	for n := 1; n <= 17; n++ {
+		items := make([][]byte, 0)
+		for i := 0; i < n; i++ {
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%d", i)))
+			items = append(items, hash[:])
+		}
+		root := ComputeMerkleHash(SHA256Hasher{}, items)
+
+		for i := 0; i < n; i++ {
+			proof, err := ComputeMerkleProof(SHA256Hasher{}, items, i)
+			assert.Nil(err)
+			assert.True(VerifyMerkleProof(SHA256Hasher{}, root, items[i], proof), "n=%d i=%d", n, i)
+
+			// The proof does not verify for another item.
+			assert.False(VerifyMerkleProof(SHA256Hasher{}, root, []byte("not in tree"), proof))
+		}
+	}
+}
+
+func TestMerkleProofInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	items := make([][]byte, 0)
+	for i := 0; i < 5; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("%d", i)))
+		items = append(items, hash[:])
+	}
+	root := ComputeMerkleHash(SHA256Hasher{}, items)
+
+	proof, err := ComputeMerkleProof(SHA256Hasher{}, items, 3)
+	assert.Nil(err)
+
+	// Wrong index.
+	wrongIndex := proof
+	wrongIndex.Index = 2
+	assert.False(VerifyMerkleProof(SHA256Hasher{}, root, items[3], wrongIndex))
+
+	// Tampered sibling.
+	tampered := MerkleProof{Index: proof.Index, NumLeaves: proof.NumLeaves, Siblings: append([][32]byte{}, proof.Siblings...)}
+	tampered.Siblings[0][0] ^= 0xff
+	assert.False(VerifyMerkleProof(SHA256Hasher{}, root, items[3], tampered))
+
+	// Out of bounds.
+	_, err = ComputeMerkleProof(SHA256Hasher{}, items, 5)
+	assert.NotNil(err)
+}
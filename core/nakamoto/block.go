@@ -4,10 +4,12 @@ package nakamoto
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"math/big"
+
+	"github.com/liamzebedee/tinychain-go/core"
 )
 
 type BlockHeader struct {
@@ -44,6 +46,35 @@ type Block struct {
 	SizeBytes       uint64
 	Hash            [32]byte
 	AccumulatedWork big.Int
+	Status          BlockStatus
+}
+
+// The validation status of a block in the DAG.
+// A block progresses from a valid header, to a valid body once its transactions are ingested, to a valid state once its
+// transactions have been applied by the state machine. A block that fails validation at any stage is marked invalid,
+// and it and all of its descendants are excluded from tip selection.
+type BlockStatus int
+
+const (
+	BlockStatusValidHeader BlockStatus = 1
+	BlockStatusValidBody   BlockStatus = 2
+	BlockStatusValidState  BlockStatus = 3
+	BlockStatusInvalid     BlockStatus = 4
+)
+
+func (s BlockStatus) String() string {
+	switch s {
+	case BlockStatusValidHeader:
+		return "valid-header"
+	case BlockStatusValidBody:
+		return "valid-body"
+	case BlockStatusValidState:
+		return "valid-state"
+	case BlockStatusInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
 }
 
 // A raw block is the block as transmitted on the network.
@@ -104,6 +135,20 @@ func (b *Block) ToBlockHeader() BlockHeader {
 // RawBlock.
 // =====================================================================================================================
 
+// Convert a raw block to a block header.
+func (b *RawBlock) ToBlockHeader() BlockHeader {
+	return BlockHeader{
+		ParentHash:             b.ParentHash,
+		ParentTotalWork:        b.ParentTotalWork,
+		Difficulty:             b.Difficulty,
+		Timestamp:              b.Timestamp,
+		NumTransactions:        b.NumTransactions,
+		TransactionsMerkleRoot: b.TransactionsMerkleRoot,
+		Nonce:                  b.Nonce,
+		Graffiti:               b.Graffiti,
+	}
+}
+
 func (b *RawBlock) SetNonce(i big.Int) {
 	b.Nonce = BigIntToBytes32(i)
 }
@@ -156,6 +201,11 @@ func (b *RawBlock) Bytes() []byte {
 	return buf.Bytes()
 }
 
+// The offset of the nonce in the block envelope, after the parent hash, parent total work, difficulty, timestamp, number
+// of transactions and transactions merkle root. Miners overwrite the nonce in place rather than re-encoding the
+// envelope for every hash.
+const blockEnvelopeNonceOffset = 32 + 32 + 32 + 8 + 8 + 32
+
 // Returns the envelope used for block hashing, which merklizes the transactions list into a merkle root.
 func (b *RawBlock) Envelope() []byte {
 	// Encode canonically.
@@ -197,15 +247,53 @@ func (b *RawBlock) Envelope() []byte {
 	return buf.Bytes()
 }
 
-func (b *RawBlock) Hash() [32]byte {
-	return sha256.Sum256(b.Envelope())
+// Hashes the block using the consensus hash function.
+func (b *RawBlock) Hash(h core.Hasher) [32]byte {
+	return h.Hash(b.Envelope())
 }
 
-func (b *RawBlock) HashStr() string {
-	sl := b.Hash()
+func (b *RawBlock) HashStr(h core.Hasher) string {
+	sl := b.Hash(h)
 	return hex.EncodeToString(sl[:])
 }
 
+// Decodes a raw block from its canonical encoding, as returned by Bytes().
+func RawBlockFromBytes(buf []byte) (RawBlock, error) {
+	if len(buf) < BlockHeaderSizeBytes {
+		return RawBlock{}, fmt.Errorf("Invalid block length: %d", len(buf))
+	}
+	header, err := BlockHeaderFromBytes(buf[:BlockHeaderSizeBytes])
+	if err != nil {
+		return RawBlock{}, err
+	}
+
+	// Decode transactions.
+	txsBuf := buf[BlockHeaderSizeBytes:]
+	if len(txsBuf)%RawTransactionSizeBytes != 0 {
+		return RawBlock{}, fmt.Errorf("Invalid block transactions length: %d", len(txsBuf))
+	}
+	txs := make([]RawTransaction, 0, len(txsBuf)/RawTransactionSizeBytes)
+	for i := 0; i < len(txsBuf); i += RawTransactionSizeBytes {
+		tx, err := RawTransactionFromBytes(txsBuf[i : i+RawTransactionSizeBytes])
+		if err != nil {
+			return RawBlock{}, err
+		}
+		txs = append(txs, tx)
+	}
+
+	return RawBlock{
+		ParentHash:             header.ParentHash,
+		ParentTotalWork:        header.ParentTotalWork,
+		Difficulty:             header.Difficulty,
+		Timestamp:              header.Timestamp,
+		NumTransactions:        header.NumTransactions,
+		TransactionsMerkleRoot: header.TransactionsMerkleRoot,
+		Nonce:                  header.Nonce,
+		Graffiti:               header.Graffiti,
+		Transactions:           txs,
+	}, nil
+}
+
 func (b *RawBlock) SizeBytes() uint64 {
 	// Calculate the size of the block.
 	return uint64(len(b.Bytes()))
@@ -214,6 +302,19 @@ func (b *RawBlock) SizeBytes() uint64 {
 // BlockHeader.
 // =====================================================================================================================
 
+// The size of a block header's canonical encoding.
+const BlockHeaderSizeBytes = 32 + 32 + 32 + 8 + 8 + 32 + 32 + 32
+
+// Decodes a block header from its canonical encoding, as returned by Bytes().
+func BlockHeaderFromBytes(buf []byte) (BlockHeader, error) {
+	var header BlockHeader
+	if len(buf) != BlockHeaderSizeBytes {
+		return header, fmt.Errorf("Invalid block header length: %d", len(buf))
+	}
+	err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &header)
+	return header, err
+}
+
 func (b *BlockHeader) Bytes() []byte {
 	// Encode canonically.
 	buf := new(bytes.Buffer)
@@ -254,11 +355,12 @@ func (b *BlockHeader) Bytes() []byte {
 	return buf.Bytes()
 }
 
-func (b *BlockHeader) BlockHash() [32]byte {
-	return sha256.Sum256(b.Bytes())
+// Hashes the block header using the consensus hash function. This is equal to the hash of the full block.
+func (b *BlockHeader) BlockHash(h core.Hasher) [32]byte {
+	return h.Hash(b.Bytes())
 }
 
-func (b *BlockHeader) BlockHashStr() string {
-	sl := b.BlockHash()
+func (b *BlockHeader) BlockHashStr(h core.Hasher) string {
+	sl := b.BlockHash(h)
 	return hex.EncodeToString(sl[:])
 }
@@ -14,7 +14,11 @@ import (
 )
 
 var (
-	ErrBlockNotFound = fmt.Errorf("Block not found.")
+	ErrBlockNotFound          = fmt.Errorf("Block not found.")
+	ErrUnknownParent          = fmt.Errorf("Unknown parent block.")
+	ErrInvalidPOW             = fmt.Errorf("POW solution is invalid.")
+	ErrInvalidParentTotalWork = fmt.Errorf("Parent total work is incorrect.")
+	ErrInvalidTxsMerkleRoot   = fmt.Errorf("Merkle root does not match computed merkle root.")
 )
 
 // The block DAG is the core data structure of the Nakamoto consensus protocol.
@@ -34,6 +38,9 @@ type BlockDAG struct {
 	// Consensus settings.
 	consensus ConsensusConfig
 
+	// The consensus hash function, selected by the consensus settings.
+	hasher core.Hasher
+
 	// Tips mutex.
 	tipsMutex *sync.Mutex
 
@@ -44,22 +51,29 @@ type BlockDAG struct {
 	FullTip Block
 
 	// OnNewTip handler.
+	// If OnNewFullTip returns a BlockStateError, the offending block is marked invalid and the tips are recomputed.
 	OnNewHeadersTip func(tip Block, prevTip Block)
-	OnNewFullTip    func(tip Block, prevTip Block)
+	OnNewFullTip    func(tip Block, prevTip Block) error
 
 	log *log.Logger
 }
 
 func NewBlockDAGFromDB(db *sql.DB, stateMachine StateMachineInterface, consensus ConsensusConfig) (BlockDAG, error) {
+	hasher, err := consensus.GetHasher()
+	if err != nil {
+		return BlockDAG{}, err
+	}
+
 	dag := BlockDAG{
 		db:           db,
 		stateMachine: stateMachine,
 		consensus:    consensus,
+		hasher:       hasher,
 		log:          NewLogger("blockdag", ""),
 		tipsMutex:    &sync.Mutex{},
 	}
 
-	err := dag.initialiseBlockDAG()
+	err = dag.initialiseBlockDAG()
 	if err != nil {
 		panic(err)
 	}
@@ -75,7 +89,7 @@ func NewBlockDAGFromDB(db *sql.DB, stateMachine StateMachineInterface, consensus
 // Initalises the block DAG with the genesis block.
 func (dag *BlockDAG) initialiseBlockDAG() error {
 	genesisBlock := GetRawGenesisBlockFromConfig(dag.consensus)
-	genesisBlockHash := genesisBlock.Hash()
+	genesisBlockHash := genesisBlock.Hash(dag.hasher)
 	genesisHeight := uint64(0)
 
 	// Check if we have already initialised the database.
@@ -119,13 +133,13 @@ func (dag *BlockDAG) initialiseBlockDAG() error {
 		return err
 	}
 
-	work := CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))
+	work := CalculateWork(Bytes32ToBigInt(genesisBlockHash))
 	dag.log.Printf("Inserted genesis epoch difficulty=%s\n", dag.consensus.GenesisDifficulty.String())
 	accWorkBuf := BigIntToBytes32(*work)
 
 	// Insert the genesis block.
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, status) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		genesisBlockHash[:],
 		genesisBlock.ParentHash[:],
 		genesisBlock.ParentTotalWork[:],
@@ -139,6 +153,7 @@ func (dag *BlockDAG) initialiseBlockDAG() error {
 		epoch0.GetId(),
 		genesisBlock.SizeBytes(),
 		PadBytes(accWorkBuf[:], 32),
+		BlockStatusValidState, // The genesis block is valid by definition.
 	)
 	if err != nil {
 		return err
@@ -178,21 +193,40 @@ func (dag *BlockDAG) updateHeadersTip() error {
 }
 
 func (dag *BlockDAG) updateFullTip() error {
+	// The tip before this update. If a new tip is found invalid, it is skipped, so the callback is always given the
+	// last tip it accepted.
 	prev_tip := dag.FullTip
-	curr_tip, err := dag.GetLatestFullTip()
-	if err != nil {
-		return err
-	}
+	for {
+		curr_tip, err := dag.GetLatestFullTip()
+		if err != nil {
+			return err
+		}
+
+		if dag.FullTip.Hash == curr_tip.Hash {
+			return nil
+		}
 
-	if prev_tip.Hash != curr_tip.Hash {
 		dag.log.Printf("New full tip: height=%d hash=%s\n", curr_tip.Height, curr_tip.HashStr())
 		dag.FullTip = curr_tip
-		if dag.OnNewFullTip != nil {
-			dag.OnNewFullTip(curr_tip, prev_tip)
+		if dag.OnNewFullTip == nil {
+			return nil
 		}
-	}
 
-	return nil
+		// If a block in the new tip's chain failed to apply, mark it invalid and move the tips off of it, before
+		// anyone else can build on it.
+		var blockErr *BlockStateError
+		if !errors.As(dag.OnNewFullTip(curr_tip, prev_tip), &blockErr) {
+			return nil
+		}
+		err = dag.markBlockInvalid(blockErr.BlockHash)
+		if err != nil {
+			return err
+		}
+		err = dag.updateHeadersTip()
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func (dag *BlockDAG) UpdateTip() error {
@@ -218,7 +252,8 @@ func (dag *BlockDAG) UpdateTip() error {
 // TODO: subjectivity.
 // 3. Verify num transactions is the same as the length of the transactions list.
 // 4a. Verify coinbase transcation is present.
-// 4b. Verify transactions are valid.
+// 4b. Verify coinbase transaction commits to the block height (UpgradeCoinbaseHeight).
+// 4c. Verify transactions are valid.
 // 5. Verify transaction merkle root is valid.
 // 6. Verify POW solution is valid.
 // 6a. Compute the current difficulty epoch.
@@ -230,13 +265,31 @@ func (dag *BlockDAG) __doc() {}
 
 // Ingests a block header, and recomputes the headers tip. Used by light clients / SPV sync.
 func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
+	blockHash := raw.BlockHash(dag.hasher)
+	return dag.ingestHeader(raw, blockHash, func(target big.Int) bool {
+		return VerifyPOW(blockHash, target)
+	})
+}
+
+// Ingests a block header with a proof of its POW solution, instead of recomputing the block hash.
+// The network must use the Poseidon hash function.
+func (dag *BlockDAG) IngestHeaderWithPOWProof(raw BlockHeader, proof POWProof, vk *core.Groth16VerifyingKey) error {
+	if dag.consensus.HashFunction != core.HashFunctionPoseidon {
+		return fmt.Errorf("POW proofs require the %s hash function.", core.HashFunctionPoseidon)
+	}
+	return dag.ingestHeader(raw, proof.BlockHash, func(target big.Int) bool {
+		return VerifyPOWProof(vk, raw, target, proof)
+	})
+}
+
+func (dag *BlockDAG) ingestHeader(raw BlockHeader, blockHash [32]byte, verifyPOW func(target big.Int) bool) error {
 	// 1. Verify parent is known.
 	parentBlock, err := dag.GetBlockByHash(raw.ParentHash)
 	if err != nil {
 		return err
 	}
 	if parentBlock == nil {
-		return fmt.Errorf("Unknown parent block.")
+		return ErrUnknownParent
 	}
 
 	// 6. Verify POW solution is valid.
@@ -260,7 +313,7 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 
 		epoch = &Epoch{
 			Number:         height / dag.consensus.EpochLengthBlocks,
-			StartBlockHash: raw.BlockHash(),
+			StartBlockHash: blockHash,
 			StartTime:      raw.Timestamp,
 			StartHeight:    height,
 			Difficulty:     newDifficulty,
@@ -290,16 +343,15 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 	}
 
 	// 6b. Verify POW solution.
-	blockHash := raw.BlockHash()
-	if !VerifyPOW(blockHash, epoch.Difficulty) {
-		return fmt.Errorf("POW solution is invalid.")
+	if !verifyPOW(epoch.Difficulty) {
+		return ErrInvalidPOW
 	}
 
 	// 6c. Verify parent total work is correct.
 	parentTotalWork := Bytes32ToBigInt(raw.ParentTotalWork)
 	if parentBlock.AccumulatedWork.Cmp(&parentTotalWork) != 0 {
 		dag.log.Printf("Comparing parent total work. expected=%s actual=%s\n", parentBlock.AccumulatedWork.String(), parentTotalWork.String())
-		return fmt.Errorf("Parent total work is incorrect.")
+		return ErrInvalidParentTotalWork
 	}
 
 	// 8. Ingest block into database store.
@@ -315,7 +367,7 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 
 	// Insert block.
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, status) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		blockHash[:],
 		raw.ParentHash[:],
 		raw.ParentTotalWork[:],
@@ -328,6 +380,7 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 		epoch.GetId(),
 		0, // Block size is 0 until we get transactions.
 		acc_work_buf[:],
+		BlockStatusValidHeader,
 	)
 	if err != nil {
 		tx.Rollback()
@@ -347,11 +400,14 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 
 // Ingests a block's body, which is linked to a previously ingested block header.
 func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
-	// Get the merkle root for this body.
-	txMerkleRoot := GetMerkleRootForTxs(body)
+	// Get the merkle roots for this body. The leaves of the tree depend on whether UpgradeWitnessMerkleLeaves is active
+	// for the block, which we don't know until we find its header, so we look up the block by either root. The root is
+	// verified against the block's height below.
+	witnessMerkleRoot := core.ComputeMerkleHash(dag.hasher, getTxMerkleLeaves(body, true))
+	legacyMerkleRoot := core.ComputeMerkleHash(dag.hasher, getTxMerkleLeaves(body, false))
 
 	// Lookup the block that has this merkle root.
-	rows, err := dag.db.Query(`select hash from blocks where transactions_merkle_root = ?`, txMerkleRoot[:])
+	rows, err := dag.db.Query(`select hash from blocks where transactions_merkle_root = ? or transactions_merkle_root = ?`, witnessMerkleRoot[:], legacyMerkleRoot[:])
 	if err != nil {
 		return err
 	}
@@ -359,6 +415,7 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 	if rows.Next() {
 		rows.Scan(&blockhashBuf)
 	} else {
+		rows.Close()
 		return fmt.Errorf("Block header not found for txs merkle root.")
 	}
 	rows.Close()
@@ -406,16 +463,16 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 	if len(raw.Transactions) < 1 {
 		return fmt.Errorf("Missing coinbase tx.")
 	}
-	// 4b. Verify transactions.
+	// 4b. Verify coinbase tx commits to the block height.
+	if dag.consensus.IsUpgradeActive(UpgradeCoinbaseHeight, block.Height) && raw.Transactions[0].Nonce != block.Height {
+		return fmt.Errorf("Coinbase tx does not commit to block height.")
+	}
+	// 4c. Verify transactions.
 	// TODO: We can parallelise this.
 	// This is one of the most expensive operations of the blockchain node.
 	for i, block_tx := range raw.Transactions {
 		dag.log.Printf("Verifying transaction %d\n", i)
-		isValid := core.VerifySignature(
-			block_tx.FromPubkey,
-			block_tx.Sig[:],
-			block_tx.Envelope(),
-		)
+		isValid := dag.consensus.verifyTxSignature(block.Height, block_tx)
 		if !isValid {
 			return fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
 		}
@@ -429,9 +486,9 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 	}
 
 	// 5. Verify transaction merkle root is valid.
-	expectedMerkleRoot := GetMerkleRootForTxs(raw.Transactions)
+	expectedMerkleRoot := dag.consensus.getMerkleRootForTxs(dag.hasher, block.Height, raw.Transactions)
 	if expectedMerkleRoot != raw.TransactionsMerkleRoot {
-		return fmt.Errorf("Merkle root does not match computed merkle root.")
+		return ErrInvalidTxsMerkleRoot
 	}
 
 	// 7. Verify block size is within bounds.
@@ -445,16 +502,27 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 		return err
 	}
 
-	// Update block size.
+	// Update block status.
+	_, err = tx.Exec(
+		"update blocks set status = ? where hash = ? and status = ?",
+		BlockStatusValidBody,
+		blockhash[:],
+		BlockStatusValidHeader,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
 	// Insert transactions, transactions_blocks.
 	for i, block_tx := range raw.Transactions {
 		txhash := block_tx.Hash()
+		witnessHash := block_tx.WitnessHash()
 
 		_, err = tx.Exec(
-			`insert into transactions_blocks (block_hash, transaction_hash, txindex) values (?, ?, ?)`,
+			`insert into transactions_blocks (block_hash, witness_hash, txindex) values (?, ?, ?)`,
 			blockhash[:],
-			txhash[:],
+			witnessHash[:],
 			i,
 		)
 		if err != nil {
@@ -463,7 +531,7 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 		}
 
 		// Check if we already have the transaction.
-		rows, err := tx.Query("select count(*) from transactions where hash = ?", txhash[:])
+		rows, err := tx.Query("select count(*) from transactions where witness_hash = ?", witnessHash[:])
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -480,8 +548,9 @@ func (dag *BlockDAG) IngestBlockBody(body []RawTransaction) error {
 
 		// Insert the transaction.
 		_, err = tx.Exec(
-			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			"insert into transactions (hash, witness_hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			txhash[:],
+			witnessHash[:],
 			block_tx.Sig[:],
 			block_tx.FromPubkey[:],
 			block_tx.ToPubkey[:],
@@ -513,7 +582,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 	// Check if block not found error.
 	if errors.Is(err, ErrBlockNotFound) {
-		return fmt.Errorf("Unknown parent block.")
+		return ErrUnknownParent
 	}
 	if err != nil {
 		return err
@@ -532,16 +601,16 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	if len(raw.Transactions) < 1 {
 		return fmt.Errorf("Missing coinbase tx.")
 	}
-	// 4b. Verify transactions.
+	// 4b. Verify coinbase tx commits to the block height.
+	if dag.consensus.IsUpgradeActive(UpgradeCoinbaseHeight, parentBlock.Height+1) && raw.Transactions[0].Nonce != parentBlock.Height+1 {
+		return fmt.Errorf("Coinbase tx does not commit to block height.")
+	}
+	// 4c. Verify transactions.
 	// TODO: We can parallelise this.
 	// This is one of the most expensive operations of the blockchain node.
 	for i, block_tx := range raw.Transactions {
 		dag.log.Printf("Verifying transaction %d\n", i)
-		isValid := core.VerifySignature(
-			block_tx.FromPubkey,
-			block_tx.Sig[:],
-			block_tx.Envelope(),
-		)
+		isValid := dag.consensus.verifyTxSignature(parentBlock.Height+1, block_tx)
 		if !isValid {
 			return fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
 		}
@@ -555,9 +624,9 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	}
 
 	// 5. Verify transaction merkle root is valid.
-	expectedMerkleRoot := GetMerkleRootForTxs(raw.Transactions)
+	expectedMerkleRoot := dag.consensus.getMerkleRootForTxs(dag.hasher, parentBlock.Height+1, raw.Transactions)
 	if expectedMerkleRoot != raw.TransactionsMerkleRoot {
-		return fmt.Errorf("Merkle root does not match computed merkle root.")
+		return ErrInvalidTxsMerkleRoot
 	}
 
 	// 6. Verify POW solution is valid.
@@ -581,7 +650,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 		epoch = &Epoch{
 			Number:         height / dag.consensus.EpochLengthBlocks,
-			StartBlockHash: raw.Hash(),
+			StartBlockHash: raw.Hash(dag.hasher),
 			StartTime:      raw.Timestamp,
 			StartHeight:    height,
 			Difficulty:     newDifficulty,
@@ -611,16 +680,16 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	}
 
 	// 6b. Verify POW solution.
-	blockHash := raw.Hash()
+	blockHash := raw.Hash(dag.hasher)
 	if !VerifyPOW(blockHash, epoch.Difficulty) {
-		return fmt.Errorf("POW solution is invalid.")
+		return ErrInvalidPOW
 	}
 
 	// 6c. Verify parent total work is correct.
 	parentTotalWork := Bytes32ToBigInt(raw.ParentTotalWork)
 	if parentBlock.AccumulatedWork.Cmp(&parentTotalWork) != 0 {
 		dag.log.Printf("Comparing parent total work. expected=%s actual=%s\n", parentBlock.AccumulatedWork.String(), parentTotalWork.String())
-		return fmt.Errorf("Parent total work is incorrect.")
+		return ErrInvalidParentTotalWork
 	}
 
 	// 7. Verify block size is within bounds.
@@ -640,9 +709,9 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	acc_work_buf := BigIntToBytes32(*acc_work)
 
 	// Insert block.
-	blockhash := raw.Hash()
+	blockhash := raw.Hash(dag.hasher)
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, status) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		blockhash[:],
 		raw.ParentHash[:],
 		raw.ParentTotalWork[:],
@@ -655,6 +724,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 		epoch.GetId(),
 		raw.SizeBytes(),
 		acc_work_buf[:],
+		BlockStatusValidBody,
 	)
 	if err != nil {
 		tx.Rollback()
@@ -664,11 +734,12 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	// Insert transactions, transactions_blocks.
 	for i, block_tx := range raw.Transactions {
 		txhash := block_tx.Hash()
+		witnessHash := block_tx.WitnessHash()
 
 		_, err = tx.Exec(
-			`insert into transactions_blocks (block_hash, transaction_hash, txindex) values (?, ?, ?)`,
+			`insert into transactions_blocks (block_hash, witness_hash, txindex) values (?, ?, ?)`,
 			blockhash[:],
-			txhash[:],
+			witnessHash[:],
 			i,
 		)
 		if err != nil {
@@ -677,7 +748,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 		}
 
 		// Check if we already have the transaction.
-		rows, err := tx.Query("select count(*) from transactions where hash = ?", txhash[:])
+		rows, err := tx.Query("select count(*) from transactions where witness_hash = ?", witnessHash[:])
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -694,8 +765,9 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 		// Insert the transaction.
 		_, err = tx.Exec(
-			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			"insert into transactions (hash, witness_hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			txhash[:],
+			witnessHash[:],
 			block_tx.Sig[:],
 			block_tx.FromPubkey[:],
 			block_tx.ToPubkey[:],
@@ -719,3 +791,104 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 	return nil
 }
+
+// Marks a block as invalid, and recomputes the tips.
+// The block and all of its descendants are excluded from tip selection until the block is reconsidered.
+func (dag *BlockDAG) InvalidateBlock(hash [32]byte) error {
+	err := dag.markBlockInvalid(hash)
+	if err != nil {
+		return err
+	}
+	return dag.UpdateTip()
+}
+
+func (dag *BlockDAG) markBlockInvalid(hash [32]byte) error {
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return err
+	}
+	if block.Height == 0 {
+		return fmt.Errorf("Cannot invalidate the genesis block.")
+	}
+
+	_, err = dag.db.Exec("update blocks set status = ? where hash = ?", BlockStatusInvalid, hash[:])
+	if err != nil {
+		return err
+	}
+	dag.log.Printf("Invalidated block hash=%x\n", hash)
+	return nil
+}
+
+// Removes the invalid status from a block, its ancestors and its descendants, and recomputes the tips.
+// Blocks are restored to a valid body status if their transactions have been ingested, otherwise a valid header status.
+func (dag *BlockDAG) ReconsiderBlock(hash [32]byte) error {
+	if !dag.HasBlock(hash) {
+		return ErrBlockNotFound
+	}
+
+	_, err := dag.db.Exec(`
+		WITH RECURSIVE
+		ancestors AS (
+			SELECT hash, parent_hash FROM blocks WHERE hash = ?
+
+			UNION
+
+			SELECT b.hash, b.parent_hash
+			FROM blocks b
+			INNER JOIN ancestors a ON b.hash = a.parent_hash
+		),
+		descendants AS (
+			SELECT hash FROM blocks WHERE hash = ?
+
+			UNION
+
+			SELECT b.hash
+			FROM blocks b
+			INNER JOIN descendants d ON b.parent_hash = d.hash
+		)
+		UPDATE blocks
+		SET status = CASE
+			WHEN num_transactions = (SELECT COUNT(*) FROM transactions_blocks tb WHERE tb.block_hash = blocks.hash) THEN ?
+			ELSE ?
+		END
+		WHERE status = ?
+		AND (hash IN (SELECT hash FROM ancestors) OR hash IN (SELECT hash FROM descendants))`,
+		hash[:],
+		hash[:],
+		BlockStatusValidBody,
+		BlockStatusValidHeader,
+		BlockStatusInvalid,
+	)
+	if err != nil {
+		return err
+	}
+	dag.log.Printf("Reconsidered block hash=%x\n", hash)
+
+	return dag.UpdateTip()
+}
+
+// Marks a block and all of its ancestors as having a valid state, after their transactions have been applied by the state machine.
+func (dag *BlockDAG) MarkValidState(hash [32]byte) error {
+	// Traverse backwards until we reach a block which is already marked as having a valid state.
+	_, err := dag.db.Exec(`
+		WITH RECURSIVE ancestors AS (
+			SELECT hash, parent_hash FROM blocks WHERE hash = ?
+
+			UNION ALL
+
+			SELECT b.hash, b.parent_hash
+			FROM blocks b
+			INNER JOIN ancestors a ON b.hash = a.parent_hash
+			WHERE b.status != ?
+		)
+		UPDATE blocks
+		SET status = ?
+		WHERE status = ?
+		AND hash IN (SELECT hash FROM ancestors)`,
+		hash[:],
+		BlockStatusValidState,
+		BlockStatusValidState,
+		BlockStatusValidBody,
+	)
+	return err
+}
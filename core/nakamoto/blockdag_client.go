@@ -3,6 +3,8 @@ package nakamoto
 import (
 	"database/sql"
 	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
 )
 
 // The methods of the BlockDAG engine:
@@ -14,6 +16,11 @@ import (
 // Full sync:
 // - IngestBlock
 //
+// Validity:
+// - InvalidateBlock
+// - ReconsiderBlock
+// - MarkValidState
+//
 
 // The methods of the BlockDAG client:
 //
@@ -25,6 +32,13 @@ import (
 // - GetBlockTransactions
 // - GetRawBlockDataByHash
 //
+// Transactions:
+// - GetTransactionByHash
+// - GetTransactionByWitnessHash
+// - GetTransactionBlocks
+// - GetTxProof
+// - GetAccountTxProofs
+//
 // Tip:
 // - GetLatestFullTip
 // - GetLatestHeadersTip
@@ -82,7 +96,7 @@ func (dag *BlockDAG) GetBlockByHash(hash [32]byte) (*Block, error) {
 
 	// Query database.
 	rows, err := dag.db.Query(
-		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work from blocks where hash = ? limit 1`,
+		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, status from blocks where hash = ? limit 1`,
 		hash[:],
 	)
 	if err != nil {
@@ -114,6 +128,7 @@ func (dag *BlockDAG) GetBlockByHash(hash [32]byte) (*Block, error) {
 			&block.Epoch,
 			&block.SizeBytes,
 			&accWorkBuf,
+			&block.Status,
 		)
 
 		if err != nil {
@@ -162,9 +177,9 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 
 	// Load the transactions in.
 	rows, err = dag.db.Query(`
-		SELECT txs.hash, txs.sig, txs.from_pubkey, txs.to_pubkey, txs.amount, txs.fee, txs.nonce, txblocks.txindex, txs.version
+		SELECT txs.hash, txs.witness_hash, txs.sig, txs.from_pubkey, txs.to_pubkey, txs.amount, txs.fee, txs.nonce, txblocks.txindex, txs.version
 		FROM transactions txs
-		JOIN transactions_blocks txblocks ON txs.hash = txblocks.transaction_hash
+		JOIN transactions_blocks txblocks ON txs.witness_hash = txblocks.witness_hash
 		WHERE txblocks.block_hash = ?
 		ORDER BY txblocks.txindex ASC;
 	`, hash[:])
@@ -176,6 +191,7 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 		tx := Transaction{}
 
 		hash := []byte{}
+		witnessHash := []byte{}
 		sig := []byte{}
 		fromPubkey := []byte{}
 		toPubkey := []byte{}
@@ -185,12 +201,13 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 		txindex := uint64(0)
 		version := 0 // TODO
 
-		err := rows.Scan(&hash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &txindex, &version)
+		err := rows.Scan(&hash, &witnessHash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &txindex, &version)
 		if err != nil {
 			return nil, err
 		}
 
 		copy(tx.Hash[:], hash)
+		copy(tx.WitnessHash[:], witnessHash)
 		copy(tx.Sig[:], sig)
 		copy(tx.FromPubkey[:], fromPubkey)
 		copy(tx.ToPubkey[:], toPubkey)
@@ -206,12 +223,27 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 	return &txs, nil
 }
 
+// Gets a full block in its canonical encoding (see RawBlock.Bytes). Blocks whose bodies we have not downloaded return
+// an error.
 func (dag *BlockDAG) GetRawBlockDataByHash(hash [32]byte) ([]byte, error) {
-	// TODO.
-	// get block from disk
-	// get txs from disk
-	// load into raw block
-	return []byte{}, nil
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := dag.GetBlockTransactions(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(*txs) != int(block.NumTransactions) {
+		return nil, fmt.Errorf("Block body has not been downloaded.")
+	}
+
+	raw := block.ToRawBlock()
+	raw.Transactions = make([]RawTransaction, len(*txs))
+	for i, tx := range *txs {
+		raw.Transactions[i] = tx.ToRawTransaction()
+	}
+	return raw.Bytes(), nil
 }
 
 // func (dag *BlockDAG) IsSynced(hash [32]byte) bool {
@@ -244,10 +276,22 @@ func (dag *BlockDAG) GetLatestHeadersTip() (Block, error) {
 	// The tip of the chain is defined as the chain with the longest proof-of-work.
 	// Simply put, given a DAG of blocks, where each block has an accumulated work, we want to find the path with the highest accumulated work.
 
-	// Query the highest accumulated work block in the database.
+	// Query the highest accumulated work block in the database, excluding invalid blocks and their descendants.
 	rows, err := dag.db.Query(`
-		select hash from blocks order by acc_work desc limit 1
-	`)
+		WITH RECURSIVE invalid_blocks AS (
+			SELECT hash FROM blocks WHERE status = ?
+
+			UNION
+
+			SELECT b.hash
+			FROM blocks b
+			INNER JOIN invalid_blocks ib ON b.parent_hash = ib.hash
+		)
+		SELECT hash FROM blocks
+		WHERE hash NOT IN (SELECT hash FROM invalid_blocks)
+		ORDER BY acc_work DESC
+		LIMIT 1
+	`, BlockStatusInvalid)
 	if err != nil {
 		return Block{}, err
 	}
@@ -276,8 +320,17 @@ func (dag *BlockDAG) GetLatestHeadersTip() (Block, error) {
 
 // Gets the latest block in the longest chain.
 func (dag *BlockDAG) GetLatestFullTip() (Block, error) {
-	// Query the highest accumulated work block in the database.
+	// Query the highest accumulated work block in the database, excluding invalid blocks and their descendants.
 	rows, err := dag.db.Query(`
+		WITH RECURSIVE invalid_blocks AS (
+			SELECT hash FROM blocks WHERE status = ?
+
+			UNION
+
+			SELECT b.hash
+			FROM blocks b
+			INNER JOIN invalid_blocks ib ON b.parent_hash = ib.hash
+		)
 		SELECT hash 
 		FROM (
 			-- Case 1: Blocks with transactions.
@@ -304,9 +357,10 @@ func (dag *BlockDAG) GetLatestFullTip() (Block, error) {
 				WHERE tb.block_hash = b.hash
 			)
 		) AS combined
+		WHERE hash NOT IN (SELECT hash FROM invalid_blocks)
 		ORDER BY acc_work DESC
 		LIMIT 1;
-	`)
+	`, BlockStatusInvalid)
 	if err != nil {
 		return Block{}, err
 	}
@@ -387,6 +441,60 @@ func (dag *BlockDAG) GetLongestChainHashList(startHash [32]byte, depthFromTip ui
 	return list, nil
 }
 
+// The maximum number of hashes in a block locator.
+const MaxBlockLocatorSize = 101
+
+// Gets a block locator for the chain ending at a block. A locator is a list of hashes from the block back to genesis,
+// where the first 10 hashes are consecutive and the gap between hashes doubles after that. A peer finds the fork point
+// between its chain and ours by taking the first hash in the locator which is in its chain (see FindForkPoint).
+func (dag *BlockDAG) GetBlockLocator(tipHash [32]byte) ([][32]byte, error) {
+	tip, err := dag.GetBlockByHash(tipHash)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := dag.GetLongestChainHashList(tipHash, tip.Height+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, ErrBlockNotFound
+	}
+
+	locator := [][32]byte{}
+	step := 1
+	for i := len(chain) - 1; 0 < i; i -= step {
+		locator = append(locator, chain[i])
+		if 10 <= len(locator) {
+			step *= 2
+		}
+	}
+
+	// Always include genesis.
+	locator = append(locator, chain[0])
+	return locator, nil
+}
+
+// Finds the first block in a locator which is in our longest chain. This is the fork point between our chain and the
+// chain the locator was made from. Returns false if none of the blocks are in our chain.
+func (dag *BlockDAG) FindForkPoint(locator [][32]byte) ([32]byte, bool, error) {
+	tip := dag.FullTip
+	chain, err := dag.GetLongestChainHashList(tip.Hash, tip.Height+1)
+	if err != nil {
+		return [32]byte{}, false, err
+	}
+
+	inChain := make(map[[32]byte]bool, len(chain))
+	for _, hash := range chain {
+		inChain[hash] = true
+	}
+	for _, hash := range locator {
+		if inChain[hash] {
+			return hash, true, nil
+		}
+	}
+	return [32]byte{}, false, nil
+}
+
 // Iterates forwards (direction = 1) or backwards (direction = -1) from startHash, accumulating `depthFromTip` items in the canonical longest chain linked list.
 // The returned list is in traversal order.
 func (dag *BlockDAG) GetPath(startHash [32]byte, depthFromTip uint64, direction int) ([][32]byte, error) {
@@ -469,12 +577,23 @@ func (dag *BlockDAG) GetPath(startHash [32]byte, depthFromTip uint64, direction
 	return list, nil
 }
 
+// Gets a transaction by its txid. Transactions which differ only by signature share a txid, in which case the first
+// one stored is returned. Use GetTransactionByWitnessHash to get a specific one.
 func (dag *BlockDAG) GetTransactionByHash(hash [32]byte) (*Transaction, error) {
+	return dag.getTransaction(`WHERE hash = ? ORDER BY rowid LIMIT 1`, hash)
+}
+
+// Gets a transaction by its witness hash, which covers its signature.
+func (dag *BlockDAG) GetTransactionByWitnessHash(witnessHash [32]byte) (*Transaction, error) {
+	return dag.getTransaction(`WHERE witness_hash = ?`, witnessHash)
+}
+
+func (dag *BlockDAG) getTransaction(where string, hash [32]byte) (*Transaction, error) {
 	tx := Transaction{}
 
 	// Query database.
 	rows, err := dag.db.Query(
-		`SELECT hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version FROM transactions WHERE hash = ?;`,
+		`SELECT hash, witness_hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version FROM transactions `+where,
 		hash[:],
 	)
 	if err != nil {
@@ -484,6 +603,7 @@ func (dag *BlockDAG) GetTransactionByHash(hash [32]byte) (*Transaction, error) {
 
 	if rows.Next() {
 		hash := []byte{}
+		witnessHash := []byte{}
 		sig := []byte{}
 		fromPubkey := []byte{}
 		toPubkey := []byte{}
@@ -492,12 +612,13 @@ func (dag *BlockDAG) GetTransactionByHash(hash [32]byte) (*Transaction, error) {
 		nonce := uint64(0)
 		version := 0 // TODO
 
-		err := rows.Scan(&hash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &version)
+		err := rows.Scan(&hash, &witnessHash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &version)
 		if err != nil {
 			return nil, err
 		}
 
 		copy(tx.Hash[:], hash)
+		copy(tx.WitnessHash[:], witnessHash)
 		copy(tx.Sig[:], sig)
 		copy(tx.FromPubkey[:], fromPubkey)
 		copy(tx.ToPubkey[:], toPubkey)
@@ -545,12 +666,16 @@ func (dag *BlockDAG) GetEpochById(id string) (*Epoch, error) {
 	return &epoch, nil
 }
 
+// Gets the hashes of the blocks which include a transaction with this txid, under any of its signatures.
 func (dag *BlockDAG) GetTransactionBlocks(txHash [32]byte) ([][32]byte, error) {
 	blocks := make([][32]byte, 0)
 
 	// Query database.
 	rows, err := dag.db.Query(
-		`SELECT block_hash FROM transactions_blocks WHERE transaction_hash = ?;`,
+		`SELECT tb.block_hash 
+		FROM transactions_blocks tb 
+		JOIN transactions txs ON txs.witness_hash = tb.witness_hash 
+		WHERE txs.hash = ?;`,
 		txHash[:],
 	)
 	if err != nil {
@@ -574,6 +699,140 @@ func (dag *BlockDAG) GetTransactionBlocks(txHash [32]byte) ([][32]byte, error) {
 	return blocks, nil
 }
 
+// Gets the inclusion proof for a transaction in the canonical chain.
+func (dag *BlockDAG) GetTxProof(txHash [32]byte) (TxProof, error) {
+	tip := dag.FullTip
+	return dag.getTxProof(txHash, func(block *Block) (bool, error) {
+		return dag.isInChain(tip, block)
+	})
+}
+
+// Builds the inclusion proof for a transaction in the first of its blocks which is in the chain.
+func (dag *BlockDAG) getTxProof(txHash [32]byte, inChain func(block *Block) (bool, error)) (TxProof, error) {
+	blockHashes, err := dag.GetTransactionBlocks(txHash)
+	if err != nil {
+		return TxProof{}, err
+	}
+
+	// Find the block containing the transaction on the longest chain.
+	for _, blockHash := range blockHashes {
+		block, err := dag.GetBlockByHash(blockHash)
+		if err != nil {
+			return TxProof{}, err
+		}
+		ok, err := inChain(block)
+		if err != nil {
+			return TxProof{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		// Build the proof.
+		txs, err := dag.GetBlockTransactions(blockHash)
+		if err != nil {
+			return TxProof{}, err
+		}
+		rawTxs := make([]RawTransaction, len(*txs))
+		txIndex := -1
+		for i, tx := range *txs {
+			rawTxs[i] = tx.ToRawTransaction()
+			if tx.Hash == txHash {
+				txIndex = i
+			}
+		}
+		if txIndex == -1 {
+			return TxProof{}, fmt.Errorf("Transaction not found in block.")
+		}
+		proof, err := dag.consensus.getMerkleProofForTx(dag.hasher, block.Height, rawTxs, txIndex)
+		if err != nil {
+			return TxProof{}, err
+		}
+
+		return TxProof{
+			Tx:          rawTxs[txIndex],
+			BlockHeader: block.ToBlockHeader(),
+			Proof:       proof,
+		}, nil
+	}
+
+	return TxProof{}, fmt.Errorf("Transaction not found in longest chain.")
+}
+
+// Gets the inclusion proofs for the transactions sent from or to an account in the canonical chain, a page at a time.
+//
+// The account's transactions are scanned in the order they were first stored, starting at offset, until limit proofs
+// are found (or without limit, if 0). Returns the proofs, and the offset of the next page, which is 0 once there are
+// no more transactions.
+func (dag *BlockDAG) GetAccountTxProofs(account [65]byte, offset uint64, limit uint64) ([]TxProof, uint64, error) {
+	rows, err := dag.db.Query(
+		`SELECT hash FROM transactions WHERE from_pubkey = ? OR to_pubkey = ? GROUP BY hash ORDER BY MIN(rowid) LIMIT -1 OFFSET ?;`,
+		account[:],
+		account[:],
+		offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	txHashes := [][32]byte{}
+	for rows.Next() {
+		hashBuf := []byte{}
+		if err := rows.Scan(&hashBuf); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		hash := [32]byte{}
+		copy(hash[:], hashBuf)
+		txHashes = append(txHashes, hash)
+	}
+	rows.Close()
+
+	// Get the canonical chain once, rather than walking it for each transaction.
+	tip := dag.FullTip
+	chain, err := dag.GetLongestChainHashList(tip.Hash, tip.Height+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	inChain := make(map[[32]byte]bool, len(chain))
+	for _, hash := range chain {
+		inChain[hash] = true
+	}
+
+	proofs := []TxProof{}
+	for i, txHash := range txHashes {
+		if 0 < limit && uint64(len(proofs)) == limit {
+			return proofs, offset + uint64(i), nil
+		}
+		proof, err := dag.getTxProof(txHash, func(block *Block) (bool, error) {
+			return inChain[block.Hash], nil
+		})
+		if err != nil {
+			// The transaction is not in the canonical chain.
+			continue
+		}
+		proofs = append(proofs, proof)
+	}
+
+	return proofs, 0, nil
+}
+
+// Returns true if the block is an ancestor of (or is) the tip.
+func (dag *BlockDAG) isInChain(tip Block, block *Block) (bool, error) {
+	if tip.Height < block.Height {
+		return false, nil
+	}
+	ancestors, err := dag.GetLongestChainHashList(tip.Hash, tip.Height-block.Height+1)
+	if err != nil {
+		return false, err
+	}
+	return 0 < len(ancestors) && ancestors[0] == block.Hash, nil
+}
+
 func (dag *BlockDAG) GetDB() *sql.DB {
 	return dag.db
 }
+
+// Gets the consensus hash function, used for block hashes, the proof-of-work and the transactions merkle tree.
+func (dag *BlockDAG) GetHasher() core.Hasher {
+	return dag.hasher
+}
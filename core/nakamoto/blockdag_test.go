@@ -9,6 +9,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	"testing"
@@ -28,6 +29,9 @@ func (m *MockStateMachine) VerifyTx(tx RawTransaction) error {
 	return nil
 }
 
+// The hash function of the networks created by newBlockdag.
+var testHasher = core.SHA256Hasher{}
+
 func newBlockdag() (BlockDAG, ConsensusConfig, *sql.DB, RawBlock) {
 	db, err := OpenDB(":memory:?journal_mode=WAL&synchronous=NORMAL&locking_mode=IMMEDIATE")
 	// db, err := OpenDB("test.sqlite3")
@@ -67,6 +71,11 @@ func newBlockdag() (BlockDAG, ConsensusConfig, *sql.DB, RawBlock) {
 		// https://serhack.me/articles/story-behind-alternative-genesis-block-bitcoin/ ;)
 		GenesisParentBlockHash: HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
 		MaxBlockSizeBytes:      2 * 1024 * 1024, // 2MB
+		Upgrades: map[string]uint64{
+			UpgradeCoinbaseHeight:      0,
+			UpgradeWitnessMerkleLeaves: 0,
+			UpgradeLowS:                0,
+		},
 	}
 
 	genesisBlock := GetRawGenesisBlockFromConfig(conf)
@@ -79,7 +88,8 @@ func newBlockdag() (BlockDAG, ConsensusConfig, *sql.DB, RawBlock) {
 	return blockdag, conf, db, genesisBlock
 }
 
-func newValidTx(t *testing.T) (RawTransaction, error) {
+// Creates a signed coinbase tx for a block at the given height.
+func newValidCoinbaseTx(t *testing.T, height uint64) (RawTransaction, error) {
 	wallets := getTestingWallets(t)
 
 	tx := RawTransaction{
@@ -89,7 +99,7 @@ func newValidTx(t *testing.T) (RawTransaction, error) {
 		ToPubkey:   [65]byte{},
 		Amount:     0,
 		Fee:        0,
-		Nonce:      0,
+		Nonce:      height,
 	}
 
 	envelope := tx.Envelope()
@@ -188,7 +198,7 @@ func TestDagLatestTipIsSet(t *testing.T) {
 
 	// The genesis block should be the latest tip.
 	// FIXME
-	assert.Equal(genesisBlock.Hash(), dag.FullTip.Hash)
+	assert.Equal(genesisBlock.Hash(testHasher), dag.FullTip.Hash)
 }
 
 func TestDagAddBlockUnknownParent(t *testing.T) {
@@ -212,13 +222,13 @@ func TestDagAddBlockTxCount(t *testing.T) {
 	assert := assert.New(t)
 	blockdag, _, _, genesisBlock := newBlockdag()
 
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		panic(err)
 	}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
+		ParentHash:             genesisBlock.Hash(testHasher),
 		Timestamp:              0,
 		NumTransactions:        0,
 		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
@@ -232,12 +242,106 @@ func TestDagAddBlockTxCount(t *testing.T) {
 	assert.Equal("Num transactions does not match length of transactions list.", err.Error())
 }
 
+func TestDagAddBlockCoinbaseHeight(t *testing.T) {
+	assert := assert.New(t)
+	blockdag, _, _, genesisBlock := newBlockdag()
+
+	// Create a coinbase tx which commits to the wrong height.
+	tx, err := newValidCoinbaseTx(t, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	b := RawBlock{
+		ParentHash:             genesisBlock.Hash(testHasher),
+		Timestamp:              0,
+		NumTransactions:        1,
+		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+		Nonce:                  [32]byte{0xBB},
+		Transactions: []RawTransaction{
+			tx,
+		},
+	}
+
+	err = blockdag.IngestBlock(b)
+	assert.Equal("Coinbase tx does not commit to block height.", err.Error())
+}
+
+func TestDagCoinbaseTxsUnique(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Mine 3 blocks with the same reward.
+	blocksMined := miner.Start(3)
+	if len(blocksMined) != 3 {
+		t.Fatalf("Failed to mine 3 blocks.")
+	}
+
+	// Each coinbase tx has a distinct hash, and is stored.
+	seen := make(map[[32]byte]bool)
+	for i, block := range blocksMined {
+		coinbase := block.Transactions[0]
+		assert.Equal(uint64(i+1), coinbase.Nonce)
+		assert.False(seen[coinbase.Hash()])
+		seen[coinbase.Hash()] = true
+
+		tx, err := dag.GetTransactionByHash(coinbase.Hash())
+		assert.Nil(err)
+		assert.Equal(coinbase.Hash(), tx.Hash)
+	}
+}
+
+func TestDagGetTransactionByWitnessHash(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+
+	// Two transactions which differ only by signature share a txid.
+	tx1 := RawTransaction{Version: 1, Amount: 100, Nonce: 1}
+	tx2 := tx1
+	tx2.Sig[0] = 1
+	for _, tx := range []RawTransaction{tx1, tx2} {
+		witnessHash := tx.WitnessHash()
+		txid := tx.Hash()
+		_, err := dag.db.Exec(
+			`INSERT INTO transactions (witness_hash, hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			witnessHash[:], txid[:], tx.Sig[:], tx.FromPubkey[:], tx.ToPubkey[:], tx.Amount, tx.Fee, tx.Nonce, tx.Version,
+		)
+		assert.Nil(err)
+	}
+
+	// The txid gets the first one stored.
+	tx, err := dag.GetTransactionByHash(tx1.Hash())
+	assert.Nil(err)
+	assert.Equal(tx1.WitnessHash(), tx.WitnessHash)
+
+	// The witness hash gets each one.
+	for _, raw := range []RawTransaction{tx1, tx2} {
+		tx, err := dag.GetTransactionByWitnessHash(raw.WitnessHash())
+		assert.Nil(err)
+		assert.Equal(raw.WitnessHash(), tx.WitnessHash)
+		assert.Equal(raw.Sig, tx.Sig)
+	}
+
+	// Unknown transactions are not found.
+	tx, err = dag.GetTransactionByWitnessHash([32]byte{})
+	assert.Nil(err)
+	assert.Nil(tx)
+}
+
 func TestDagAddBlockTxsValid(t *testing.T) {
 	assert := assert.New(t)
 	blockdag, _, _, genesisBlock := newBlockdag()
 
 	// Create a transaction.
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		panic(err)
 	}
@@ -245,7 +349,7 @@ func TestDagAddBlockTxsValid(t *testing.T) {
 	tx.Sig = [64]byte{0xCA, 0xFE, 0xBA, 0xBE}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
+		ParentHash:             genesisBlock.Hash(testHasher),
 		Timestamp:              0,
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
@@ -263,13 +367,13 @@ func TestDagAddBlockTxMerkleRootValid(t *testing.T) {
 	assert := assert.New(t)
 	blockdag, _, _, genesisBlock := newBlockdag()
 
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		panic(err)
 	}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
+		ParentHash:             genesisBlock.Hash(testHasher),
 		Timestamp:              0,
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
@@ -296,7 +400,7 @@ func TestDagAddBlockSuccess(t *testing.T) {
 		ToPubkey:   [65]byte{},
 		Amount:     0,
 		Fee:        0,
-		Nonce:      0,
+		Nonce:      1,
 	}
 	tx.FromPubkey = wallets[0].PubkeyBytes()
 
@@ -306,7 +410,7 @@ func TestDagAddBlockSuccess(t *testing.T) {
 	// }
 	// t.Logf("Signature: %s\n", hex.EncodeToString(sig))
 
-	sigHex := "084401618c78b2e778cba17eb04892331f1f69f860c24f039e1da6b959830ab567efc3fb2403af2c63c65a17648348211ce2fb5251f038d5151dff67152d1f6a"
+	sigHex := "e7cd37bdd2f046f792fd9c9e97580083c1703e0908eadc963c5c3cd71bb799fc45326299018857ed684374a339a266bb1fe9c7b773b2c88e71f41192dc3d8183"
 	sigBytes, err := hex.DecodeString(sigHex)
 	if err != nil {
 		t.Fatalf("Failed to decode signature: %s", err)
@@ -314,8 +418,8 @@ func TestDagAddBlockSuccess(t *testing.T) {
 	copy(tx.Sig[:], sigBytes)
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+		ParentHash:             genesisBlock.Hash(testHasher),
+		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash(testHasher)))),
 		Timestamp:              1719379532750,
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{},
@@ -325,14 +429,14 @@ func TestDagAddBlockSuccess(t *testing.T) {
 			tx,
 		},
 	}
-	b.TransactionsMerkleRoot = GetMerkleRootForTxs(b.Transactions)
+	b.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, b.Transactions)
 
 	// Mine the POW solution.
 	epoch, err := blockdag.GetEpochForBlockHash(b.ParentHash)
 	if err != nil {
 		t.Fatalf("Failed to get epoch for block hash: %s", err)
 	}
-	solution, err := SolvePOW(b, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	solution, err := SolvePOW(testHasher, b, *big.NewInt(0), epoch.Difficulty, 1000000000000)
 	if err != nil {
 		t.Fatalf("Failed to solve POW: %s", err)
 	}
@@ -351,7 +455,7 @@ func TestDagAddBlockWithDynamicSignature(t *testing.T) {
 	blockdag, _, _, genesisBlock := newBlockdag()
 
 	// Create a tx with a valid signature.
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		panic(err)
 	}
@@ -360,8 +464,8 @@ func TestDagAddBlockWithDynamicSignature(t *testing.T) {
 	t.Logf("Signature: %s\n", hex.EncodeToString(tx.Sig[:]))
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+		ParentHash:             genesisBlock.Hash(testHasher),
+		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash(testHasher)))),
 		Timestamp:              1719379532750,
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{},
@@ -370,14 +474,14 @@ func TestDagAddBlockWithDynamicSignature(t *testing.T) {
 			tx,
 		},
 	}
-	b.TransactionsMerkleRoot = GetMerkleRootForTxs(b.Transactions)
+	b.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, b.Transactions)
 
 	// Mine the POW solution.
 	epoch, err := blockdag.GetEpochForBlockHash(b.ParentHash)
 	if err != nil {
 		t.Fatalf("Failed to get epoch for block hash: %s", err)
 	}
-	solution, err := SolvePOW(b, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	solution, err := SolvePOW(testHasher, b, *big.NewInt(0), epoch.Difficulty, 1000000000000)
 	if err != nil {
 		t.Fatalf("Failed to solve POW: %s", err)
 	}
@@ -396,7 +500,7 @@ func TestDagGetBlockByHashGenesis(t *testing.T) {
 	dag, conf, _, genesisBlock := newBlockdag()
 
 	// Test we can get the genesis block.
-	block, err := dag.GetBlockByHash(genesisBlock.Hash())
+	block, err := dag.GetBlockByHash(genesisBlock.Hash(testHasher))
 	assert.Equal(nil, err)
 
 	// Check the genesis block.
@@ -409,15 +513,15 @@ func TestDagGetBlockByHashGenesis(t *testing.T) {
 	assert.Equal(conf.GenesisParentBlockHash, block.ParentHash)
 	assert.Equal(uint64(0), block.Timestamp)
 	assert.Equal(uint64(1), block.NumTransactions)
-	assert.Equal([32]uint8{0x59, 0xe0, 0xaa, 0xf, 0x1f, 0xe6, 0x6f, 0x3b, 0xe, 0xb0, 0xc, 0xa3, 0x31, 0x33, 0x1a, 0x69, 0x1, 0xc4, 0xc4, 0xa1, 0x21, 0x99, 0xba, 0xa0, 0x16, 0x77, 0xfd, 0xe2, 0xd4, 0xb7, 0xc6, 0x88}, block.TransactionsMerkleRoot)
-	assert.Equal(big.NewInt(19).String(), genesisNonce.String())
+	assert.Equal([32]uint8{0x4f, 0x9, 0xa0, 0x2c, 0x31, 0x24, 0x47, 0x18, 0x11, 0x7c, 0x63, 0xde, 0x63, 0xdc, 0xb0, 0x55, 0x37, 0x82, 0x82, 0xf2, 0x8, 0xb2, 0x2, 0xfd, 0x52, 0x2d, 0x1c, 0x89, 0xe8, 0x96, 0xf6, 0xa5}, block.TransactionsMerkleRoot)
+	assert.Equal(big.NewInt(3).String(), genesisNonce.String())
 	// Block.
 	assert.Equal(uint64(0), block.Height)
-	assert.Equal(GetIdForEpoch(genesisBlock.Hash(), 0), block.Epoch)
+	assert.Equal(GetIdForEpoch(genesisBlock.Hash(testHasher), 0), block.Epoch)
 	assert.Equal(uint64(0x1ab), block.SizeBytes)
-	assert.Equal(HexStringToBytes32("04ce8ce628e56bab073ff2298f1f9d0e96d31fb7a81f388d8fe6e4aa4dc1aaa8"), block.Hash)
+	assert.Equal(HexStringToBytes32("078943760698d69cba7aeef1cbba3dba6307c187a23dc700473d7316f5893664"), block.Hash)
 	t.Logf("Block: acc_work=%s\n", block.AccumulatedWork.String())
-	assert.Equal(big.NewInt(53).String(), block.AccumulatedWork.String())
+	assert.Equal(big.NewInt(33).String(), block.AccumulatedWork.String())
 }
 
 func TestDagBlockDAGInitialised(t *testing.T) {
@@ -425,7 +529,7 @@ func TestDagBlockDAGInitialised(t *testing.T) {
 	_, conf, db, genesisBlock := newBlockdag()
 
 	// Query the blocks column.
-	genesisBlockHash := genesisBlock.Hash()
+	genesisBlockHash := genesisBlock.Hash(testHasher)
 	rows, err := db.Query("select hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work from blocks where hash = ? limit 1", genesisBlockHash[:])
 	if err != nil {
 		t.Fatalf("Failed to query blocks table: %s", err)
@@ -483,8 +587,8 @@ func TestDagBlockDAGInitialised(t *testing.T) {
 
 	// Compute the acc work.
 	rawGenesisBlock := GetRawGenesisBlockFromConfig(conf)
-	accWork := CalculateWork(Bytes32ToBigInt(rawGenesisBlock.Hash()))
-	t.Logf("Genesis block: %v\n", Bytes32ToHexString(rawGenesisBlock.Hash()))
+	accWork := CalculateWork(Bytes32ToBigInt(rawGenesisBlock.Hash(testHasher)))
+	t.Logf("Genesis block: %v\n", Bytes32ToHexString(rawGenesisBlock.Hash(testHasher)))
 	t.Logf("Genesis block acc work: %s\n", accWork.String())
 
 	t.Logf("Block: %v\n", block.Hash)
@@ -492,15 +596,15 @@ func TestDagBlockDAGInitialised(t *testing.T) {
 	// Check the genesis block.
 	// find:GENESIS-BLOCK-ASSERTS
 	genesisNonce := Bytes32ToBigInt(genesisBlock.Nonce)
-	assert.Equal(genesisBlock.Hash(), block.Hash)
+	assert.Equal(genesisBlock.Hash(testHasher), block.Hash)
 	assert.Equal(conf.GenesisParentBlockHash, block.ParentHash)
 	assert.Equal(big.NewInt(0).String(), block.ParentTotalWork.String())
 	assert.Equal(uint64(0), block.Timestamp)
 	assert.Equal(uint64(1), block.NumTransactions)
-	assert.Equal([32]uint8{0x59, 0xe0, 0xaa, 0xf, 0x1f, 0xe6, 0x6f, 0x3b, 0xe, 0xb0, 0xc, 0xa3, 0x31, 0x33, 0x1a, 0x69, 0x1, 0xc4, 0xc4, 0xa1, 0x21, 0x99, 0xba, 0xa0, 0x16, 0x77, 0xfd, 0xe2, 0xd4, 0xb7, 0xc6, 0x88}, block.TransactionsMerkleRoot)
-	assert.Equal(big.NewInt(19).String(), genesisNonce.String())
+	assert.Equal([32]uint8{0x4f, 0x9, 0xa0, 0x2c, 0x31, 0x24, 0x47, 0x18, 0x11, 0x7c, 0x63, 0xde, 0x63, 0xdc, 0xb0, 0x55, 0x37, 0x82, 0x82, 0xf2, 0x8, 0xb2, 0x2, 0xfd, 0x52, 0x2d, 0x1c, 0x89, 0xe8, 0x96, 0xf6, 0xa5}, block.TransactionsMerkleRoot)
+	assert.Equal(big.NewInt(3).String(), genesisNonce.String())
 	assert.Equal(uint64(0), block.Height)
-	assert.Equal(GetIdForEpoch(genesisBlock.Hash(), 0), block.Epoch)
+	assert.Equal(GetIdForEpoch(genesisBlock.Hash(testHasher), 0), block.Epoch)
 
 	// Query the epochs column.
 	rows, err = db.Query("SELECT id, start_block_hash, start_time, start_height, difficulty FROM epochs")
@@ -524,8 +628,8 @@ func TestDagBlockDAGInitialised(t *testing.T) {
 
 	// Check the genesis epoch.
 	t.Logf("Genesis epoch: %v\n", epoch.Id)
-	assert.Equal(GetIdForEpoch(genesisBlock.Hash(), 0), epoch.Id)
-	assert.Equal(HexStringToBytes32("04ce8ce628e56bab073ff2298f1f9d0e96d31fb7a81f388d8fe6e4aa4dc1aaa8"), epoch.StartBlockHash)
+	assert.Equal(GetIdForEpoch(genesisBlock.Hash(testHasher), 0), epoch.Id)
+	assert.Equal(HexStringToBytes32("078943760698d69cba7aeef1cbba3dba6307c187a23dc700473d7316f5893664"), epoch.StartBlockHash)
 	assert.Equal(uint64(0), epoch.StartTime)
 	assert.Equal(uint64(0), epoch.StartHeight)
 	assert.Equal(conf.GenesisDifficulty, epoch.Difficulty)
@@ -536,9 +640,9 @@ func TestDagGetEpochForBlockHashGenesis(t *testing.T) {
 	blockdag, _, _, genesisBlock := newBlockdag()
 
 	// Test we can get the genesis epoch.
-	epoch, err := blockdag.GetEpochForBlockHash(genesisBlock.Hash())
+	epoch, err := blockdag.GetEpochForBlockHash(genesisBlock.Hash(testHasher))
 	assert.Equal(nil, err)
-	assert.Equal(GetIdForEpoch(genesisBlock.Hash(), 0), epoch.Id)
+	assert.Equal(GetIdForEpoch(genesisBlock.Hash(testHasher), 0), epoch.Id)
 }
 
 func TestDagGetEpochForBlockHashNewBlock(t *testing.T) {
@@ -546,14 +650,14 @@ func TestDagGetEpochForBlockHashNewBlock(t *testing.T) {
 	blockdag, _, _, genesisBlock := newBlockdag()
 
 	// Create a tx with a valid signature.
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		t.Fatalf("Failed to sign transaction: %s", err)
 	}
 
 	raw := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+		ParentHash:             genesisBlock.Hash(testHasher),
+		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash(testHasher)))),
 		Timestamp:              1719379532750,
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{},
@@ -562,14 +666,14 @@ func TestDagGetEpochForBlockHashNewBlock(t *testing.T) {
 			tx,
 		},
 	}
-	raw.TransactionsMerkleRoot = GetMerkleRootForTxs(raw.Transactions)
+	raw.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, raw.Transactions)
 
 	// Mine the POW solution.
 	epoch, err := blockdag.GetEpochForBlockHash(raw.ParentHash)
 	if err != nil {
 		t.Fatalf("Failed to get epoch for block hash: %s", err)
 	}
-	solution, err := SolvePOW(raw, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	solution, err := SolvePOW(testHasher, raw, *big.NewInt(0), epoch.Difficulty, 1000000000000)
 	if err != nil {
 		t.Fatalf("Failed to solve POW: %s", err)
 	}
@@ -583,9 +687,9 @@ func TestDagGetEpochForBlockHashNewBlock(t *testing.T) {
 	assert.Equal(nil, err)
 
 	// Verify block ingested into data store.
-	block, err := blockdag.GetBlockByHash(raw.Hash())
+	block, err := blockdag.GetBlockByHash(raw.Hash(testHasher))
 	assert.Equal(nil, err)
-	assert.Equal(raw.Hash(), block.Hash)
+	assert.Equal(raw.Hash(testHasher), block.Hash)
 	assert.Equal(raw.ParentHash, block.ParentHash)
 	assert.Equal(raw.Timestamp, block.Timestamp)
 	assert.Equal(raw.NumTransactions, block.NumTransactions)
@@ -602,10 +706,10 @@ func TestDagGetLatestTip(t *testing.T) {
 	// The genesis will be the first tip.
 	current_tip, err := blockdag.GetLatestFullTip()
 	assert.Equal(nil, err)
-	assert.Equal(genesisBlock.Hash(), current_tip.Hash)
+	assert.Equal(genesisBlock.Hash(testHasher), current_tip.Hash)
 
 	// Mine a few blocks.
-	tx, err := newValidTx(t)
+	tx, err := newValidCoinbaseTx(t, 1)
 	if err != nil {
 		t.Fatalf("Failed to create valid tx: %s", err)
 	}
@@ -613,7 +717,7 @@ func TestDagGetLatestTip(t *testing.T) {
 	// Construct block template for mining.
 	raw := RawBlock{
 		ParentHash:             current_tip.Hash,
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash(testHasher)))),
 		Timestamp:              Timestamp(),
 		NumTransactions:        1,
 		TransactionsMerkleRoot: [32]byte{},
@@ -622,14 +726,14 @@ func TestDagGetLatestTip(t *testing.T) {
 			tx,
 		},
 	}
-	raw.TransactionsMerkleRoot = GetMerkleRootForTxs(raw.Transactions)
+	raw.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, raw.Transactions)
 
 	// Mine the POW solution.
 	epoch, err := blockdag.GetEpochForBlockHash(raw.ParentHash)
 	if err != nil {
 		t.Fatalf("Failed to get epoch for block hash: %s", err)
 	}
-	solution, err := SolvePOW(raw, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	solution, err := SolvePOW(testHasher, raw, *big.NewInt(0), epoch.Difficulty, 1000000000000)
 	if err != nil {
 		t.Fatalf("Failed to solve POW: %s", err)
 	}
@@ -645,21 +749,21 @@ func TestDagGetLatestTip(t *testing.T) {
 	// Check if the block is the latest tip.
 	current_tip, err = blockdag.GetLatestFullTip()
 	assert.Equal(nil, err)
-	assert.Equal(raw.Hash(), current_tip.Hash)
+	assert.Equal(raw.Hash(testHasher), current_tip.Hash)
 
 	// Check the in-memory latest tip is updated.
-	assert.Equal(raw.Hash(), blockdag.FullTip.Hash)
+	assert.Equal(raw.Hash(testHasher), blockdag.FullTip.Hash)
 }
 
 func TestMinerProcedural(t *testing.T) {
 	dag, _, _, genesisBlock := newBlockdag()
 
 	// Mine 10 blocks.
-	current_tip := genesisBlock.Hash()
+	current_tip := genesisBlock.Hash(testHasher)
 	current_height := uint64(0)
 
 	// Get genesis block.
-	genesis, err := dag.GetBlockByHash(genesisBlock.Hash())
+	genesis, err := dag.GetBlockByHash(genesisBlock.Hash(testHasher))
 	if err != nil {
 		t.Fatalf("Failed to get genesis block: %s", err)
 	}
@@ -671,7 +775,7 @@ func TestMinerProcedural(t *testing.T) {
 	acc_work := genesis.AccumulatedWork
 
 	for i := 0; i < 10; i++ {
-		tx, err := newValidTx(t)
+		tx, err := newValidCoinbaseTx(t, current_height)
 		if err != nil {
 			t.Fatalf("Failed to create valid tx: %s", err)
 		}
@@ -688,7 +792,7 @@ func TestMinerProcedural(t *testing.T) {
 				tx,
 			},
 		}
-		raw.TransactionsMerkleRoot = GetMerkleRootForTxs(raw.Transactions)
+		raw.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, raw.Transactions)
 
 		t.Logf("Mining block height=%d parentTotalWork=%s\n", current_height, acc_work.String())
 
@@ -707,18 +811,18 @@ func TestMinerProcedural(t *testing.T) {
 		}
 
 		// Solve the POW puzzle.
-		solution, err := SolvePOW(raw, *big.NewInt(0), difficulty, 1000000000000)
+		solution, err := SolvePOW(testHasher, raw, *big.NewInt(0), difficulty, 1000000000000)
 		if err != nil {
 			t.Fatalf("Failed to solve POW: %s", err)
 		}
 		raw.SetNonce(solution)
 
 		// Check the acc work.
-		work := CalculateWork(Bytes32ToBigInt(raw.Hash()))
+		work := CalculateWork(Bytes32ToBigInt(raw.Hash(testHasher)))
 		acc_work = *acc_work.Add(&acc_work, work)
 		current_height += 1
 
-		t.Logf("Solution: height=%d hash=%s nonce=%s acc_work=%s\n", current_height, Bytes32ToString(raw.Hash()), solution.String(), acc_work.String())
+		t.Logf("Solution: height=%d hash=%s nonce=%s acc_work=%s\n", current_height, Bytes32ToString(raw.Hash(testHasher)), solution.String(), acc_work.String())
 
 		// Ingest the block.
 		err = dag.IngestBlock(raw)
@@ -727,7 +831,7 @@ func TestMinerProcedural(t *testing.T) {
 		}
 
 		// Print log.
-		block, err := dag.GetBlockByHash(raw.Hash())
+		block, err := dag.GetBlockByHash(raw.Hash(testHasher))
 		current_tip = block.Hash
 	}
 }
@@ -791,7 +895,7 @@ func TestDagGetLongestChainHashList(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to ingest block: %s", err)
 		}
-		expectedHashList = append(expectedHashList, block.Hash())
+		expectedHashList = append(expectedHashList, block.Hash(testHasher))
 	}
 	miner.Start(N_BLOCKS)
 
@@ -858,7 +962,7 @@ func TestDagGetPathSingleChain(t *testing.T) {
 	fullChain = append(fullChain, genesisBlock)
 	fullChain = append(fullChain, blocksMined...)
 	for i, block := range fullChain {
-		t.Logf("block #%d: %s\n", i+1, block.HashStr())
+		t.Logf("block #%d: %s\n", i+1, block.HashStr(testHasher))
 	}
 
 	// Get path.
@@ -880,11 +984,11 @@ func TestDagGetPathSingleChain(t *testing.T) {
 	for i, blockHash := range path {
 		t.Logf("Path block #%d: %x\n", i+1, blockHash)
 		// We asked for the path from tip to genesis, so the path should be in reverse order.
-		assert.Equal(fullChain[len(fullChain)-1-i].HashStr(), Bytes32ToHexString(blockHash))
+		assert.Equal(fullChain[len(fullChain)-1-i].HashStr(testHasher), Bytes32ToHexString(blockHash))
 	}
 
 	// (2) Get the path from the genesis to the tip (forwards traversal).
-	path, err = dag.GetPath(genesisBlock.Hash(), 4, 1)
+	path, err = dag.GetPath(genesisBlock.Hash(testHasher), 4, 1)
 	if err != nil {
 		t.Fatalf("Failed to get path: %s", err)
 	}
@@ -896,7 +1000,7 @@ func TestDagGetPathSingleChain(t *testing.T) {
 	for i, blockHash := range path {
 		t.Logf("Path block #%d: %x\n", i+1, blockHash)
 		// We asked for the path from tip to genesis, so the path should be in reverse order.
-		assert.Equal(fullChain[i].HashStr(), Bytes32ToHexString(blockHash))
+		assert.Equal(fullChain[i].HashStr(testHasher), Bytes32ToHexString(blockHash))
 	}
 }
 
@@ -932,7 +1036,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	fullChain = append(fullChain, genesisBlock)
 	fullChain = append(fullChain, blocksMined...)
 	for i, block := range fullChain {
-		t.Logf("block #%d: %s\n", i+1, block.HashStr())
+		t.Logf("block #%d: %s\n", i+1, block.HashStr(testHasher))
 	}
 
 	// Get path.
@@ -951,7 +1055,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	assert.Equal(4, len(path))
 
 	// (2) Insert a new branch.
-	altBranchBaseBlock, err := dag.GetBlockByHash(blocksMined[0].Hash())
+	altBranchBaseBlock, err := dag.GetBlockByHash(blocksMined[0].Hash(testHasher))
 	if err != nil {
 		t.Fatalf("Failed to get block: %s", err)
 	}
@@ -964,7 +1068,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to ingest block: %s", err)
 		}
-		blk, err := dag.GetBlockByHash(block.Hash())
+		blk, err := dag.GetBlockByHash(block.Hash(testHasher))
 		if err != nil {
 			t.Fatalf("Failed to get block: %s", err)
 		}
@@ -975,7 +1079,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	// (3) Log the two chains.
 	t.Logf("First branch:\n")
 	for i, block := range fullChain {
-		t.Logf("block #%d: %s\n", i+1, block.HashStr())
+		t.Logf("block #%d: %s\n", i+1, block.HashStr(testHasher))
 	}
 	t.Log()
 
@@ -985,12 +1089,12 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	altBranch = append(altBranch, blocksMined[0])
 	altBranch = append(altBranch, altBranchBlocks...)
 	for i, block := range altBranch {
-		t.Logf("block #%d: %s\n", i+1, block.HashStr())
+		t.Logf("block #%d: %s\n", i+1, block.HashStr(testHasher))
 	}
 
 	// Log the accumulated work on the tips of both branches.
-	firstBranchTip, _ := dag.GetBlockByHash(fullChain[len(fullChain)-1].Hash())
-	secondBranchTip, _ := dag.GetBlockByHash(altBranch[len(altBranch)-1].Hash())
+	firstBranchTip, _ := dag.GetBlockByHash(fullChain[len(fullChain)-1].Hash(testHasher))
+	secondBranchTip, _ := dag.GetBlockByHash(altBranch[len(altBranch)-1].Hash(testHasher))
 	t.Logf("First branch tip acc work: %s\n", firstBranchTip.AccumulatedWork.String())
 	t.Logf("Second branch tip acc work: %s\n", secondBranchTip.AccumulatedWork.String())
 
@@ -1016,7 +1120,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	//
 
 	// (4) Get the path from the tip to the genesis (backwards traversal).
-	path, err = dag.GetPath(genesisBlock.Hash(), 17, 1)
+	path, err = dag.GetPath(genesisBlock.Hash(testHasher), 17, 1)
 	if err != nil {
 		t.Fatalf("Failed to get path: %s", err)
 	}
@@ -1026,7 +1130,7 @@ func TestDagGetPathComplexChain(t *testing.T) {
 	// 1b. Check the path is correct and is in traversal order.
 	for i, blockHash := range path {
 		t.Logf("Path block #%d: %x\n", i+1, blockHash)
-		assert.Equal(altBranch[i].HashStr(), Bytes32ToHexString(blockHash))
+		assert.Equal(altBranch[i].HashStr(testHasher), Bytes32ToHexString(blockHash))
 	}
 
 	/*
@@ -1198,3 +1302,331 @@ func TestDagIngestBody(t *testing.T) {
 	// Ingest body.
 	// Updates both full and header tip.
 }
+
+func TestDagInvalidateBlock(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, genesisBlock := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Mine 3 blocks.
+	blocksMined := miner.Start(3)
+	if len(blocksMined) != 3 {
+		t.Fatalf("Failed to mine 3 blocks.")
+	}
+	assert.Equal(blocksMined[2].Hash(testHasher), dag.FullTip.Hash)
+
+	// Invalidate block #2. Block #3 descends from it, so the tip should fall back to block #1.
+	err := dag.InvalidateBlock(blocksMined[1].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(blocksMined[0].Hash(testHasher), dag.FullTip.Hash)
+	assert.Equal(blocksMined[0].Hash(testHasher), dag.HeadersTip.Hash)
+
+	block, err := dag.GetBlockByHash(blocksMined[1].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(BlockStatusInvalid, block.Status)
+
+	// Descendants keep their own status, they are excluded by ancestry.
+	block, err = dag.GetBlockByHash(blocksMined[2].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(BlockStatusValidBody, block.Status)
+
+	// The genesis block cannot be invalidated.
+	err = dag.InvalidateBlock(genesisBlock.Hash(testHasher))
+	assert.NotNil(err)
+}
+
+func TestDagInvalidatesBlockOnStateError(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Mine 2 blocks.
+	blocksMined := miner.Start(2)
+	if len(blocksMined) != 2 {
+		t.Fatalf("Failed to mine 2 blocks.")
+	}
+
+	// Block #3 fails to apply to the state.
+	badBlock := [32]byte{}
+	tips := [][32]byte{}
+	prevTips := [][32]byte{}
+	dag.OnNewFullTip = func(tip Block, prevTip Block) error {
+		tips = append(tips, tip.Hash)
+		prevTips = append(prevTips, prevTip.Hash)
+		if tip.Hash == badBlock {
+			return &BlockStateError{BlockHash: badBlock, TxIndex: -1, Err: errors.New("bad block")}
+		}
+		return nil
+	}
+	miner.OnBlockSolution = func(block RawBlock) {
+		badBlock = block.Hash(testHasher)
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(1)
+
+	// By the time the block is ingested, it is invalid and the tip has moved back to its parent.
+	assert.Equal([][32]byte{badBlock, blocksMined[1].Hash(testHasher)}, tips)
+	// The invalid block is skipped, so both updates are from the tip before it.
+	assert.Equal([][32]byte{blocksMined[1].Hash(testHasher), blocksMined[1].Hash(testHasher)}, prevTips)
+	assert.Equal(blocksMined[1].Hash(testHasher), dag.FullTip.Hash)
+	assert.Equal(blocksMined[1].Hash(testHasher), dag.HeadersTip.Hash)
+
+	block, err := dag.GetBlockByHash(badBlock)
+	assert.Nil(err)
+	assert.Equal(BlockStatusInvalid, block.Status)
+}
+
+func TestDagReconsiderBlock(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Mine 3 blocks.
+	blocksMined := miner.Start(3)
+	if len(blocksMined) != 3 {
+		t.Fatalf("Failed to mine 3 blocks.")
+	}
+
+	// Invalidate block #2, then reconsider it.
+	err := dag.InvalidateBlock(blocksMined[1].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(blocksMined[0].Hash(testHasher), dag.FullTip.Hash)
+
+	err = dag.ReconsiderBlock(blocksMined[1].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(blocksMined[2].Hash(testHasher), dag.FullTip.Hash)
+	assert.Equal(blocksMined[2].Hash(testHasher), dag.HeadersTip.Hash)
+
+	block, err := dag.GetBlockByHash(blocksMined[1].Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal(BlockStatusValidBody, block.Status)
+
+	// Unknown blocks cannot be reconsidered.
+	err = dag.ReconsiderBlock([32]byte{})
+	assert.Equal(ErrBlockNotFound, err)
+}
+
+func TestDagGetTxProof(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Mine a block with a few transfers.
+	txs := []RawTransaction{
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 1, 0, 0, &wallets[0]),
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 2, 0, 0, &wallets[0]),
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 3, 0, 0, &wallets[0]),
+	}
+	miner.GetBlockBody = func() BlockBody {
+		return txs
+	}
+	blocksMined := miner.Start(1)
+	if len(blocksMined) != 1 {
+		t.Fatalf("Failed to mine block.")
+	}
+	block := blocksMined[0]
+
+	// Get and verify a proof for each transaction, including the coinbase.
+	for _, tx := range block.Transactions {
+		txProof, err := dag.GetTxProof(tx.Hash())
+		assert.Nil(err)
+		assert.Equal(tx, txProof.Tx)
+		assert.Equal(block.Hash(testHasher), txProof.BlockHeader.BlockHash(testHasher))
+		assert.True(txProof.verify(testHasher, true))
+	}
+
+	// A proof for a tampered transaction fails.
+	txProof, err := dag.GetTxProof(txs[1].Hash())
+	assert.Nil(err)
+	txProof.Tx.Amount = 1000
+	assert.False(txProof.verify(testHasher, true))
+
+	// Unknown transactions have no proof.
+	_, err = dag.GetTxProof([32]byte{})
+	assert.NotNil(err)
+}
+
+func TestDagGetBlockLocator(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, genesisBlock := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// The locator of the genesis block is just the genesis block.
+	locator, err := dag.GetBlockLocator(genesisBlock.Hash(testHasher))
+	assert.Nil(err)
+	assert.Equal([][32]byte{genesisBlock.Hash(testHasher)}, locator)
+
+	miner.Start(30)
+	tip, err := dag.GetLatestFullTip()
+	if err != nil {
+		t.Fatalf("Failed to get tip: %s", err)
+	}
+
+	// The locator has the 10 most recent blocks, then blocks spaced exponentially back to genesis.
+	locator, err = dag.GetBlockLocator(tip.Hash)
+	assert.Nil(err)
+	heights := []uint64{}
+	for _, hash := range locator {
+		block, err := dag.GetBlockByHash(hash)
+		assert.Nil(err)
+		heights = append(heights, block.Height)
+	}
+	assert.Equal([]uint64{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0}, heights)
+
+	// Unknown blocks have no locator.
+	_, err = dag.GetBlockLocator([32]byte{})
+	assert.Equal(ErrBlockNotFound, err)
+}
+
+func TestDagFindForkPoint(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallet := getTestingWallets(t)[0]
+	miner := NewMiner(dag, &wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	blocksMined := miner.Start(3)
+	if len(blocksMined) != 3 {
+		t.Fatalf("Failed to mine 3 blocks.")
+	}
+
+	// Mine a second branch from the first block.
+	altBranchBaseBlock, err := dag.GetBlockByHash(blocksMined[0].Hash(testHasher))
+	if err != nil {
+		t.Fatalf("Failed to get block: %s", err)
+	}
+	var alternativeTipForMining Block = *altBranchBaseBlock
+	miner.GetTipForMining = func() Block {
+		return alternativeTipForMining
+	}
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		blk, err := dag.GetBlockByHash(block.Hash(testHasher))
+		if err != nil {
+			t.Fatalf("Failed to get block: %s", err)
+		}
+		alternativeTipForMining = *blk
+	}
+	altBranchBlocks := miner.Start(5)
+
+	// The work of a block is estimated from its hash, so either branch can be the heaviest.
+	otherBranchTip := blocksMined[2].Hash(testHasher)
+	if dag.FullTip.Hash == otherBranchTip {
+		otherBranchTip = altBranchBlocks[4].Hash(testHasher)
+	}
+
+	// The fork point of a locator from our own tip is our tip.
+	locator, err := dag.GetBlockLocator(dag.FullTip.Hash)
+	assert.Nil(err)
+	forkPoint, ok, err := dag.FindForkPoint(locator)
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal(dag.FullTip.Hash, forkPoint)
+
+	// The fork point of a locator from the other branch is where it branched off our chain.
+	locator, err = dag.GetBlockLocator(otherBranchTip)
+	assert.Nil(err)
+	forkPoint, ok, err = dag.FindForkPoint(locator)
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal(blocksMined[0].Hash(testHasher), forkPoint)
+
+	// A locator of unknown blocks has no fork point.
+	_, ok, err = dag.FindForkPoint([][32]byte{{1}, {2}})
+	assert.Nil(err)
+	assert.False(ok)
+}
+
+func TestDagGetRawBlockDataByHash(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{
+			MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 0, 0, 0, &wallets[0]),
+		}
+	}
+	blocksMined := miner.Start(1)
+	if len(blocksMined) != 1 {
+		t.Fatalf("Failed to mine block.")
+	}
+	block := blocksMined[0]
+
+	// Blocks are returned in their canonical encoding, with their transactions.
+	rawBlockData, err := dag.GetRawBlockDataByHash(block.Hash(testHasher))
+	assert.Nil(err)
+	decoded, err := RawBlockFromBytes(rawBlockData)
+	assert.Nil(err)
+	assert.Equal(block.Hash(testHasher), decoded.Hash(testHasher))
+	assert.Equal(block.Transactions, decoded.Transactions)
+
+	// Blocks whose bodies we don't have can't be returned.
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestHeader(block.ToBlockHeader())
+		if err != nil {
+			t.Fatalf("Failed to ingest header: %s", err)
+		}
+	}
+	blocksMined = miner.Start(1)
+	if len(blocksMined) != 1 {
+		t.Fatalf("Failed to mine block.")
+	}
+	_, err = dag.GetRawBlockDataByHash(blocksMined[0].Hash(testHasher))
+	assert.ErrorContains(err, "Block body has not been downloaded.")
+
+	// Unknown blocks.
+	_, err = dag.GetRawBlockDataByHash([32]byte{})
+	assert.Equal(ErrBlockNotFound, err)
+}
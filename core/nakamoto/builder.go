@@ -0,0 +1,358 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Block building is separated from mining (proposer-builder separation). Builders assemble block bodies from
+// transactions, and bid for the miner to include their body by paying the miner's coinbase account. The miner runs an
+// auction for the blockspace of its next block, choosing the bid which pays it the most while being valid against the
+// current state.
+//
+// Builders can be local, implementing the BlockBuilder interface, or external, submitting bids to the miner's peer.
+
+var ErrBidStaleParent = errors.New("builder bid is not built on the current tip")
+var ErrBidTooLow = errors.New("builder bid is too low to be kept")
+var ErrBuilderNoTxs = errors.New("builder has no transactions to bid")
+
+// A builder's bid for the body of the next block.
+type BuilderBid struct {
+	// The block the body is built on.
+	ParentHash [32]byte `json:"parentHash"`
+
+	// The transactions of the body.
+	Transactions []RawTransaction `json:"transactions"`
+
+	// The builder's payment to the miner's coinbase account for including the body.
+	Payment RawTransaction `json:"payment"`
+}
+
+// Gets the block body of the bid, which is the bid's transactions followed by the payment.
+func (bid *BuilderBid) Body() BlockBody {
+	body := slices.Clone(bid.Transactions)
+	return append(body, bid.Payment)
+}
+
+// Gets the value of the bid to the miner, which is the payment plus the fees of all transactions.
+func (bid *BuilderBid) Value() uint64 {
+	value := uint64(0)
+	for _, tx := range bid.Body() {
+		value += tx.Fee
+	}
+	return value + bid.Payment.Amount
+}
+
+// A block builder constructs block bodies, and bids for their inclusion in the next block.
+type BlockBuilder interface {
+	// Builds a block body on the parent block, and bids for its inclusion by paying the coinbase account.
+	BuildBid(parent Block, coinbase [65]byte) (BuilderBid, error)
+}
+
+// The BuilderAuction collects bids from block builders, and chooses the best body for the miner's next block.
+type BuilderAuction struct {
+	dag      *BlockDAG
+	coinbase [65]byte
+	getState func() *StateMachine
+
+	// Local builders, which are asked for a bid each time a body is needed.
+	Builders []BlockBuilder
+
+	// The maximum number of external bids kept. When full, the lowest-value bid is dropped.
+	MaxBids int
+
+	// Bids submitted by external builders on the current tip.
+	bids  []BuilderBid
+	mutex sync.Mutex
+
+	log *log.Logger
+}
+
+// Creates a new auction for the blockspace of blocks paying the coinbase account. Bids are checked against the state
+// returned by getState, which is the state at the current full tip.
+func NewBuilderAuction(dag *BlockDAG, coinbase [65]byte, getState func() *StateMachine) *BuilderAuction {
+	return &BuilderAuction{
+		dag:      dag,
+		coinbase: coinbase,
+		getState: getState,
+		Builders: []BlockBuilder{},
+		MaxBids:  64,
+		bids:     []BuilderBid{},
+		log:      NewLogger("builder-auction", ""),
+	}
+}
+
+// Submits a bid from an external builder. The bid must be built on the current tip, and be valid against the
+// current state.
+func (a *BuilderAuction) SubmitBid(bid BuilderBid) error {
+	tip := a.dag.FullTip
+	if err := a.checkBid(bid, tip, BlockBody{}); err != nil {
+		return err
+	}
+
+	// Checking a bid against the state is expensive, so reject bids which wouldn't be kept first.
+	a.mutex.Lock()
+	lowest, full := a.getLowestBidValue(tip.Hash)
+	a.mutex.Unlock()
+	if full && bid.Value() <= lowest {
+		return ErrBidTooLow
+	}
+	if err := a.checkBidState(bid, tip, BlockBody{}); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Drop bids on old tips.
+	a.bids = slices.DeleteFunc(a.bids, func(b BuilderBid) bool {
+		return b.ParentHash != tip.Hash
+	})
+	a.bids = append(a.bids, bid)
+
+	// Keep the highest-value bids.
+	if a.MaxBids < len(a.bids) {
+		slices.SortStableFunc(a.bids, func(x, y BuilderBid) int {
+			return -1 * cmpUint64(x.Value(), y.Value())
+		})
+		a.bids = a.bids[:a.MaxBids]
+	}
+
+	a.log.Printf("Received bid: parent=%x txs=%d value=%d\n", bid.ParentHash, len(bid.Transactions), bid.Value())
+	return nil
+}
+
+// Gets the lowest value of the bids kept on the parent, and whether the auction is full. Must be called with the mutex
+// held.
+func (a *BuilderAuction) getLowestBidValue(parentHash [32]byte) (uint64, bool) {
+	count := 0
+	lowest := uint64(0)
+	for _, bid := range a.bids {
+		if bid.ParentHash != parentHash {
+			continue
+		}
+		if count == 0 || bid.Value() < lowest {
+			lowest = bid.Value()
+		}
+		count++
+	}
+	return lowest, a.MaxBids <= count
+}
+
+// Chooses the highest-value bid which is valid on the current tip, and returns its block body. Returns an empty
+// body if there are no valid bids.
+func (a *BuilderAuction) GetBestBody() BlockBody {
+	body, _ := a.GetBestBodyAfter(BlockBody{})
+	return body
+}
+
+// Chooses the highest-value bid which is valid on the current tip after the required transactions, such as a pool's
+// payouts, and returns the required transactions followed by the bid's body. Returns an error if the required
+// transactions are themselves invalid.
+func (a *BuilderAuction) GetBestBodyAfter(required BlockBody) (BlockBody, error) {
+	tip := a.dag.FullTip
+	if err := a.verifyRequiredTxs(required, tip); err != nil {
+		return nil, err
+	}
+
+	// Collect bids from the local builders, and the external bids on the tip.
+	bids := []BuilderBid{}
+	for _, builder := range a.Builders {
+		bid, err := builder.BuildBid(tip, a.coinbase)
+		if errors.Is(err, ErrBuilderNoTxs) {
+			continue
+		}
+		if err != nil {
+			a.log.Printf("Local builder failed to build bid: %s\n", err)
+			continue
+		}
+		bids = append(bids, bid)
+	}
+	a.mutex.Lock()
+	for _, bid := range a.bids {
+		if bid.ParentHash == tip.Hash {
+			bids = append(bids, bid)
+		}
+	}
+	a.mutex.Unlock()
+
+	// Choose the highest-value valid bid.
+	var best *BuilderBid
+	for i, bid := range bids {
+		if best != nil && bid.Value() <= best.Value() {
+			continue
+		}
+		if err := a.verifyBid(bid, tip, required); err != nil {
+			a.log.Printf("Discarding invalid bid: %s\n", err)
+			continue
+		}
+		best = &bids[i]
+	}
+
+	body := slices.Clone(required)
+	if best == nil {
+		return body, nil
+	}
+	a.log.Printf("Chose bid: parent=%x txs=%d value=%d\n", best.ParentHash, len(best.Transactions), best.Value())
+	return append(body, best.Body()...), nil
+}
+
+// Verifies a bid would produce a valid block on the tip after the required transactions, paying the coinbase account.
+func (a *BuilderAuction) verifyBid(bid BuilderBid, tip Block, required BlockBody) error {
+	if err := a.checkBid(bid, tip, required); err != nil {
+		return err
+	}
+	return a.checkBidState(bid, tip, required)
+}
+
+// Performs the checks on a bid which don't need the state: that it is built on the tip, pays the coinbase account,
+// fits in the block after the required transactions, and is signed.
+func (a *BuilderAuction) checkBid(bid BuilderBid, tip Block, required BlockBody) error {
+	if bid.ParentHash != tip.Hash {
+		return ErrBidStaleParent
+	}
+	if bid.Payment.ToPubkey != a.coinbase {
+		return fmt.Errorf("Bid payment is not to the coinbase account.")
+	}
+
+	// Check the block fits, including its coinbase tx.
+	body := bid.Body()
+	txs := append([]RawTransaction{{}}, required...)
+	block := RawBlock{Transactions: append(txs, body...)}
+	if a.dag.consensus.MaxBlockSizeBytes < block.SizeBytes() {
+		return fmt.Errorf("Bid body is too large: %d bytes", block.SizeBytes())
+	}
+
+	// Check the signatures.
+	for i, tx := range body {
+		if !a.dag.consensus.verifyTxSignature(tip.Height+1, tx) {
+			return fmt.Errorf("Bid transaction %d is invalid: signature invalid.", i)
+		}
+	}
+	return nil
+}
+
+// Checks the bid's transactions apply to the current state, after the required transactions.
+func (a *BuilderAuction) checkBidState(bid BuilderBid, tip Block, required BlockBody) error {
+	state := a.getState().Copy()
+	if i, err := a.applyTxs(state, tip, required); err != nil {
+		return fmt.Errorf("Required transaction %d is invalid: %s", i, err)
+	}
+	if i, err := a.applyTxs(state, tip, bid.Body()); err != nil {
+		return fmt.Errorf("Bid transaction %d is invalid: %s", i, err)
+	}
+	return nil
+}
+
+// Verifies the required transactions would be valid on their own in a block on the tip.
+func (a *BuilderAuction) verifyRequiredTxs(required BlockBody, tip Block) error {
+	block := RawBlock{Transactions: append([]RawTransaction{{}}, required...)}
+	if a.dag.consensus.MaxBlockSizeBytes < block.SizeBytes() {
+		return fmt.Errorf("Required transactions are too large: %d bytes", block.SizeBytes())
+	}
+	for i, tx := range required {
+		if !a.dag.consensus.verifyTxSignature(tip.Height+1, tx) {
+			return fmt.Errorf("Required transaction %d is invalid: signature invalid.", i)
+		}
+	}
+	if i, err := a.applyTxs(a.getState().Copy(), tip, required); err != nil {
+		return fmt.Errorf("Required transaction %d is invalid: %s", i, err)
+	}
+	return nil
+}
+
+// Applies transactions in a block on the tip to the state. Returns the index of the first transaction which is
+// invalid.
+func (a *BuilderAuction) applyTxs(state *StateMachine, tip Block, txs BlockBody) (int, error) {
+	for i, tx := range txs {
+		effects, err := state.Transition(StateMachineInput{
+			RawTransaction:   tx,
+			IsCoinbase:       false,
+			MinerPubkey:      a.coinbase,
+			BlockReward:      GetBlockReward(int(tip.Height)),
+			BlockHeight:      tip.Height + 1,
+			CoinbaseMaturity: a.dag.consensus.getCoinbaseMaturity(tip.Height + 1),
+		})
+		if err != nil {
+			return i, err
+		}
+		state.Apply(effects)
+	}
+	return 0, nil
+}
+
+func cmpUint64(x, y uint64) int {
+	if x < y {
+		return -1
+	} else if y < x {
+		return 1
+	}
+	return 0
+}
+
+// LocalBuilder builds block bodies from a mempool, taking transactions by fee descending until the body is full,
+// and bids a fixed payment from its wallet.
+type LocalBuilder struct {
+	mempool *Mempool
+	wallet  *core.Wallet
+
+	// The payment bid for each block.
+	Payment uint64
+
+	// The maximum size of the bodies built.
+	MaxBodySizeBytes uint64
+}
+
+func NewLocalBuilder(mempool *Mempool, wallet *core.Wallet, payment uint64, maxBodySizeBytes uint64) *LocalBuilder {
+	return &LocalBuilder{
+		mempool:          mempool,
+		wallet:           wallet,
+		Payment:          payment,
+		MaxBodySizeBytes: maxBodySizeBytes,
+	}
+}
+
+// Builds a bid from the mempool's transactions. Returns ErrBuilderNoTxs if the mempool is empty.
+func (b *LocalBuilder) BuildBid(parent Block, coinbase [65]byte) (BuilderBid, error) {
+	mempoolTxs := b.mempool.GetTxs()
+	if len(mempoolTxs) == 0 {
+		return BuilderBid{}, ErrBuilderNoTxs
+	}
+
+	// The payment commits to the block height, so it is unique to the block.
+	payment := RawTransaction{
+		Version:    1,
+		FromPubkey: b.wallet.PubkeyBytes(),
+		ToPubkey:   coinbase,
+		Amount:     b.Payment,
+		Fee:        0,
+		Nonce:      parent.Height + 1,
+	}
+	sig, err := b.wallet.Sign(payment.Envelope())
+	if err != nil {
+		return BuilderBid{}, err
+	}
+	copy(payment.Sig[:], sig)
+
+	// The mempool is sorted by fee descending.
+	size := payment.SizeBytes()
+	txs := []RawTransaction{}
+	for _, tx := range mempoolTxs {
+		if b.MaxBodySizeBytes < size+tx.SizeBytes() {
+			break
+		}
+		size += tx.SizeBytes()
+		txs = append(txs, tx)
+	}
+
+	return BuilderBid{
+		ParentHash:   parent.Hash,
+		Transactions: txs,
+		Payment:      payment,
+	}, nil
+}
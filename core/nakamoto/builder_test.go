@@ -0,0 +1,203 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBuilderAuctionForTest(t *testing.T) (*BuilderAuction, *BlockDAG, *StateMachine, *core.Wallet) {
+	miner, dag := newMinerForTest(t)
+	coinbaseWallet := miner.CoinbaseWallet
+	state, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatalf("Failed to create state machine: %s", err)
+	}
+	auction := NewBuilderAuction(dag, coinbaseWallet.PubkeyBytes(), func() *StateMachine {
+		return state
+	})
+	return auction, dag, state, coinbaseWallet
+}
+
+func newFundedWallet(t *testing.T, state *StateMachine, balance uint64) *core.Wallet {
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %s", err)
+	}
+	state.Apply([]*StateLeaf{{PubKey: wallet.PubkeyBytes(), Balance: balance}})
+	return wallet
+}
+
+func makeBidForTest(parent [32]byte, builder *core.Wallet, coinbase [65]byte, payment uint64, txs []RawTransaction) BuilderBid {
+	return BuilderBid{
+		ParentHash:   parent,
+		Transactions: txs,
+		Payment:      MakeTransferTx(builder.PubkeyBytes(), coinbase, payment, 0, 0, builder),
+	}
+}
+
+func TestBuilderAuctionChoosesBestValidBid(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	coinbase := coinbaseWallet.PubkeyBytes()
+	tip := dag.FullTip.Hash
+
+	builder1 := newFundedWallet(t, state, 100)
+	builder2 := newFundedWallet(t, state, 100)
+	user := newFundedWallet(t, state, 100)
+
+	// No bids.
+	assert.Equal(0, len(auction.GetBestBody()))
+
+	// A bid paying 10, with a user tx paying a fee of 5.
+	userTx := MakeTransferTx(user.PubkeyBytes(), builder1.PubkeyBytes(), 50, 5, 0, user)
+	bid1 := makeBidForTest(tip, builder1, coinbase, 10, []RawTransaction{userTx})
+	assert.Equal(uint64(15), bid1.Value())
+	assert.Nil(auction.SubmitBid(bid1))
+
+	// A bid paying 12.
+	bid2 := makeBidForTest(tip, builder2, coinbase, 12, []RawTransaction{})
+	assert.Nil(auction.SubmitBid(bid2))
+
+	// The bid with the highest value is chosen, with the payment last.
+	body := auction.GetBestBody()
+	assert.Equal(bid1.Body(), body)
+	assert.Equal(bid1.Payment, body[len(body)-1])
+
+	// Bids are checked against the state when the body is chosen. If the user's tx in bid 1 becomes invalid, bid 2
+	// wins.
+	state.Apply([]*StateLeaf{{PubKey: user.PubkeyBytes(), Balance: 0}})
+	assert.Equal(bid2.Body(), auction.GetBestBody())
+}
+
+func TestBuilderAuctionRejectsInvalidBids(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	coinbase := coinbaseWallet.PubkeyBytes()
+	tip := dag.FullTip.Hash
+	builder := newFundedWallet(t, state, 100)
+
+	// Not built on the tip.
+	bid := makeBidForTest([32]byte{1}, builder, coinbase, 10, []RawTransaction{})
+	assert.ErrorIs(auction.SubmitBid(bid), ErrBidStaleParent)
+
+	// Not paying the coinbase.
+	bid = makeBidForTest(tip, builder, builder.PubkeyBytes(), 10, []RawTransaction{})
+	assert.ErrorContains(auction.SubmitBid(bid), "not to the coinbase account")
+
+	// Invalid signature.
+	bid = makeBidForTest(tip, builder, coinbase, 10, []RawTransaction{})
+	bid.Payment.Amount = 20
+	assert.ErrorContains(auction.SubmitBid(bid), "signature invalid")
+
+	// Payment exceeds the builder's balance.
+	bid = makeBidForTest(tip, builder, coinbase, 1000, []RawTransaction{})
+	assert.ErrorContains(auction.SubmitBid(bid), ErrInsufficientBalance.Error())
+
+	// Spends the same funds twice.
+	tx := MakeTransferTx(builder.PubkeyBytes(), coinbase, 60, 0, 0, builder)
+	bid = makeBidForTest(tip, builder, coinbase, 60, []RawTransaction{tx})
+	assert.ErrorContains(auction.SubmitBid(bid), "Bid transaction 1 is invalid")
+
+	assert.Equal(0, len(auction.bids))
+}
+
+func TestLocalBuilder(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, _ := newBuilderAuctionForTest(t)
+	builderWallet := newFundedWallet(t, state, 100)
+	user := newFundedWallet(t, state, 100)
+
+	mempool := NewMempool()
+	for _, fee := range []uint64{1, 5, 3} {
+		err := mempool.SubmitTx(MakeTransferTx(user.PubkeyBytes(), builderWallet.PubkeyBytes(), 10, fee, 0, user))
+		assert.Nil(err)
+	}
+
+	// The body fits the payment and two txs.
+	tx := RawTransaction{}
+	builder := NewLocalBuilder(mempool, builderWallet, 7, 3*tx.SizeBytes())
+	auction.Builders = append(auction.Builders, builder)
+
+	body := auction.GetBestBody()
+	assert.Equal(3, len(body))
+	assert.Equal(uint64(5), body[0].Fee)
+	assert.Equal(uint64(3), body[1].Fee)
+	assert.Equal(uint64(7), body[2].Amount)
+	assert.Equal(dag.FullTip.Height+1, body[2].Nonce)
+}
+
+func TestMinerMinesBuilderBody(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	builder := newFundedWallet(t, state, 100)
+
+	bid := makeBidForTest(dag.FullTip.Hash, builder, coinbaseWallet.PubkeyBytes(), 10, []RawTransaction{})
+	assert.Nil(auction.SubmitBid(bid))
+
+	miner := NewMiner(*dag, coinbaseWallet)
+	miner.GetBlockBody = auction.GetBestBody
+	mined := miner.Start(1)
+	assert.Equal(1, len(mined))
+	assert.Equal(append([]RawTransaction{mined[0].Transactions[0]}, bid.Body()...), mined[0].Transactions)
+}
+
+func TestBuilderAuctionRejectsHighSBids(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	builder := newFundedWallet(t, state, 100)
+	dag.consensus.Upgrades = map[string]uint64{UpgradeLowS: 0}
+
+	// Signatures are checked under the rules of the next block.
+	bid := makeBidForTest(dag.FullTip.Hash, builder, coinbaseWallet.PubkeyBytes(), 10, []RawTransaction{})
+	bid.Payment = toHighSForTest(bid.Payment)
+	assert.ErrorContains(auction.SubmitBid(bid), "signature invalid")
+}
+
+func TestBuilderAuctionRejectsLowBidsWhenFull(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	coinbase := coinbaseWallet.PubkeyBytes()
+	tip := dag.FullTip.Hash
+	builder := newFundedWallet(t, state, 100)
+	auction.MaxBids = 1
+
+	assert.Nil(auction.SubmitBid(makeBidForTest(tip, builder, coinbase, 10, []RawTransaction{})))
+
+	// Once full, bids which don't beat the lowest kept bid are rejected before they are checked against the state.
+	assert.ErrorIs(auction.SubmitBid(makeBidForTest(tip, builder, coinbase, 10, []RawTransaction{})), ErrBidTooLow)
+	unfunded, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	assert.ErrorIs(auction.SubmitBid(makeBidForTest(tip, unfunded, coinbase, 5, []RawTransaction{})), ErrBidTooLow)
+
+	// Higher bids replace it.
+	bid := makeBidForTest(tip, builder, coinbase, 20, []RawTransaction{})
+	assert.Nil(auction.SubmitBid(bid))
+	assert.Equal([]BuilderBid{bid}, auction.bids)
+}
+
+func TestBuilderAuctionVerifiesBidsAfterRequiredTxs(t *testing.T) {
+	assert := assert.New(t)
+	auction, dag, state, coinbaseWallet := newBuilderAuctionForTest(t)
+	coinbase := coinbaseWallet.PubkeyBytes()
+	tip := dag.FullTip.Hash
+	builder1 := newFundedWallet(t, state, 100)
+	builder2 := newFundedWallet(t, state, 100)
+
+	bid1 := makeBidForTest(tip, builder1, coinbase, 20, []RawTransaction{})
+	bid2 := makeBidForTest(tip, builder2, coinbase, 10, []RawTransaction{})
+	assert.Nil(auction.SubmitBid(bid1))
+	assert.Nil(auction.SubmitBid(bid2))
+
+	// The required txs spend builder 1's funds, so its bid is invalid after them, and bid 2 is chosen.
+	required := BlockBody{MakeTransferTx(builder1.PubkeyBytes(), coinbase, 90, 0, 1, builder1)}
+	body, err := auction.GetBestBodyAfter(required)
+	assert.Nil(err)
+	assert.Equal(append(required, bid2.Body()...), body)
+
+	// Invalid required txs are an error.
+	required = BlockBody{MakeTransferTx(builder1.PubkeyBytes(), coinbase, 1000, 0, 1, builder1)}
+	_, err = auction.GetBestBodyAfter(required)
+	assert.ErrorContains(err, "Required transaction 0 is invalid")
+}
@@ -183,24 +183,134 @@ func OpenDB(dbPath string) (*sql.DB, error) {
 		return nil
 	})
 
+	dbMigrate(db, 3, func(tx *sql.Tx) error {
+		// Block validation status.
+		// Existing blocks are marked as valid headers, and those with their full body downloaded are marked as valid bodies.
+		_, err = tx.Exec(
+			`ALTER TABLE blocks ADD COLUMN status INTEGER NOT NULL DEFAULT 1;
+			UPDATE blocks SET status = 2 WHERE num_transactions = (
+				SELECT COUNT(*) FROM transactions_blocks tb WHERE tb.block_hash = blocks.hash
+			);
+			CREATE INDEX idx_blocks_status ON blocks (status);
+		`)
+		if err != nil {
+			return fmt.Errorf("error adding 'status' column to 'blocks' table: %s", err)
+		}
+		return nil
+	})
+
+	dbMigrate(db, 4, func(tx *sql.Tx) error {
+		// Transaction IDs.
+		// The transaction hash is now computed over the envelope, excluding the signature, and the hash over the full
+		// transaction is stored separately as the witness hash. Transactions which differ only by signature share a
+		// txid, so transactions are now keyed by their witness hash, which is what existing rows were keyed by.
+		_, err = tx.Exec(
+			`CREATE TABLE transactions_v4 (
+				witness_hash BLOB PRIMARY KEY, 
+				hash BLOB NOT NULL, 
+				sig BLOB, 
+				from_pubkey BLOB, 
+				to_pubkey BLOB, 
+				amount INTEGER, 
+				fee INTEGER, 
+				nonce INTEGER, 
+				version INTEGER
+			);
+			CREATE TABLE transactions_blocks_v4 (
+				block_hash BLOB, witness_hash BLOB, txindex INTEGER, 
+				
+				PRIMARY KEY (block_hash, witness_hash, txindex),
+				FOREIGN KEY (block_hash) REFERENCES blocks (hash), 
+				FOREIGN KEY (witness_hash) REFERENCES transactions (witness_hash)
+			);
+			INSERT INTO transactions_blocks_v4 (block_hash, witness_hash, txindex) 
+				SELECT block_hash, transaction_hash, txindex FROM transactions_blocks;
+		`)
+		if err != nil {
+			return fmt.Errorf("error creating 'transactions_v4' tables: %s", err)
+		}
+
+		// Copy the existing transactions, computing their txid.
+		rows, err := tx.Query(`SELECT hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version FROM transactions`)
+		if err != nil {
+			return fmt.Errorf("error reading transactions: %s", err)
+		}
+		txs := []RawTransaction{}
+		for rows.Next() {
+			witnessHash, sig, fromPubkey, toPubkey := []byte{}, []byte{}, []byte{}, []byte{}
+			raw := RawTransaction{}
+			err := rows.Scan(&witnessHash, &sig, &fromPubkey, &toPubkey, &raw.Amount, &raw.Fee, &raw.Nonce, &raw.Version)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("error reading transactions: %s", err)
+			}
+			copy(raw.Sig[:], sig)
+			copy(raw.FromPubkey[:], fromPubkey)
+			copy(raw.ToPubkey[:], toPubkey)
+			txs = append(txs, raw)
+		}
+		rows.Close()
+
+		for _, raw := range txs {
+			txid := raw.Hash()
+			witnessHash := raw.WitnessHash()
+			_, err = tx.Exec(
+				`INSERT INTO transactions_v4 (witness_hash, hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				witnessHash[:], txid[:], raw.Sig[:], raw.FromPubkey[:], raw.ToPubkey[:], raw.Amount, raw.Fee, raw.Nonce, raw.Version,
+			)
+			if err != nil {
+				return fmt.Errorf("error updating 'transactions' table: %s", err)
+			}
+		}
+
+		_, err = tx.Exec(
+			`DROP TABLE transactions_blocks;
+			DROP TABLE transactions;
+			ALTER TABLE transactions_v4 RENAME TO transactions;
+			ALTER TABLE transactions_blocks_v4 RENAME TO transactions_blocks;
+			CREATE INDEX idx_transactions_hash ON transactions (hash);
+			CREATE INDEX idx_transactions_blocks_block_hash ON transactions_blocks (block_hash);
+			CREATE INDEX idx_transactions_blocks_witness_hash ON transactions_blocks (witness_hash);
+			CREATE INDEX idx_transactions_blocks_txindex ON transactions_blocks (txindex);
+		`)
+		if err != nil {
+			return fmt.Errorf("error replacing 'transactions' tables: %s", err)
+		}
+		return nil
+	})
+
 	return db, err
 }
 
 // DataStore is a generic interface for reading/writing persistent data to the database.
 // It is used for storing configuration (wallet private keys), caching (peer addresses) and other things. They are stored in the database under a unique key, and are serialised/deserialised using the JSON encoding.
 type DataStore interface {
-	NetworkStore | WalletsStore
+	NetworkStore | WalletsStore | PoolStore
 }
 
 type NetworkStore struct {
 	// A cache of peers we have connected to.
 	PeerCache []Peer `json:"peerCache"`
+	// Peers which are banned.
+	Bans []PeerBan `json:"bans"`
 }
 
 type WalletsStore struct {
 	Wallets []UserWallet `json:"wallets"`
 }
 
+// The accounting of a mining pool.
+type PoolStore struct {
+	// The last PPLNS window of shares.
+	Shares []PoolShare `json:"shares"`
+	// Blocks found by the pool whose rewards have not matured.
+	Blocks []PoolBlockRecord `json:"blocks"`
+	// Stats for each miner, including their owed and paid balances.
+	Miners []PoolMinerStats `json:"miners"`
+	// The nonce of the next payout transaction.
+	PayoutNonce uint64 `json:"payoutNonce"`
+}
+
 type UserWallet struct {
 	// Wallet label.
 	Label string `json:"label"`
@@ -1,9 +1,12 @@
 package nakamoto
 
 import (
+	"database/sql"
+	"path/filepath"
 	"testing"
 
 	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestOpenDB(t *testing.T) {
@@ -97,3 +100,67 @@ func TestLoadSaveConfigStore(t *testing.T) {
 		return
 	}
 }
+
+func TestOpenDBMigrateTransactionIds(t *testing.T) {
+	assert := assert.New(t)
+	dbPath := filepath.Join(t.TempDir(), "v3.db")
+
+	// Create a v3 database, where transactions are keyed by the hash of the full transaction.
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE tinychain_version (version INT);
+		INSERT INTO tinychain_version (version) VALUES (0), (1), (2), (3);
+		CREATE TABLE transactions_blocks (block_hash BLOB, transaction_hash BLOB, txindex INTEGER, PRIMARY KEY (block_hash, transaction_hash, txindex));
+		CREATE TABLE transactions (hash BLOB PRIMARY KEY, sig BLOB, from_pubkey BLOB, to_pubkey BLOB, amount INTEGER, fee INTEGER, nonce INTEGER, version INTEGER);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two transactions which differ only by signature, in two blocks.
+	tx1 := RawTransaction{Version: 1, Amount: 100, Nonce: 1}
+	tx2 := tx1
+	tx2.Sig[0] = 1
+	for i, tx := range []RawTransaction{tx1, tx2} {
+		hash := tx.WitnessHash()
+		_, err = db.Exec(
+			`INSERT INTO transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			hash[:], tx.Sig[:], tx.FromPubkey[:], tx.ToPubkey[:], tx.Amount, tx.Fee, tx.Nonce, tx.Version,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO transactions_blocks (block_hash, transaction_hash, txindex) VALUES (?, ?, 0)`, []byte{byte(i)}, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Migrate.
+	db, err = OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Both transactions are kept, under the same txid.
+	txid := tx1.Hash()
+	for i, tx := range []RawTransaction{tx1, tx2} {
+		witnessHash := tx.WitnessHash()
+		storedTxid := []byte{}
+		err := db.QueryRow(
+			`SELECT txs.hash FROM transactions txs JOIN transactions_blocks tb ON txs.witness_hash = tb.witness_hash WHERE tb.block_hash = ?`,
+			[]byte{byte(i)},
+		).Scan(&storedTxid)
+		assert.Nil(err)
+		assert.Equal(txid[:], storedTxid)
+
+		count := 0
+		db.QueryRow(`SELECT COUNT(*) FROM transactions WHERE witness_hash = ?`, witnessHash[:]).Scan(&count)
+		assert.Equal(1, count)
+	}
+}
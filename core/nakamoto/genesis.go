@@ -1,8 +1,11 @@
 package nakamoto
 
 import (
+	"encoding/hex"
 	"fmt"
 	"math/big"
+
+	"github.com/liamzebedee/tinychain-go/core"
 )
 
 // The Nakamoto consensus configuration, pertaining to difficulty readjustment, genesis block, and block size.
@@ -21,6 +24,32 @@ type ConsensusConfig struct {
 
 	// Maximum block size.
 	MaxBlockSizeBytes uint64 `json:"max_block_size_bytes"`
+
+	// The number of blocks that must be built on top of a block before its coinbase reward can be spent.
+	// Enforced from the activation of UpgradeCoinbaseMaturity.
+	CoinbaseMaturity uint64 `json:"coinbase_maturity"`
+
+	// Consensus upgrades scheduled for the network, mapping the upgrade name to its activation height.
+	Upgrades map[string]uint64 `json:"upgrades"`
+
+	// The hash function used for block hashes, the proof-of-work and the transactions merkle tree.
+	// One of "sha256" (the default when empty) or "poseidon".
+	HashFunction string `json:"hash_function"`
+}
+
+// Gets the consensus hash function.
+func (c *ConsensusConfig) GetHasher() (core.Hasher, error) {
+	hasher, err := core.GetHasher(c.HashFunction)
+	if err != nil {
+		return nil, err
+	}
+	if c.HashFunction != "" && c.HashFunction != core.HashFunctionSHA256 {
+		activationHeight, ok := c.Upgrades[UpgradeHashFunction]
+		if !ok || activationHeight != 0 {
+			return nil, fmt.Errorf("The %s hash function must be activated at genesis by the %s upgrade.", c.HashFunction, UpgradeHashFunction)
+		}
+	}
+	return hasher, nil
 }
 
 // Builds the raw genesis block from the consensus configuration.
@@ -29,6 +58,12 @@ type ConsensusConfig struct {
 // If the values are changed, the genesis hash will change, and a bunch of tests will fail / need to be updated with the new hash.
 // These tests have been marked with the comment string find:GENESIS-BLOCK-ASSERTS so you can find them easily.
 func GetRawGenesisBlockFromConfig(consensus ConsensusConfig) RawBlock {
+	// The genesis hash depends on the hash function.
+	hasher, err := consensus.GetHasher()
+	if err != nil {
+		panic(err)
+	}
+
 	txs := []RawTransaction{
 		RawTransaction{
 			Version:    1,
@@ -47,28 +82,41 @@ func GetRawGenesisBlockFromConfig(consensus ConsensusConfig) RawBlock {
 		Difficulty:             BigIntToBytes32(consensus.GenesisDifficulty),
 		Timestamp:              0,
 		NumTransactions:        1,
-		TransactionsMerkleRoot: GetMerkleRootForTxs(txs),
+		TransactionsMerkleRoot: consensus.getMerkleRootForTxs(hasher, 0, txs),
 		Nonce:                  [32]byte{},
 		Graffiti:               [32]byte{0xca, 0xfe, 0xba, 0xbe, 0xde, 0xca, 0xfb, 0xad, 0xde, 0xad, 0xbe, 0xef}, // 0x cafebabe decafbad deadbeef
 		Transactions:           txs,
 	}
 
 	// Mine the block.
-	solution, err := SolvePOW(block, *new(big.Int), consensus.GenesisDifficulty, 100)
+	solution, err := SolvePOW(hasher, block, *new(big.Int), consensus.GenesisDifficulty, 100)
 	if err != nil {
 		panic(err)
 	}
 	block.SetNonce(solution)
 
 	// Sanity-check: verify the block.
-	if !VerifyPOW(block.Hash(), consensus.GenesisDifficulty) {
+	blockHash := block.Hash(hasher)
+	if !VerifyPOW(blockHash, consensus.GenesisDifficulty) {
 		panic("Genesis block POW solution is invalid.")
 	}
 
 	// Calculate work.
-	work := CalculateWork(Bytes32ToBigInt(block.Hash()))
+	work := CalculateWork(Bytes32ToBigInt(blockHash))
 
-	fmt.Printf("Genesis block hash=%x work=%s\n", block.Hash(), work.String())
+	fmt.Printf("Genesis block hash=%x work=%s\n", blockHash, work.String())
 
 	return block
 }
+
+// Gets the ID of the network defined by a consensus configuration, which is derived from its genesis block hash. Nodes
+// only peer with nodes on the same network.
+func GetNetworkId(consensus ConsensusConfig) string {
+	hasher, err := consensus.GetHasher()
+	if err != nil {
+		panic(err)
+	}
+	genesis := GetRawGenesisBlockFromConfig(consensus)
+	genesisHash := genesis.Hash(hasher)
+	return hex.EncodeToString(genesisHash[:8])
+}
@@ -29,17 +29,49 @@ func TestGetRawGenesisBlockFromConfig(t *testing.T) {
 	genesisNonce := Bytes32ToBigInt(block.Nonce)
 
 	// Print the hash.
-	fmt.Printf("Genesis block hash: %x\n", block.Hash())
+	fmt.Printf("Genesis block hash: %x\n", block.Hash(testHasher))
 
 	// Check the genesis block.
 	// find:GENESIS-BLOCK-ASSERTS
-	assert.Equal(HexStringToBytes32("04ce8ce628e56bab073ff2298f1f9d0e96d31fb7a81f388d8fe6e4aa4dc1aaa8"), block.Hash())
+	assert.Equal(HexStringToBytes32("04ce8ce628e56bab073ff2298f1f9d0e96d31fb7a81f388d8fe6e4aa4dc1aaa8"), block.Hash(testHasher))
 	assert.Equal(conf.GenesisParentBlockHash, block.ParentHash)
 	assert.Equal(BigIntToBytes32(*big.NewInt(0)), block.ParentTotalWork)
 	assert.Equal(uint64(0), block.Timestamp)
 	assert.Equal(uint64(1), block.NumTransactions)
 	assert.Equal([32]uint8{0x59, 0xe0, 0xaa, 0xf, 0x1f, 0xe6, 0x6f, 0x3b, 0xe, 0xb0, 0xc, 0xa3, 0x31, 0x33, 0x1a, 0x69, 0x1, 0xc4, 0xc4, 0xa1, 0x21, 0x99, 0xba, 0xa0, 0x16, 0x77, 0xfd, 0xe2, 0xd4, 0xb7, 0xc6, 0x88}, block.TransactionsMerkleRoot)
 	assert.Equal(big.NewInt(19).String(), genesisNonce.String())
+
+	// Activating witness merkle leaves at genesis changes the transactions merkle root, and so the genesis block.
+	conf.Upgrades = map[string]uint64{UpgradeWitnessMerkleLeaves: 0}
+	block = GetRawGenesisBlockFromConfig(conf)
+	genesisNonce = Bytes32ToBigInt(block.Nonce)
+	assert.Equal(HexStringToBytes32("078943760698d69cba7aeef1cbba3dba6307c187a23dc700473d7316f5893664"), block.Hash(testHasher))
+	assert.Equal([32]uint8{0x4f, 0x9, 0xa0, 0x2c, 0x31, 0x24, 0x47, 0x18, 0x11, 0x7c, 0x63, 0xde, 0x63, 0xdc, 0xb0, 0x55, 0x37, 0x82, 0x82, 0xf2, 0x8, 0xb2, 0x2, 0xfd, 0x52, 0x2d, 0x1c, 0x89, 0xe8, 0x96, 0xf6, 0xa5}, block.TransactionsMerkleRoot)
+	assert.Equal(big.NewInt(3).String(), genesisNonce.String())
+}
+
+func TestGetNetworkId(t *testing.T) {
+	assert := assert.New(t)
+
+	genesis_difficulty := new(big.Int)
+	genesis_difficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesis_difficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+	}
+
+	// The network ID is derived from the genesis block hash.
+	// find:GENESIS-BLOCK-ASSERTS
+	assert.Equal("04ce8ce628e56bab", GetNetworkId(conf))
+
+	// Networks with different genesis blocks have different IDs.
+	other := conf
+	other.GenesisParentBlockHash = [32]byte{1}
+	assert.NotEqual(GetNetworkId(conf), GetNetworkId(other))
 }
 
 func formatByteArrayDynamic(b []byte) string {
@@ -59,7 +91,7 @@ func TestWalletCreateSignTransferTx(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	tx := MakeCoinbaseTx(wallet, GetBlockReward(0))
+	tx := MakeCoinbaseTx(wallet, GetBlockReward(0), 0)
 
 	// JSON dump.
 	// str, err := json.Marshal(tx)
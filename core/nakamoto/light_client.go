@@ -0,0 +1,142 @@
+package nakamoto
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// The light client follows the chain by block headers only, and tracks the balances of a set of accounts.
+//
+// Rather than downloading and executing every block body, it asks full peers for the transactions of its accounts
+// along with their merkle inclusion proofs. Each proof is verified against a block header in the light client's own
+// header chain, so a peer can withhold transactions but cannot forge them.
+//
+// Balances are computed from the verified transactions which remain in the longest header chain, so they follow reorgs.
+// As a light client does not see the other transactions in a block, fees earned by a tracked account as a miner are not
+// included in its balance.
+type LightClient struct {
+	dag      *BlockDAG
+	peer     *PeerCore
+	accounts [][65]byte
+
+	// Verified transaction proofs, keyed by txid.
+	proofsMutex sync.Mutex
+	proofs      map[[32]byte]TxProof
+
+	log *log.Logger
+}
+
+func NewLightClient(dag *BlockDAG, peer *PeerCore, accounts [][65]byte) *LightClient {
+	return &LightClient{
+		dag:      dag,
+		peer:     peer,
+		accounts: accounts,
+		proofs:   make(map[[32]byte]TxProof),
+		log:      NewLogger("light-client", ""),
+	}
+}
+
+// Fetches the transactions of all tracked accounts from our peers, and ingests the valid proofs.
+// Returns the number of new transactions verified.
+func (c *LightClient) Sync() int {
+	verified := 0
+	for _, peer := range c.peer.GetPeers() {
+		for _, account := range c.accounts {
+			proofs, err := c.peer.GetAccountTxProofs(peer, account)
+			if err != nil {
+				c.log.Printf("Failed to get tx proofs from peer %s: %s\n", peer.String(), err)
+				continue
+			}
+
+			for _, proof := range proofs {
+				isNew, err := c.IngestTxProof(proof)
+				if err != nil {
+					c.log.Printf("Rejected tx proof from peer %s: %s\n", peer.String(), err)
+					continue
+				}
+				if isNew {
+					verified += 1
+				}
+			}
+		}
+	}
+	return verified
+}
+
+// Verifies a transaction proof and stores it.
+// Returns true if the transaction was not already known.
+func (c *LightClient) IngestTxProof(proof TxProof) (bool, error) {
+	// The block must be in our header chain.
+	block, err := c.dag.GetBlockByHash(proof.BlockHeader.BlockHash(c.dag.hasher))
+	if err != nil {
+		return false, fmt.Errorf("Block header unknown.")
+	}
+	if !c.dag.consensus.verifyTxProof(c.dag.hasher, block.Height, proof) {
+		return false, fmt.Errorf("Merkle proof is invalid.")
+	}
+	inChain, err := c.dag.isInChain(c.dag.HeadersTip, block)
+	if err != nil {
+		return false, err
+	}
+	if !inChain {
+		return false, fmt.Errorf("Block is not in the longest chain.")
+	}
+
+	c.proofsMutex.Lock()
+	defer c.proofsMutex.Unlock()
+
+	txid := proof.Tx.Hash()
+	_, known := c.proofs[txid]
+	c.proofs[txid] = proof
+	return !known, nil
+}
+
+// Gets the balance of a tracked account from the verified transactions in the longest chain.
+func (c *LightClient) GetBalance(account [65]byte) (uint64, error) {
+	c.proofsMutex.Lock()
+	defer c.proofsMutex.Unlock()
+
+	credits := uint64(0)
+	debits := uint64(0)
+	for _, proof := range c.proofs {
+		// Skip transactions in blocks which have been reorg'd out.
+		block, err := c.dag.GetBlockByHash(proof.BlockHeader.BlockHash(c.dag.hasher))
+		if err != nil {
+			return 0, err
+		}
+		inChain, err := c.dag.isInChain(c.dag.HeadersTip, block)
+		if err != nil {
+			return 0, err
+		}
+		if !inChain {
+			continue
+		}
+
+		tx := proof.Tx
+		isCoinbase := proof.Proof.Index == 0
+		if tx.ToPubkey == account {
+			credits += tx.Amount
+		}
+		if tx.FromPubkey == account && !isCoinbase {
+			debits += tx.Amount + tx.Fee
+		}
+	}
+
+	if credits < debits {
+		return 0, fmt.Errorf("Account balance is negative, transactions are missing.")
+	}
+	return credits - debits, nil
+}
+
+// Gets the verified transactions of the tracked accounts.
+func (c *LightClient) GetTxProofs() []TxProof {
+	c.proofsMutex.Lock()
+	defer c.proofsMutex.Unlock()
+
+	proofs := make([]TxProof, 0, len(c.proofs))
+	for _, proof := range c.proofs {
+		proofs = append(proofs, proof)
+	}
+	return proofs
+}
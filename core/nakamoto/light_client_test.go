@@ -0,0 +1,99 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightClientIngestTxProofs(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+
+	// A full node mines some blocks with transfers to wallet 1.
+	fullDag, _, _, _ := newBlockdag()
+	miner := NewMiner(fullDag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := fullDag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	// Each transfer has a distinct amount, as otherwise they would be the same tx.
+	amount := uint64(0)
+	miner.GetBlockBody = func() BlockBody {
+		amount += 100
+		return []RawTransaction{
+			MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), amount, 5, 0, &wallets[0]),
+		}
+	}
+	blocks := miner.Start(3)
+	if len(blocks) != 3 {
+		t.Fatalf("Failed to mine blocks.")
+	}
+
+	// A light node syncs the headers of the first two blocks only.
+	lightDag, _, _, _ := newBlockdag()
+	for _, block := range blocks[:2] {
+		err := lightDag.IngestHeader(block.ToBlockHeader())
+		if err != nil {
+			t.Fatalf("Failed to ingest header: %s", err)
+		}
+	}
+	assert.Equal(blocks[1].Hash(testHasher), lightDag.HeadersTip.Hash)
+	assert.Equal(uint64(0), lightDag.FullTip.Height)
+
+	lightClient := NewLightClient(&lightDag, nil, [][65]byte{wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()})
+
+	// Ingest the proofs for wallet 1 from the full node.
+	proofs, _, err := fullDag.GetAccountTxProofs(wallets[1].PubkeyBytes(), 0, 0)
+	assert.Nil(err)
+	assert.Equal(3, len(proofs))
+
+	// Proofs are also served a page at a time.
+	page, next, err := fullDag.GetAccountTxProofs(wallets[1].PubkeyBytes(), 0, 2)
+	assert.Nil(err)
+	assert.Equal(proofs[:2], page)
+	assert.Equal(uint64(2), next)
+	page, next, err = fullDag.GetAccountTxProofs(wallets[1].PubkeyBytes(), next, 2)
+	assert.Nil(err)
+	assert.Equal(proofs[2:], page)
+	assert.Equal(uint64(0), next)
+	numVerified := 0
+	for _, proof := range proofs {
+		isNew, err := lightClient.IngestTxProof(proof)
+		if err != nil {
+			// The proof from the third block is rejected, as we do not have its header.
+			assert.Equal(blocks[2].Hash(testHasher), proof.BlockHeader.BlockHash(testHasher))
+			continue
+		}
+		assert.True(isNew)
+		numVerified += 1
+	}
+	assert.Equal(2, numVerified)
+
+	// Re-ingesting a proof is not new.
+	isNew, err := lightClient.IngestTxProof(lightClient.GetTxProofs()[0])
+	assert.Nil(err)
+	assert.False(isNew)
+
+	balance, err := lightClient.GetBalance(wallets[1].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(uint64(100+200), balance)
+
+	// Ingest the proofs for wallet 0, the miner, which includes the coinbase txs.
+	proofs, _, err = fullDag.GetAccountTxProofs(wallets[0].PubkeyBytes(), 0, 0)
+	assert.Nil(err)
+	for _, proof := range proofs {
+		lightClient.IngestTxProof(proof)
+	}
+	balance, err = lightClient.GetBalance(wallets[0].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(GetBlockReward(0)+GetBlockReward(1)-(100+5)-(200+5), balance)
+
+	// A tampered proof is rejected.
+	proof := proofs[0]
+	proof.Tx.Amount += 1
+	_, err = lightClient.IngestTxProof(proof)
+	assert.Equal("Merkle proof is invalid.", err.Error())
+}
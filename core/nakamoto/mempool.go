@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"errors"
 	"slices"
+	"sync"
 )
 
 // The mempool stores transactions that have not yet been confirmed by the network. When a user submits a transaction, it goes into a mempool. Miners request a transaction bundle from the mempool to include in the next block they mine.
@@ -15,6 +16,11 @@ import (
 // Note that due to how Nakamoto consensus works, there is the possibility of reorgs, which means that a block that was previously mined may be replaced by a longer chain. In this case, transactions which have been taken from the mempool and included in a block that is later reorged out should be "returned" to the mempool. This is the intuition for the mempool's behaviour, however it is designed as a one-way flow.
 type Mempool struct {
 	txs []*RawTransaction
+
+	// The hashes of the transactions in the mempool, to reject duplicates.
+	hashes map[[32]byte]bool
+
+	mutex sync.Mutex
 }
 
 type FeeStatistics struct {
@@ -25,6 +31,7 @@ type FeeStatistics struct {
 }
 
 var ErrFeeTooLow = errors.New("mempool: fee too low")
+var ErrTxInMempool = errors.New("mempool: transaction already in mempool")
 
 // The maximum size of the mempool in transactions.
 const MempoolMaxSize = 8192
@@ -32,13 +39,20 @@ const MempoolMaxSize = 8192
 // NewMempool creates a new mempool.
 func NewMempool() *Mempool {
 	return &Mempool{
-		txs: []*RawTransaction{},
+		txs:    []*RawTransaction{},
+		hashes: make(map[[32]byte]bool),
 	}
 }
 
 // Insert transactions into the mempool without validation.
 func (m *Mempool) Insert(txs []*RawTransaction) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	m.txs = append(m.txs, txs...)
+	for _, tx := range txs {
+		m.hashes[tx.Hash()] = true
+	}
 
 	// Sort the mempool by fee descending.
 	slices.SortFunc(m.txs, func(i, j *RawTransaction) int {
@@ -48,16 +62,25 @@ func (m *Mempool) Insert(txs []*RawTransaction) {
 
 // Add a transaction to the mempool, performing logic checks.
 func (m *Mempool) SubmitTx(tx RawTransaction) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txHash := tx.Hash()
+	if m.hashes[txHash] {
+		return ErrTxInMempool
+	}
+
 	if MempoolMaxSize == len(m.txs) {
 		// Enact fee policy.
-		// Txs are ordered by fee, so the first tx in the mempool has the lowest fee.
-		minFee := m.txs[0].Fee
+		// Txs are ordered by fee descending, so the last tx in the mempool has the lowest fee.
+		minFee := m.txs[len(m.txs)-1].Fee
 		if tx.Fee <= minFee {
 			return ErrFeeTooLow
 		}
 	}
 
 	m.txs = append(m.txs, &tx)
+	m.hashes[txHash] = true
 
 	// Sort the mempool by fee descending.
 	slices.SortFunc(m.txs, func(i, j *RawTransaction) int {
@@ -66,14 +89,51 @@ func (m *Mempool) SubmitTx(tx RawTransaction) error {
 
 	// Trim the mempool to its max size.
 	if MempoolMaxSize < len(m.txs) {
+		for _, trimmed := range m.txs[MempoolMaxSize:] {
+			delete(m.hashes, trimmed.Hash())
+		}
 		m.txs = m.txs[0:MempoolMaxSize]
 	}
 
 	return nil
 }
 
+// Removes the transactions for which keep returns false, such as those which were mined, or are no longer valid.
+// Transactions are visited by fee descending. Returns the number removed.
+func (m *Mempool) Prune(keep func(tx RawTransaction) bool) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txs := []*RawTransaction{}
+	for _, tx := range m.txs {
+		if keep(*tx) {
+			txs = append(txs, tx)
+		} else {
+			delete(m.hashes, tx.Hash())
+		}
+	}
+	removed := len(m.txs) - len(txs)
+	m.txs = txs
+	return removed
+}
+
+// Gets the transactions in the mempool, sorted by fee descending.
+func (m *Mempool) GetTxs() []RawTransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txs := make([]RawTransaction, len(m.txs))
+	for i, tx := range m.txs {
+		txs[i] = *tx
+	}
+	return txs
+}
+
 // Gets the fee statistics for use in fee estimation.
 func (m *Mempool) GetFeeStatistics() FeeStatistics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	stats := FeeStatistics{
 		MinFee:    0,
 		MedianFee: 0,
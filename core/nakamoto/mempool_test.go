@@ -78,6 +78,37 @@ func TestMempoolSubmitTx(t *testing.T) {
 	assert.Equal(t, &tx4, mempool3.txs[0])
 }
 
+func TestMempoolRejectsDuplicates(t *testing.T) {
+	mempool := NewMempool()
+	tx := newValidTxWithFee(t, 100, 1)
+	assert.NoError(t, mempool.SubmitTx(tx))
+	assert.ErrorIs(t, mempool.SubmitTx(tx), ErrTxInMempool)
+	assert.Equal(t, 1, len(mempool.txs))
+}
+
+func TestMempoolPrune(t *testing.T) {
+	mempool := NewMempool()
+	tx1 := newValidTxWithFee(t, 100, 1)
+	tx2 := newValidTxWithFee(t, 100, 2)
+	tx3 := newValidTxWithFee(t, 100, 3)
+	for _, tx := range []RawTransaction{tx1, tx2, tx3} {
+		assert.NoError(t, mempool.SubmitTx(tx))
+	}
+
+	// Transactions are visited by fee descending.
+	visited := []uint64{}
+	removed := mempool.Prune(func(tx RawTransaction) bool {
+		visited = append(visited, tx.Fee)
+		return tx.Hash() != tx2.Hash()
+	})
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, []uint64{3, 2, 1}, visited)
+	assert.Equal(t, []RawTransaction{tx3, tx1}, mempool.GetTxs())
+
+	// A pruned transaction can be submitted again.
+	assert.NoError(t, mempool.SubmitTx(tx2))
+}
+
 func TestMempoolEmptyGetFeeStatistics(t *testing.T) {
 	mempool1 := NewMempool()
 	stats := mempool1.GetFeeStatistics()
@@ -1,17 +1,24 @@
 package nakamoto
 
 import (
+	"bytes"
+	"context"
 	"log"
 	"math/big"
-	"time"
-
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/liamzebedee/tinychain-go/core"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 )
 
+// The default MempoolFeeThreshold for a node's miner. The puzzle is rebuilt when the mempool's mean fee rises by 10%.
+const DefaultMempoolFeeThreshold = 0.1
+
 // The Miner is responsible for solving the Hashcash proof-of-work puzzle.
 type Miner struct {
 	dag            BlockDAG
@@ -19,6 +26,9 @@ type Miner struct {
 	IsRunning      bool
 	GraffitiTag    [32]byte
 
+	// The number of worker goroutines to mine with. Defaults to the number of CPUs.
+	NumWorkers int
+
 	// Mutex.
 	mutex sync.Mutex
 
@@ -32,6 +42,33 @@ type Miner struct {
 	// By default, the miner constructs a block with just a coinbase transaction.
 	GetBlockBody func() BlockBody
 
+	// GetTimestamp is an optional callback that can be used to override the block timestamp, such as with a
+	// simulated clock. By default, the miner uses the current time.
+	GetTimestamp func() uint64
+
+	// GetMempoolFees is an optional callback which gets the mempool's current fees. The fees are recorded with each
+	// puzzle, so that NotifyMempoolFees can tell when they have risen.
+	GetMempoolFees func() FeeStatistics
+
+	// The fractional increase in the mempool's mean fee which causes the puzzle to be rebuilt, so that the miner
+	// includes the higher-paying transactions. Zero disables rebuilding on mempool changes.
+	MempoolFeeThreshold float64
+
+	// Signals the mining loop that the miner's state (paused, stale) has changed.
+	wake chan bool
+
+	// Whether mining is paused.
+	paused bool
+
+	// Whether the current puzzle is stale and should be rebuilt.
+	stale bool
+
+	// The mempool fees the current puzzle was built with.
+	puzzleFees FeeStatistics
+
+	// Cancels the running miner.
+	cancel context.CancelFunc
+
 	log *log.Logger
 }
 
@@ -41,11 +78,14 @@ func NewMiner(dag BlockDAG, coinbaseWallet *core.Wallet) *Miner {
 		CoinbaseWallet: coinbaseWallet,
 		IsRunning:      false,
 		mutex:          sync.Mutex{},
+		wake:           make(chan bool, 1),
 		log:            NewLogger("miner", ""),
 	}
 }
 
-func MakeCoinbaseTx(wallet *core.Wallet, amount uint64) RawTransaction {
+// Makes the coinbase transaction for a block at the given height.
+// The coinbase nonce commits to the block height, so that every coinbase tx has a unique hash.
+func MakeCoinbaseTx(wallet *core.Wallet, amount uint64, height uint64) RawTransaction {
 	// Construct coinbase tx.
 	tx := RawTransaction{
 		Version:    1,
@@ -54,7 +94,7 @@ func MakeCoinbaseTx(wallet *core.Wallet, amount uint64) RawTransaction {
 		ToPubkey:   wallet.PubkeyBytes(),
 		Amount:     amount,
 		Fee:        0,
-		Nonce:      0,
+		Nonce:      height,
 	}
 	envelope := tx.Envelope()
 	sig, err := wallet.Sign(envelope)
@@ -72,82 +112,176 @@ type POWPuzzle struct {
 	solution   big.Int
 }
 
-func (miner *Miner) MineWithStatus(hashrateChannel chan float64, solutionChannel chan POWPuzzle, puzzleChannel chan POWPuzzle) (big.Int, error) {
-	// Execute in 3s increments.
-	lastHashrateMeasurement := Timestamp()
-	numHashes := 0
+// The hashrate of the miner, in hashes per second.
+type MinerHashrate struct {
+	Total   float64
+	Workers []float64
+}
+
+// Gets the number of mining workers, defaulting to the number of CPUs.
+func (miner *Miner) numWorkers() int {
+	if miner.NumWorkers <= 0 {
+		return runtime.NumCPU()
+	}
+	return miner.NumWorkers
+}
+
+// Mines puzzles received on the puzzle channel, sending solutions to the solution channel. A new puzzle replaces the
+// current one. Returns when the context is cancelled.
+//
+// Each puzzle is searched by a set of workers, where worker i searches the nonces startNonce + i*2^64 + [1, 2^64), so
+// their ranges never overlap.
+func (miner *Miner) MineWithStatus(ctx context.Context, hashrateChannel chan MinerHashrate, solutionChannel chan POWPuzzle, puzzleChannel chan POWPuzzle) {
+	numWorkers := miner.numWorkers()
+	hashes := make([]atomic.Uint64, numWorkers)
 
 	// Routine: Measure hashrate.
-	go (func() {
-		for {
-			// Wait 3s.
-			<-time.After(3 * time.Second)
+	go miner.measureHashrate(hashes, hashrateChannel, ctx.Done())
+
+	// The workers for the current puzzle.
+	var stop chan bool
+	var workers sync.WaitGroup
+	solutions := make(chan POWPuzzle, numWorkers)
+	stopWorkers := func() {
+		if stop == nil {
+			return
+		}
+		close(stop)
+		workers.Wait()
+		stop = nil
 
-			// Print iterations using commas.
-			// p := message.NewPrinter(language.English)
-			// p.Printf("Hashes: %d\n", numHashes)
-
-			// Check if 3s has elapsed since last time.
-			now := Timestamp()
-			duration := now - lastHashrateMeasurement
-			hashrate := float64(numHashes) / float64(duration/1000)
-			hashrateChannel <- hashrate
-			numHashes = 0
-			lastHashrateMeasurement = now
+		// Discard any other solutions to the puzzle.
+		for len(solutions) > 0 {
+			<-solutions
 		}
-	})()
+	}
+	defer stopWorkers()
 
-	// Routine: Mine.
+	miner.log.Println("Waiting for new puzzle")
 	for {
-		var i uint64 = 0
-		miner.log.Println("Waiting for new puzzle")
-		puzzle := <-puzzleChannel
-		block := puzzle.block
-		nonce := puzzle.startNonce
-		target := puzzle.target
-		miner.log.Printf("New puzzle block=%s target=%s\n", block.HashStr(), target.String())
-
-		// Loop: mine 1 hash.
-		for {
-			numHashes++
-			i++
-
-			// Increment nonce.
-			nonce.Add(&nonce, big.NewInt(1))
-			block.SetNonce(nonce)
-
-			// Hash.
-			h := block.Hash()
-			guess := new(big.Int).SetBytes(h[:])
-
-			// miner.log.Printf("hash block=%s i=%d\n", Bytes32ToString(h), i)
-
-			// Check solution: hash < target.
-			if guess.Cmp(&target) == -1 {
-				miner.log.Printf("Puzzle solved: iterations=%d\n", i)
-
-				puzzle.solution = nonce
-				solutionChannel <- puzzle
-				break
+		select {
+		case <-ctx.Done():
+			return
+
+		case puzzle := <-puzzleChannel:
+			stopWorkers()
+
+			miner.log.Printf("New puzzle block=%s target=%s workers=%d\n", puzzle.block.HashStr(miner.dag.hasher), puzzle.target.String(), numWorkers)
+			stop = make(chan bool)
+			for i := 0; i < numWorkers; i++ {
+				workers.Add(1)
+				go func(worker int) {
+					defer workers.Done()
+					miner.mineWorker(worker, puzzle, &hashes[worker], solutions, stop)
+				}(i)
 			}
 
-			// Check if new puzzle has been received.
+		case puzzle := <-solutions:
+			stopWorkers()
 			select {
-			case newPuzzle := <-puzzleChannel:
-				puzzle = newPuzzle
-				block = puzzle.block
-				nonce = puzzle.startNonce
-				target = puzzle.target
-				miner.log.Printf("New puzzle block=%s target=%s\n", block.HashStr(), target.String())
+			case solutionChannel <- puzzle:
+			case <-ctx.Done():
+				return
+			}
+			miner.log.Println("Waiting for new puzzle")
+		}
+	}
+}
+
+// Searches the worker's nonce range for a solution to the puzzle, until a solution is found or the worker is stopped.
+func (miner *Miner) mineWorker(worker int, puzzle POWPuzzle, hashes *atomic.Uint64, solutions chan POWPuzzle, stop chan bool) {
+	// The worker's nonce range starts at startNonce + worker*2^64.
+	startNonce := new(big.Int).Lsh(big.NewInt(int64(worker)), 64)
+	startNonce.Add(startNonce, &puzzle.startNonce)
+	nonce := BigIntToBytes32(*startNonce)
+
+	// Encode the envelope once, and overwrite the nonce for each hash.
+	envelope := puzzle.block.Envelope()
+	target := BigIntToBytes32(puzzle.target)
+
+	var i uint64 = 0
+	for {
+		i++
+
+		// Increment nonce.
+		incrementNonce(&nonce)
+		copy(envelope[blockEnvelopeNonceOffset:blockEnvelopeNonceOffset+32], nonce[:])
+
+		// Hash.
+		h := miner.dag.hasher.Hash(envelope)
+
+		// Check solution: hash < target.
+		if bytes.Compare(h[:], target[:]) < 0 {
+			hashes.Add(i % 1024)
+			miner.log.Printf("Puzzle solved: worker=%d iterations=%d\n", worker, i)
+
+			block := *puzzle.block
+			block.Nonce = nonce
+			puzzle.block = &block
+			puzzle.solution = Bytes32ToBigInt(nonce)
+			solutions <- puzzle
+			return
+		}
+
+		// Report progress and check if we have been stopped every 1024 hashes.
+		if i%1024 == 0 {
+			hashes.Add(1024)
+			select {
+			case <-stop:
+				return
 			default:
-				// Do nothing.
 			}
 		}
 	}
 }
 
+// Increments a big-endian nonce by 1.
+func incrementNonce(nonce *[32]byte) {
+	for i := len(nonce) - 1; 0 <= i; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// Reports the hashrate every 3s, until done is closed.
+func (miner *Miner) measureHashrate(hashes []atomic.Uint64, hashrateChannel chan MinerHashrate, done <-chan struct{}) {
+	lastHashrateMeasurement := Timestamp()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(3 * time.Second):
+		}
+
+		now := Timestamp()
+		duration := float64(now-lastHashrateMeasurement) / 1000
+		lastHashrateMeasurement = now
+
+		hashrate := MinerHashrate{
+			Workers: make([]float64, len(hashes)),
+		}
+		for i := range hashes {
+			hashrate.Workers[i] = float64(hashes[i].Swap(0)) / duration
+			hashrate.Total += hashrate.Workers[i]
+		}
+
+		// Drop the measurement if nobody is listening.
+		select {
+		case hashrateChannel <- hashrate:
+		default:
+		}
+	}
+}
+
 // Creates a new block template for mining.
 func (miner *Miner) MakeNewPuzzle() POWPuzzle {
+	return miner.MakeNewPuzzleWithBody(miner.GetBlockBody)
+}
+
+// Creates a new block template for mining, with the block body from getBlockBody rather than GetBlockBody.
+func (miner *Miner) MakeNewPuzzleWithBody(getBlockBody func() BlockBody) POWPuzzle {
 	// Get the current tip.
 	current_tip, err := miner.dag.GetLatestFullTip()
 	if err != nil {
@@ -160,28 +294,39 @@ func (miner *Miner) MakeNewPuzzle() POWPuzzle {
 
 	// Construct coinbase tx.
 	blockReward := GetBlockReward(int(current_tip.Height))
-	coinbaseTx := MakeCoinbaseTx(miner.CoinbaseWallet, blockReward)
-
-	// Get the block body.
+	coinbaseTx := MakeCoinbaseTx(miner.CoinbaseWallet, blockReward, current_tip.Height+1)
+
+	// Get the block body, and record the mempool fees it was built with.
+	if miner.GetMempoolFees != nil {
+		fees := miner.GetMempoolFees()
+		miner.mutex.Lock()
+		miner.puzzleFees = fees
+		miner.mutex.Unlock()
+	}
 	blockBody := []RawTransaction{}
 	blockBody = append(blockBody, coinbaseTx)
-	if miner.GetBlockBody != nil {
+	if getBlockBody != nil {
 		miner.log.Printf("Getting block body for mining")
-		blockBody = append(blockBody, miner.GetBlockBody()...)
+		blockBody = append(blockBody, getBlockBody()...)
+	}
+
+	timestamp := Timestamp()
+	if miner.GetTimestamp != nil {
+		timestamp = miner.GetTimestamp()
 	}
 
 	// Construct block template for mining.
 	raw := RawBlock{
 		ParentHash:             current_tip.Hash,
 		ParentTotalWork:        BigIntToBytes32(current_tip.AccumulatedWork),
-		Timestamp:              Timestamp(),
+		Timestamp:              timestamp,
 		NumTransactions:        uint64(len(blockBody)),
 		TransactionsMerkleRoot: [32]byte{},
 		Nonce:                  [32]byte{},
 		Transactions:           blockBody,
 		Graffiti:               miner.GraffitiTag,
 	}
-	raw.TransactionsMerkleRoot = GetMerkleRootForTxs(raw.Transactions)
+	raw.TransactionsMerkleRoot = miner.dag.consensus.getMerkleRootForTxs(miner.dag.hasher, current_tip.Height+1, raw.Transactions)
 
 	// Mine the POW solution.
 	curr_height := current_tip.Height + 1
@@ -207,42 +352,118 @@ func (miner *Miner) MakeNewPuzzle() POWPuzzle {
 	return puzzle
 }
 
+// Starts the miner, mining until mineMaxBlocks blocks are mined (or forever, if -1), or the miner is stopped.
+// Returns the blocks mined.
 func (miner *Miner) Start(mineMaxBlocks int64) []RawBlock {
+	return miner.StartWithContext(context.Background(), mineMaxBlocks)
+}
+
+// Starts the miner, mining until mineMaxBlocks blocks are mined (or forever, if -1), the miner is stopped, or the
+// context is cancelled. Returns the blocks mined.
+func (miner *Miner) StartWithContext(ctx context.Context, mineMaxBlocks int64) []RawBlock {
 	miner.mutex.Lock()
 	if miner.IsRunning {
+		miner.mutex.Unlock()
 		miner.log.Printf("Miner already running")
 		return []RawBlock{}
 	}
 	miner.IsRunning = true
+	ctx, cancel := context.WithCancel(ctx)
+	miner.cancel = cancel
 	miner.mutex.Unlock()
 
-	// The next tip channel.
-	// next_tip := make(chan Block)
-	// block_solutions := make(chan Block)
-	hashrateChannel := make(chan float64, 1)
+	defer func() {
+		cancel()
+		miner.mutex.Lock()
+		miner.IsRunning = false
+		miner.cancel = nil
+		miner.mutex.Unlock()
+	}()
+
+	hashrateChannel := make(chan MinerHashrate, 1)
 	puzzleChannel := make(chan POWPuzzle, 1)
 	solutionChannel := make(chan POWPuzzle, 1)
 
-	go miner.MineWithStatus(hashrateChannel, solutionChannel, puzzleChannel)
+	// The current puzzle, and a cancel func for the mining routine, which is nil while paused.
+	var puzzle POWPuzzle
+	var stopMining context.CancelFunc
+	defer func() {
+		if stopMining != nil {
+			stopMining()
+		}
+	}()
+
+	// Sends a new puzzle to the mining routine, replacing any puzzle it has not yet received.
+	sendNewPuzzle := func() {
+		miner.mutex.Lock()
+		miner.stale = false
+		miner.mutex.Unlock()
+
+		puzzle = miner.MakeNewPuzzle()
+		select {
+		case <-puzzleChannel:
+		default:
+		}
+		puzzleChannel <- puzzle
+	}
+
+	// Starts or stops the mining routine according to whether the miner is paused, and rebuilds the puzzle if stale.
+	update := func() {
+		miner.mutex.Lock()
+		paused := miner.paused
+		stale := miner.stale
+		miner.mutex.Unlock()
+
+		if paused && stopMining != nil {
+			miner.log.Println("Pausing miner")
+			stopMining()
+			stopMining = nil
+		} else if !paused && stopMining == nil {
+			miner.log.Println("Starting miner")
+			var miningCtx context.Context
+			miningCtx, stopMining = context.WithCancel(ctx)
+			go miner.MineWithStatus(miningCtx, hashrateChannel, solutionChannel, puzzleChannel)
+			sendNewPuzzle()
+		} else if !paused && stale {
+			miner.log.Println("Puzzle is stale; rebuilding puzzle")
+			sendNewPuzzle()
+		}
+	}
 
 	var blocksMined int64 = 0
 	mined := []RawBlock{}
 
-	puzzleChannel <- miner.MakeNewPuzzle()
+	update()
 	for {
 		select {
+		case <-ctx.Done():
+			miner.log.Println("Stopping miner")
+			return mined
+		case <-miner.wake:
+			update()
 		case hashrate := <-hashrateChannel:
 			// Print iterations using commas.
 			p := message.NewPrinter(language.English)
-			miner.log.Printf(p.Sprintf("Hashrate: %.2f H/s\n", hashrate))
-		case puzzle := <-solutionChannel:
+			workers := []string{}
+			for _, workerHashrate := range hashrate.Workers {
+				workers = append(workers, p.Sprintf("%.2f", workerHashrate))
+			}
+			miner.log.Print(p.Sprintf("Hashrate: %.2f H/s (workers: %s)\n", hashrate.Total, strings.Join(workers, ", ")))
+		case solved := <-solutionChannel:
 			miner.log.Println("Received solution")
 
-			raw := puzzle.block
-			solution := puzzle.solution
+			// A solution to an old puzzle may arrive after the puzzle was replaced. Discard it if it doesn't
+			// build on the parent we are currently mining on.
+			if stopMining == nil || solved.block.ParentHash != puzzle.block.ParentHash {
+				miner.log.Printf("Discarding stale solution: parent=%s\n", Bytes32ToString(solved.block.ParentHash))
+				continue
+			}
+
+			raw := solved.block
+			solution := solved.solution
 			raw.SetNonce(solution)
 
-			miner.log.Printf("Solution: hash=%s nonce=%s\n", Bytes32ToString(raw.Hash()), solution.String())
+			miner.log.Printf("Solution: hash=%s nonce=%s\n", Bytes32ToString(raw.Hash(miner.dag.hasher)), solution.String())
 
 			if miner.OnBlockSolution != nil {
 				miner.OnBlockSolution(*raw)
@@ -253,15 +474,69 @@ func (miner *Miner) Start(mineMaxBlocks int64) []RawBlock {
 
 			if mineMaxBlocks != -1 && mineMaxBlocks <= blocksMined {
 				miner.log.Println("Mined max blocks; stopping miner")
-				miner.mutex.Lock()
-				miner.IsRunning = false
-				miner.mutex.Unlock()
 				return mined
 			}
 
 			miner.log.Println("Making new puzzle")
+			sendNewPuzzle()
 			miner.log.Println("New puzzle ready")
-			puzzleChannel <- miner.MakeNewPuzzle()
 		}
 	}
 }
+
+// Stops the miner, if it is running.
+func (miner *Miner) Stop() {
+	miner.mutex.Lock()
+	defer miner.mutex.Unlock()
+	if miner.cancel != nil {
+		miner.cancel()
+	}
+}
+
+// Pauses mining, stopping the mining workers until Resume is called.
+func (miner *Miner) Pause() {
+	miner.mutex.Lock()
+	miner.paused = true
+	miner.mutex.Unlock()
+	miner.signal()
+}
+
+// Resumes mining after a call to Pause, on a new puzzle.
+func (miner *Miner) Resume() {
+	miner.mutex.Lock()
+	miner.paused = false
+	miner.mutex.Unlock()
+	miner.signal()
+}
+
+// Notifies the miner of a new full tip. The miner rebuilds its puzzle on the new tip, rather than continuing to
+// mine on a stale parent.
+func (miner *Miner) NotifyNewTip(tip Block) {
+	miner.log.Printf("New tip: height=%d hash=%s\n", tip.Height, tip.HashStr())
+	miner.mutex.Lock()
+	miner.stale = true
+	miner.mutex.Unlock()
+	miner.signal()
+}
+
+// Notifies the miner of the mempool's current fees. If the mean fee has risen by more than MempoolFeeThreshold since
+// the current puzzle was built, the miner rebuilds its puzzle to include the higher-paying transactions.
+func (miner *Miner) NotifyMempoolFees(fees FeeStatistics) {
+	miner.mutex.Lock()
+	if miner.MempoolFeeThreshold <= 0 || fees.MeanFee <= miner.puzzleFees.MeanFee*(1+miner.MempoolFeeThreshold) {
+		miner.mutex.Unlock()
+		return
+	}
+	miner.log.Printf("Mempool fees changed: mean_fee=%.2f prev_mean_fee=%.2f\n", fees.MeanFee, miner.puzzleFees.MeanFee)
+	miner.stale = true
+	miner.mutex.Unlock()
+	miner.signal()
+}
+
+// Wakes the mining loop to act on a change in the miner's state. Signals are coalesced.
+func (miner *Miner) signal() {
+	select {
+	case miner.wake <- true:
+	default:
+	}
+}
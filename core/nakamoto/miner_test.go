@@ -1,12 +1,17 @@
 package nakamoto
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"math/big"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
 )
 
 func newBlockdagForMiner() (BlockDAG, ConsensusConfig, *sql.DB) {
@@ -49,6 +54,36 @@ func newBlockdagForMiner() (BlockDAG, ConsensusConfig, *sql.DB) {
 	return blockdag, conf, db
 }
 
+// Creates a miner with a random coinbase wallet on a new block DAG. Blocks it solves are ingested into the returned DAG.
+func newMinerForTest(t *testing.T) (*Miner, *BlockDAG) {
+	dag, _, _ := newBlockdagForMiner()
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, wallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Errorf("Failed to ingest block: %s", err)
+		}
+	}
+	return miner, &dag
+}
+
+// Solves a block header the way an external miner would, starting from a random nonce. Returns the nonce and the
+// header's hash.
+func solveHeaderForTest(header BlockHeader, target big.Int) ([32]byte, [32]byte) {
+	rand.Read(header.Nonce[:])
+	for {
+		incrementNonce(&header.Nonce)
+		h := header.BlockHash(testHasher)
+		if new(big.Int).SetBytes(h[:]).Cmp(&target) == -1 {
+			return header.Nonce, h
+		}
+	}
+}
+
 func TestMiner(t *testing.T) {
 	dag, _, _ := newBlockdagForMiner()
 	minerWallet, err := core.CreateRandomWallet()
@@ -59,3 +94,234 @@ func TestMiner(t *testing.T) {
 	miner := NewMiner(dag, minerWallet)
 	miner.Start(10)
 }
+
+func TestMinerWorkers(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	miner := NewMiner(dag, minerWallet)
+	miner.NumWorkers = 4
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		assert.Nil(err)
+	}
+	mined := miner.Start(5)
+	assert.Equal(5, len(mined))
+	assert.Equal(mined[4].Hash(testHasher), dag.FullTip.Hash)
+
+	// The miner can be restarted.
+	mined = miner.Start(1)
+	assert.Equal(1, len(mined))
+	assert.Equal(uint64(6), dag.FullTip.Height)
+}
+
+func TestMinerWorkerNonceRanges(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	puzzle := miner.MakeNewPuzzle()
+
+	// Run worker 3 alone, and check its solution comes from its own range.
+	var hashes atomic.Uint64
+	solutions := make(chan POWPuzzle, 1)
+	miner.mineWorker(3, puzzle, &hashes, solutions, make(chan bool))
+	solution := <-solutions
+
+	rangeStart := new(big.Int).Lsh(big.NewInt(3), 64)
+	rangeEnd := new(big.Int).Lsh(big.NewInt(4), 64)
+	assert.Equal(1, solution.solution.Cmp(rangeStart))
+	assert.Equal(-1, solution.solution.Cmp(rangeEnd))
+
+	// The solution is valid.
+	assert.Equal(BigIntToBytes32(solution.solution), solution.block.Nonce)
+	assert.True(VerifyPOW(solution.block.Hash(testHasher), puzzle.target))
+
+	// The puzzle block is not modified.
+	assert.Equal([32]byte{}, puzzle.block.Nonce)
+}
+
+func TestIncrementNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	nonce := [32]byte{}
+	incrementNonce(&nonce)
+	assert.Equal(*big.NewInt(1), Bytes32ToBigInt(nonce))
+
+	// Carry.
+	nonce = BigIntToBytes32(*big.NewInt(0xffff))
+	incrementNonce(&nonce)
+	assert.Equal(*big.NewInt(0x10000), Bytes32ToBigInt(nonce))
+}
+
+func TestBlockEnvelopeNonceOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	block := RawBlock{}
+	envelope := block.Envelope()
+
+	block.SetNonce(*big.NewInt(0xcafe))
+	copy(envelope[blockEnvelopeNonceOffset:blockEnvelopeNonceOffset+32], block.Nonce[:])
+	assert.Equal(block.Envelope(), envelope)
+}
+
+func TestMinerSwapsPuzzleMidSearch(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.NumWorkers = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hashrateChannel := make(chan MinerHashrate, 1)
+	puzzleChannel := make(chan POWPuzzle, 1)
+	solutionChannel := make(chan POWPuzzle, 1)
+	go miner.MineWithStatus(ctx, hashrateChannel, solutionChannel, puzzleChannel)
+
+	// A puzzle which can never be solved.
+	impossible := miner.MakeNewPuzzle()
+	impossible.target = *big.NewInt(0)
+	puzzleChannel <- impossible
+
+	// Swap it for a solvable puzzle.
+	puzzle := miner.MakeNewPuzzle()
+	puzzle.block.Graffiti = StringToBytes32("swapped")
+	puzzleChannel <- puzzle
+
+	select {
+	case solution := <-solutionChannel:
+		assert.Equal(puzzle.block.Graffiti, solution.block.Graffiti)
+		assert.True(VerifyPOW(solution.block.Hash(testHasher), puzzle.target))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for solution")
+	}
+}
+
+func TestMinerStop(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+
+	// Mine forever, until stopped.
+	done := make(chan []RawBlock)
+	go func() {
+		done <- miner.Start(-1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	miner.Stop()
+
+	select {
+	case <-done:
+		assert.False(miner.IsRunning)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for miner to stop")
+	}
+
+	// Stopping with a context.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- miner.StartWithContext(ctx, -1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+		assert.False(miner.IsRunning)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for miner to stop")
+	}
+}
+
+func TestMinerPauseResume(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+
+	// Start paused.
+	miner.Pause()
+	done := make(chan []RawBlock)
+	go func() {
+		done <- miner.Start(1)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Paused miner mined a block")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Meanwhile, a block from another miner becomes the tip.
+	other := NewMiner(dag, minerWallet)
+	other.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		assert.Nil(err)
+	}
+	other.Start(1)
+	miner.NotifyNewTip(dag.FullTip)
+
+	// Resume, and the miner mines on the new tip.
+	miner.Resume()
+	select {
+	case mined := <-done:
+		assert.Equal(1, len(mined))
+		assert.Equal(dag.FullTip.Hash, mined[0].ParentHash)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for miner to resume")
+	}
+}
+
+func TestMinerNotifyMempoolFees(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagForMiner()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	mempool := NewMempool()
+	miner.GetMempoolFees = mempool.GetFeeStatistics
+
+	// Disabled by default.
+	miner.NotifyMempoolFees(FeeStatistics{MeanFee: 10})
+	assert.False(miner.stale)
+
+	// The puzzle records the mempool fees it was built with.
+	mempool.SubmitTx(RawTransaction{Fee: 10})
+	miner.MakeNewPuzzle()
+	assert.Equal(10.0, miner.puzzleFees.MeanFee)
+
+	// A small increase doesn't rebuild the puzzle.
+	miner.MempoolFeeThreshold = 0.5
+	mempool.SubmitTx(RawTransaction{Fee: 14})
+	miner.NotifyMempoolFees(mempool.GetFeeStatistics())
+	assert.False(miner.stale)
+
+	// A large increase does.
+	mempool.SubmitTx(RawTransaction{Fee: 36})
+	miner.NotifyMempoolFees(mempool.GetFeeStatistics())
+	assert.True(miner.stale)
+
+	// The rebuilt puzzle records the new fees.
+	miner.MakeNewPuzzle()
+	assert.Equal(20.0, miner.puzzleFees.MeanFee)
+}
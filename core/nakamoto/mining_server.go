@@ -0,0 +1,305 @@
+package nakamoto
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The maximum number of block templates the mining server remembers. Submissions for older templates are rejected.
+const MiningServerMaxTemplates = 64
+
+// MiningServer is an RPC server for external miners, running over HTTP.
+// Miners request a block template from http://<host>:<port>/miningapi/getwork, search for a nonce, and submit it to
+// http://<host>:<port>/miningapi/submitwork. All messages are encoded using JSON.
+type MiningServer struct {
+	miner  *Miner
+	log    *log.Logger
+	server *http.Server
+
+	// The templates issued to miners.
+	templates *workTemplates[POWPuzzle]
+
+	// OnBlockSolution is called when a miner submits a valid solution. An error is returned to the miner.
+	OnBlockSolution func(block RawBlock) error
+}
+
+func NewMiningServer(miner *Miner, addr string, port string) *MiningServer {
+	s := &MiningServer{
+		miner:     miner,
+		log:       NewLogger("mining-server", fmt.Sprintf(":%s", port)),
+		templates: newWorkTemplates[POWPuzzle](MiningServerMaxTemplates),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/miningapi/getwork", http.HandlerFunc(s.getWorkHandler))
+	mux.Handle("/miningapi/submitwork", http.HandlerFunc(s.submitWorkHandler))
+
+	s.server = &http.Server{
+		Addr:         addr + ":" + port,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	return s
+}
+
+func (s *MiningServer) Start() error {
+	s.log.Printf("Mining server listening on http://%s\n", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		s.log.Println("Error starting server:", err)
+		return err
+	}
+	return nil
+}
+
+func (s *MiningServer) Stop() {
+	s.log.Println("Stopping mining server")
+	s.server.Shutdown(context.Background())
+}
+
+// Creates a new block template and remembers it, so a solution to it can be validated later.
+func (s *MiningServer) GetWork() GetWorkReply {
+	puzzle := s.miner.MakeNewPuzzle()
+	header := puzzle.block.ToBlockHeader()
+
+	workId := getWorkId(s.miner.dag.hasher, header)
+	s.templates.add(workId, puzzle)
+
+	s.log.Printf("Issued work: id=%s parent=%s\n", workId, Bytes32ToString(header.ParentHash))
+
+	return GetWorkReply{
+		Type:   "getwork_reply",
+		WorkId: workId,
+		Header: header,
+		Target: Bytes32ToHexString(BigIntToBytes32(puzzle.target)),
+	}
+}
+
+// Validates a nonce for a template we issued. If the nonce solves the template's puzzle, the block is passed to
+// OnBlockSolution, and any error ingesting it is returned.
+func (s *MiningServer) SubmitWork(workId string, nonce [32]byte) (RawBlock, error) {
+	puzzle, ok := s.templates.get(workId)
+	if !ok {
+		return RawBlock{}, fmt.Errorf("Unknown or expired work: %s", workId)
+	}
+
+	block := *puzzle.block
+	block.Nonce = nonce
+	if !VerifyPOW(block.Hash(s.miner.dag.hasher), puzzle.target) {
+		return RawBlock{}, fmt.Errorf("Nonce does not solve the puzzle: work=%s", workId)
+	}
+
+	// Each template can only be solved once.
+	if !s.templates.remove(workId) {
+		return RawBlock{}, fmt.Errorf("Work already submitted: %s", workId)
+	}
+
+	s.log.Printf("Accepted work: id=%s block=%s\n", workId, block.HashStr(s.miner.dag.hasher))
+	if s.OnBlockSolution != nil {
+		err := s.OnBlockSolution(block)
+		if err != nil {
+			return RawBlock{}, fmt.Errorf("Block not accepted: %s", err)
+		}
+	}
+	return block, nil
+}
+
+// Handler for /miningapi/getwork
+func (s *MiningServer) getWorkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.GetWork())
+}
+
+// Handler for /miningapi/submitwork
+func (s *MiningServer) submitWorkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var msg SubmitWorkMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	nonceBuf, err := hex.DecodeString(msg.Nonce)
+	if err != nil || len(nonceBuf) != 32 {
+		http.Error(w, fmt.Sprintf("Invalid nonce: %s", msg.Nonce), http.StatusBadRequest)
+		return
+	}
+	nonce := [32]byte{}
+	copy(nonce[:], nonceBuf)
+
+	block, err := s.SubmitWork(msg.WorkId, nonce)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to submit work: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SubmitWorkReply{
+		Type:      "submitwork_reply",
+		BlockHash: block.HashStr(s.miner.dag.hasher),
+	})
+}
+
+// The work ID of a block template is the hash of its header, which is unique as the template commits to its timestamp.
+func getWorkId(hasher core.Hasher, header BlockHeader) string {
+	return header.BlockHashStr(hasher)
+}
+
+// A bounded set of the block templates issued to miners, by work ID. When full, the oldest template is evicted.
+type workTemplates[T any] struct {
+	items map[string]T
+	order []string
+	max   int
+	mutex sync.Mutex
+}
+
+func newWorkTemplates[T any](max int) *workTemplates[T] {
+	return &workTemplates[T]{
+		items: make(map[string]T),
+		max:   max,
+	}
+}
+
+// Adds a template. Returns the template evicted to make room, if any.
+func (w *workTemplates[T]) add(workId string, template T) (T, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.items[workId]; !ok {
+		w.order = append(w.order, workId)
+	}
+	w.items[workId] = template
+
+	if w.max < len(w.order) {
+		evicted := w.items[w.order[0]]
+		delete(w.items, w.order[0])
+		w.order = w.order[1:]
+		return evicted, true
+	}
+	var none T
+	return none, false
+}
+
+func (w *workTemplates[T]) get(workId string) (T, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	template, ok := w.items[workId]
+	return template, ok
+}
+
+// Removes a template, returning false if it was already removed.
+func (w *workTemplates[T]) remove(workId string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.items[workId]; !ok {
+		return false
+	}
+	delete(w.items, workId)
+	w.order = slices.DeleteFunc(w.order, func(id string) bool { return id == workId })
+	return true
+}
+
+// Removes all templates matching the predicate, returning them.
+func (w *workTemplates[T]) removeFunc(del func(T) bool) []T {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	removed := []T{}
+	for id, template := range w.items {
+		if del(template) {
+			delete(w.items, id)
+			removed = append(removed, template)
+		}
+	}
+	w.order = slices.DeleteFunc(w.order, func(id string) bool {
+		_, ok := w.items[id]
+		return !ok
+	})
+	return removed
+}
+
+func (w *workTemplates[T]) len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.items)
+}
+
+// MiningClient is a client for the mining RPC server, used by external miners.
+type MiningClient struct {
+	url string
+	log *log.Logger
+}
+
+func NewMiningClient(url string) *MiningClient {
+	return &MiningClient{
+		url: url,
+		log: NewLogger("mining-client", ""),
+	}
+}
+
+// Requests a block template to mine on. Returns the work ID, the block header, and the target.
+func (c *MiningClient) GetWork() (string, BlockHeader, big.Int, error) {
+	res, err := c.send("getwork", GetWorkMessage{Type: "getwork"})
+	if err != nil {
+		return "", BlockHeader{}, big.Int{}, err
+	}
+
+	var reply GetWorkReply
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return "", BlockHeader{}, big.Int{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return reply.WorkId, reply.Header, Bytes32ToBigInt(HexStringToBytes32(reply.Target)), nil
+}
+
+// Submits a nonce solving the template with the given work ID. Returns the hash of the block.
+func (c *MiningClient) SubmitWork(workId string, nonce [32]byte) ([32]byte, error) {
+	res, err := c.send("submitwork", SubmitWorkMessage{
+		Type:   "submitwork",
+		WorkId: workId,
+		Nonce:  Bytes32ToHexString(nonce),
+	})
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	var reply SubmitWorkReply
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return [32]byte{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return HexStringToBytes32(reply.BlockHash), nil
+}
+
+func (c *MiningClient) send(method string, message any) ([]byte, error) {
+	return sendJSON(fmt.Sprintf("%s/miningapi/%s", c.url, method), message, c.log)
+}
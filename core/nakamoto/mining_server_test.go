@@ -0,0 +1,140 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMiningServerForTest(t *testing.T) (*MiningServer, *MiningClient, *BlockDAG) {
+	miner, dag := newMinerForTest(t)
+
+	port := getRandomPort()
+	server := NewMiningServer(miner, "127.0.0.1", port)
+	server.OnBlockSolution = func(block RawBlock) error {
+		return dag.IngestBlock(block)
+	}
+	go server.Start()
+	t.Cleanup(server.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewMiningClient(fmt.Sprintf("http://127.0.0.1:%s", port))
+	return server, client, dag
+}
+
+func TestMiningServerGetWorkSubmitWork(t *testing.T) {
+	assert := assert.New(t)
+	_, client, dag := newMiningServerForTest(t)
+
+	// Mine 3 blocks with a fake external miner.
+	for i := 0; i < 3; i++ {
+		workId, header, target, err := client.GetWork()
+		assert.Nil(err)
+		assert.Equal(dag.FullTip.Hash, header.ParentHash)
+
+		nonce, _ := solveHeaderForTest(header, target)
+		blockHash, err := client.SubmitWork(workId, nonce)
+		assert.Nil(err)
+
+		header.Nonce = nonce
+		assert.Equal(header.BlockHash(testHasher), blockHash)
+		assert.Equal(blockHash, dag.FullTip.Hash)
+	}
+	assert.Equal(uint64(3), dag.FullTip.Height)
+}
+
+func TestMiningServerRejectsInvalidWork(t *testing.T) {
+	assert := assert.New(t)
+	_, client, dag := newMiningServerForTest(t)
+
+	workId, header, target, err := client.GetWork()
+	assert.Nil(err)
+
+	// Unknown work.
+	_, err = client.SubmitWork("abcd", [32]byte{})
+	assert.ErrorContains(err, "Unknown or expired work")
+
+	// A nonce that doesn't solve the puzzle.
+	badNonce := [32]byte{}
+	for i := int64(1); ; i++ {
+		header.Nonce = BigIntToBytes32(*big.NewInt(i))
+		h := header.BlockHash(testHasher)
+		if new(big.Int).SetBytes(h[:]).Cmp(&target) != -1 {
+			badNonce = header.Nonce
+			break
+		}
+	}
+	_, err = client.SubmitWork(workId, badNonce)
+	assert.ErrorContains(err, "Nonce does not solve the puzzle")
+	assert.Equal(uint64(0), dag.FullTip.Height)
+
+	// Work can only be submitted once.
+	nonce, _ := solveHeaderForTest(header, target)
+	_, err = client.SubmitWork(workId, nonce)
+	assert.Nil(err)
+	_, err = client.SubmitWork(workId, nonce)
+	assert.ErrorContains(err, "Unknown or expired work")
+	assert.Equal(uint64(1), dag.FullTip.Height)
+}
+
+func TestMiningServerReturnsIngestErrors(t *testing.T) {
+	assert := assert.New(t)
+	server, client, dag := newMiningServerForTest(t)
+
+	// The node rejects the block, e.g. because it became invalid after the template was issued.
+	server.OnBlockSolution = func(block RawBlock) error {
+		return fmt.Errorf("Block rejected")
+	}
+
+	workId, header, target, err := client.GetWork()
+	assert.Nil(err)
+	nonce, _ := solveHeaderForTest(header, target)
+	_, err = client.SubmitWork(workId, nonce)
+	assert.ErrorContains(err, "Block not accepted: Block rejected")
+	assert.Equal(uint64(0), dag.FullTip.Height)
+}
+
+func TestMiningServerRejectsMalformedNonce(t *testing.T) {
+	assert := assert.New(t)
+	_, client, dag := newMiningServerForTest(t)
+
+	workId, _, _, err := client.GetWork()
+	assert.Nil(err)
+
+	for _, nonce := range []string{"zz", "abcd", strings.Repeat("00", 33)} {
+		body, err := json.Marshal(SubmitWorkMessage{Type: "submitwork", WorkId: workId, Nonce: nonce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(client.url+"/miningapi/submitwork", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+	assert.Equal(uint64(0), dag.FullTip.Height)
+}
+
+func TestMiningServerExpiresTemplates(t *testing.T) {
+	assert := assert.New(t)
+	server, _, _ := newMiningServerForTest(t)
+
+	first := server.GetWork()
+	for i := 0; i < MiningServerMaxTemplates; i++ {
+		// Templates are unique by timestamp.
+		time.Sleep(time.Millisecond)
+		server.GetWork()
+	}
+	assert.Equal(MiningServerMaxTemplates, server.templates.len())
+
+	_, err := server.SubmitWork(first.WorkId, [32]byte{})
+	assert.ErrorContains(err, "Unknown or expired work")
+}
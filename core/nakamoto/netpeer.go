@@ -1,10 +1,11 @@
 package nakamoto
 
 import (
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/url"
+	"slices"
 	"sync"
 	"time"
 
@@ -12,12 +13,13 @@ import (
 )
 
 var CLIENT_VERSION = "tinychain v0.0.0 / aggressive alpha"
-var WIRE_PROTOCOL_VERSION = uint(1)
+var WIRE_PROTOCOL_VERSION = uint(WireProtocolVersionBinary)
+var MIN_WIRE_PROTOCOL_VERSION = uint(1)
 
 // Bootstrap by connecting to peers.
-// Fill your peer cache with 20 peers max.
+// Fill your peer cache with 20 peers max (MaxPeers).
 // Do routines:
-// - regular heartbeat every 30s to each peer, checking current tip. Insert into DB as last_seen, client_version, ip/port.
+// - regular heartbeat every 30s to each peer, checking current tip. Evict peers which stop responding.
 // - regular bootstrap, find peers in network. our cache can be large - 1000 peers big.
 // Perform sync routine:
 // - interactive bissect to find common ancestor. Then download missing blocks.
@@ -40,16 +42,67 @@ type PeerCore struct {
 	externalIp   string
 	externalPort string
 
-	peerId string
+	// Our peer ID is the public key of our peer identity, which we prove ownership of when we connect to peers.
+	peerId   string
+	identity *core.Wallet
+	auth     *peerAuth
+
+	// The transport used to send messages to peers.
+	transport PeerTransport
+
+	// The ID of the network we are on. Peers on other networks are rejected.
+	NetworkId string
+
+	// The network's consensus hash function, used to identify the blocks we are sent.
+	Hasher core.Hasher
 
 	GossipPeersIntervalSeconds int
 
-	OnNewBlock          func(block RawBlock)
-	OnNewTransaction    func(tx RawTransaction)
-	OnGetBlocks         func(msg GetBlocksMessage) ([][]byte, error)
-	OnGetTip            func(msg GetTipMessage) (BlockHeader, error)
-	OnSyncGetTipAtDepth func(msg SyncGetTipAtDepthMessage) (SyncGetTipAtDepthReply, error)
-	OnSyncGetData       func(msg SyncGetBlockDataMessage) (SyncGetBlockDataReply, error)
+	// How often we heartbeat our peers, and how many heartbeats in a row a peer can fail before it is evicted.
+	HeartbeatIntervalSeconds int
+	MaxHeartbeatFailures     int
+
+	// The maximum number of peers we keep, or 0 for no limit.
+	MaxPeers int
+
+	// The maximum number of blocks served, and requested, in a single get_blocks request, or 0 for no limit.
+	MaxGetBlocks int
+
+	// The maximum number of proofs served, and requested, in a single get_account_tx_proofs request, or 0 for no limit.
+	MaxAccountTxProofs int
+
+	// Always send messages as JSON, even to peers which support the binary wire encoding.
+	DisableBinaryWire bool
+
+	// The misbehaviour score at which a peer is banned, and how long it is banned for.
+	BanThreshold       int
+	BanDurationSeconds int
+
+	// The time it takes for a misbehaviour score to halve, so occasional misbehaviour by an honest peer doesn't add up
+	// to a ban.
+	ScoreHalfLifeSeconds int
+
+	scores      map[string]peerScore
+	bans        []PeerBan
+	scoresMutex sync.Mutex
+
+	OnNewBlock           func(block RawBlock) error
+	OnNewTransaction     func(tx RawTransaction)
+	OnGetBlocks          func(msg GetBlocksMessage) ([][]byte, error)
+	OnGetTip             func(msg GetTipMessage) (BlockHeader, error)
+	OnSyncGetTipAtDepth  func(msg SyncGetTipAtDepthMessage) (SyncGetTipAtDepthReply, error)
+	OnSyncGetData        func(msg SyncGetBlockDataMessage) (SyncGetBlockDataReply, error)
+	OnSyncGetForkPoint   func(msg SyncGetForkPointMessage) (SyncGetForkPointReply, error)
+	OnHasBlock           func(blockhash [32]byte) (bool, error)
+	OnGetTxProof         func(msg GetTxProofMessage) (TxProof, error)
+	OnGetAccountTxProofs func(msg GetAccountTxProofsMessage) ([]TxProof, uint64, error)
+	OnSubmitBuilderBid   func(msg SubmitBuilderBidMessage) error
+	OnPeerBanned         func(ban PeerBan)
+	OnPeerConnected      func(peer Peer)
+	OnPeerDisconnected   func(peer Peer)
+
+	// Gets our tip, which we include in our heartbeats.
+	GetLocalTip func() Block
 
 	peerLogger log.Logger
 }
@@ -58,13 +111,55 @@ type Peer struct {
 	Addr          string `json:"addr"`
 	LastSeen      uint64 `json:"lastSeen"`
 	ClientVersion string `json:"clientVersion"`
+	// The wire protocol version negotiated with the peer, which is the newest version we both support.
+	WireProtocolVersion uint `json:"wireProtocolVersion"`
+
+	// The peer's authenticated ID.
+	PeerId string `json:"peerId"`
+
+	// The peer's tip, as of its last heartbeat.
+	TipHash   string `json:"tipHash"`
+	TipHeight int    `json:"tipHeight"`
+
+	// The session token which identifies us to the peer.
+	session string
+	// The number of heartbeats the peer has failed in a row.
+	heartbeatFailures int
 }
 
 func (peer *Peer) String() string {
 	return peer.Addr // TODO url not always available.
 }
 
+// A PeerTransport sends an encoded message to a peer, returning the peer's encoded reply. Messages to an authenticated
+// peer include our session token, which the peer uses to identify us.
+type PeerTransport interface {
+	SendMessage(peer Peer, encoding WireEncoding, message []byte) ([]byte, error)
+}
+
+// Sends messages to peers over HTTP.
+type httpPeerTransport struct {
+	log *log.Logger
+}
+
+func (t httpPeerTransport) SendMessage(peer Peer, encoding WireEncoding, message []byte) ([]byte, error) {
+	return sendEncodedMessageToPeer(peer.Addr, peer.session, encoding, message, t.log)
+}
+
 func NewPeerCore(config PeerConfig) *PeerCore {
+	externalIp, _, err := DiscoverIP()
+	if err != nil {
+		log.Fatalf("Failed to discover external IP: %v", err)
+	}
+
+	p := NewPeerCoreWithTransport(config, nil)
+	p.externalIp = externalIp
+	return p
+}
+
+// Creates a peer which sends messages using the given transport, or over HTTP if nil. The peer's external address is
+// its configured address.
+func NewPeerCoreWithTransport(config PeerConfig, transport PeerTransport) *PeerCore {
 	wallet, err := core.CreateRandomWallet()
 	if err != nil {
 		log.Fatalf("Failed to create internal peer keypair: %v", err)
@@ -75,100 +170,137 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 		peers:                      []Peer{},
 		server:                     nil,
 		config:                     config,
+		externalIp:                 config.ipAddress,
+		transport:                  transport,
 		GossipPeersIntervalSeconds: 30,
+		HeartbeatIntervalSeconds:   30,
+		MaxHeartbeatFailures:       3,
+		MaxPeers:                   20,
+		MaxGetBlocks:               10,
+		MaxAccountTxProofs:         100,
+		Hasher:                     core.SHA256Hasher{},
+		BanThreshold:               100,
+		BanDurationSeconds:         24 * 60 * 60,
+		ScoreHalfLifeSeconds:       60 * 60,
+		scores:                     make(map[string]peerScore),
 		peerId:                     wallet.PubkeyStr(),
+		identity:                   wallet,
+		auth:                       newPeerAuth(),
 		peerLogger:                 *NewLogger("peer", fmt.Sprintf(":%s", config.port)),
 	}
-
-	externalIp, _, err := DiscoverIP()
-	if err != nil {
-		log.Fatalf("Failed to discover external IP: %v", err)
+	if p.transport == nil {
+		p.transport = httpPeerTransport{log: &p.peerLogger}
 	}
-	p.externalIp = externalIp
+
 	// p.externalPort = fmt.Sprintf("%d", externalPort)
 	p.externalPort = config.port
 	p.server = NewPeerServer(p.config)
+	p.server.GetSessionPeerId = p.auth.getSessionPeerId
+	p.server.IsPeerBanned = func(peerId string) bool {
+		return p.IsBanned(Peer{PeerId: peerId})
+	}
 
 	// Message handlers.
 	//
 
-	p.server.RegisterMesageHandler("heartbeat", func(message []byte) (interface{}, error) {
-		// Decode message into HeartbeatMessage.
-		var msg HeartbeatMesage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "heartbeat", func(msg HeartbeatMesage) (HeartbeatMesage, error) {
+		// Reject peers on other networks, or which we share no wire protocol version with.
+		if _, err := p.negotiatePeer(msg); err != nil {
+			return HeartbeatMesage{}, &RPCError{Code: RPCErrInvalidRequest, Message: err.Error()}
+		}
+
+		// Banned peers are not added back, as each AddPeer would send them a heartbeat, which triggers another.
+		if p.IsBanned(Peer{PeerId: msg.PeerId, Addr: msg.ClientAddress}) {
+			return HeartbeatMesage{}, &RPCError{Code: RPCErrPeerBanned, Message: "Peer is banned"}
 		}
 
 		// Check if this peer is contactable, try to add it to our peers cache.
+		// Peers we have already authenticated are skipped, otherwise each AddPeer's heartbeat would trigger another.
 		// TODO engineer this better.
-		go p.AddPeer(msg.ClientAddress)
-
-		// Send a heartbeat back.
-		heartbeatReply := p.makeHeartbeat()
+		if known, ok := p.getPeerById(msg.PeerId); !ok || known.Addr != msg.ClientAddress || known.session == "" {
+			go p.AddPeer(msg.ClientAddress)
+		}
 
-		return heartbeatReply, nil
+		// Send a heartbeat back, signing the peer's challenge.
+		reply := p.makeHeartbeat()
+		if msg.Challenge != "" {
+			sig, err := signPeerChallenge(p.identity, msg.Challenge)
+			if err != nil {
+				return reply, err
+			}
+			reply.Signature = sig
+		}
+		return reply, nil
 	})
 
-	p.server.RegisterMesageHandler("new_block", func(message []byte) (interface{}, error) {
-		var msg NewBlockMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "peer_auth", func(msg PeerAuthMessage) (PeerAuthReply, error) {
+		if !p.auth.useChallenge(msg.Challenge) {
+			return PeerAuthReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: "Unknown or expired challenge"}
 		}
+		if err := verifyPeerChallenge(msg.PeerId, msg.Challenge, msg.Signature); err != nil {
+			return PeerAuthReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: err.Error()}
+		}
+		if p.IsBanned(Peer{PeerId: msg.PeerId}) {
+			return PeerAuthReply{}, &RPCError{Code: RPCErrPeerBanned, Message: "Peer is banned"}
+		}
+		p.peerLogger.Printf("Authenticated peer: peerId=%s\n", msg.PeerId)
+		return PeerAuthReply{Session: p.auth.newSession(msg.PeerId)}, nil
+	})
 
+	RegisterPeerHandler(p.server, "new_block", func(sender string, msg NewBlockMessage) (struct{}, error) {
 		// Call the OnNewBlock callback.
 		if p.OnNewBlock != nil {
-			p.OnNewBlock(msg.RawBlock)
-		}
-		return nil, nil
-	})
+			err := p.OnNewBlock(msg.RawBlock)
 
-	p.server.RegisterMesageHandler("new_tx", func(message []byte) (interface{}, error) {
-		var msg NewTransactionMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+			// Penalise peers which send invalid blocks.
+			if penalty := invalidBlockPenalty(err); 0 < penalty {
+				p.reportSenderMisbehaviour(sender, penalty, fmt.Sprintf("Invalid block %s: %s", msg.RawBlock.HashStr(p.Hasher), err))
+			}
 		}
+		return struct{}{}, nil
+	})
 
+	RegisterHandler(p.server, "new_tx", func(msg NewTransactionMessage) (struct{}, error) {
 		// Call the OnNewTransaction callback.
 		if p.OnNewTransaction != nil {
 			p.OnNewTransaction(msg.RawTransaction)
 		}
-		return nil, nil
+		return struct{}{}, nil
 	})
 
-	p.server.RegisterMesageHandler("get_blocks", func(message []byte) (interface{}, error) {
-		var msg GetBlocksMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "get_blocks", func(msg GetBlocksMessage) (GetBlocksReply, error) {
+		if p.OnGetBlocks == nil {
+			return GetBlocksReply{}, errCallbackNotSet("GetBlocks")
 		}
-
-		if p.OnGetBlocks != nil {
-			rawBlocksDatas, err := p.OnGetBlocks(msg)
-			if err != nil {
-				return nil, err
+		if 0 < p.MaxGetBlocks && p.MaxGetBlocks < len(msg.BlockHashes) {
+			return GetBlocksReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Too many hashes requested. Max is %d", p.MaxGetBlocks)}
+		}
+		for _, hash := range msg.BlockHashes {
+			blockhash, err := hex.DecodeString(hash)
+			if err != nil || len(blockhash) != 32 {
+				return GetBlocksReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Invalid block hash: %s", hash)}
 			}
+		}
 
-			return GetBlocksReply{
-				Type:          "get_blocks_reply",
-				RawBlockDatas: rawBlocksDatas,
-			}, nil
+		rawBlocksDatas, err := p.OnGetBlocks(msg)
+		if err != nil {
+			return GetBlocksReply{}, err
 		}
 
-		return nil, nil
+		return GetBlocksReply{
+			Type:          "get_blocks_reply",
+			RawBlockDatas: rawBlocksDatas,
+		}, nil
 	})
 
-	p.server.RegisterMesageHandler("get_tip", func(message []byte) (interface{}, error) {
-		var msg GetTipMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
-		}
-
+	RegisterHandler(p.server, "get_tip", func(msg GetTipMessage) (GetTipMessage, error) {
 		if p.OnGetTip == nil {
-			return nil, fmt.Errorf("GetTip callback not set")
+			return GetTipMessage{}, errCallbackNotSet("GetTip")
 		}
 
 		tip, err := p.OnGetTip(msg)
 		if err != nil {
-			return nil, err
+			return GetTipMessage{}, err
 		}
 
 		return GetTipMessage{
@@ -177,62 +309,116 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 		}, nil
 	})
 
-	p.server.RegisterMesageHandler("sync_get_tip_at_depth", func(message []byte) (interface{}, error) {
-		var msg SyncGetTipAtDepthMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "sync_get_tip_at_depth", func(msg SyncGetTipAtDepthMessage) (SyncGetTipAtDepthReply, error) {
+		if p.OnSyncGetTipAtDepth == nil {
+			return SyncGetTipAtDepthReply{}, errCallbackNotSet("SyncGetTipAtDepth")
 		}
+		return p.OnSyncGetTipAtDepth(msg)
+	})
 
-		if p.OnSyncGetTipAtDepth == nil {
-			return nil, fmt.Errorf("OnSyncGetTipAtDepth callback not set")
+	RegisterHandler(p.server, "sync_get_data", func(msg SyncGetBlockDataMessage) (SyncGetBlockDataReply, error) {
+		if p.OnSyncGetData == nil {
+			return SyncGetBlockDataReply{}, errCallbackNotSet("SyncGetData")
+		}
+		return p.OnSyncGetData(msg)
+	})
+
+	RegisterHandler(p.server, "sync_get_fork_point", func(msg SyncGetForkPointMessage) (SyncGetForkPointReply, error) {
+		if p.OnSyncGetForkPoint == nil {
+			return SyncGetForkPointReply{}, errCallbackNotSet("SyncGetForkPoint")
+		}
+		if len(msg.Locator) == 0 || MaxBlockLocatorSize < len(msg.Locator) {
+			return SyncGetForkPointReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Locator must have between 1 and %d hashes", MaxBlockLocatorSize)}
+		}
+		return p.OnSyncGetForkPoint(msg)
+	})
+
+	RegisterHandler(p.server, "has_block", func(msg HasBlockMessage) (HasBlockReply, error) {
+		if p.OnHasBlock == nil {
+			return HasBlockReply{}, errCallbackNotSet("HasBlock")
+		}
+
+		blockhash, err := hex.DecodeString(msg.BlockHash)
+		if err != nil || len(blockhash) != 32 {
+			return HasBlockReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Invalid block hash: %s", msg.BlockHash)}
 		}
 
-		reply, err := p.OnSyncGetTipAtDepth(msg)
+		has, err := p.OnHasBlock([32]byte(blockhash))
 		if err != nil {
-			return nil, err
+			return HasBlockReply{}, err
 		}
 
-		return reply, nil
+		return HasBlockReply{
+			Type: "has_block_reply",
+			Has:  has,
+		}, nil
 	})
 
-	p.server.RegisterMesageHandler("sync_get_data", func(message []byte) (interface{}, error) {
-		var msg SyncGetBlockDataMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "get_tx_proof", func(msg GetTxProofMessage) (GetTxProofReply, error) {
+		if p.OnGetTxProof == nil {
+			return GetTxProofReply{}, errCallbackNotSet("GetTxProof")
 		}
 
-		if p.OnSyncGetData == nil {
-			return nil, fmt.Errorf("SyncGetData callback not set")
+		txhash, err := hex.DecodeString(msg.TxHash)
+		if err != nil || len(txhash) != 32 {
+			return GetTxProofReply{}, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Invalid tx hash: %s", msg.TxHash)}
 		}
 
-		reply, err := p.OnSyncGetData(msg)
+		txProof, err := p.OnGetTxProof(msg)
 		if err != nil {
-			return nil, err
+			return GetTxProofReply{}, err
 		}
 
-		return reply, nil
+		return GetTxProofReply{
+			Type:    "get_tx_proof_reply",
+			TxProof: txProof,
+		}, nil
 	})
 
-	p.server.RegisterMesageHandler("gossip_peers", func(message []byte) (interface{}, error) {
-		var msg GossipPeersMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+	RegisterHandler(p.server, "get_account_tx_proofs", func(msg GetAccountTxProofsMessage) (GetAccountTxProofsReply, error) {
+		if p.OnGetAccountTxProofs == nil {
+			return GetAccountTxProofsReply{}, errCallbackNotSet("GetAccountTxProofs")
 		}
 
-		// Ingest new peers.
+		if 0 < p.MaxAccountTxProofs && (msg.Limit == 0 || uint64(p.MaxAccountTxProofs) < msg.Limit) {
+			msg.Limit = uint64(p.MaxAccountTxProofs)
+		}
+
+		txProofs, nextOffset, err := p.OnGetAccountTxProofs(msg)
+		if err != nil {
+			return GetAccountTxProofsReply{}, err
+		}
+
+		return GetAccountTxProofsReply{
+			Type:       "get_account_tx_proofs_reply",
+			TxProofs:   txProofs,
+			NextOffset: nextOffset,
+		}, nil
+	})
+
+	RegisterHandler(p.server, "submit_builder_bid", func(msg SubmitBuilderBidMessage) (struct{}, error) {
+		if p.OnSubmitBuilderBid == nil {
+			return struct{}{}, errCallbackNotSet("SubmitBuilderBid")
+		}
+		return struct{}{}, p.OnSubmitBuilderBid(msg)
+	})
+
+	RegisterPeerHandler(p.server, "gossip_peers", func(sender string, msg GossipPeersMessage) (GossipPeersMessage, error) {
+		// Ingest new peers, if they were sent by an authenticated peer.
+		ourPeers := p.GetPeers()
 		havePeers := make(map[string]bool)
-		for _, peer := range p.peers {
+		for _, peer := range ourPeers {
 			havePeers[peer.Addr] = true
 		}
 		for _, peerUrl := range msg.Peers {
-			if _, ok := havePeers[peerUrl]; !ok {
+			if _, ok := havePeers[peerUrl]; !ok && sender != "" {
 				go p.AddPeer(peerUrl)
 			}
 		}
 
 		// Reply with our peers.
 		peers := []string{}
-		for _, peer := range p.peers {
+		for _, peer := range ourPeers {
 			peers = append(peers, peer.Addr)
 		}
 
@@ -248,6 +434,7 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 func (p *PeerCore) Start() {
 	go p.statusLoggerRoutine()
 	go p.gossipPeersRoutine()
+	go p.heartbeatRoutine()
 
 	err := p.server.Start()
 	if err != nil {
@@ -264,14 +451,49 @@ func (p *PeerCore) gossipPeersRoutine() {
 	}
 }
 
+func (p *PeerCore) heartbeatRoutine() {
+	for {
+		time.Sleep(time.Duration(p.HeartbeatIntervalSeconds) * time.Second)
+		p.HeartbeatPeers()
+	}
+}
+
 func (p *PeerCore) statusLoggerRoutine() {
 	for {
 		// Set timeout.
-		p.peerLogger.Printf("Connected to %d peers", len(p.peers))
+		peers := p.GetPeers()
+		p.peerLogger.Printf("Connected to %d peers", len(peers))
+		for _, peer := range peers {
+			p.peerLogger.Printf("Peer: addr=%s version=%q wireProtocolVersion=%d tipHeight=%d\n", peer.Addr, peer.ClientVersion, peer.WireProtocolVersion, peer.TipHeight)
+		}
 		time.Sleep(30 * time.Second)
 	}
 }
 
+// Sends messages to peers over persistent, encrypted stream connections, instead of one HTTP request per message. Peers
+// which don't support streams are sent messages over HTTP. Must be called before the peer is started.
+func (p *PeerCore) EnableStreamTransport() *StreamTransport {
+	transport := NewStreamTransport(p.server, p.GetExternalAddr, p.identity, p.transport)
+	p.server.Handle("/peerapi/stream", transport)
+	p.transport = transport
+	return transport
+}
+
+// Closes any open connections to peers.
+func (p *PeerCore) CloseConnections() {
+	if transport, ok := p.transport.(*StreamTransport); ok {
+		transport.Close()
+	}
+}
+
+// Gets the wire encoding to use for messages to a peer, which is binary if the peer supports it.
+func (p *PeerCore) getWireEncoding(peer Peer) WireEncoding {
+	if p.DisableBinaryWire || peer.WireProtocolVersion < WireProtocolVersionBinary {
+		return WireEncodingJSON
+	}
+	return WireEncodingBinary
+}
+
 func (p *PeerCore) GetLocalAddr() string {
 	// TODO for now.
 	return fmt.Sprintf("http://%s:%s", p.config.ipAddress, p.config.port)
@@ -282,21 +504,24 @@ func (p *PeerCore) GetExternalAddr() string {
 }
 
 func (p *PeerCore) GetPeers() []Peer {
-	return p.peers
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	return append([]Peer{}, p.peers...)
 }
 
 func (p *PeerCore) GossipBlock(block RawBlock) {
-	p.peerLogger.Printf("Gossiping block %s to %d peers\n", block.HashStr(), len(p.peers))
+	peers := p.GetPeers()
+	p.peerLogger.Printf("Gossiping block %s to %d peers\n", block.HashStr(p.Hasher), len(peers))
 
 	// Send block to all peers.
 	newBlockMsg := NewBlockMessage{
 		Type:     "new_block",
 		RawBlock: block,
 	}
-	for _, peer := range p.peers {
+	for _, peer := range peers {
 		// TODO gossip the block header but not the full block.
 		// Let the peer decide on whether they need to download block.
-		_, err := SendMessageToPeer(peer.Addr, newBlockMsg, &p.peerLogger)
+		_, err := CallPeer[NewBlockMessage, struct{}](p, peer, newBlockMsg)
 		if err != nil {
 			p.peerLogger.Printf("Failed to send block to peer: %v", err)
 			continue
@@ -305,11 +530,12 @@ func (p *PeerCore) GossipBlock(block RawBlock) {
 }
 
 func (p *PeerCore) GossipPeers() {
-	p.peerLogger.Printf("Gossiping peers list to %d peers\n", len(p.peers))
+	ourPeers := p.GetPeers()
+	p.peerLogger.Printf("Gossiping peers list to %d peers\n", len(ourPeers))
 
 	// Send list to all peers.
 	peers := []string{}
-	for _, peer := range p.peers {
+	for _, peer := range ourPeers {
 		peers = append(peers, peer.Addr)
 	}
 	gossipPeersMsg := GossipPeersMessage{
@@ -317,22 +543,16 @@ func (p *PeerCore) GossipPeers() {
 		Peers: peers,
 	}
 
-	for _, peer := range p.peers {
-		reply, err := SendMessageToPeer(peer.Addr, gossipPeersMsg, &p.peerLogger)
+	for _, peer := range ourPeers {
+		msg, err := CallPeer[GossipPeersMessage, GossipPeersMessage](p, peer, gossipPeersMsg)
 		if err != nil {
-			p.peerLogger.Printf("Failed to send block to peer: %v", err)
-		}
-
-		// Handle reply.
-		var msg GossipPeersMessage
-		if err := json.Unmarshal(reply, &msg); err != nil {
-			p.peerLogger.Printf("Failed to unmarshal gossip peers reply: %v", err)
+			p.peerLogger.Printf("Failed to gossip peers to peer: %v", err)
 			continue
 		}
 
 		// Ingest new peers.
 		havePeers := make(map[string]bool)
-		for _, peer := range p.peers {
+		for _, peer := range p.GetPeers() {
 			havePeers[peer.Addr] = true
 		}
 		for _, peerUrl := range msg.Peers {
@@ -348,19 +568,8 @@ func (p *PeerCore) GetTip(peer Peer) (BlockHeader, error) {
 		Type: "get_tip",
 		Tip:  BlockHeader{},
 	}
-	res, err := SendMessageToPeer(peer.Addr, msg, &p.peerLogger)
-	if err != nil {
-		p.peerLogger.Printf("Failed to send block to peer: %v", err)
-		return BlockHeader{}, err
-	}
-
-	// Decode reply.
-	var reply GetTipMessage
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply.Tip, err
-	}
-
-	return reply.Tip, nil
+	reply, err := CallPeer[GetTipMessage, GetTipMessage](p, peer, msg)
+	return reply.Tip, err
 }
 
 func (p *PeerCore) SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64, dir int) ([32]byte, error) {
@@ -370,19 +579,18 @@ func (p *PeerCore) SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64
 		Depth:     depth,
 		Direction: dir,
 	}
-	res, err := SendMessageToPeer(peer.Addr, msg, &p.peerLogger)
-	if err != nil {
-		p.peerLogger.Printf("Failed to send message to peer: %v", err)
-		return [32]byte{}, err
-	}
+	reply, err := CallPeer[SyncGetTipAtDepthMessage, SyncGetTipAtDepthReply](p, peer, msg)
+	return reply.Tip, err
+}
 
-	// Decode reply.
-	var reply SyncGetTipAtDepthReply
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply.Tip, err
+// Finds the fork point between our chain and the peer's chain, given a block locator for our chain.
+func (p *PeerCore) SyncGetForkPoint(peer Peer, locator [][32]byte) ([32]byte, error) {
+	msg := SyncGetForkPointMessage{
+		Type:    "sync_get_fork_point",
+		Locator: locator,
 	}
-
-	return reply.Tip, nil
+	reply, err := CallPeer[SyncGetForkPointMessage, SyncGetForkPointReply](p, peer, msg)
+	return reply.ForkPoint, err
 }
 
 func (p *PeerCore) SyncGetBlockData(peer Peer, fromBlock [32]byte, heights core.Bitset, inclHeaders bool, inclBodies bool) (SyncGetBlockDataReply, error) {
@@ -393,39 +601,117 @@ func (p *PeerCore) SyncGetBlockData(peer Peer, fromBlock [32]byte, heights core.
 		Headers:   inclHeaders,
 		Bodies:    inclBodies,
 	}
-	res, err := SendMessageToPeer(peer.Addr, msg, &p.peerLogger)
+	return CallPeer[SyncGetBlockDataMessage, SyncGetBlockDataReply](p, peer, msg)
+}
+
+// Gets the inclusion proof for a transaction from a peer.
+// The merkle proof depends on the height of the block, so it is not verified here. The caller is responsible for
+// checking the block header is part of the chain it follows, and verifying the proof against it.
+func (p *PeerCore) GetTxProof(peer Peer, txhash [32]byte) (TxProof, error) {
+	msg := GetTxProofMessage{
+		Type:   "get_tx_proof",
+		TxHash: fmt.Sprintf("%x", txhash),
+	}
+	reply, err := CallPeer[GetTxProofMessage, GetTxProofReply](p, peer, msg)
 	if err != nil {
-		p.peerLogger.Printf("Failed to send message to peer: %v", err)
-		return SyncGetBlockDataReply{}, err
+		return TxProof{}, err
 	}
 
-	// Decode reply.
-	var reply SyncGetBlockDataReply
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply, err
+	// Verify the proof.
+	if reply.TxProof.Tx.Hash() != txhash {
+		return TxProof{}, fmt.Errorf("Tx proof is for a different transaction.")
 	}
 
-	return reply, nil
+	return reply.TxProof, nil
 }
 
-func (p *PeerCore) HasBlock(peer Peer, blockhash [32]byte) (bool, error) {
-	msg := HasBlockMessage{
-		Type:      "has_block",
-		BlockHash: fmt.Sprintf("%x", blockhash),
+// Gets the inclusion proofs for all transactions of an account from a peer, in pages of MaxAccountTxProofs.
+// The proofs are not verified, this is left to the caller.
+func (p *PeerCore) GetAccountTxProofs(peer Peer, account [65]byte) ([]TxProof, error) {
+	proofs := []TxProof{}
+	msg := GetAccountTxProofsMessage{
+		Type:    "get_account_tx_proofs",
+		Account: fmt.Sprintf("%x", account),
+		Limit:   uint64(p.MaxAccountTxProofs),
 	}
-	res, err := SendMessageToPeer(peer.Addr, msg, &p.peerLogger)
-	if err != nil {
-		p.peerLogger.Printf("Failed to send block to peer: %v", err)
-		return false, err
+	for {
+		reply, err := CallPeer[GetAccountTxProofsMessage, GetAccountTxProofsReply](p, peer, msg)
+		if err != nil {
+			return nil, err
+		}
+		if 0 < msg.Limit && msg.Limit < uint64(len(reply.TxProofs)) {
+			return nil, fmt.Errorf("%w: %d proofs exceeds the limit of %d", ErrMalformedReply, len(reply.TxProofs), msg.Limit)
+		}
+		proofs = append(proofs, reply.TxProofs...)
+
+		if reply.NextOffset == 0 {
+			return proofs, nil
+		}
+		// Each page must make progress, so a peer can't keep us paging forever.
+		if reply.NextOffset <= msg.Offset {
+			return nil, fmt.Errorf("%w: next offset %d does not follow offset %d", ErrMalformedReply, reply.NextOffset, msg.Offset)
+		}
+		msg.Offset = reply.NextOffset
 	}
+}
+
+// Submits a block builder's bid to a miner's peer.
+func (p *PeerCore) SubmitBuilderBid(peer Peer, bid BuilderBid) error {
+	msg := SubmitBuilderBidMessage{
+		Type: "submit_builder_bid",
+		Bid:  bid,
+	}
+	_, err := CallPeer[SubmitBuilderBidMessage, struct{}](p, peer, msg)
+	return err
+}
 
-	// Decode reply.
-	var reply HasBlockReply
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply.Has, err
+// Downloads full blocks by hash from a peer, in batches of MaxGetBlocks. Blocks the peer does not have are omitted.
+func (p *PeerCore) GetBlocks(peer Peer, blockhashes [][32]byte) ([]RawBlock, error) {
+	batchSize := p.MaxGetBlocks
+	if batchSize == 0 {
+		batchSize = len(blockhashes)
 	}
+	blocks := []RawBlock{}
 
-	return reply.Has, nil
+	for start := 0; start < len(blockhashes); start += batchSize {
+		batch := blockhashes[start:min(start+batchSize, len(blockhashes))]
+		msg := GetBlocksMessage{
+			Type:        "get_blocks",
+			BlockHashes: make([]string, len(batch)),
+		}
+		for i, blockhash := range batch {
+			msg.BlockHashes[i] = fmt.Sprintf("%x", blockhash)
+		}
+
+		reply, err := CallPeer[GetBlocksMessage, GetBlocksReply](p, peer, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		// Peers must only reply with the blocks we requested.
+		for _, rawBlockData := range reply.RawBlockDatas {
+			block, err := RawBlockFromBytes(rawBlockData)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedReply, err)
+			}
+			blockHash := block.Hash(p.Hasher)
+			if !slices.Contains(batch, blockHash) {
+				return nil, fmt.Errorf("%w: block %x was not requested", ErrMalformedReply, blockHash)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	return blocks, nil
+}
+
+func (p *PeerCore) HasBlock(peer Peer, blockhash [32]byte) (bool, error) {
+	msg := HasBlockMessage{
+		Type:      "has_block",
+		BlockHash: fmt.Sprintf("%x", blockhash),
+	}
+	reply, err := CallPeer[HasBlockMessage, HasBlockReply](p, peer, msg)
+	return reply.Has, err
 }
 
 // Bootstraps the connection to the network.
@@ -454,19 +740,49 @@ func (p *PeerCore) Bootstrap(peerInfos []string) {
 }
 
 func (p *PeerCore) makeHeartbeat() HeartbeatMesage {
+	tipHash, tipHeight := p.getLocalTip()
 	heartbeatMsg := HeartbeatMesage{
 		Type:                "heartbeat",
-		TipHash:             "",
-		TipHeight:           0,
+		TipHash:             tipHash,
+		TipHeight:           tipHeight,
 		ClientVersion:       CLIENT_VERSION,
 		WireProtocolVersion: WIRE_PROTOCOL_VERSION,
 		ClientAddress:       p.GetExternalAddr(),
 		Time:                time.Now(),
 		PeerId:              p.peerId,
+		Challenge:           p.auth.newChallenge(),
+
+		NetworkId:              p.NetworkId,
+		MinWireProtocolVersion: MIN_WIRE_PROTOCOL_VERSION,
 	}
 	return heartbeatMsg
 }
 
+// Checks a peer's heartbeat is compatible with us, returning the wire protocol version to use with the peer.
+func (p *PeerCore) negotiatePeer(msg HeartbeatMesage) (uint, error) {
+	if msg.NetworkId != p.NetworkId {
+		return 0, fmt.Errorf("Peer is on a different network: ours=%s theirs=%s", p.NetworkId, msg.NetworkId)
+	}
+	if msg.WireProtocolVersion < MIN_WIRE_PROTOCOL_VERSION {
+		return 0, fmt.Errorf("Peer's wire protocol version %d is older than our minimum %d", msg.WireProtocolVersion, MIN_WIRE_PROTOCOL_VERSION)
+	}
+	if WIRE_PROTOCOL_VERSION < msg.MinWireProtocolVersion {
+		return 0, fmt.Errorf("Peer requires wire protocol version %d, we support up to %d", msg.MinWireProtocolVersion, WIRE_PROTOCOL_VERSION)
+	}
+	return min(WIRE_PROTOCOL_VERSION, msg.WireProtocolVersion), nil
+}
+
+// Sends a heartbeat to a peer. Heartbeats negotiate the wire protocol version, so are always sent as JSON.
+func (p *PeerCore) sendHeartbeat(peer Peer, msg HeartbeatMesage) (HeartbeatMesage, error) {
+	return callPeer[HeartbeatMesage, HeartbeatMesage](p, peer, msg, WireEncodingJSON)
+}
+
+func (p *PeerCore) hasPeerAddr(peerAddress string) bool {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	return p.HasPeer(peerAddress)
+}
+
 func (p *PeerCore) HasPeer(peerAddress string) bool {
 	for _, peer := range p.peers {
 		if peer.Addr == peerAddress {
@@ -498,22 +814,45 @@ func (p *PeerCore) AddPeer(peerAddress string) {
 		return
 	}
 
+	if p.IsBanned(peer) {
+		p.peerLogger.Printf("Peer is banned. Skipping: peer=%s\n", peer.Addr)
+		return
+	}
+
+	// Don't contact new peers if we're full.
+	isNew := !p.hasPeerAddr(peer.Addr)
+	if isNew && p.isPeersFull() {
+		p.peerLogger.Printf("Peers full. Skipping: peer=%s\n", peer.Addr)
+		return
+	}
+
 	// Send heartbeat message to peer.
-	res, err := SendMessageToPeer(peer.Addr, heartbeatMsg, &p.peerLogger)
+	heartbeatReply, err := p.sendHeartbeat(peer, heartbeatMsg)
 	if err != nil {
 		p.peerLogger.Printf("Failed to send heartbeat to peer: %v", err)
 		return
 	}
 
-	// Decode response.
-	var heartbeatReply HeartbeatMesage
-	if err := json.Unmarshal(res, &heartbeatReply); err != nil {
-		p.peerLogger.Printf("Failed to unmarshal heartbeat reply: %v", err)
+	// Check the peer owns its peer ID.
+	if err := verifyPeerChallenge(heartbeatReply.PeerId, heartbeatMsg.Challenge, heartbeatReply.Signature); err != nil {
+		p.peerLogger.Printf("Peer failed to authenticate: peer=%s err=%v\n", peer.Addr, err)
+		return
+	}
+
+	// Check the peer is on our network, and speaks a wire protocol version we support.
+	version, err := p.negotiatePeer(heartbeatReply)
+	if err != nil {
+		p.peerLogger.Printf("Peer is incompatible. Skipping: peer=%s reason=%q\n", peer.Addr, err)
 		return
 	}
 
 	p.peerLogger.Println("Peer is alive")
 	peer.LastSeen = uint64(time.Now().UnixMilli())
+	peer.ClientVersion = heartbeatReply.ClientVersion
+	peer.WireProtocolVersion = version
+	peer.PeerId = heartbeatReply.PeerId
+	peer.TipHash = heartbeatReply.TipHash
+	peer.TipHeight = heartbeatReply.TipHeight
 
 	// Now we check if this is our peer.
 	if heartbeatReply.PeerId == p.peerId {
@@ -521,13 +860,52 @@ func (p *PeerCore) AddPeer(peerAddress string) {
 		return
 	}
 
-	// Add peer to list.
+	if p.IsBanned(peer) {
+		p.peerLogger.Printf("Peer is banned. Skipping: peer=%s peerId=%s\n", peer.Addr, peer.PeerId)
+		return
+	}
+
+	// Prove we own our peer ID, and get a session which identifies us in later messages.
+	sig, err := signPeerChallenge(p.identity, heartbeatReply.Challenge)
+	if err != nil {
+		p.peerLogger.Printf("Failed to sign peer challenge: %v", err)
+		return
+	}
+	authReply, err := CallPeer[PeerAuthMessage, PeerAuthReply](p, peer, PeerAuthMessage{
+		Type:      "peer_auth",
+		PeerId:    p.peerId,
+		Challenge: heartbeatReply.Challenge,
+		Signature: sig,
+	})
+	if err != nil {
+		p.peerLogger.Printf("Failed to authenticate with peer: %v", err)
+		return
+	}
+	peer.session = authReply.Session
+
+	// Add peer to list, or update it with its new session.
 	p.peersMutex.Lock()
+	added := false
 	if !p.HasPeer(peer.Addr) {
+		if 0 < p.MaxPeers && p.MaxPeers <= len(p.peers) {
+			p.peersMutex.Unlock()
+			p.peerLogger.Printf("Peers full. Skipping: peer=%s\n", peer.Addr)
+			return
+		}
 		p.peers = append(p.peers, peer)
+		added = true
+	} else {
+		for i := range p.peers {
+			if p.peers[i].Addr == peer.Addr {
+				p.peers[i] = peer
+			}
+		}
 	}
-	defer p.peersMutex.Unlock()
+	p.peersMutex.Unlock()
 
 	// Print.
 	p.peerLogger.Printf("Added peer.Addr=%s\n", peer.Addr)
+	if added && p.OnPeerConnected != nil {
+		p.OnPeerConnected(peer)
+	}
 }
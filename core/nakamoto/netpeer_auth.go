@@ -0,0 +1,173 @@
+package nakamoto
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Peers authenticate each other with a challenge-response handshake, proving they own their peer key.
+//
+// When peer A adds peer B:
+//
+//  1. A sends a heartbeat with a random challenge.
+//  2. B replies with a heartbeat containing its signature over A's challenge, and a challenge of its own.
+//  3. A verifies B's signature against B's peer ID (its public key), and sends peer_auth with its signature over B's
+//     challenge.
+//  4. B verifies A's signature, and replies with a session token.
+//
+// A includes the session token in later messages to B, so B knows they were sent by A. Message handlers registered
+// with RegisterPeerHandler are given the authenticated peer ID of the sender.
+//
+// Each side authenticates the other when it adds it as a peer, and B adds A when it receives A's heartbeat, so both
+// directions are authenticated.
+
+const (
+	peerChallengeSizeBytes = 32
+	peerSessionSizeBytes   = 32
+
+	// How long a peer has to respond to a challenge.
+	peerChallengeTTL = 60 * time.Second
+)
+
+// Tracks the challenges we have issued and the sessions of authenticated peers.
+type peerAuth struct {
+	mutex sync.Mutex
+
+	// Challenges we have issued, by challenge, to the time they were issued.
+	challenges map[string]time.Time
+	// Authenticated peer IDs, by session token.
+	sessions map[string]string
+	// Session tokens, by peer ID.
+	peerSessions map[string]string
+}
+
+func newPeerAuth() *peerAuth {
+	return &peerAuth{
+		challenges:   make(map[string]time.Time),
+		sessions:     make(map[string]string),
+		peerSessions: make(map[string]string),
+	}
+}
+
+// Creates a challenge for a peer to sign.
+func (a *peerAuth) newChallenge() string {
+	challenge := randomHex(peerChallengeSizeBytes)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Forget expired challenges.
+	now := time.Now()
+	for c, issued := range a.challenges {
+		if peerChallengeTTL < now.Sub(issued) {
+			delete(a.challenges, c)
+		}
+	}
+	a.challenges[challenge] = now
+	return challenge
+}
+
+// Consumes a challenge we issued, returning false if we didn't issue it or it has expired. Each challenge can only be
+// used once.
+func (a *peerAuth) useChallenge(challenge string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	issued, ok := a.challenges[challenge]
+	if !ok {
+		return false
+	}
+	delete(a.challenges, challenge)
+	return time.Since(issued) <= peerChallengeTTL
+}
+
+// Creates a session for an authenticated peer, replacing any previous session.
+func (a *peerAuth) newSession(peerId string) string {
+	session := randomHex(peerSessionSizeBytes)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if old, ok := a.peerSessions[peerId]; ok {
+		delete(a.sessions, old)
+	}
+	a.sessions[session] = peerId
+	a.peerSessions[peerId] = session
+	return session
+}
+
+// Revokes a peer's session.
+func (a *peerAuth) revokePeer(peerId string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if session, ok := a.peerSessions[peerId]; ok {
+		delete(a.sessions, session)
+		delete(a.peerSessions, peerId)
+	}
+}
+
+// Gets the peer ID for a session.
+func (a *peerAuth) getSessionPeerId(session string) (string, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	peerId, ok := a.sessions[session]
+	return peerId, ok
+}
+
+// The message signed to answer a challenge. It includes the signer's peer ID, so a signature can't be claimed by
+// another peer.
+func peerAuthMessage(challenge string, peerId string) []byte {
+	return []byte(fmt.Sprintf("tinychain-peer-auth:%s:%s", challenge, peerId))
+}
+
+// Signs a challenge with our peer key.
+func signPeerChallenge(identity *core.Wallet, challenge string) (string, error) {
+	sig, err := identity.Sign(peerAuthMessage(challenge, identity.PubkeyStr()))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// Verifies a peer's signature over a challenge, proving it owns the key for its peer ID.
+func verifyPeerChallenge(peerId string, challenge string, signature string) error {
+	pubkey, err := parsePeerId(peerId)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("Invalid signature")
+	}
+	if !core.VerifySignature(pubkey, sig, peerAuthMessage(challenge, peerId)) {
+		return fmt.Errorf("Signature does not match peer ID")
+	}
+	return nil
+}
+
+// Parses a peer ID, which is a hex-encoded P-256 public key.
+func parsePeerId(peerId string) ([65]byte, error) {
+	var pubkey [65]byte
+	buf, err := hex.DecodeString(peerId)
+	if err != nil || len(buf) != len(pubkey) {
+		return pubkey, fmt.Errorf("Invalid peer ID: %s", peerId)
+	}
+	copy(pubkey[:], buf)
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), pubkey[:]); x == nil {
+		return pubkey, fmt.Errorf("Invalid peer ID: %s", peerId)
+	}
+	return pubkey, nil
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,161 @@
+package nakamoto
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates peers which send messages to each other in-process, addressed by their external address.
+func newTestAuthPeers(n int) ([]*PeerCore, *recordingTransport) {
+	transport := &recordingTransport{servers: map[string]*PeerServer{}}
+	peers := []*PeerCore{}
+	for i := 0; i < n; i++ {
+		p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", getRandomPort(), []string{}), transport)
+		transport.servers[p.GetExternalAddr()] = p.server
+		peers = append(peers, p)
+	}
+	return peers, transport
+}
+
+func getTestPeer(p *PeerCore, addr string) (Peer, bool) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	for _, peer := range p.peers {
+		if peer.Addr == addr {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+func TestVerifyPeerChallenge(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+	peerId := wallets[0].PubkeyStr()
+
+	sig, err := signPeerChallenge(&wallets[0], "challenge")
+	assert.Nil(err)
+	assert.Nil(verifyPeerChallenge(peerId, "challenge", sig))
+
+	// The signature is only valid for the challenge and signer.
+	assert.NotNil(verifyPeerChallenge(peerId, "other challenge", sig))
+	assert.NotNil(verifyPeerChallenge(wallets[1].PubkeyStr(), "challenge", sig))
+
+	// Malformed peer IDs and signatures are rejected.
+	assert.NotNil(verifyPeerChallenge("", "challenge", sig))
+	assert.NotNil(verifyPeerChallenge("04"+peerId[2:66]+"00"+peerId[68:], "challenge", sig))
+	assert.NotNil(verifyPeerChallenge(peerId, "challenge", "not hex"))
+	assert.NotNil(verifyPeerChallenge(peerId, "challenge", ""))
+}
+
+func TestPeerAuthHandshake(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	RegisterPeerHandler(p2.server, "whoami", func(sender string, msg echoMessage) (PeerAuthMessage, error) {
+		return PeerAuthMessage{Type: "whoami", PeerId: sender}, nil
+	})
+
+	p1.AddPeer(p2.GetExternalAddr())
+
+	// p1 has authenticated p2.
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	if !ok {
+		t.Fatal("Expected p2 to be added as a peer")
+	}
+	assert.Equal(p2.peerId, peer.PeerId)
+	assert.NotEqual("", peer.session)
+
+	// Messages sent with the session identify p1.
+	reply, err := CallPeer[echoMessage, PeerAuthMessage](p1, peer, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal(p1.peerId, reply.PeerId)
+
+	// Messages sent without a session are unauthenticated.
+	reply, err = CallPeer[echoMessage, PeerAuthMessage](p1, Peer{Addr: peer.Addr}, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal("", reply.PeerId)
+
+	// p2 authenticates p1 in turn, after receiving its heartbeat.
+	assert.Eventually(func() bool {
+		peer, ok := getTestPeer(p2, p1.GetExternalAddr())
+		return ok && peer.PeerId == p1.peerId && peer.session != ""
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPeerAuthRejectsImpostor(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	victim, err := core.CreateRandomWallet()
+	assert.Nil(err)
+
+	// p2 claims another peer's ID, but can only sign with its own key.
+	RegisterHandler(p2.server, "heartbeat", func(msg HeartbeatMesage) (HeartbeatMesage, error) {
+		reply := p2.makeHeartbeat()
+		reply.PeerId = victim.PubkeyStr()
+		reply.Signature, err = signPeerChallenge(p2.identity, msg.Challenge)
+		return reply, err
+	})
+
+	p1.AddPeer(p2.GetExternalAddr())
+	_, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.False(ok)
+}
+
+func TestPeerAuthChallenges(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	peer := Peer{Addr: p2.GetExternalAddr()}
+
+	assertInvalidRequest := func(err error) {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Fatalf("Expected RPCError, got: %v", err)
+		}
+		assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+	}
+
+	authenticate := func(challenge string, sig string) (PeerAuthReply, error) {
+		return CallPeer[PeerAuthMessage, PeerAuthReply](p1, peer, PeerAuthMessage{
+			Type:      "peer_auth",
+			PeerId:    p1.peerId,
+			Challenge: challenge,
+			Signature: sig,
+		})
+	}
+
+	// Challenges must be issued by the peer.
+	sig, err := signPeerChallenge(p1.identity, "made up")
+	assert.Nil(err)
+	_, err = authenticate("made up", sig)
+	assertInvalidRequest(err)
+
+	// Signatures must match.
+	challenge := p2.auth.newChallenge()
+	otherSig, err := signPeerChallenge(p2.identity, challenge)
+	assert.Nil(err)
+	_, err = authenticate(challenge, otherSig)
+	assertInvalidRequest(err)
+
+	// Challenges can only be used once.
+	challenge = p2.auth.newChallenge()
+	sig, err = signPeerChallenge(p1.identity, challenge)
+	assert.Nil(err)
+	reply, err := authenticate(challenge, sig)
+	assert.Nil(err)
+	assert.NotEqual("", reply.Session)
+	_, err = authenticate(challenge, sig)
+	assertInvalidRequest(err)
+
+	// Sessions identify the peer which authenticated.
+	peerId, ok := p2.auth.getSessionPeerId(reply.Session)
+	assert.True(ok)
+	assert.Equal(p1.peerId, peerId)
+}
@@ -0,0 +1,136 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Peers are kept alive with a regular heartbeat.
+//
+// Every HeartbeatIntervalSeconds, we send a heartbeat to each peer, and update its LastSeen time, client version and
+// tip from its reply. A peer which fails MaxHeartbeatFailures heartbeats in a row is evicted from our peers.
+//
+// We keep at most MaxPeers peers. Once full, new peers are not added until a peer is evicted or banned.
+
+// Sends a heartbeat to each peer, evicting peers which have failed too many heartbeats in a row.
+func (p *PeerCore) HeartbeatPeers() {
+	peers := p.GetPeers()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.heartbeatPeer(peer)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *PeerCore) heartbeatPeer(peer Peer) {
+	heartbeatMsg := p.makeHeartbeat()
+	reply, err := p.sendHeartbeat(peer, heartbeatMsg)
+	if err == nil && reply.PeerId != peer.PeerId {
+		err = fmt.Errorf("Peer ID changed: %s", reply.PeerId)
+	}
+	if err == nil {
+		err = verifyPeerChallenge(reply.PeerId, heartbeatMsg.Challenge, reply.Signature)
+	}
+
+	if err != nil {
+		failures := p.recordHeartbeatFailure(peer)
+		p.peerLogger.Printf("Heartbeat failed: peer=%s failures=%d err=%v\n", peer.Addr, failures, err)
+		if p.MaxHeartbeatFailures <= failures {
+			p.DisconnectPeer(peer, fmt.Sprintf("Failed %d heartbeats", failures))
+		}
+		return
+	}
+
+	// Peers which are no longer compatible, e.g. they restarted on another network, are disconnected.
+	version, err := p.negotiatePeer(reply)
+	if err != nil {
+		p.DisconnectPeer(peer, err.Error())
+		return
+	}
+
+	p.updatePeer(peer.Addr, func(known *Peer) {
+		known.LastSeen = uint64(time.Now().UnixMilli())
+		known.ClientVersion = reply.ClientVersion
+		known.WireProtocolVersion = version
+		known.TipHash = reply.TipHash
+		known.TipHeight = reply.TipHeight
+		known.heartbeatFailures = 0
+	})
+}
+
+// Records a failed heartbeat to a peer, returning the number of heartbeats it has failed in a row.
+func (p *PeerCore) recordHeartbeatFailure(peer Peer) int {
+	failures := 0
+	p.updatePeer(peer.Addr, func(known *Peer) {
+		known.heartbeatFailures++
+		failures = known.heartbeatFailures
+	})
+	return failures
+}
+
+// Updates a peer in our peers, if it is still a peer.
+func (p *PeerCore) updatePeer(addr string, update func(peer *Peer)) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	for i := range p.peers {
+		if p.peers[i].Addr == addr {
+			update(&p.peers[i])
+		}
+	}
+}
+
+// Removes a peer from our peers, closing its connection.
+func (p *PeerCore) DisconnectPeer(peer Peer, reason string) {
+	removed := p.removePeer(peer)
+	if transport, ok := p.transport.(*StreamTransport); ok && peer.Addr != "" {
+		transport.CloseConnection(peer.Addr)
+	}
+
+	for _, peer := range removed {
+		p.peerLogger.Printf("Disconnected peer: peer=%s reason=%q\n", peer.Addr, reason)
+		if p.OnPeerDisconnected != nil {
+			p.OnPeerDisconnected(peer)
+		}
+	}
+}
+
+// Removes a peer from our peers, matching by address or peer ID. Returns the peers removed.
+func (p *PeerCore) removePeer(peer Peer) []Peer {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	peers := []Peer{}
+	removed := []Peer{}
+	for _, other := range p.peers {
+		matches := (peer.Addr != "" && other.Addr == peer.Addr) || (peer.PeerId != "" && other.PeerId == peer.PeerId)
+		if matches {
+			removed = append(removed, other)
+		} else {
+			peers = append(peers, other)
+		}
+	}
+	p.peers = peers
+	return removed
+}
+
+// Returns true if we have as many peers as we keep.
+func (p *PeerCore) isPeersFull() bool {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	return 0 < p.MaxPeers && p.MaxPeers <= len(p.peers)
+}
+
+// Gets our tip, to include in our heartbeats.
+func (p *PeerCore) getLocalTip() (string, int) {
+	if p.GetLocalTip == nil {
+		return "", 0
+	}
+	tip := p.GetLocalTip()
+	return hex.EncodeToString(tip.Hash[:]), int(tip.Height)
+}
@@ -0,0 +1,172 @@
+package nakamoto
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerHeartbeatUpdatesPeer(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	p1.AddPeer(p2.GetExternalAddr())
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	if !ok {
+		t.Fatal("Expected p2 to be added as a peer")
+	}
+	assert.Equal("", peer.TipHash)
+	assert.Eventually(func() bool {
+		_, ok := getTestPeer(p2, p1.GetExternalAddr())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// p2's tip advances, which p1 learns from the next heartbeat.
+	p2.GetLocalTip = func() Block {
+		return Block{Hash: [32]byte{1, 2, 3}, Height: 42}
+	}
+	p1.HeartbeatPeers()
+
+	updated, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.True(ok)
+	assert.Equal("0102030000000000000000000000000000000000000000000000000000000000", updated.TipHash)
+	assert.Equal(42, updated.TipHeight)
+	assert.Equal(CLIENT_VERSION, updated.ClientVersion)
+	assert.LessOrEqual(peer.LastSeen, updated.LastSeen)
+}
+
+func TestPeerHeartbeatEvictsDeadPeers(t *testing.T) {
+	assert := assert.New(t)
+	peers, transport := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	p1.MaxHeartbeatFailures = 2
+
+	disconnected := []Peer{}
+	p1.OnPeerDisconnected = func(peer Peer) {
+		disconnected = append(disconnected, peer)
+	}
+
+	p1.AddPeer(p2.GetExternalAddr())
+	_, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.True(ok)
+
+	// p2 goes offline.
+	transport.mutex.Lock()
+	delete(transport.servers, p2.GetExternalAddr())
+	transport.mutex.Unlock()
+
+	// p2 is kept until it has failed MaxHeartbeatFailures heartbeats in a row.
+	p1.HeartbeatPeers()
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.True(ok)
+	assert.Equal(1, peer.heartbeatFailures)
+	assert.Empty(disconnected)
+
+	p1.HeartbeatPeers()
+	_, ok = getTestPeer(p1, p2.GetExternalAddr())
+	assert.False(ok)
+	assert.Len(disconnected, 1)
+	assert.Equal(p2.peerId, disconnected[0].PeerId)
+}
+
+func TestPeerHeartbeatResetsFailures(t *testing.T) {
+	assert := assert.New(t)
+	peers, transport := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	p1.AddPeer(p2.GetExternalAddr())
+
+	transport.mutex.Lock()
+	delete(transport.servers, p2.GetExternalAddr())
+	transport.mutex.Unlock()
+	p1.HeartbeatPeers()
+
+	// p2 comes back online.
+	transport.mutex.Lock()
+	transport.servers[p2.GetExternalAddr()] = p2.server
+	transport.mutex.Unlock()
+	p1.HeartbeatPeers()
+
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.True(ok)
+	assert.Equal(0, peer.heartbeatFailures)
+}
+
+func TestPeerMaxPeers(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(3)
+	p1, p2, p3 := peers[0], peers[1], peers[2]
+	p1.MaxPeers = 1
+
+	connected := []Peer{}
+	p1.OnPeerConnected = func(peer Peer) {
+		connected = append(connected, peer)
+	}
+
+	p1.AddPeer(p2.GetExternalAddr())
+	p1.AddPeer(p3.GetExternalAddr())
+	assert.Len(p1.GetPeers(), 1)
+	assert.Len(connected, 1)
+	assert.Equal(p2.GetExternalAddr(), connected[0].Addr)
+
+	// Existing peers can still be updated.
+	p1.AddPeer(p2.GetExternalAddr())
+	assert.Len(p1.GetPeers(), 1)
+	assert.Len(connected, 1)
+
+	// Once a peer is removed, there is room for another.
+	p1.DisconnectPeer(Peer{Addr: p2.GetExternalAddr()}, "testing")
+	p1.AddPeer(p3.GetExternalAddr())
+	assert.Len(p1.GetPeers(), 1)
+	assert.Len(connected, 2)
+	assert.Equal(p3.GetExternalAddr(), connected[1].Addr)
+}
+
+func TestPeerBanDisconnects(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	disconnected := []Peer{}
+	p1.OnPeerDisconnected = func(peer Peer) {
+		disconnected = append(disconnected, peer)
+	}
+
+	p1.AddPeer(p2.GetExternalAddr())
+	p1.BanPeer(Peer{PeerId: p2.peerId}, time.Hour, "testing")
+	assert.Len(disconnected, 1)
+	assert.Equal(p2.GetExternalAddr(), disconnected[0].Addr)
+}
+
+func TestPeerBanStopsHeartbeats(t *testing.T) {
+	assert := assert.New(t)
+	peers, transport := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	p1.AddPeer(p2.GetExternalAddr())
+	p1.BanPeer(Peer{PeerId: p2.peerId}, time.Hour, "testing")
+
+	// The banned peer's heartbeats are rejected, rather than added back as a peer.
+	_, err := p2.sendHeartbeat(Peer{Addr: p1.GetExternalAddr()}, p2.makeHeartbeat())
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Expected RPCError, got: %v", err)
+	}
+	assert.Equal(RPCErrPeerBanned, rpcErr.Code)
+
+	// So the peers stop exchanging heartbeats.
+	countMessages := func() int {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		return len(transport.encodings)
+	}
+	time.Sleep(100 * time.Millisecond)
+	sent := countMessages()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(sent, countMessages())
+	_, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.False(ok)
+}
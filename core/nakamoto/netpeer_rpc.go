@@ -0,0 +1,146 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The peer RPC layer is a typed request/response registry over the peer wire protocol.
+//
+// A message type is served by registering a typed handler:
+//
+//	RegisterHandler(server, "get_tip", func(msg GetTipMessage) (GetTipMessage, error) { ... })
+//
+// And called using the matching typed client:
+//
+//	reply, err := CallPeer[GetTipMessage, GetTipMessage](p, peer, GetTipMessage{Type: "get_tip"})
+//
+// The request is decoded from JSON before the handler is called, and the reply is encoded to JSON. Errors are returned
+// to the caller as an RPCError with an error code, so callers can distinguish a malformed request from an unavailable
+// service or a failed handler.
+
+// RPC error codes.
+const (
+	// The request could not be decoded.
+	RPCErrInvalidRequest = 1
+	// No handler is registered for the message type.
+	RPCErrUnknownMessageType = 2
+	// The peer does not provide this service, e.g. the callback is not set.
+	RPCErrNotAvailable = 3
+	// The handler failed to process the request.
+	RPCErrInternal = 4
+	// The message type does not accept the request's wire encoding.
+	RPCErrUnsupportedEncoding = 5
+	// The sender is banned.
+	RPCErrPeerBanned = 6
+)
+
+// Returned when a peer's reply can't be decoded.
+var ErrMalformedReply = errors.New("Malformed reply")
+
+// An RPCError is an error returned by a peer's message handler.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error (code=%d): %s", e.Code, e.Message)
+}
+
+// The HTTP status code for the error.
+func (e *RPCError) httpStatus() int {
+	switch e.Code {
+	case RPCErrInvalidRequest:
+		return http.StatusBadRequest
+	case RPCErrUnknownMessageType:
+		return http.StatusNotFound
+	case RPCErrUnsupportedEncoding:
+		return http.StatusUnsupportedMediaType
+	case RPCErrNotAvailable:
+		return http.StatusNotImplemented
+	case RPCErrPeerBanned:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// The reply sent when a handler fails.
+type RPCErrorReply struct {
+	Error *RPCError `json:"error"`
+}
+
+// Converts an error to an RPCError. Errors which are not already RPCErrors are internal errors.
+func toRPCError(err error) *RPCError {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	return &RPCError{Code: RPCErrInternal, Message: err.Error()}
+}
+
+// Returns the error for a message handler whose callback is not set.
+func errCallbackNotSet(name string) error {
+	return &RPCError{Code: RPCErrNotAvailable, Message: fmt.Sprintf("%s callback not set", name)}
+}
+
+// Registers a typed handler for a message type, in both the JSON and binary wire encodings. The request is decoded into
+// Req, and the handler's reply is encoded in the request's encoding.
+func RegisterHandler[Req any, Resp any](s *PeerServer, messageType string, handler func(msg Req) (Resp, error)) {
+	RegisterPeerHandler(s, messageType, func(sender string, msg Req) (Resp, error) {
+		return handler(msg)
+	})
+}
+
+// Registers a typed handler for a message type, which is given the ID of the authenticated peer which sent the
+// message, or "" if the sender is not authenticated.
+func RegisterPeerHandler[Req any, Resp any](s *PeerServer, messageType string, handler func(sender string, msg Req) (Resp, error)) {
+	decodeAndHandle := func(encoding WireEncoding) peerMessageHandler {
+		return func(sender string, message []byte) (interface{}, error) {
+			var msg Req
+			if err := DecodeMessage(encoding, message, &msg); err != nil {
+				return nil, &RPCError{Code: RPCErrInvalidRequest, Message: err.Error()}
+			}
+			return handler(sender, msg)
+		}
+	}
+	s.registerMessageHandler(messageType, decodeAndHandle(WireEncodingJSON))
+	s.binaryHandlers[messageType] = decodeAndHandle(WireEncodingBinary)
+}
+
+// Sends a typed request to a peer, and decodes the reply into Resp. Errors returned by the peer's handler are returned
+// as an *RPCError.
+//
+// Requests use the binary wire encoding if the peer supports it, and JSON otherwise.
+func CallPeer[Req any, Resp any](p *PeerCore, peer Peer, msg Req) (Resp, error) {
+	encoding := p.getWireEncoding(peer)
+	reply, err := callPeer[Req, Resp](p, peer, msg, encoding)
+
+	// Fall back to JSON for message types the peer only accepts as JSON.
+	var rpcErr *RPCError
+	if encoding == WireEncodingBinary && errors.As(err, &rpcErr) && rpcErr.Code == RPCErrUnsupportedEncoding {
+		return callPeer[Req, Resp](p, peer, msg, WireEncodingJSON)
+	}
+	return reply, err
+}
+
+func callPeer[Req any, Resp any](p *PeerCore, peer Peer, msg Req, encoding WireEncoding) (Resp, error) {
+	var reply Resp
+	body, err := EncodeMessage(encoding, msg)
+	if err != nil {
+		return reply, fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	res, err := p.transport.SendMessage(peer, encoding, body)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send message to peer: %v", err)
+		return reply, err
+	}
+
+	if err := DecodeMessage(encoding, res, &reply); err != nil {
+		return reply, fmt.Errorf("%w: %v", ErrMalformedReply, err)
+	}
+	return reply, nil
+}
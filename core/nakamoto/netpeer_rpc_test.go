@@ -0,0 +1,99 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type echoMessage struct {
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+// Creates a peer whose server is reachable over HTTP at its returned URL.
+func newTestRPCPeer(t *testing.T) (*PeerCore, string) {
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", getRandomPort(), []string{}), nil)
+	ts := httptest.NewServer(http.HandlerFunc(p.server.inboxHandler))
+	t.Cleanup(ts.Close)
+	return p, ts.URL
+}
+
+func TestPeerRPCCall(t *testing.T) {
+	assert := assert.New(t)
+	p, url := newTestRPCPeer(t)
+
+	RegisterHandler(p.server, "echo", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{Type: "echo_reply", Value: msg.Value + 1}, nil
+	})
+
+	reply, err := CallPeer[echoMessage, echoMessage](p, Peer{Addr: url}, echoMessage{Type: "echo", Value: 41})
+	assert.Nil(err)
+	assert.Equal(echoMessage{Type: "echo_reply", Value: 42}, reply)
+}
+
+func TestPeerRPCErrors(t *testing.T) {
+	assert := assert.New(t)
+	p, url := newTestRPCPeer(t)
+	peer := Peer{Addr: url}
+
+	RegisterHandler(p.server, "fail", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{}, fmt.Errorf("Something went wrong.")
+	})
+	RegisterHandler(p.server, "fail_typed", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{}, &RPCError{Code: RPCErrInvalidRequest, Message: "Value out of range."}
+	})
+
+	assertRPCError := func(err error, code int) *RPCError {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Fatalf("Expected RPCError, got: %v", err)
+		}
+		assert.Equal(code, rpcErr.Code)
+		return rpcErr
+	}
+
+	// Handler errors are internal errors.
+	_, err := CallPeer[echoMessage, echoMessage](p, peer, echoMessage{Type: "fail"})
+	rpcErr := assertRPCError(err, RPCErrInternal)
+	assert.Equal("Something went wrong.", rpcErr.Message)
+
+	// Handlers can return their own error codes.
+	_, err = CallPeer[echoMessage, echoMessage](p, peer, echoMessage{Type: "fail_typed"})
+	assertRPCError(err, RPCErrInvalidRequest)
+
+	// Unknown message types.
+	_, err = CallPeer[echoMessage, echoMessage](p, peer, echoMessage{Type: "unknown"})
+	assertRPCError(err, RPCErrUnknownMessageType)
+
+	// Malformed requests.
+	_, err = CallPeer[map[string]any, echoMessage](p, peer, map[string]any{"type": "fail", "value": "not a number"})
+	assertRPCError(err, RPCErrInvalidRequest)
+
+	// Services the peer doesn't provide.
+	_, err = p.GetTip(peer)
+	assertRPCError(err, RPCErrNotAvailable)
+}
+
+func TestPeerServerHandleMessage(t *testing.T) {
+	assert := assert.New(t)
+	s := NewPeerServer(PeerConfig{ipAddress: "127.0.0.1", port: "0"})
+
+	RegisterHandler(s, "echo", func(msg echoMessage) (echoMessage, error) {
+		return msg, nil
+	})
+
+	reply, err := s.HandleMessage([]byte(`{"type":"echo","value":7}`), WireEncodingJSON)
+	assert.Nil(err)
+	assert.JSONEq(`{"type":"echo","value":7}`, string(reply))
+
+	_, err = s.HandleMessage([]byte(`{"value":7}`), WireEncodingJSON)
+	assert.Equal(RPCErrInvalidRequest, toRPCError(err).Code)
+
+	_, err = s.HandleMessage([]byte(`not json`), WireEncodingJSON)
+	assert.Equal(RPCErrInvalidRequest, toRPCError(err).Code)
+}
@@ -0,0 +1,241 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// Peers which misbehave are scored, and banned once their score reaches a threshold.
+//
+// Misbehaviour includes sending invalid blocks, malformed messages, and bad sync replies, and failing to respond to
+// requests. Each is given a penalty, which is added to the peer's score. Once the score reaches BanThreshold, the peer
+// is disconnected and banned for BanDurationSeconds. Scores decay over time, halving every ScoreHalfLifeSeconds. Banned peers are not added as peers, cannot authenticate, and
+// their messages are rejected.
+//
+// Peers are scored by their authenticated peer ID, or by their address if they are not authenticated.
+
+// Misbehaviour penalties.
+const (
+	// Sending a block with an invalid POW solution, parent total work, or transactions merkle root.
+	PeerPenaltyInvalidBlock = 100
+	// Replying to a sync request with data which is invalid, or which wasn't requested.
+	PeerPenaltyBadSyncReply = 50
+	// Sending a message or reply which can't be decoded.
+	PeerPenaltyMalformedMessage = 20
+	// Failing to respond to a request.
+	PeerPenaltyTimeout = 10
+)
+
+// A PeerBan bans a peer by its address and/or peer ID until a time.
+type PeerBan struct {
+	Addr   string `json:"addr"`
+	PeerId string `json:"peerId"`
+	Reason string `json:"reason"`
+	// The time the ban expires, in UNIX milliseconds.
+	Until uint64 `json:"until"`
+}
+
+// Returns true if the ban applies to the peer.
+func (ban PeerBan) Matches(peer Peer) bool {
+	return (ban.Addr != "" && ban.Addr == peer.Addr) || (ban.PeerId != "" && ban.PeerId == peer.PeerId)
+}
+
+func (ban PeerBan) String() string {
+	return fmt.Sprintf("addr=%s peerId=%s until=%s reason=%q", ban.Addr, ban.PeerId, time.UnixMilli(int64(ban.Until)).Format(time.RFC3339), ban.Reason)
+}
+
+// A peer's misbehaviour score, as of the time it was last updated.
+type peerScore struct {
+	value   float64
+	updated time.Time
+}
+
+// Gets the score at a time, after decaying it by the half-life.
+func (s peerScore) at(now time.Time, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return s.value
+	}
+	elapsed := now.Sub(s.updated)
+	return s.value * math.Pow(0.5, elapsed.Seconds()/halfLife.Seconds())
+}
+
+// The key a peer is scored by.
+func peerScoreKey(peer Peer) string {
+	if peer.PeerId != "" {
+		return peer.PeerId
+	}
+	return peer.Addr
+}
+
+// Records misbehaviour by a peer, banning it if its score reaches the threshold.
+func (p *PeerCore) ReportMisbehaviour(peer Peer, penalty int, reason string) {
+	key := peerScoreKey(peer)
+	if key == "" {
+		return
+	}
+
+	p.scoresMutex.Lock()
+	now := time.Now()
+	value := p.scores[key].at(now, p.scoreHalfLife()) + float64(penalty)
+	p.scores[key] = peerScore{value: value, updated: now}
+	score := int(math.Round(value))
+	p.scoresMutex.Unlock()
+
+	p.peerLogger.Printf("Peer misbehaved: peer=%s penalty=%d score=%d reason=%q\n", key, penalty, score, reason)
+	if p.BanThreshold <= score {
+		p.BanPeer(peer, time.Duration(p.BanDurationSeconds)*time.Second, reason)
+	}
+}
+
+// Records misbehaviour by the sender of a message. Messages from unauthenticated senders can't be attributed.
+func (p *PeerCore) reportSenderMisbehaviour(sender string, penalty int, reason string) {
+	if sender == "" {
+		p.peerLogger.Printf("Unauthenticated peer misbehaved: reason=%q\n", reason)
+		return
+	}
+	peer := Peer{PeerId: sender}
+	if known, ok := p.getPeerById(sender); ok {
+		peer = known
+	}
+	p.ReportMisbehaviour(peer, penalty, reason)
+}
+
+// Records a failed request to a peer. Only malformed replies and timeouts are misbehaviour. Errors returned by the
+// peer's message handler, and connection errors (e.g. the peer is offline), are not - unreachable peers are evicted by
+// the heartbeat instead.
+func (p *PeerCore) reportRequestError(peer Peer, err error) {
+	if errors.Is(err, ErrMalformedReply) {
+		p.ReportMisbehaviour(peer, PeerPenaltyMalformedMessage, err.Error())
+		return
+	}
+	if isRequestTimeout(err) {
+		p.ReportMisbehaviour(peer, PeerPenaltyTimeout, err.Error())
+	}
+}
+
+// Returns true if a request was sent to the peer, but it didn't reply in time.
+func isRequestTimeout(err error) bool {
+	if errors.Is(err, ErrRequestTimeout) {
+		return true
+	}
+	// Timing out while dialing means we couldn't connect, rather than the peer failing to respond.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Gets the penalty for a block which failed to ingest, or 0 if the failure is not misbehaviour (e.g. the parent is
+// unknown to us).
+func invalidBlockPenalty(err error) int {
+	if errors.Is(err, ErrInvalidPOW) || errors.Is(err, ErrInvalidParentTotalWork) || errors.Is(err, ErrInvalidTxsMerkleRoot) {
+		return PeerPenaltyInvalidBlock
+	}
+	return 0
+}
+
+// Bans a peer for a duration, disconnecting it.
+func (p *PeerCore) BanPeer(peer Peer, duration time.Duration, reason string) {
+	ban := PeerBan{
+		Addr:   peer.Addr,
+		PeerId: peer.PeerId,
+		Reason: reason,
+		Until:  uint64(time.Now().Add(duration).UnixMilli()),
+	}
+
+	p.scoresMutex.Lock()
+	delete(p.scores, peerScoreKey(peer))
+	p.bans = append(p.bans, ban)
+	p.scoresMutex.Unlock()
+
+	// Disconnect.
+	p.DisconnectPeer(peer, reason)
+	if peer.PeerId != "" {
+		p.auth.revokePeer(peer.PeerId)
+	}
+
+	p.peerLogger.Printf("Banned peer: %s\n", ban)
+	if p.OnPeerBanned != nil {
+		p.OnPeerBanned(ban)
+	}
+}
+
+// Removes all bans matching the address or peer ID, returning the number removed.
+func (p *PeerCore) UnbanPeer(addrOrPeerId string) int {
+	p.scoresMutex.Lock()
+	defer p.scoresMutex.Unlock()
+
+	bans := []PeerBan{}
+	for _, ban := range p.bans {
+		if ban.Addr != addrOrPeerId && ban.PeerId != addrOrPeerId {
+			bans = append(bans, ban)
+		}
+	}
+	removed := len(p.bans) - len(bans)
+	p.bans = bans
+	return removed
+}
+
+// Returns true if the peer is banned, by its address or peer ID.
+func (p *PeerCore) IsBanned(peer Peer) bool {
+	p.scoresMutex.Lock()
+	defer p.scoresMutex.Unlock()
+
+	now := uint64(time.Now().UnixMilli())
+	for _, ban := range p.bans {
+		if now < ban.Until && ban.Matches(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the bans which have not expired.
+func (p *PeerCore) GetBans() []PeerBan {
+	p.scoresMutex.Lock()
+	defer p.scoresMutex.Unlock()
+
+	now := uint64(time.Now().UnixMilli())
+	bans := []PeerBan{}
+	for _, ban := range p.bans {
+		if now < ban.Until {
+			bans = append(bans, ban)
+		}
+	}
+	p.bans = bans
+	return append([]PeerBan{}, bans...)
+}
+
+// Sets the ban list, e.g. when loading it from the database.
+func (p *PeerCore) SetBans(bans []PeerBan) {
+	p.scoresMutex.Lock()
+	defer p.scoresMutex.Unlock()
+	p.bans = append([]PeerBan{}, bans...)
+}
+
+// Gets the misbehaviour score of a peer.
+func (p *PeerCore) GetScore(peer Peer) int {
+	p.scoresMutex.Lock()
+	defer p.scoresMutex.Unlock()
+	return int(math.Round(p.scores[peerScoreKey(peer)].at(time.Now(), p.scoreHalfLife())))
+}
+
+func (p *PeerCore) scoreHalfLife() time.Duration {
+	return time.Duration(p.ScoreHalfLifeSeconds) * time.Second
+}
+
+func (p *PeerCore) getPeerById(peerId string) (Peer, bool) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	for _, peer := range p.peers {
+		if peer.PeerId == peerId {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
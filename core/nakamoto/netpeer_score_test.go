@@ -0,0 +1,225 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerScoreBansAtThreshold(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	banned := []PeerBan{}
+	p1.OnPeerBanned = func(ban PeerBan) {
+		banned = append(banned, ban)
+	}
+
+	p1.AddPeer(p2.GetExternalAddr())
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	if !ok {
+		t.Fatal("Expected p2 to be added as a peer")
+	}
+
+	// Scores accumulate below the threshold.
+	p1.ReportMisbehaviour(peer, PeerPenaltyBadSyncReply, "bad reply")
+	p1.ReportMisbehaviour(peer, PeerPenaltyMalformedMessage, "malformed")
+	assert.Equal(70, p1.GetScore(peer))
+	assert.False(p1.IsBanned(peer))
+	assert.Empty(banned)
+
+	// Reaching the threshold bans and disconnects the peer.
+	p1.ReportMisbehaviour(peer, PeerPenaltyBadSyncReply, "bad reply")
+	assert.True(p1.IsBanned(peer))
+	assert.Equal(0, p1.GetScore(peer))
+	assert.Len(banned, 1)
+	assert.Equal(peer.Addr, banned[0].Addr)
+	assert.Equal(peer.PeerId, banned[0].PeerId)
+	assert.Equal("bad reply", banned[0].Reason)
+
+	_, ok = getTestPeer(p1, p2.GetExternalAddr())
+	assert.False(ok)
+
+	// The ban applies by address or peer ID.
+	assert.True(p1.IsBanned(Peer{Addr: peer.Addr}))
+	assert.True(p1.IsBanned(Peer{PeerId: peer.PeerId}))
+	assert.False(p1.IsBanned(Peer{Addr: "http://127.0.0.1:1"}))
+
+	// Banned peers are not added again.
+	p1.AddPeer(p2.GetExternalAddr())
+	_, ok = getTestPeer(p1, p2.GetExternalAddr())
+	assert.False(ok)
+}
+
+func TestPeerBanRejectsMessages(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	RegisterPeerHandler(p2.server, "whoami", func(sender string, msg echoMessage) (PeerAuthMessage, error) {
+		return PeerAuthMessage{Type: "whoami", PeerId: sender}, nil
+	})
+
+	p1.AddPeer(p2.GetExternalAddr())
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	if !ok {
+		t.Fatal("Expected p2 to be added as a peer")
+	}
+	_, err := CallPeer[echoMessage, PeerAuthMessage](p1, peer, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+
+	// p2 bans p1, revoking its session.
+	p2.BanPeer(Peer{PeerId: p1.peerId}, time.Hour, "testing")
+	reply, err := CallPeer[echoMessage, PeerAuthMessage](p1, peer, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal("", reply.PeerId)
+
+	// p1 can't authenticate again.
+	challenge := p2.auth.newChallenge()
+	sig, err := signPeerChallenge(p1.identity, challenge)
+	assert.Nil(err)
+	_, err = CallPeer[PeerAuthMessage, PeerAuthReply](p1, peer, PeerAuthMessage{
+		Type:      "peer_auth",
+		PeerId:    p1.peerId,
+		Challenge: challenge,
+		Signature: sig,
+	})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Expected RPCError, got: %v", err)
+	}
+	assert.Equal(RPCErrPeerBanned, rpcErr.Code)
+
+	// Messages from banned senders are rejected, even with a valid session.
+	session := p2.auth.newSession(p1.peerId)
+	_, err = p2.server.HandlePeerMessage(session, []byte(`{"type":"whoami"}`), WireEncodingJSON)
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Expected RPCError, got: %v", err)
+	}
+	assert.Equal(RPCErrPeerBanned, rpcErr.Code)
+}
+
+func TestPeerBannedForInvalidBlock(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+
+	blockErr := fmt.Errorf("Block has invalid POW solution: %w", ErrInvalidPOW)
+	p2.OnNewBlock = func(block RawBlock) error {
+		return blockErr
+	}
+
+	p1.AddPeer(p2.GetExternalAddr())
+	peer, ok := getTestPeer(p1, p2.GetExternalAddr())
+	if !ok {
+		t.Fatal("Expected p2 to be added as a peer")
+	}
+	assert.Eventually(func() bool {
+		_, ok := getTestPeer(p2, p1.GetExternalAddr())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Blocks with unknown parents are not misbehaviour.
+	blockErr = ErrUnknownParent
+	_, err := CallPeer[NewBlockMessage, struct{}](p1, peer, NewBlockMessage{Type: "new_block", RawBlock: newTestWireBlock(t)})
+	assert.Nil(err)
+	assert.False(p2.IsBanned(Peer{PeerId: p1.peerId}))
+
+	// Invalid blocks are.
+	blockErr = fmt.Errorf("Block has invalid POW solution: %w", ErrInvalidPOW)
+	_, err = CallPeer[NewBlockMessage, struct{}](p1, peer, NewBlockMessage{Type: "new_block", RawBlock: newTestWireBlock(t)})
+	assert.Nil(err)
+	assert.True(p2.IsBanned(Peer{PeerId: p1.peerId}))
+	assert.True(p2.IsBanned(Peer{Addr: p1.GetExternalAddr()}))
+	_, ok = getTestPeer(p2, p1.GetExternalAddr())
+	assert.False(ok)
+}
+
+func TestPeerReportRequestError(t *testing.T) {
+	assert := assert.New(t)
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "1", []string{}), &recordingTransport{})
+	peer := Peer{Addr: "http://127.0.0.1:2"}
+
+	// Errors returned by the peer's handlers are not penalised.
+	p.reportRequestError(peer, &RPCError{Code: RPCErrUnknownMessageType, Message: "Unknown message type"})
+	assert.Equal(0, p.GetScore(peer))
+
+	p.reportRequestError(peer, fmt.Errorf("%w: unexpected EOF", ErrMalformedReply))
+	assert.Equal(PeerPenaltyMalformedMessage, p.GetScore(peer))
+
+	p.reportRequestError(peer, fmt.Errorf("%w after 30s", ErrRequestTimeout))
+	assert.Equal(PeerPenaltyMalformedMessage+PeerPenaltyTimeout, p.GetScore(peer))
+
+	// Connection errors are not, as the peer may just be offline.
+	p.reportRequestError(peer, fmt.Errorf("connection refused"))
+	p.reportRequestError(peer, &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded})
+	assert.Equal(PeerPenaltyMalformedMessage+PeerPenaltyTimeout, p.GetScore(peer))
+
+	// Read deadlines are.
+	p.reportRequestError(peer, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded})
+	assert.Equal(PeerPenaltyMalformedMessage+2*PeerPenaltyTimeout, p.GetScore(peer))
+}
+
+func TestPeerScoreDecays(t *testing.T) {
+	assert := assert.New(t)
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "1", []string{}), &recordingTransport{})
+	peer := Peer{Addr: "http://127.0.0.1:2"}
+
+	p.ReportMisbehaviour(peer, 80, "testing")
+	assert.Equal(80, p.GetScore(peer))
+
+	// After one half-life, the score halves.
+	p.scores[peerScoreKey(peer)] = peerScore{value: 80, updated: time.Now().Add(-time.Duration(p.ScoreHalfLifeSeconds) * time.Second)}
+	assert.Equal(40, p.GetScore(peer))
+
+	// Penalties add to the decayed score, so the peer is not banned.
+	p.ReportMisbehaviour(peer, 50, "testing")
+	assert.Equal(90, p.GetScore(peer))
+	assert.False(p.IsBanned(peer))
+}
+
+func TestPeerBans(t *testing.T) {
+	assert := assert.New(t)
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "1", []string{}), &recordingTransport{})
+
+	now := uint64(time.Now().UnixMilli())
+	p.SetBans([]PeerBan{
+		{Addr: "http://127.0.0.1:2", Reason: "expired", Until: now - 1000},
+		{Addr: "http://127.0.0.1:3", PeerId: "peer3", Reason: "active", Until: now + 60000},
+		{PeerId: "peer3", Reason: "active", Until: now + 60000},
+	})
+
+	// Expired bans don't apply, and are pruned.
+	assert.False(p.IsBanned(Peer{Addr: "http://127.0.0.1:2"}))
+	assert.True(p.IsBanned(Peer{Addr: "http://127.0.0.1:3"}))
+	assert.Len(p.GetBans(), 2)
+
+	// Unbanning removes every ban for the peer.
+	assert.Equal(2, p.UnbanPeer("peer3"))
+	assert.Equal(0, p.UnbanPeer("peer3"))
+	assert.False(p.IsBanned(Peer{Addr: "http://127.0.0.1:3"}))
+	assert.Empty(p.GetBans())
+}
+
+func TestValidateSyncReply(t *testing.T) {
+	assert := assert.New(t)
+
+	heights := core.NewBitset(10)
+	heights.Insert(0)
+	heights.Insert(1)
+	item := DownloadWorkItem{Heights: *heights, Headers: true}
+
+	header := BlockHeader{}
+	assert.Nil(validateSyncReply(item, DownloadWorkResult{Headers: []BlockHeader{header, header}}))
+
+	// Replies can't contain more than was requested.
+	assert.NotNil(validateSyncReply(item, DownloadWorkResult{Headers: []BlockHeader{header, header, header}}))
+	assert.NotNil(validateSyncReply(item, DownloadWorkResult{Headers: []BlockHeader{header}, Bodies: [][]RawTransaction{{}}}))
+}
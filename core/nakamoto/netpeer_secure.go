@@ -0,0 +1,262 @@
+package nakamoto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Stream connections are encrypted, using a handshake which authenticates both peers with their peer keys.
+//
+// After the stream is upgraded, the peers exchange ephemeral P-256 keys, and each signs the handshake transcript with
+// its peer key:
+//
+//  1. The dialer sends its ephemeral public key.
+//  2. The listener sends its ephemeral public key, its peer ID, and its signature over the transcript.
+//  3. The dialer verifies the listener's signature, and sends its peer ID and its signature over the transcript.
+//
+// Both sides derive a key for each direction from the ECDH shared secret using HKDF, and all later traffic is sent in
+// records encrypted with AES-256-GCM:
+//
+//	length (uint32) ++ ciphertext
+//
+// The nonce for each record is a counter, so records can't be replayed, reordered or dropped without the connection
+// failing. Using ephemeral keys means past traffic can't be decrypted if a peer key is later compromised.
+
+const (
+	secureHandshakePrefix = "tinychain-stream-handshake"
+
+	// The size of an uncompressed P-256 public key.
+	securePubkeySizeBytes = 65
+	secureSigSizeBytes    = 64
+
+	// The maximum plaintext size of a record.
+	secureRecordSizeBytes = 64 * 1024
+)
+
+// The transcript signed by each side of the handshake. The role prevents a signature from being reflected back.
+func secureHandshakeTranscript(role string, dialerEphemeral []byte, listenerEphemeral []byte) []byte {
+	buf := bytes.NewBufferString(secureHandshakePrefix)
+	buf.WriteString(":" + role + ":")
+	buf.Write(dialerEphemeral)
+	buf.Write(listenerEphemeral)
+	return buf.Bytes()
+}
+
+// Writes our peer ID and our signature over the transcript.
+func writeSecureIdentity(w io.Writer, identity *core.Wallet, transcript []byte) error {
+	sig, err := identity.Sign(transcript)
+	if err != nil {
+		return err
+	}
+	pubkey := identity.PubkeyBytes()
+	_, err = w.Write(append(pubkey[:], sig...))
+	return err
+}
+
+// Reads the peer's ID and verifies its signature over the transcript, returning the peer ID.
+func readSecureIdentity(r io.Reader, transcript []byte) (string, error) {
+	buf := make([]byte, securePubkeySizeBytes+secureSigSizeBytes)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	peerId := hex.EncodeToString(buf[:securePubkeySizeBytes])
+	pubkey, err := parsePeerId(peerId)
+	if err != nil {
+		return "", err
+	}
+	if !core.VerifySignature(pubkey, buf[securePubkeySizeBytes:], transcript) {
+		return "", fmt.Errorf("Invalid handshake signature from peer %s", peerId)
+	}
+	return peerId, nil
+}
+
+// Performs the dialer's side of the handshake, returning the encrypted connection and the listener's peer ID.
+func secureDial(conn net.Conn, r io.Reader, identity *core.Wallet) (*secureConn, string, error) {
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	dialerEphemeral := ephemeral.PublicKey().Bytes()
+	if _, err := conn.Write(dialerEphemeral); err != nil {
+		return nil, "", err
+	}
+
+	// Read the listener's ephemeral key and identity.
+	listenerEphemeral := make([]byte, securePubkeySizeBytes)
+	if _, err := io.ReadFull(r, listenerEphemeral); err != nil {
+		return nil, "", err
+	}
+	peerId, err := readSecureIdentity(r, secureHandshakeTranscript("listener", dialerEphemeral, listenerEphemeral))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Prove our identity.
+	err = writeSecureIdentity(conn, identity, secureHandshakeTranscript("dialer", dialerEphemeral, listenerEphemeral))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sc, err := newSecureConn(conn, r, ephemeral, dialerEphemeral, listenerEphemeral, true)
+	return sc, peerId, err
+}
+
+// Performs the listener's side of the handshake, returning the encrypted connection and the dialer's peer ID.
+func secureAccept(conn net.Conn, r io.Reader, identity *core.Wallet) (*secureConn, string, error) {
+	dialerEphemeral := make([]byte, securePubkeySizeBytes)
+	if _, err := io.ReadFull(r, dialerEphemeral); err != nil {
+		return nil, "", err
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	listenerEphemeral := ephemeral.PublicKey().Bytes()
+
+	// Send our ephemeral key and identity.
+	if _, err := conn.Write(listenerEphemeral); err != nil {
+		return nil, "", err
+	}
+	err = writeSecureIdentity(conn, identity, secureHandshakeTranscript("listener", dialerEphemeral, listenerEphemeral))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Read the dialer's identity.
+	peerId, err := readSecureIdentity(r, secureHandshakeTranscript("dialer", dialerEphemeral, listenerEphemeral))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sc, err := newSecureConn(conn, r, ephemeral, dialerEphemeral, listenerEphemeral, false)
+	return sc, peerId, err
+}
+
+// A secureConn is a connection whose traffic is encrypted with AES-GCM.
+type secureConn struct {
+	net.Conn
+	reader io.Reader
+
+	sendCipher cipher.AEAD
+	sendNonce  uint64
+	sendMutex  sync.Mutex
+
+	recvCipher cipher.AEAD
+	recvNonce  uint64
+	// Decrypted data which has not been read yet.
+	recvBuf []byte
+}
+
+// Creates an encrypted connection, deriving the keys for each direction from the ECDH shared secret.
+func newSecureConn(conn net.Conn, r io.Reader, ephemeral *ecdh.PrivateKey, dialerEphemeral []byte, listenerEphemeral []byte, isDialer bool) (*secureConn, error) {
+	remoteEphemeral := dialerEphemeral
+	if isDialer {
+		remoteEphemeral = listenerEphemeral
+	}
+	remote, err := ecdh.P256().NewPublicKey(remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte{}, dialerEphemeral...), listenerEphemeral...)
+	newCipher := func(info string) (cipher.AEAD, error) {
+		key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	dialerCipher, err := newCipher(secureHandshakePrefix + ":dialer")
+	if err != nil {
+		return nil, err
+	}
+	listenerCipher, err := newCipher(secureHandshakePrefix + ":listener")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &secureConn{Conn: conn, reader: r}
+	if isDialer {
+		sc.sendCipher, sc.recvCipher = dialerCipher, listenerCipher
+	} else {
+		sc.sendCipher, sc.recvCipher = listenerCipher, dialerCipher
+	}
+	return sc, nil
+}
+
+func secureNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// Encrypts and writes data, in records of up to secureRecordSizeBytes.
+func (c *secureConn) Write(data []byte) (int, error) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	written := 0
+	for written < len(data) {
+		chunk := data[written:min(len(data), written+secureRecordSizeBytes)]
+
+		record := make([]byte, 4, 4+len(chunk)+c.sendCipher.Overhead())
+		record = c.sendCipher.Seal(record, secureNonce(c.sendCipher, c.sendNonce), chunk, nil)
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(record)-4))
+		c.sendNonce++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Reads and decrypts data.
+func (c *secureConn) Read(buf []byte) (int, error) {
+	if len(c.recvBuf) == 0 {
+		var length uint32
+		if err := binary.Read(c.reader, binary.BigEndian, &length); err != nil {
+			return 0, err
+		}
+		if length < uint32(c.recvCipher.Overhead()) || uint32(secureRecordSizeBytes+c.recvCipher.Overhead()) < length {
+			return 0, fmt.Errorf("Invalid record length: %d", length)
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, record); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recvCipher.Open(record[:0], secureNonce(c.recvCipher, c.recvNonce), record, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to decrypt record: %v", err)
+		}
+		c.recvNonce++
+		c.recvBuf = plaintext
+	}
+
+	n := copy(buf, c.recvBuf)
+	c.recvBuf = c.recvBuf[n:]
+	return n, nil
+}
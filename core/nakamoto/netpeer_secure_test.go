@@ -0,0 +1,161 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// A connection which records the bytes written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(data []byte) (int, error) {
+	c.written.Write(data)
+	return c.Conn.Write(data)
+}
+
+// Performs the handshake over an in-memory connection, returning the dialer's and listener's ends.
+func newTestSecureConns(t *testing.T, dialerIdentity *core.Wallet, listenerIdentity *core.Wallet) (*secureConn, *secureConn, *recordingConn) {
+	dialerEnd, listenerEnd := net.Pipe()
+	recorder := &recordingConn{Conn: dialerEnd}
+	t.Cleanup(func() {
+		dialerEnd.Close()
+		listenerEnd.Close()
+	})
+
+	type result struct {
+		conn   *secureConn
+		peerId string
+		err    error
+	}
+	accepted := make(chan result)
+	go func() {
+		conn, peerId, err := secureAccept(listenerEnd, listenerEnd, listenerIdentity)
+		accepted <- result{conn, peerId, err}
+	}()
+
+	dialer, peerId, err := secureDial(recorder, dialerEnd, dialerIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := <-accepted
+	if listener.err != nil {
+		t.Fatal(listener.err)
+	}
+
+	// Each side learns the other's peer ID.
+	assert.Equal(t, listenerIdentity.PubkeyStr(), peerId)
+	assert.Equal(t, dialerIdentity.PubkeyStr(), listener.peerId)
+	return dialer, listener.conn, recorder
+}
+
+func TestSecureConn(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+	dialer, listener, recorder := newTestSecureConns(t, &wallets[0], &wallets[1])
+
+	// Messages are delivered in both directions, including messages larger than a record.
+	small := []byte("hello from the dialer")
+	large := bytes.Repeat([]byte("block data "), secureRecordSizeBytes/5)
+
+	go func() {
+		dialer.Write(small)
+		dialer.Write(large)
+	}()
+	buf := make([]byte, len(small)+len(large))
+	_, err := io.ReadFull(listener, buf)
+	assert.Nil(err)
+	assert.Equal(append(append([]byte{}, small...), large...), buf)
+
+	go listener.Write([]byte("hello from the listener"))
+	buf = make([]byte, len("hello from the listener"))
+	_, err = io.ReadFull(dialer, buf)
+	assert.Nil(err)
+	assert.Equal("hello from the listener", string(buf))
+
+	// The plaintext is not sent over the wire.
+	assert.False(bytes.Contains(recorder.written.Bytes(), small))
+}
+
+func TestSecureConnRejectsTampering(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+	dialer, listener, _ := newTestSecureConns(t, &wallets[0], &wallets[1])
+
+	// Encrypt a record as the dialer, and flip a bit in its ciphertext.
+	sealed := dialer.sendCipher.Seal(nil, secureNonce(dialer.sendCipher, dialer.sendNonce), []byte("transfer 1 coin"), nil)
+	sealed[0] ^= 1
+	var record bytes.Buffer
+	binary.Write(&record, binary.BigEndian, uint32(len(sealed)))
+	record.Write(sealed)
+
+	listener.reader = &record
+	_, err := listener.Read(make([]byte, 64))
+	assert.NotNil(err)
+}
+
+func TestSecureHandshakeRejectsInvalidSignature(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+
+	dialerEphemeral := bytes.Repeat([]byte{1}, securePubkeySizeBytes)
+	listenerEphemeral := bytes.Repeat([]byte{2}, securePubkeySizeBytes)
+
+	// A signature over the dialer's transcript can't be used as the listener's.
+	var identity bytes.Buffer
+	err := writeSecureIdentity(&identity, &wallets[0], secureHandshakeTranscript("dialer", dialerEphemeral, listenerEphemeral))
+	assert.Nil(err)
+	_, err = readSecureIdentity(bytes.NewReader(identity.Bytes()), secureHandshakeTranscript("listener", dialerEphemeral, listenerEphemeral))
+	assert.NotNil(err)
+
+	// The signature must be from the claimed peer ID.
+	forged := identity.Bytes()
+	other := wallets[1].PubkeyBytes()
+	copy(forged, other[:])
+	_, err = readSecureIdentity(bytes.NewReader(forged), secureHandshakeTranscript("dialer", dialerEphemeral, listenerEphemeral))
+	assert.NotNil(err)
+}
+
+func TestStreamTransportEncrypted(t *testing.T) {
+	assert := assert.New(t)
+	a, _, _ := newTestStreamPeer(t)
+	b, _, urlB := newTestStreamPeer(t)
+	RegisterPeerHandler(b.server, "whoami", func(sender string, msg echoMessage) (PeerAuthMessage, error) {
+		return PeerAuthMessage{Type: "whoami", PeerId: sender}, nil
+	})
+
+	// Requests over an encrypted stream are identified by the peer key which authenticated it.
+	reply, err := CallPeer[echoMessage, PeerAuthMessage](a, Peer{Addr: urlB}, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal(a.peerId, reply.PeerId)
+
+	// Streams to a peer with a different ID are rejected.
+	c, _, urlC := newTestStreamPeer(t)
+	_, err = CallPeer[echoMessage, echoMessage](c, Peer{Addr: urlB, PeerId: a.peerId}, echoMessage{Type: "echo"})
+	assert.NotNil(err)
+	_, err = CallPeer[echoMessage, echoMessage](a, Peer{Addr: urlC, PeerId: c.peerId}, echoMessage{Type: "echo"})
+	assert.Nil(err)
+}
+
+func TestStreamTransportUnencrypted(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+	transportA.DisableEncryption = true
+	b, _, urlB := newTestStreamPeer(t)
+	RegisterPeerHandler(b.server, "whoami", func(sender string, msg echoMessage) (PeerAuthMessage, error) {
+		return PeerAuthMessage{Type: "whoami", PeerId: sender}, nil
+	})
+
+	// Peers accept unencrypted streams, which are not authenticated.
+	reply, err := CallPeer[echoMessage, PeerAuthMessage](a, Peer{Addr: urlB}, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal("", reply.PeerId)
+}
@@ -17,15 +17,26 @@ import (
 // All messages are encoded using JSON.
 type PeerServer struct {
 	config          PeerConfig
-	messageHandlers map[string]PeerMessageHandler
+	messageHandlers map[string]peerMessageHandler
 	log             log.Logger
 	server          *http.Server
+	mux             *http.ServeMux
+
+	// Handlers for messages in the binary wire encoding. Message types without one only accept JSON.
+	binaryHandlers map[string]peerMessageHandler
+
+	// Gets the ID of the authenticated peer for a session token.
+	GetSessionPeerId func(session string) (string, bool)
+
+	// Returns true if messages from the peer should be rejected.
+	IsPeerBanned func(peerId string) bool
 }
 
 func NewPeerServer(config PeerConfig) *PeerServer {
 	s := PeerServer{
 		config:          config,
-		messageHandlers: make(map[string]PeerMessageHandler),
+		messageHandlers: make(map[string]peerMessageHandler),
+		binaryHandlers:  make(map[string]peerMessageHandler),
 		log:             *NewLogger("peer-server", fmt.Sprintf(":%s", config.port)),
 	}
 
@@ -34,13 +45,13 @@ func NewPeerServer(config PeerConfig) *PeerServer {
 	port := s.config.port
 
 	// Setup HTTP server mux.
-	mux := http.NewServeMux()
-	mux.Handle("/peerapi/inbox", http.HandlerFunc(s.inboxHandler))
+	s.mux = http.NewServeMux()
+	s.mux.Handle("/peerapi/inbox", http.HandlerFunc(s.inboxHandler))
 
 	// Configure server with no transfer limits and gracious timeouts
 	s.server = &http.Server{
 		Addr:         addr + ":" + port,
-		Handler:      mux,
+		Handler:      s.mux,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -51,9 +62,27 @@ func NewPeerServer(config PeerConfig) *PeerServer {
 
 type PeerMessageHandler = func(message []byte) (interface{}, error)
 
+// A message handler which is given the ID of the authenticated peer which sent the message, or "" if the sender is not
+// authenticated.
+type peerMessageHandler = func(sender string, message []byte) (interface{}, error)
+
+// Registers a handler for JSON messages of a type. This replaces any handler registered for the type, including its
+// binary handler.
 func (s *PeerServer) RegisterMesageHandler(messageKey string, handler PeerMessageHandler) {
+	s.registerMessageHandler(messageKey, func(sender string, message []byte) (interface{}, error) {
+		return handler(message)
+	})
+}
+
+func (s *PeerServer) registerMessageHandler(messageKey string, handler peerMessageHandler) {
 	s.log.Printf("Registering message handler for '%s'\n", messageKey)
 	s.messageHandlers[messageKey] = handler
+	delete(s.binaryHandlers, messageKey)
+}
+
+// Registers a HTTP handler on the server, e.g. for a transport.
+func (s *PeerServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
 }
 
 func (s *PeerServer) Start() error {
@@ -81,6 +110,63 @@ func (s *PeerServer) Stop() {
 	s.server.Shutdown(context.Background())
 }
 
+// Handles an encoded message, dispatching it to the handler for its type, and returns the encoded reply. Errors are
+// returned as an *RPCError.
+func (s *PeerServer) HandleMessage(message []byte, encoding WireEncoding) ([]byte, error) {
+	return s.handleMessageFrom("", message, encoding)
+}
+
+// Handles an encoded message sent with a session token, which identifies the sending peer to the message handler.
+// Messages with an unknown session are handled as unauthenticated.
+func (s *PeerServer) HandlePeerMessage(session string, message []byte, encoding WireEncoding) ([]byte, error) {
+	sender := ""
+	if session != "" && s.GetSessionPeerId != nil {
+		sender, _ = s.GetSessionPeerId(session)
+	}
+	return s.handleMessageFrom(sender, message, encoding)
+}
+
+func (s *PeerServer) handleMessageFrom(sender string, message []byte, encoding WireEncoding) ([]byte, error) {
+	if sender != "" && s.IsPeerBanned != nil && s.IsPeerBanned(sender) {
+		return nil, &RPCError{Code: RPCErrPeerBanned, Message: "Peer is banned"}
+	}
+
+	messageType, err := PeekMessageType(encoding, message)
+	if err != nil {
+		return nil, &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Invalid payload: %s", err)}
+	}
+	if messageType == "" {
+		return nil, &RPCError{Code: RPCErrInvalidRequest, Message: "Missing 'type' field in payload"}
+	}
+
+	handlers := s.messageHandlers
+	if encoding == WireEncodingBinary {
+		handlers = s.binaryHandlers
+	}
+	handler, ok := handlers[messageType]
+	if !ok {
+		if _, ok := s.messageHandlers[messageType]; ok {
+			return nil, &RPCError{Code: RPCErrUnsupportedEncoding, Message: fmt.Sprintf("Message type '%s' only accepts JSON", messageType)}
+		}
+		return nil, &RPCError{Code: RPCErrUnknownMessageType, Message: fmt.Sprintf("No message handler registered for '%s'", messageType)}
+	}
+
+	res, err := handler(sender, message)
+	if err != nil {
+		return nil, toRPCError(err)
+	}
+
+	// Encode the reply.
+	if res == nil {
+		res = struct{}{}
+	}
+	reply, err := EncodeMessage(encoding, res)
+	if err != nil {
+		return nil, toRPCError(err)
+	}
+	return reply, nil
+}
+
 // Handler for /peerapi/inbox
 func (s *PeerServer) inboxHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -94,53 +180,48 @@ func (s *PeerServer) inboxHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
-		return
-	}
+	encoding := WireEncodingFromContentType(r.Header.Get("Content-Type"))
 
-	// Check message type.
-	if _, ok := payload["type"]; !ok {
-		http.Error(w, "Missing 'type' field in payload", http.StatusBadRequest)
-		return
-	}
 	// Log the message type.
-	messageType := payload["type"].(string)
-	s.log.Printf("Received '%s' message from %s\n", messageType, r.RemoteAddr)
-
-	// Check we have a message handler.
-	if _, ok := s.messageHandlers[messageType]; !ok {
-		http.Error(w, fmt.Sprintf("No message handler registered for '%s'", messageType), http.StatusInternalServerError)
-		return
+	if messageType, err := PeekMessageType(encoding, body); err == nil {
+		s.log.Printf("Received '%s' message from %s\n", messageType, r.RemoteAddr)
 	}
 
 	// Handle.
-	res, err := s.messageHandlers[messageType](body)
+	res, err := s.HandlePeerMessage(r.Header.Get(peerSessionHeader), body, encoding)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to process message: %s", err), http.StatusInternalServerError)
-		return
-	}
-
-	if res == nil {
-		// Send back HTTP 200 OK with empty JSON.
+		rpcErr := toRPCError(err)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("{}"))
+		w.WriteHeader(rpcErr.httpStatus())
+		json.NewEncoder(w).Encode(RPCErrorReply{Error: rpcErr})
 		return
-	} else {
-		// Respond.
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(res)
 	}
 
+	// Respond.
+	w.Header().Set("Content-Type", encoding.ContentType())
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
 }
 
+// The HTTP header containing the sender's session token.
+const peerSessionHeader = "X-Tinychain-Session"
+
 func SendMessageToPeer(peerUrl string, message any, log *log.Logger) ([]byte, error) {
 	// Dial on HTTP.
 	url := fmt.Sprintf("%s/peerapi/inbox", peerUrl)
 	log.Printf("Sending message to peer at %s\n", url)
+	return sendJSON(url, message, log)
+}
 
+// Sends an encoded message to a peer, returning the encoded reply. The session token, if set, identifies us to the peer.
+func sendEncodedMessageToPeer(peerUrl string, session string, encoding WireEncoding, message []byte, log *log.Logger) ([]byte, error) {
+	url := fmt.Sprintf("%s/peerapi/inbox", peerUrl)
+	log.Printf("Sending message to peer at %s\n", url)
+	return postMessage(url, encoding.ContentType(), session, message)
+}
+
+// Sends a JSON-encoded message in a HTTP POST request, returning the response body.
+func sendJSON(url string, message any, log *log.Logger) ([]byte, error) {
 	// JSON encode message.
 	messageJson, err := json.Marshal(message)
 	if err != nil {
@@ -150,14 +231,22 @@ func SendMessageToPeer(peerUrl string, message any, log *log.Logger) ([]byte, er
 	// Print json.
 	log.Printf("Sending message: %s\n", messageJson)
 
+	return postMessage(url, "application/json", "", messageJson)
+}
+
+// Sends a message in a HTTP POST request, returning the response body.
+func postMessage(url string, contentType string, session string, message []byte) ([]byte, error) {
 	// Create a new HTTP request.
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(messageJson))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(message))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	// Set headers.
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	if session != "" {
+		req.Header.Set(peerSessionHeader, session)
+	}
 
 	// Send request.
 	client := &http.Client{}
@@ -175,6 +264,11 @@ func SendMessageToPeer(peerUrl string, message any, log *log.Logger) ([]byte, er
 
 	// Print response and status code.
 	if resp.StatusCode != http.StatusOK {
+		// Decode errors from the peer RPC layer.
+		var errorReply RPCErrorReply
+		if err := json.Unmarshal(body, &errorReply); err == nil && errorReply.Error != nil {
+			return nil, errorReply.Error
+		}
 		return nil, fmt.Errorf("error in request, status=%d, body=\"%s\"", resp.StatusCode, body)
 	}
 
@@ -0,0 +1,526 @@
+package nakamoto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The stream transport sends messages to peers over persistent, bidirectional connections, rather than one HTTP request
+// per message.
+//
+// A connection is opened by upgrading a HTTP request to /peerapi/stream on the peer's existing port, in the same way
+// as WebSockets. After the upgrade, both sides exchange frames:
+//
+//	length (uint32) ++ kind (uint8) ++ id (uint64) ++ encoding (uint8) ++ session length (uint8) ++ session ++ payload
+//
+// where the length covers everything after it. Requests carry a correlation ID, which the peer echoes in its response,
+// so many requests can be in flight at once, and the sender's session token, which identifies it to the peer. Connections are symmetric: either side can send requests, so a peer can
+// push messages (e.g. new blocks) over a connection it accepted, without dialing back.
+//
+// Peers which don't support streams are sent messages over HTTP.
+//
+// Streams are encrypted by default, and the peer at each end is authenticated by its peer key (see netpeer_secure.go).
+// Requests over an encrypted stream are identified as being sent by the peer which authenticated the stream.
+
+const (
+	streamUpgradeProtocol       = "tinychain-stream"
+	streamSecureUpgradeProtocol = "tinychain-stream-secure"
+
+	// The header the dialer uses to tell the peer its address, so the peer can push messages over the connection.
+	streamPeerAddrHeader = "X-Tinychain-Peer"
+)
+
+// Stream frame kinds.
+const (
+	streamFrameRequest  = 1
+	streamFrameResponse = 2
+	streamFrameError    = 3
+)
+
+var errStreamClosed = errors.New("Stream closed")
+var ErrRequestTimeout = errors.New("Request timed out")
+var errStreamsUnsupported = errors.New("Peer does not support streams")
+
+type streamFrame struct {
+	kind     byte
+	id       uint64
+	encoding WireEncoding
+	session  string
+	payload  []byte
+}
+
+// The size of the frame fields after the length, excluding the session and payload.
+const streamFrameHeaderSizeBytes = 1 + 8 + 1 + 1
+
+func writeStreamFrame(w io.Writer, f streamFrame) error {
+	if 255 < len(f.session) {
+		return fmt.Errorf("Session too long: %d", len(f.session))
+	}
+	buf := make([]byte, 4+streamFrameHeaderSizeBytes, 4+streamFrameHeaderSizeBytes+len(f.session)+len(f.payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(streamFrameHeaderSizeBytes+len(f.session)+len(f.payload)))
+	buf[4] = f.kind
+	binary.BigEndian.PutUint64(buf[5:13], f.id)
+	buf[13] = byte(f.encoding)
+	buf[14] = byte(len(f.session))
+	buf = append(buf, f.session...)
+	buf = append(buf, f.payload...)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readStreamFrame(r io.Reader) (streamFrame, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return streamFrame{}, err
+	}
+	if length < streamFrameHeaderSizeBytes || MaxWireFrameSizeBytes < length {
+		return streamFrame{}, fmt.Errorf("Invalid stream frame length: %d", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return streamFrame{}, err
+	}
+	sessionEnd := streamFrameHeaderSizeBytes + int(buf[10])
+	if int(length) < sessionEnd {
+		return streamFrame{}, fmt.Errorf("Invalid stream frame session length: %d", buf[10])
+	}
+	return streamFrame{
+		kind:     buf[0],
+		id:       binary.BigEndian.Uint64(buf[1:9]),
+		encoding: WireEncoding(buf[9]),
+		session:  string(buf[streamFrameHeaderSizeBytes:sessionEnd]),
+		payload:  buf[sessionEnd:],
+	}, nil
+}
+
+// A streamConn is a connection to a peer, over which both sides send requests.
+type streamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+
+	// Requests awaiting a response, by ID.
+	nextId       atomic.Uint64
+	pending      map[uint64]chan streamFrame
+	pendingMutex sync.Mutex
+
+	// Handles requests from the peer.
+	handle func(session string, message []byte, encoding WireEncoding) ([]byte, error)
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	// The ID of the peer, if the connection is encrypted.
+	peerId string
+}
+
+func newStreamConn(conn net.Conn, reader *bufio.Reader, handle func(string, []byte, WireEncoding) ([]byte, error)) *streamConn {
+	return &streamConn{
+		conn:    conn,
+		reader:  reader,
+		pending: make(map[uint64]chan streamFrame),
+		handle:  handle,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *streamConn) write(f streamFrame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return writeStreamFrame(c.conn, f)
+}
+
+// Sends a request and waits for its response.
+func (c *streamConn) request(session string, message []byte, encoding WireEncoding, timeout time.Duration) ([]byte, error) {
+	id := c.nextId.Add(1)
+	responses := make(chan streamFrame, 1)
+
+	c.pendingMutex.Lock()
+	c.pending[id] = responses
+	c.pendingMutex.Unlock()
+	defer func() {
+		c.pendingMutex.Lock()
+		delete(c.pending, id)
+		c.pendingMutex.Unlock()
+	}()
+
+	err := c.write(streamFrame{kind: streamFrameRequest, id: id, encoding: encoding, session: session, payload: message})
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	select {
+	case res := <-responses:
+		if res.kind == streamFrameError {
+			var rpcErr RPCError
+			if err := json.Unmarshal(res.payload, &rpcErr); err != nil {
+				return nil, fmt.Errorf("failed to decode error: %v", err)
+			}
+			return nil, &rpcErr
+		}
+		return res.payload, nil
+	case <-c.closed:
+		return nil, errStreamClosed
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%w after %s", ErrRequestTimeout, timeout)
+	}
+}
+
+// Reads frames until the connection is closed, handling requests and delivering responses.
+func (c *streamConn) readLoop() {
+	defer c.close()
+	for {
+		f, err := readStreamFrame(c.reader)
+		if err != nil {
+			return
+		}
+
+		switch f.kind {
+		case streamFrameRequest:
+			go c.handleRequest(f)
+		case streamFrameResponse, streamFrameError:
+			c.pendingMutex.Lock()
+			responses, ok := c.pending[f.id]
+			c.pendingMutex.Unlock()
+			if ok {
+				responses <- f
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *streamConn) handleRequest(req streamFrame) {
+	reply, err := c.handle(req.session, req.payload, req.encoding)
+	if err != nil {
+		payload, _ := json.Marshal(toRPCError(err))
+		c.write(streamFrame{kind: streamFrameError, id: req.id, encoding: WireEncodingJSON, payload: payload})
+		return
+	}
+	c.write(streamFrame{kind: streamFrameResponse, id: req.id, encoding: req.encoding, payload: reply})
+}
+
+func (c *streamConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+// StreamTransport is a PeerTransport which keeps a persistent connection to each peer.
+type StreamTransport struct {
+	// The timeout for requests, and for opening connections.
+	RequestTimeout time.Duration
+
+	// Open unencrypted streams to peers. Peers accept both encrypted and unencrypted streams.
+	DisableEncryption bool
+
+	server       *PeerServer
+	getLocalAddr func() string
+	identity     *core.Wallet
+
+	// Used for peers which don't support streams.
+	fallback PeerTransport
+
+	// Open connections, by peer address.
+	conns map[string]*streamConn
+	// Peers which don't support streams.
+	httpOnly map[string]bool
+	// Held while dialing a peer.
+	dialing map[string]*sync.Mutex
+	mutex   sync.Mutex
+
+	log *log.Logger
+}
+
+// Creates a stream transport, which handles requests from peers using the server, and sends messages to peers which
+// don't support streams using the fallback transport. The local address is sent to peers, so they can push messages.
+// Encrypted streams are authenticated using the identity.
+func NewStreamTransport(server *PeerServer, getLocalAddr func() string, identity *core.Wallet, fallback PeerTransport) *StreamTransport {
+	return &StreamTransport{
+		RequestTimeout: 30 * time.Second,
+		server:         server,
+		getLocalAddr:   getLocalAddr,
+		identity:       identity,
+		fallback:       fallback,
+		conns:          make(map[string]*streamConn),
+		httpOnly:       make(map[string]bool),
+		dialing:        make(map[string]*sync.Mutex),
+		log:            NewLogger("peer-stream", ""),
+	}
+}
+
+func (t *StreamTransport) SendMessage(peer Peer, encoding WireEncoding, message []byte) ([]byte, error) {
+	conn, err := t.getConn(peer.Addr)
+	if err == nil && conn.peerId != "" && peer.PeerId != "" && conn.peerId != peer.PeerId {
+		return nil, fmt.Errorf("Stream authenticated as a different peer: expected=%s actual=%s", peer.PeerId, conn.peerId)
+	}
+	if err == errStreamsUnsupported {
+		return t.fallback.SendMessage(peer, encoding, message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn.request(peer.session, message, encoding, t.RequestTimeout)
+}
+
+// Gets the connection to a peer, connecting if there is none.
+func (t *StreamTransport) getConn(peerUrl string) (*streamConn, error) {
+	t.mutex.Lock()
+	if t.httpOnly[peerUrl] {
+		t.mutex.Unlock()
+		return nil, errStreamsUnsupported
+	}
+	if conn, ok := t.conns[peerUrl]; ok {
+		t.mutex.Unlock()
+		return conn, nil
+	}
+	t.mutex.Unlock()
+
+	// Only dial a peer once at a time.
+	dialMutex := t.getDialMutex(peerUrl)
+	dialMutex.Lock()
+	defer dialMutex.Unlock()
+
+	t.mutex.Lock()
+	if conn, ok := t.conns[peerUrl]; ok {
+		t.mutex.Unlock()
+		return conn, nil
+	}
+	t.mutex.Unlock()
+
+	conn, err := t.dial(peerUrl)
+	if err == errStreamsUnsupported {
+		t.log.Printf("Peer does not support streams, using HTTP: peer=%s\n", peerUrl)
+		t.mutex.Lock()
+		t.httpOnly[peerUrl] = true
+		t.mutex.Unlock()
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer may have connected to us in the meantime.
+	t.mutex.Lock()
+	existing, ok := t.conns[peerUrl]
+	if !ok {
+		t.addConn(peerUrl, conn)
+	}
+	t.mutex.Unlock()
+	if ok {
+		conn.close()
+		return existing, nil
+	}
+	return conn, nil
+}
+
+func (t *StreamTransport) getDialMutex(peerUrl string) *sync.Mutex {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.dialing[peerUrl]; !ok {
+		t.dialing[peerUrl] = &sync.Mutex{}
+	}
+	return t.dialing[peerUrl]
+}
+
+// Opens a connection to a peer, by upgrading a HTTP request.
+func (t *StreamTransport) dial(peerUrl string) (*streamConn, error) {
+	u, err := url.Parse(peerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, t.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/peerapi/stream", peerUrl), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	protocol := streamSecureUpgradeProtocol
+	if t.DisableEncryption {
+		protocol = streamUpgradeProtocol
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	req.Header.Set(streamPeerAddrHeader, t.getLocalAddr())
+
+	conn.SetDeadline(time.Now().Add(t.RequestTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errStreamsUnsupported
+	}
+
+	// Encrypt the stream.
+	var streamConn net.Conn = conn
+	peerId := ""
+	if !t.DisableEncryption {
+		secure, remotePeerId, err := secureDial(conn, reader, t.identity)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Stream handshake failed: %v", err)
+		}
+		streamConn, reader, peerId = secure, bufio.NewReader(secure), remotePeerId
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.log.Printf("Opened stream to peer: peer=%s peerId=%s\n", peerUrl, peerId)
+	sc := t.newConn(streamConn, reader, peerId)
+	go sc.readLoop()
+	return sc, nil
+}
+
+// Creates a connection. Requests over an encrypted connection are handled as being sent by the peer which
+// authenticated it.
+func (t *StreamTransport) newConn(conn net.Conn, reader *bufio.Reader, peerId string) *streamConn {
+	handle := t.server.HandlePeerMessage
+	if peerId != "" {
+		handle = func(session string, message []byte, encoding WireEncoding) ([]byte, error) {
+			return t.server.handleMessageFrom(peerId, message, encoding)
+		}
+	}
+	sc := newStreamConn(conn, reader, handle)
+	sc.peerId = peerId
+	return sc
+}
+
+// Tracks a connection, until it is closed. The caller must hold the mutex.
+func (t *StreamTransport) addConn(peerUrl string, conn *streamConn) {
+	t.conns[peerUrl] = conn
+	conn.onClose = func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.conns[peerUrl] == conn {
+			delete(t.conns, peerUrl)
+		}
+		t.log.Printf("Stream closed: peer=%s\n", peerUrl)
+	}
+}
+
+// Handler for /peerapi/stream, which accepts connections from peers.
+func (t *StreamTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Header.Get("Upgrade")
+	if protocol != streamUpgradeProtocol && protocol != streamSecureUpgradeProtocol {
+		http.Error(w, "Expected stream upgrade", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Streams not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		t.log.Printf("Failed to accept stream: %s\n", err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(t.RequestTimeout))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	// Encrypt the stream.
+	var streamConn net.Conn = conn
+	reader := rw.Reader
+	peerId := ""
+	if protocol == streamSecureUpgradeProtocol {
+		secure, remotePeerId, err := secureAccept(conn, rw.Reader, t.identity)
+		if err != nil {
+			t.log.Printf("Stream handshake failed: remote=%s err=%v\n", r.RemoteAddr, err)
+			conn.Close()
+			return
+		}
+		streamConn, reader, peerId = secure, bufio.NewReader(secure), remotePeerId
+	}
+
+	// Clear the HTTP server's timeouts, as the connection is long-lived.
+	conn.SetDeadline(time.Time{})
+
+	sc := t.newConn(streamConn, reader, peerId)
+
+	// Push messages to the peer over this connection, unless we are already connected.
+	peerUrl := r.Header.Get(streamPeerAddrHeader)
+	if peerUrl != "" {
+		t.mutex.Lock()
+		if _, ok := t.conns[peerUrl]; !ok {
+			t.addConn(peerUrl, sc)
+		}
+		delete(t.httpOnly, peerUrl)
+		t.mutex.Unlock()
+	}
+
+	t.log.Printf("Accepted stream from peer: peer=%s peerId=%s remote=%s\n", peerUrl, peerId, r.RemoteAddr)
+	go sc.readLoop()
+}
+
+// Closes the connection to a peer, if there is one.
+func (t *StreamTransport) CloseConnection(peerUrl string) {
+	t.mutex.Lock()
+	conn, ok := t.conns[peerUrl]
+	t.mutex.Unlock()
+	if ok {
+		conn.close()
+	}
+}
+
+// Gets the number of open connections.
+func (t *StreamTransport) NumConnections() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+// Closes all connections.
+func (t *StreamTransport) Close() {
+	t.mutex.Lock()
+	conns := make([]*streamConn, 0, len(t.conns))
+	for _, conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.close()
+	}
+}
@@ -0,0 +1,173 @@
+package nakamoto
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a peer which sends messages over streams, whose server is reachable at its returned URL.
+func newTestStreamPeer(t *testing.T) (*PeerCore, *StreamTransport, string) {
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", getRandomPort(), []string{}), nil)
+	transport := p.EnableStreamTransport()
+	ts := httptest.NewServer(p.server.mux)
+	t.Cleanup(func() {
+		transport.Close()
+		ts.Close()
+	})
+	RegisterHandler(p.server, "echo", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{Type: "echo_reply", Value: msg.Value + 1}, nil
+	})
+	return p, transport, ts.URL
+}
+
+func TestStreamTransportReusesConnection(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+	_, transportB, urlB := newTestStreamPeer(t)
+	peer := Peer{Addr: urlB, WireProtocolVersion: WIRE_PROTOCOL_VERSION}
+
+	for i := 0; i < 10; i++ {
+		reply, err := CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "echo", Value: i})
+		assert.Nil(err)
+		assert.Equal(i+1, reply.Value)
+	}
+
+	// All requests were sent over one connection.
+	assert.Equal(1, transportA.NumConnections())
+	assert.Equal(1, transportB.NumConnections())
+}
+
+func TestStreamTransportConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+	_, _, urlB := newTestStreamPeer(t)
+	peer := Peer{Addr: urlB, WireProtocolVersion: WIRE_PROTOCOL_VERSION}
+
+	// Each reply is matched to its request.
+	var wg sync.WaitGroup
+	replies := make([]int, 100)
+	errs := make([]error, 100)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply, err := CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "echo", Value: i})
+			replies[i], errs[i] = reply.Value, err
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range replies {
+		assert.Nil(errs[i])
+		assert.Equal(i+1, replies[i])
+	}
+	assert.Equal(1, transportA.NumConnections())
+}
+
+func TestStreamTransportServerPush(t *testing.T) {
+	assert := assert.New(t)
+
+	// Peer A has no listener, so it can only be reached over the connection it opens.
+	a := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", getRandomPort(), []string{}), nil)
+	transportA := a.EnableStreamTransport()
+	t.Cleanup(transportA.Close)
+	RegisterHandler(a.server, "echo", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{Type: "echo_reply", Value: msg.Value * 2}, nil
+	})
+
+	b, _, urlB := newTestStreamPeer(t)
+
+	// A connects to B.
+	_, err := CallPeer[echoMessage, echoMessage](a, Peer{Addr: urlB}, echoMessage{Type: "echo", Value: 1})
+	assert.Nil(err)
+
+	// B sends a message to A, over A's connection.
+	reply, err := CallPeer[echoMessage, echoMessage](b, Peer{Addr: a.GetExternalAddr()}, echoMessage{Type: "echo", Value: 21})
+	assert.Nil(err)
+	assert.Equal(42, reply.Value)
+}
+
+func TestStreamTransportFallback(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+
+	// Peer B only supports HTTP.
+	b, urlB := newTestRPCPeer(t)
+	RegisterHandler(b.server, "echo", func(msg echoMessage) (echoMessage, error) {
+		return echoMessage{Type: "echo_reply", Value: msg.Value + 1}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		reply, err := CallPeer[echoMessage, echoMessage](a, Peer{Addr: urlB}, echoMessage{Type: "echo", Value: i})
+		assert.Nil(err)
+		assert.Equal(i+1, reply.Value)
+	}
+	assert.Equal(0, transportA.NumConnections())
+}
+
+func TestStreamTransportErrors(t *testing.T) {
+	assert := assert.New(t)
+	a, _, _ := newTestStreamPeer(t)
+	_, _, urlB := newTestStreamPeer(t)
+	peer := Peer{Addr: urlB, WireProtocolVersion: WIRE_PROTOCOL_VERSION}
+
+	// Errors are returned as RPCErrors.
+	_, err := CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "unknown"})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Expected RPCError, got: %v", err)
+	}
+	assert.Equal(RPCErrUnknownMessageType, rpcErr.Code)
+
+	_, err = a.GetTip(peer)
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Expected RPCError, got: %v", err)
+	}
+	assert.Equal(RPCErrNotAvailable, rpcErr.Code)
+}
+
+func TestStreamTransportReconnects(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+	_, transportB, urlB := newTestStreamPeer(t)
+	peer := Peer{Addr: urlB}
+
+	_, err := CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "echo"})
+	assert.Nil(err)
+
+	// When the connection is closed, the next request opens a new one.
+	transportB.Close()
+	_, err = CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "echo"})
+	if err != nil {
+		// The close may not yet be observed by A.
+		_, err = CallPeer[echoMessage, echoMessage](a, peer, echoMessage{Type: "echo"})
+	}
+	assert.Nil(err)
+	assert.Equal(1, transportA.NumConnections())
+}
+
+func TestStreamTransportSession(t *testing.T) {
+	assert := assert.New(t)
+	a, transportA, _ := newTestStreamPeer(t)
+	b, _, urlB := newTestStreamPeer(t)
+
+	// Encrypted streams identify the sender by the stream's authentication, so use an unencrypted one.
+	transportA.DisableEncryption = true
+	RegisterPeerHandler(b.server, "whoami", func(sender string, msg echoMessage) (PeerAuthMessage, error) {
+		return PeerAuthMessage{Type: "whoami", PeerId: sender}, nil
+	})
+
+	// Requests over the same connection are identified by their session.
+	session := b.auth.newSession(a.peerId)
+	reply, err := CallPeer[echoMessage, PeerAuthMessage](a, Peer{Addr: urlB, session: session}, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal(a.peerId, reply.PeerId)
+
+	reply, err = CallPeer[echoMessage, PeerAuthMessage](a, Peer{Addr: urlB}, echoMessage{Type: "whoami"})
+	assert.Nil(err)
+	assert.Equal("", reply.PeerId)
+}
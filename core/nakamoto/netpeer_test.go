@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -103,12 +104,20 @@ func TestStartPeerHeartbeat(t *testing.T) {
 		// Decode message into HeartbeatMessage.
 		var hb HeartbeatMesage
 		if err := json.Unmarshal(message, &hb); err != nil {
-			t.Fatalf(err.Error())
+			t.Fatal(err)
 			return nil, err
 		}
 
 		heartbeatChan <- hb
-		return nil, nil
+
+		// Reply with a signed heartbeat, so peer 2 can authenticate us.
+		reply := peer1.makeHeartbeat()
+		sig, err := signPeerChallenge(peer1.identity, hb.Challenge)
+		if err != nil {
+			return nil, err
+		}
+		reply.Signature = sig
+		return reply, nil
 	})
 
 	go peer1.Start()
@@ -154,3 +163,190 @@ func TestPeerGossip(t *testing.T) {
 	// Gossip a block from peer 1 to peer 2.
 	// raw := RawBlock{}
 }
+
+func TestPeerRejectsOtherNetworks(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(3)
+	p1, p2, p3 := peers[0], peers[1], peers[2]
+	p1.NetworkId = "testnet1"
+	p2.NetworkId = "testnet1"
+	p3.NetworkId = "testnet2"
+
+	p1.AddPeer(p2.GetExternalAddr())
+	_, ok := getTestPeer(p1, p2.GetExternalAddr())
+	assert.True(ok)
+
+	// Neither side peers with a node on another network.
+	p1.AddPeer(p3.GetExternalAddr())
+	_, ok = getTestPeer(p1, p3.GetExternalAddr())
+	assert.False(ok)
+
+	p3.AddPeer(p1.GetExternalAddr())
+	_, ok = getTestPeer(p3, p1.GetExternalAddr())
+	assert.False(ok)
+
+	// Heartbeats from other networks are rejected with the reason.
+	_, err := p3.sendHeartbeat(Peer{Addr: p1.GetExternalAddr()}, p3.makeHeartbeat())
+	assert.ErrorContains(err, "Peer is on a different network: ours=testnet1 theirs=testnet2")
+}
+
+func TestPeerNegotiateVersion(t *testing.T) {
+	assert := assert.New(t)
+	p := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "1", []string{}), &recordingTransport{})
+
+	heartbeat := p.makeHeartbeat()
+	version, err := p.negotiatePeer(heartbeat)
+	assert.Nil(err)
+	assert.Equal(WIRE_PROTOCOL_VERSION, version)
+
+	// Older peers negotiate their version.
+	heartbeat.WireProtocolVersion = 1
+	heartbeat.MinWireProtocolVersion = 0
+	version, err = p.negotiatePeer(heartbeat)
+	assert.Nil(err)
+	assert.Equal(uint(1), version)
+	assert.Equal(WireEncodingJSON, p.getWireEncoding(Peer{WireProtocolVersion: version}))
+
+	// Newer peers negotiate our version.
+	heartbeat.WireProtocolVersion = WIRE_PROTOCOL_VERSION + 1
+	version, err = p.negotiatePeer(heartbeat)
+	assert.Nil(err)
+	assert.Equal(WIRE_PROTOCOL_VERSION, version)
+
+	// Peers older than our minimum are rejected.
+	heartbeat.WireProtocolVersion = MIN_WIRE_PROTOCOL_VERSION - 1
+	_, err = p.negotiatePeer(heartbeat)
+	assert.ErrorContains(err, "older than our minimum")
+
+	// Peers which require a newer version than ours are rejected.
+	heartbeat.WireProtocolVersion = WIRE_PROTOCOL_VERSION + 1
+	heartbeat.MinWireProtocolVersion = WIRE_PROTOCOL_VERSION + 1
+	_, err = p.negotiatePeer(heartbeat)
+	assert.ErrorContains(err, "Peer requires wire protocol version")
+}
+
+func TestPeerHasBlock(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	peer := Peer{Addr: p2.GetExternalAddr()}
+
+	// Peers which don't serve blocks say so.
+	_, err := p1.HasBlock(peer, [32]byte{1})
+	var rpcErr *RPCError
+	assert.ErrorAs(err, &rpcErr)
+	assert.Equal(RPCErrNotAvailable, rpcErr.Code)
+
+	p2.OnHasBlock = func(blockhash [32]byte) (bool, error) {
+		return blockhash == [32]byte{1}, nil
+	}
+	has, err := p1.HasBlock(peer, [32]byte{1})
+	assert.Nil(err)
+	assert.True(has)
+
+	has, err = p1.HasBlock(peer, [32]byte{2})
+	assert.Nil(err)
+	assert.False(has)
+
+	// Invalid block hashes are rejected.
+	_, err = CallPeer[HasBlockMessage, HasBlockReply](p1, peer, HasBlockMessage{Type: "has_block", BlockHash: "zz"})
+	assert.ErrorAs(err, &rpcErr)
+	assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+}
+
+func TestPeerGetTxProofRejectsInvalidHash(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	peer := Peer{Addr: p2.GetExternalAddr()}
+
+	p2.OnGetTxProof = func(msg GetTxProofMessage) (TxProof, error) {
+		return TxProof{}, nil
+	}
+
+	// Hashes must be 32 bytes of hex.
+	for _, txhash := range []string{"zz", "abcd", strings.Repeat("00", 33)} {
+		_, err := CallPeer[GetTxProofMessage, GetTxProofReply](p1, peer, GetTxProofMessage{Type: "get_tx_proof", TxHash: txhash})
+		var rpcErr *RPCError
+		assert.ErrorAs(err, &rpcErr)
+		assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+	}
+}
+
+func TestPeerSyncGetForkPoint(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	peer := Peer{Addr: p2.GetExternalAddr()}
+
+	p2.OnSyncGetForkPoint = func(msg SyncGetForkPointMessage) (SyncGetForkPointReply, error) {
+		return SyncGetForkPointReply{Type: "sync_get_fork_point_reply", ForkPoint: msg.Locator[len(msg.Locator)-1]}, nil
+	}
+	forkPoint, err := p1.SyncGetForkPoint(peer, [][32]byte{{3}, {2}, {1}})
+	assert.Nil(err)
+	assert.Equal([32]byte{1}, forkPoint)
+
+	// Locators must be non-empty and bounded.
+	var rpcErr *RPCError
+	_, err = p1.SyncGetForkPoint(peer, [][32]byte{})
+	assert.ErrorAs(err, &rpcErr)
+	assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+
+	_, err = p1.SyncGetForkPoint(peer, make([][32]byte, MaxBlockLocatorSize+1))
+	assert.ErrorAs(err, &rpcErr)
+	assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+}
+
+func TestPeerGetBlocks(t *testing.T) {
+	assert := assert.New(t)
+	peers, _ := newTestAuthPeers(2)
+	p1, p2 := peers[0], peers[1]
+	peer := Peer{Addr: p2.GetExternalAddr()}
+
+	blocks := map[string]RawBlock{}
+	hashes := [][32]byte{}
+	for i := 0; i < 3; i++ {
+		block := newTestWireBlock(t)
+		block.Timestamp = uint64(i)
+		blocks[block.HashStr(testHasher)] = block
+		hashes = append(hashes, block.Hash(testHasher))
+	}
+	requests := 0
+	p2.OnGetBlocks = func(msg GetBlocksMessage) ([][]byte, error) {
+		requests++
+		reply := [][]byte{}
+		for _, hash := range msg.BlockHashes {
+			if block, ok := blocks[hash]; ok {
+				reply = append(reply, block.Bytes())
+			}
+		}
+		return reply, nil
+	}
+
+	// Blocks are downloaded in batches, and unknown blocks are omitted.
+	p1.MaxGetBlocks = 2
+	got, err := p1.GetBlocks(peer, append(hashes, [32]byte{1}))
+	assert.Nil(err)
+	assert.Equal(2, requests)
+	assert.Equal(3, len(got))
+	for i, block := range got {
+		assert.Equal(hashes[i], block.Hash(testHasher))
+		assert.Equal(blocks[block.HashStr(testHasher)], block)
+	}
+
+	// Requests over the peer's limit are rejected.
+	p2.MaxGetBlocks = 2
+	p1.MaxGetBlocks = 3
+	_, err = p1.GetBlocks(peer, hashes)
+	var rpcErr *RPCError
+	assert.ErrorAs(err, &rpcErr)
+	assert.Equal(RPCErrInvalidRequest, rpcErr.Code)
+
+	// Blocks we didn't request are rejected.
+	p2.OnGetBlocks = func(msg GetBlocksMessage) ([][]byte, error) {
+		block := blocks[Bytes32ToHexString(hashes[0])]
+		return [][]byte{block.Bytes()}, nil
+	}
+	_, err = p1.GetBlocks(peer, [][32]byte{hashes[1]})
+	assert.ErrorIs(err, ErrMalformedReply)
+}
@@ -1,8 +1,10 @@
 package nakamoto
 
 import (
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -11,6 +13,12 @@ type Node struct {
 	Miner         *Miner
 	Peer          *PeerCore
 	StateMachine1 *StateMachine
+	LightClient   *LightClient  // Only set in light mode.
+	MiningServer  *MiningServer // Only set when serving work to external miners.
+	Pool          *Pool         // Only set in pool mode.
+	Builders      *BuilderAuction
+	Mempool       *Mempool
+	stateMutex    sync.Mutex
 	log           *log.Logger
 	syncLog       *log.Logger
 	stateLog      *log.Logger
@@ -27,6 +35,7 @@ func NewNode(dag *BlockDAG, miner *Miner, peer *PeerCore) *Node {
 		Miner:         miner,
 		Peer:          peer,
 		StateMachine1: stateMachine,
+		Mempool:       NewMempool(),
 		log:           NewLogger("node", ""),
 		syncLog:       NewLogger("node", "sync"),
 		stateLog:      NewLogger("node", "state"),
@@ -37,18 +46,27 @@ func NewNode(dag *BlockDAG, miner *Miner, peer *PeerCore) *Node {
 
 func (n *Node) setup() {
 	// Listen for new blocks.
-	n.Peer.OnNewBlock = func(b RawBlock) {
-		n.log.Printf("New block gossip from peer: block=%s\n", b.HashStr())
+	n.Peer.OnNewBlock = func(b RawBlock) error {
+		n.log.Printf("New block gossip from peer: block=%s\n", b.HashStr(n.Dag.hasher))
 
-		if n.Dag.HasBlock(b.Hash()) {
-			n.log.Printf("Block already in DAG: block=%s\n", b.HashStr())
-			return
+		if n.Dag.HasBlock(b.Hash(n.Dag.hasher)) {
+			n.log.Printf("Block already in DAG: block=%s\n", b.HashStr(n.Dag.hasher))
+			return nil
 		}
 
 		isUnknownParent := n.Dag.HasBlock(b.ParentHash)
 		if isUnknownParent {
 			// We need to sync the chain.
-			n.log.Printf("Block parent unknown: block=%s\n", b.HashStr())
+			n.log.Printf("Block parent unknown: block=%s\n", b.HashStr(n.Dag.hasher))
+		}
+
+		// Light nodes only ingest the header.
+		if n.IsLight() {
+			err := n.Dag.IngestHeader(b.ToBlockHeader())
+			if err != nil {
+				n.log.Printf("Failed to ingest header from peer: %s\n", err)
+			}
+			return err
 		}
 
 		// Ingest the block.
@@ -56,52 +74,90 @@ func (n *Node) setup() {
 		if err != nil {
 			n.log.Printf("Failed to ingest block from peer: %s\n", err)
 		}
+		return err
 	}
 
 	// Upload blocks to other peers.
 	n.Peer.OnGetBlocks = func(msg GetBlocksMessage) ([][]byte, error) {
-		// Assert hashes length.
-		MAX_GET_BLOCKS_LEN := 10
-		if MAX_GET_BLOCKS_LEN < len(msg.BlockHashes) {
-			return nil, fmt.Errorf("Too many hashes requested. Max is %d", MAX_GET_BLOCKS_LEN)
-		}
-
 		reply := make([][]byte, 0)
 		for _, hash := range msg.BlockHashes {
-			blockhash := HexStringToBytes32(hash)
+			buf, err := hex.DecodeString(hash)
+			if err != nil || len(buf) != 32 {
+				return nil, fmt.Errorf("Invalid block hash: %s", hash)
+			}
+			blockhash := [32]byte(buf)
 
 			// Get the raw block.
 			rawBlockData, err := n.Dag.GetRawBlockDataByHash(blockhash)
 			if err != nil {
-				// If there is an error getting the block hash, skip it.
+				// If we don't have the block, skip it.
 				continue
 			}
 
 			reply = append(reply, rawBlockData)
 		}
 
-		// return reply, nil
-		return nil, nil
+		return reply, nil
+	}
+
+	// Mine the best body bid by block builders.
+	n.Builders = NewBuilderAuction(n.Dag, n.Miner.CoinbaseWallet.PubkeyBytes(), n.GetState)
+	n.Miner.GetBlockBody = n.Builders.GetBestBody
+
+	// Bid the mempool's transactions for our own blocks. As we build for our own miner, the payment is zero.
+	emptyBlock := RawBlock{Transactions: []RawTransaction{{}}}
+	maxBodySize := uint64(0)
+	if emptyBlock.SizeBytes() < n.Dag.consensus.MaxBlockSizeBytes {
+		maxBodySize = n.Dag.consensus.MaxBlockSizeBytes - emptyBlock.SizeBytes()
+	}
+	n.Builders.Builders = append(n.Builders.Builders, NewLocalBuilder(n.Mempool, n.Miner.CoinbaseWallet, 0, maxBodySize))
+	n.Peer.OnSubmitBuilderBid = func(msg SubmitBuilderBidMessage) error {
+		if n.IsLight() {
+			return fmt.Errorf("Light node does not mine.")
+		}
+		return n.Builders.SubmitBid(msg.Bid)
 	}
 
 	// Gossip blocks when we mine a new solution.
 	n.Miner.OnBlockSolution = func(b RawBlock) {
-		n.log.Printf("Mined new block: %s\n", b.HashStr())
-
-		// Ingest the block.
-		err := n.Dag.IngestBlock(b)
+		err := n.ingestMinedBlock(b)
 		if err != nil {
 			n.log.Printf("Failed to ingest block from miner: %s\n", err)
 		}
-
-		// Gossip the block.
-		n.Peer.GossipBlock(b)
 	}
 
 	// Gossip the latest tip.
 	n.Peer.OnGetTip = func(msg GetTipMessage) (BlockHeader, error) {
 		return n.Dag.FullTip.ToBlockHeader(), nil
 	}
+	n.Peer.GetLocalTip = func() Block {
+		return n.Dag.FullTip
+	}
+
+	// Only peer with nodes on our network.
+	n.Peer.NetworkId = GetNetworkId(n.Dag.consensus)
+	n.Peer.Hasher = n.Dag.hasher
+
+	// Serve transaction inclusion proofs to light clients.
+	n.Peer.OnGetTxProof = func(msg GetTxProofMessage) (TxProof, error) {
+		buf, err := hex.DecodeString(msg.TxHash)
+		if err != nil || len(buf) != 32 {
+			return TxProof{}, fmt.Errorf("Invalid tx hash: %s", msg.TxHash)
+		}
+		return n.Dag.GetTxProof([32]byte(buf))
+	}
+	n.Peer.OnGetAccountTxProofs = func(msg GetAccountTxProofsMessage) ([]TxProof, uint64, error) {
+		if n.IsLight() {
+			return nil, 0, fmt.Errorf("Light node does not store transactions.")
+		}
+		buf, err := hex.DecodeString(msg.Account)
+		if err != nil || len(buf) != 65 {
+			return nil, 0, fmt.Errorf("Invalid account: %s", msg.Account)
+		}
+		account := [65]byte{}
+		copy(account[:], buf)
+		return n.Dag.GetAccountTxProofs(account, msg.Offset, msg.Limit)
+	}
 
 	n.Peer.OnSyncGetTipAtDepth = func(msg SyncGetTipAtDepthMessage) (SyncGetTipAtDepthReply, error) {
 		direction := msg.Direction
@@ -125,6 +181,24 @@ func (n *Node) setup() {
 
 	}
 
+	n.Peer.OnSyncGetForkPoint = func(msg SyncGetForkPointMessage) (SyncGetForkPointReply, error) {
+		forkPoint, ok, err := n.Dag.FindForkPoint(msg.Locator)
+		if err != nil {
+			return SyncGetForkPointReply{}, err
+		}
+		if !ok {
+			return SyncGetForkPointReply{}, fmt.Errorf("None of the locator's blocks are in our chain.")
+		}
+		return SyncGetForkPointReply{
+			Type:      "sync_get_fork_point_reply",
+			ForkPoint: forkPoint,
+		}, nil
+	}
+
+	n.Peer.OnHasBlock = func(blockhash [32]byte) (bool, error) {
+		return n.Dag.HasBlock(blockhash), nil
+	}
+
 	// Upload blocks to other peers.
 	n.Peer.OnSyncGetData = func(msg SyncGetBlockDataMessage) (SyncGetBlockDataReply, error) {
 		reply := SyncGetBlockDataReply{
@@ -179,26 +253,38 @@ func (n *Node) setup() {
 	}
 
 	// Recompute the state after a new tip.
-	n.Dag.OnNewFullTip = func(new_tip Block, prev_tip Block) {
+	n.Dag.OnNewFullTip = func(new_tip Block, prev_tip Block) error {
 		// 1. Rebuild state.
 		// 2. Regenerate current mempool.
 
 		n.stateLog.Printf("rebuild-state\n")
 		start := time.Now()
 
+		// If a block in the chain failed to apply, the DAG marks it invalid and moves the tip off of it.
 		err := n.rebuildState()
 		if err != nil {
 			n.stateLog.Printf("Failed to rebuild state: %s\n", err)
-			return
+			return err
+		}
+
+		// Mark the chain as having a valid state.
+		err = n.Dag.MarkValidState(new_tip.Hash)
+		if err != nil {
+			n.stateLog.Printf("Failed to mark chain state valid: %s\n", err)
 		}
 
 		duration := time.Since(start)
 		n.stateLog.Printf("rebuild-state completed duration=%s n_blocks=%d\n", duration.String(), n.Dag.FullTip.Height)
+
+		n.pruneMempool(new_tip)
+
+		// Begin mining on the new tip.
+		n.Miner.NotifyNewTip(new_tip)
+		return nil
 	}
 
 	// When we get a tx, add it to the mempool.
 	// When mempool changes, restart miner.
-	// When DAG tip changes, restart miner.
 	// When we first boot node, perform a full sync before doing anything.
 	// When we get new block that doesn't have known parent, do a sync.
 
@@ -211,21 +297,96 @@ func (n *Node) setup() {
 	//   c. Begin mining on the new tip.
 
 	// When we get new transaction, add it to mempool.
+	// Rebuild the miner's puzzle if the mempool's fees rise enough to be worth including.
+	n.Miner.GetMempoolFees = n.Mempool.GetFeeStatistics
+	if n.Miner.MempoolFeeThreshold == 0 {
+		n.Miner.MempoolFeeThreshold = DefaultMempoolFeeThreshold
+	}
 	n.Peer.OnNewTransaction = func(tx RawTransaction) {
-		// Add transaction to mempool.
-		// TODO.
+		if n.IsLight() {
+			return
+		}
+		state := n.GetState().Copy()
+		if err := n.applyMempoolTx(state, n.Dag.FullTip, tx); err != nil {
+			n.log.Printf("Rejected transaction from peer: %s\n", err)
+			return
+		}
+		err := n.Mempool.SubmitTx(tx)
+		if err != nil {
+			n.log.Printf("Failed to add transaction to mempool: %s\n", err)
+			return
+		}
+		n.Miner.NotifyMempoolFees(n.Mempool.GetFeeStatistics())
+	}
+
+	// Persist bans as they happen.
+	n.Peer.OnPeerBanned = func(ban PeerBan) {
+		n.saveNetworkStore()
 	}
 
-	// Load peers from cache.
+	// Load bans and peers from cache.
 	networkStore, err := LoadDataStore[NetworkStore](n.Dag.db, "network")
 	if err != nil {
 		n.log.Printf("Failed to load network store: %s\n", err)
+		networkStore = &NetworkStore{}
 	}
+	n.Peer.SetBans(networkStore.Bans)
 	for _, peer := range networkStore.PeerCache {
 		go n.Peer.AddPeer(peer.Addr)
 	}
 }
 
+// Saves our peers and bans to the database.
+func (n *Node) saveNetworkStore() {
+	networkStore := NetworkStore{
+		PeerCache: n.Peer.GetPeers(),
+		Bans:      n.Peer.GetBans(),
+	}
+	err := SaveDataStore(n.Dag.db, "network", networkStore)
+	if err != nil {
+		n.log.Printf("Failed to save network store: %s\n", err)
+	}
+}
+
+// Ingests a block we mined, and gossips it to our peers.
+func (n *Node) ingestMinedBlock(b RawBlock) error {
+	n.log.Printf("Mined new block: %s\n", b.HashStr(n.Dag.hasher))
+
+	err := n.Dag.IngestBlock(b)
+	if err != nil {
+		return err
+	}
+
+	n.Peer.GossipBlock(b)
+	return nil
+}
+
+// Serves block templates to external miners on the given address and port. Solutions are ingested and gossipped the
+// same as blocks mined by the node's own miner.
+func (n *Node) EnableMiningServer(addr string, port string) {
+	n.MiningServer = NewMiningServer(n.Miner, addr, port)
+	n.MiningServer.OnBlockSolution = n.ingestMinedBlock
+}
+
+// Runs a mining pool on the given address and port. Blocks found by the pool's miners are ingested and gossipped the
+// same as blocks mined by the node's own miner.
+func (n *Node) EnablePool(addr string, port string) *Pool {
+	n.Pool = NewPool(n.Dag, n.Miner, addr, port)
+	n.Pool.OnBlockSolution = n.ingestMinedBlock
+	n.Pool.GetBlockBody = n.Builders.GetBestBodyAfter
+	return n.Pool
+}
+
+// Switches the node to light mode, where it syncs block headers only and tracks the given accounts
+// using transaction inclusion proofs from full peers.
+func (n *Node) EnableLightMode(accounts [][65]byte) {
+	n.LightClient = NewLightClient(n.Dag, n.Peer, accounts)
+}
+
+func (n *Node) IsLight() bool {
+	return n.LightClient != nil
+}
+
 func (n *Node) rebuildState() error {
 	longestChainHashList, err := n.Dag.GetLongestChainHashList(n.Dag.FullTip.Hash, n.Dag.FullTip.Height)
 	if err != nil {
@@ -233,22 +394,94 @@ func (n *Node) rebuildState() error {
 		return err
 	}
 
-	state2, err := RebuildState(n.Dag, *n.StateMachine1, longestChainHashList)
+	// Rebuild from an empty state, so that state from a reorg'd branch is rolled back.
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		return err
+	}
+	state2, err := RebuildState(n.Dag, *stateMachine, longestChainHashList)
 	if err != nil {
 		n.stateLog.Printf("Failed to rebuild state: %s\n", err)
 		return err
 	}
 
+	n.stateMutex.Lock()
 	n.StateMachine1 = state2
+	n.stateMutex.Unlock()
 
 	return nil
 }
 
+// Checks a transaction would be valid in the next block on the tip, and applies it to the state.
+func (n *Node) applyMempoolTx(state *StateMachine, tip Block, tx RawTransaction) error {
+	if !n.Dag.consensus.verifyTxSignature(tip.Height+1, tx) {
+		return fmt.Errorf("Transaction %x signature invalid.", tx.Hash())
+	}
+	effects, err := state.Transition(StateMachineInput{
+		RawTransaction:   tx,
+		IsCoinbase:       false,
+		MinerPubkey:      n.Miner.CoinbaseWallet.PubkeyBytes(),
+		BlockReward:      GetBlockReward(int(tip.Height)),
+		BlockHeight:      tip.Height + 1,
+		CoinbaseMaturity: n.Dag.consensus.getCoinbaseMaturity(tip.Height + 1),
+	})
+	if err != nil {
+		return fmt.Errorf("Transaction %x is invalid: %s", tx.Hash(), err)
+	}
+	state.Apply(effects)
+	return nil
+}
+
+// Removes the transactions which were mined in the chain of the new tip from the mempool, along with those which are
+// no longer valid against its state, e.g. because they spend funds already spent.
+func (n *Node) pruneMempool(tip Block) {
+	chain, err := n.Dag.GetLongestChainHashList(tip.Hash, tip.Height+1)
+	if err != nil {
+		n.log.Printf("Failed to prune mempool: %s\n", err)
+		return
+	}
+	inChain := make(map[[32]byte]bool, len(chain))
+	for _, hash := range chain {
+		inChain[hash] = true
+	}
+
+	// Transactions are applied in fee order, so of two conflicting transactions, the one paying more is kept.
+	state := n.GetState().Copy()
+	removed := n.Mempool.Prune(func(tx RawTransaction) bool {
+		blocks, err := n.Dag.GetTransactionBlocks(tx.Hash())
+		if err != nil {
+			return false
+		}
+		for _, block := range blocks {
+			if inChain[block] {
+				return false
+			}
+		}
+		return n.applyMempoolTx(state, tip, tx) == nil
+	})
+	if 0 < removed {
+		n.log.Printf("Pruned mempool: removed=%d\n", removed)
+	}
+}
+
+// Gets the state at the full tip. The state is replaced when the tip changes, and must not be modified.
+func (n *Node) GetState() *StateMachine {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+	return n.StateMachine1
+}
+
 func (n *Node) Start() {
 	done := make(chan bool)
 
 	go n.Peer.Start()
 	go n.syncRoutine()
+	if n.MiningServer != nil {
+		go n.MiningServer.Start()
+	}
+	if n.Pool != nil {
+		go n.Pool.Start()
+	}
 
 	<-done
 }
@@ -258,17 +491,38 @@ func (n *Node) syncRoutine() {
 		n.log.Println("Syncing...")
 		downloaded := n.Sync()
 		n.log.Printf("Sync complete downloaded=%d\n", downloaded)
+
+		if n.IsLight() {
+			verified := n.LightClient.Sync()
+			n.log.Printf("Light client sync complete verified_txs=%d\n", verified)
+			for _, account := range n.LightClient.accounts {
+				balance, err := n.LightClient.GetBalance(account)
+				if err != nil {
+					n.log.Printf("Failed to get balance account=%x: %s\n", account, err)
+					continue
+				}
+				n.log.Printf("Balance account=%x balance=%d\n", account, balance)
+			}
+		}
 		time.Sleep(5 * time.Second)
 	}
 }
 
 func (n *Node) Shutdown() {
-	// Save peers to cache.
-	peers := n.Peer.GetPeers()
-	networkStore := NetworkStore{
-		PeerCache: peers,
+	// Stop the miner.
+	n.Miner.Stop()
+	if n.MiningServer != nil {
+		n.MiningServer.Stop()
 	}
-	SaveDataStore(n.Dag.db, "network", networkStore)
+	if n.Pool != nil {
+		n.Pool.Stop()
+	}
+
+	// Save peers and bans.
+	n.saveNetworkStore()
+
+	// Close connections to peers.
+	n.Peer.CloseConnections()
 
 	// Close the database.
 	err := n.Dag.db.Close()
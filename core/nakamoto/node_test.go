@@ -48,6 +48,113 @@ func TestNewNode(t *testing.T) {
 	<-ch
 }
 
+func TestNodeAddsNewTransactionsToMempool(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestSimulation(t, 1, 0).Nodes[0]
+	assert.Equal(DefaultMempoolFeeThreshold, node.Miner.MempoolFeeThreshold)
+
+	// Mine a block to fund the miner's wallet.
+	node.mineBlock()
+	wallet := node.Miner.CoinbaseWallet
+	wallets := getTestingWallets(t)
+	newTx := func(amount uint64) RawTransaction {
+		return MakeTransferTx(wallet.PubkeyBytes(), wallets[1].PubkeyBytes(), amount, 5, 0, wallet)
+	}
+
+	// A new transaction raises the mempool's fees, so the miner rebuilds its puzzle to include it.
+	node.Miner.stale = false
+	node.Peer.OnNewTransaction(newTx(1))
+	assert.Equal(5.0, node.Mempool.GetFeeStatistics().MeanFee)
+	assert.True(node.Miner.stale)
+
+	// The rebuilt puzzle records the fees.
+	node.Miner.stale = false
+	node.Miner.MakeNewPuzzle()
+	assert.Equal(5.0, node.Miner.puzzleFees.MeanFee)
+
+	// A transaction which doesn't raise the fees enough doesn't.
+	node.Peer.OnNewTransaction(newTx(2))
+	assert.False(node.Miner.stale)
+	assert.Len(node.Mempool.GetTxs(), 2)
+}
+
+func TestNodeRejectsInvalidTransactions(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestSimulation(t, 1, 0).Nodes[0]
+	node.mineBlock()
+	wallet := node.Miner.CoinbaseWallet
+	wallets := getTestingWallets(t)
+
+	// Unsigned.
+	node.Peer.OnNewTransaction(RawTransaction{Fee: 5})
+	// Signed by the wrong key.
+	node.Peer.OnNewTransaction(MakeTransferTx(wallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 1, 5, 0, &wallets[0]))
+	// Unfunded.
+	node.Peer.OnNewTransaction(MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 1, 5, 0, &wallets[0]))
+	assert.Empty(node.Mempool.GetTxs())
+
+	// A duplicate is only added once.
+	tx := MakeTransferTx(wallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 1, 5, 0, wallet)
+	node.Peer.OnNewTransaction(tx)
+	node.Peer.OnNewTransaction(tx)
+	assert.Equal([]RawTransaction{tx}, node.Mempool.GetTxs())
+}
+
+func TestNodePrunesMempoolOnNewTip(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestSimulation(t, 1, 0).Nodes[0]
+	node.mineBlock()
+	wallet := node.Miner.CoinbaseWallet
+	wallets := getTestingWallets(t)
+	balance := node.GetState().GetBalance(wallet.PubkeyBytes())
+
+	// Two transfers, which can't both be paid for.
+	tx1 := MakeTransferTx(wallet.PubkeyBytes(), wallets[1].PubkeyBytes(), balance-10, 5, 0, wallet)
+	tx2 := MakeTransferTx(wallet.PubkeyBytes(), wallets[1].PubkeyBytes(), balance-10, 5, 1, wallet)
+	node.Peer.OnNewTransaction(tx1)
+	node.Peer.OnNewTransaction(tx2)
+	assert.Len(node.Mempool.GetTxs(), 2)
+
+	// Once tx1 is mined, it is pruned, and so is tx2, which is no longer funded.
+	node.Miner.CoinbaseWallet = &wallets[0]
+	node.Miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{tx1}
+	}
+	node.mineBlock()
+	assert.Equal(uint64(2), node.Dag.FullTip.Height)
+	assert.Empty(node.Mempool.GetTxs())
+}
+
+func TestNodeMinesTransactionsFromPeers(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 1, 0, 0)
+	node1, node2 := sim.Nodes[0], sim.Nodes[1]
+
+	// Node 1 mines a block, funding its coinbase wallet.
+	node1.mineBlock()
+	sim.Run(1_000)
+
+	// Node 2 gossips a transfer from it.
+	wallets := getTestingWallets(t)
+	minerWallet := node1.Miner.CoinbaseWallet
+	tx := MakeTransferTx(minerWallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 5, 0, minerWallet)
+	_, err := CallPeer[NewTransactionMessage, struct{}](node2.Peer, Peer{Addr: node1.Addr}, NewTransactionMessage{Type: "new_tx", RawTransaction: tx})
+	assert.Nil(err)
+	sim.Run(1_000)
+
+	// Node 1's next block includes it.
+	node1.mineBlock()
+	sim.Run(1_000)
+	txs, err := node1.Dag.GetBlockTransactions(node1.Dag.FullTip.Hash)
+	assert.Nil(err)
+	hashes := [][32]byte{}
+	for _, blockTx := range *txs {
+		hashes = append(hashes, blockTx.Hash)
+	}
+	assert.Contains(hashes, tx.Hash())
+	assert.Equal(uint64(100), node1.GetState().GetBalance(wallets[1].PubkeyBytes()))
+}
+
 func TestTwoNodesGossipBlocks(t *testing.T) {
 	assert := assert.New(t)
 
@@ -89,7 +196,7 @@ func TestTwoNodesGossipBlocks(t *testing.T) {
 	case msg := <-newBlockChan:
 		assert.Equal("new_block", msg.Type)
 		// Print block hash.
-		t.Logf("New block hash: %s", msg.RawBlock.HashStr())
+		t.Logf("New block hash: %s", msg.RawBlock.HashStr(testHasher))
 	case <-time.After(8 * time.Second):
 		t.Error("Timed out.")
 	}
@@ -327,3 +434,67 @@ func uint64To32ByteArray(num uint64) [32]byte {
 	binary.BigEndian.PutUint64(arr[24:], num) // Store the uint64 in the last 8 bytes of the array
 	return arr
 }
+
+func TestNodeGetTxProof(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 1, 0, 0)
+	node1, node2 := sim.Nodes[0], sim.Nodes[1]
+
+	// Node 1 mines a block with a transfer, spending from the coinbase in the same block.
+	wallets := getTestingWallets(t)
+	minerWallet := node1.Miner.CoinbaseWallet
+	tx := MakeTransferTx(minerWallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 0, 0, minerWallet)
+	node1.Miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{tx}
+	}
+	node1.mineBlock()
+	sim.Run(1_000)
+	assert.Equal(uint64(1), node1.Dag.FullTip.Height)
+
+	// Node 2 requests the proof from node 1.
+	peer1 := Peer{Addr: node1.Addr}
+	txProof, err := node2.Peer.GetTxProof(peer1, tx.Hash())
+	assert.Nil(err)
+	assert.Equal(tx.Hash(), txProof.Tx.Hash())
+	assert.Equal(node1.Dag.FullTip.Hash, txProof.BlockHeader.BlockHash(node1.Dag.hasher))
+	assert.True(node2.Dag.consensus.verifyTxProof(node2.Dag.hasher, 1, txProof))
+}
+
+func TestNodeLightClientSync(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 1, 0, 0)
+	node1, node2 := sim.Nodes[0], sim.Nodes[1]
+
+	// Node 2 is a light node tracking wallet 1.
+	wallets := getTestingWallets(t)
+	node2.EnableLightMode([][65]byte{wallets[1].PubkeyBytes()})
+
+	// Node 1 mines a block with two transfers to wallet 1, then two empty blocks.
+	minerWallet := node1.Miner.CoinbaseWallet
+	node1.Miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{
+			MakeTransferTx(minerWallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 0, 0, minerWallet),
+			MakeTransferTx(minerWallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 200, 0, 1, minerWallet),
+		}
+	}
+	node1.mineBlock()
+	sim.Run(1_000)
+	node1.Miner.GetBlockBody = nil
+	node1.mineBlock()
+	node1.mineBlock()
+	sim.Run(1_000)
+
+	// Node 2 syncs the headers, without the bodies.
+	node2.Sync()
+	assert.Equal(node1.Dag.HeadersTip.Hash, node2.Dag.HeadersTip.Hash)
+	assert.Equal(uint64(0), node2.Dag.FullTip.Height)
+
+	// Node 2 verifies its transactions from node 1, a page at a time.
+	node1.Peer.MaxAccountTxProofs = 1
+	node2.Peer.MaxAccountTxProofs = 1
+	verified := node2.LightClient.Sync()
+	assert.Equal(2, verified)
+	balance, err := node2.LightClient.GetBalance(wallets[1].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(uint64(300), balance)
+}
@@ -0,0 +1,736 @@
+package nakamoto
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The pool issues shares at a lower difficulty than the network, so small miners are paid regularly for their work,
+// rather than waiting for the rare occasion they find a block.
+//
+// Miners request a block template from http://<host>:<port>/poolapi/getwork, which pays the coinbase to the pool's
+// wallet, and submit solutions to the easier share target to http://<host>:<port>/poolapi/submitshare. When a share
+// also solves the network target, the pool has found a block, and its reward is split between the miners of the last
+// N shares, weighted by their work (PPLNS, "pay per last N shares"). Once the block's coinbase has matured, the
+// miners' credits are paid out with regular transfer transactions, which the pool includes in the blocks it mines.
+//
+// Per-miner statistics are served at http://<host>:<port>/poolapi/stats.
+type Pool struct {
+	dag    *BlockDAG
+	miner  *Miner
+	log    *log.Logger
+	server *http.Server
+
+	// The share target is the network target multiplied by this factor. A share takes this many times less work to
+	// find than a block.
+	ShareTargetMultiplier int64
+
+	// The number of recent shares a block reward is split over (the N in PPLNS).
+	PPLNSWindow int
+
+	// The minimum matured credit a miner must have before they are paid out.
+	MinPayout uint64
+
+	// OnBlockSolution is called when a share solves the network target.
+	OnBlockSolution func(block RawBlock) error
+
+	// GetBlockBody builds the body of the pool's blocks following the payouts, and must check the body is valid after
+	// them. By default, the payouts are followed by the miner's block body.
+	GetBlockBody func(payouts BlockBody) (BlockBody, error)
+
+	templates *workTemplates[*poolTemplate]
+
+	// The last PPLNSWindow shares.
+	shares []PoolShare
+
+	// Blocks found by the pool whose rewards have not matured.
+	blocks []poolBlock
+
+	// Stats for each miner.
+	miners map[[65]byte]*PoolMinerStats
+
+	// The nonce of the next payout transaction. Each payout has a unique nonce, so that paying a miner the same amount
+	// twice creates two distinct transactions.
+	payoutNonce uint64
+
+	// The owed credits paid out by outstanding block templates, which are not paid out again by other templates. A
+	// reservation is released when its template is evicted or goes stale, and spent when its template is solved.
+	reserved map[[65]byte]uint64
+
+	mutex sync.Mutex
+}
+
+// A share is a solution to the pool's share target. Shares prove a miner's contribution of work to the pool.
+type PoolShare struct {
+	Miner     [65]byte `json:"miner"`
+	Work      big.Int  `json:"work"`
+	Timestamp uint64   `json:"timestamp"`
+}
+
+type PoolMinerStats struct {
+	Miner         string  `json:"miner"`
+	Shares        uint64  `json:"shares"`
+	InvalidShares uint64  `json:"invalidShares"`
+	BlocksFound   uint64  `json:"blocksFound"`
+	LastShareTime uint64  `json:"lastShareTime"`
+	Hashrate      float64 `json:"hashrate"`
+
+	// Credits from blocks whose coinbase has not yet matured.
+	Immature uint64 `json:"immature"`
+	// Matured credits which have not yet been paid out.
+	Owed uint64 `json:"owed"`
+	// Credits paid out.
+	Paid uint64 `json:"paid"`
+}
+
+type poolTemplate struct {
+	puzzle      POWPuzzle
+	shareTarget big.Int
+
+	// The payouts included in the template's block.
+	payouts map[[65]byte]uint64
+
+	// The hashes of the shares submitted for the template, to reject duplicates.
+	shares map[[32]byte]bool
+}
+
+type poolBlock struct {
+	hash    [32]byte
+	height  uint64
+	credits map[[65]byte]uint64
+	payouts map[[65]byte]uint64
+}
+
+// A block found by the pool, as persisted in the PoolStore. Miners are keyed by their hex-encoded account.
+type PoolBlockRecord struct {
+	Hash    [32]byte          `json:"hash"`
+	Height  uint64            `json:"height"`
+	Credits map[string]uint64 `json:"credits"`
+	Payouts map[string]uint64 `json:"payouts"`
+}
+
+// The period over which a miner's hashrate is estimated from their shares.
+const poolHashrateWindowMillis = 5 * 60 * 1000
+
+// Creates a new pool, which builds block templates using the miner, paying the coinbase to the miner's wallet.
+// The pool's accounting is loaded from, and saved to, the block DAG's database.
+func NewPool(dag *BlockDAG, miner *Miner, addr string, port string) *Pool {
+	p := &Pool{
+		dag:                   dag,
+		miner:                 miner,
+		log:                   NewLogger("pool", fmt.Sprintf(":%s", port)),
+		ShareTargetMultiplier: 1024,
+		PPLNSWindow:           1000,
+		MinPayout:             1,
+		templates:             newWorkTemplates[*poolTemplate](MiningServerMaxTemplates),
+		shares:                []PoolShare{},
+		blocks:                []poolBlock{},
+		miners:                make(map[[65]byte]*PoolMinerStats),
+		reserved:              make(map[[65]byte]uint64),
+	}
+
+	err := p.load()
+	if err != nil {
+		p.log.Printf("Failed to load pool store: %s\n", err)
+	}
+
+	p.GetBlockBody = func(payouts BlockBody) (BlockBody, error) {
+		body := slices.Clone(payouts)
+		if miner.GetBlockBody != nil {
+			body = append(body, miner.GetBlockBody()...)
+		}
+		return body, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/poolapi/getwork", http.HandlerFunc(p.getWorkHandler))
+	mux.Handle("/poolapi/submitshare", http.HandlerFunc(p.submitShareHandler))
+	mux.Handle("/poolapi/stats", http.HandlerFunc(p.statsHandler))
+
+	p.server = &http.Server{
+		Addr:         addr + ":" + port,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	return p
+}
+
+func (p *Pool) Start() error {
+	p.log.Printf("Pool server listening on http://%s\n", p.server.Addr)
+	if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		p.log.Println("Error starting server:", err)
+		return err
+	}
+	return nil
+}
+
+func (p *Pool) Stop() {
+	p.log.Println("Stopping pool server")
+	p.server.Shutdown(context.Background())
+}
+
+// Gets the share target for a network target.
+func (p *Pool) getShareTarget(target big.Int) big.Int {
+	maxTarget := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	shareTarget := new(big.Int).Mul(&target, big.NewInt(p.ShareTargetMultiplier))
+	if shareTarget.Cmp(maxTarget) == 1 {
+		return *maxTarget
+	}
+	return *shareTarget
+}
+
+// Creates a new block template, with the network target and the easier share target. The template pays out the
+// miners' owed credits which are not already paid out by another template.
+func (p *Pool) GetWork() GetWorkReply {
+	p.mutex.Lock()
+	payoutTxs, payouts := p.reservePayouts()
+	p.mutex.Unlock()
+
+	// If the payouts can't be included, the block is built without them.
+	included := true
+	puzzle := p.miner.MakeNewPuzzleWithBody(func() BlockBody {
+		body, err := p.GetBlockBody(payoutTxs)
+		if err != nil {
+			p.log.Printf("Failed to build block body with payouts: %s\n", err)
+			included = false
+			body, _ = p.GetBlockBody(BlockBody{})
+		}
+		return body
+	})
+	header := puzzle.block.ToBlockHeader()
+	workId := getWorkId(p.dag.hasher, header)
+
+	p.mutex.Lock()
+	if !included {
+		p.releasePayouts(payouts)
+		payouts = make(map[[65]byte]uint64)
+	}
+	template := &poolTemplate{
+		puzzle:      puzzle,
+		shareTarget: p.getShareTarget(puzzle.target),
+		payouts:     payouts,
+		shares:      make(map[[32]byte]bool),
+	}
+	if evicted, ok := p.templates.add(workId, template); ok {
+		p.releasePayouts(evicted.payouts)
+	}
+	p.mutex.Unlock()
+
+	p.log.Printf("Issued work: id=%s parent=%s\n", workId, Bytes32ToString(header.ParentHash))
+
+	return GetWorkReply{
+		Type:        "getwork_reply",
+		WorkId:      workId,
+		Header:      header,
+		Target:      Bytes32ToHexString(BigIntToBytes32(puzzle.target)),
+		ShareTarget: Bytes32ToHexString(BigIntToBytes32(template.shareTarget)),
+	}
+}
+
+// Verifies and records a share from a miner. Returns the hash of the share, and whether it solved a block.
+func (p *Pool) SubmitShare(workId string, nonce [32]byte, miner [65]byte) ([32]byte, bool, error) {
+	template, ok := p.templates.get(workId)
+	if !ok {
+		p.recordInvalidShare(miner)
+		return [32]byte{}, false, fmt.Errorf("Unknown or expired work: %s", workId)
+	}
+
+	block := *template.puzzle.block
+	block.Nonce = nonce
+	hash := block.Hash(p.dag.hasher)
+	if !VerifyPOW(hash, template.shareTarget) {
+		p.recordInvalidShare(miner)
+		return hash, false, fmt.Errorf("Nonce does not solve the share target: work=%s", workId)
+	}
+
+	p.mutex.Lock()
+	if template.shares[hash] {
+		p.mutex.Unlock()
+		p.recordInvalidShare(miner)
+		return hash, false, fmt.Errorf("Duplicate share: %x", hash)
+	}
+	template.shares[hash] = true
+
+	// Record the share.
+	share := PoolShare{
+		Miner:     miner,
+		Work:      *CalculateWork(template.shareTarget),
+		Timestamp: Timestamp(),
+	}
+	p.shares = append(p.shares, share)
+	if p.PPLNSWindow < len(p.shares) {
+		p.shares = p.shares[len(p.shares)-p.PPLNSWindow:]
+	}
+	stats := p.getMinerStats(miner)
+	stats.Shares++
+	stats.LastShareTime = share.Timestamp
+
+	// Check if the share solves a block. Each template can only be solved once.
+	isBlock := VerifyPOW(hash, template.puzzle.target) && p.templates.remove(workId)
+	if isBlock {
+		err := p.creditBlock(block, template, miner)
+		if err != nil {
+			p.mutex.Unlock()
+			return hash, false, err
+		}
+
+		// The other templates on this parent are now stale, so their payouts can be paid by later templates.
+		stale := p.templates.removeFunc(func(t *poolTemplate) bool {
+			return t.puzzle.block.ParentHash == block.ParentHash
+		})
+		for _, t := range stale {
+			p.releasePayouts(t.payouts)
+		}
+	}
+	p.save()
+	p.mutex.Unlock()
+
+	if isBlock {
+		p.log.Printf("Block found: block=%x miner=%x\n", hash, miner)
+		if p.OnBlockSolution != nil {
+			err := p.OnBlockSolution(block)
+			if err != nil {
+				return hash, true, fmt.Errorf("Block not accepted: %s", err)
+			}
+		}
+	}
+
+	return hash, isBlock, nil
+}
+
+// Splits the reward of a block found by the pool between the miners of the last N shares, weighted by their work.
+// Any remainder from rounding goes to the miner who found the block.
+func (p *Pool) creditBlock(block RawBlock, template *poolTemplate, finder [65]byte) error {
+	parent, err := p.dag.GetBlockByHash(block.ParentHash)
+	if err != nil {
+		return err
+	}
+
+	reward := new(big.Int).SetUint64(block.Transactions[0].Amount)
+	totalWork := big.NewInt(0)
+	for _, share := range p.shares {
+		totalWork.Add(totalWork, &share.Work)
+	}
+
+	credits := make(map[[65]byte]uint64)
+	credited := uint64(0)
+	for _, share := range p.shares {
+		credit := new(big.Int).Mul(reward, &share.Work)
+		credit.Div(credit, totalWork)
+		credits[share.Miner] += credit.Uint64()
+		credited += credit.Uint64()
+	}
+	credits[finder] += reward.Uint64() - credited
+
+	for miner, credit := range credits {
+		p.getMinerStats(miner).Immature += credit
+	}
+	p.getMinerStats(finder).BlocksFound++
+
+	// The block pays out the miners' owed credits, which were reserved for it.
+	p.releasePayouts(template.payouts)
+	for miner, amount := range template.payouts {
+		stats := p.getMinerStats(miner)
+		stats.Owed -= amount
+		stats.Paid += amount
+	}
+
+	p.blocks = append(p.blocks, poolBlock{
+		hash:    block.Hash(p.dag.hasher),
+		height:  parent.Height + 1,
+		credits: credits,
+		payouts: template.payouts,
+	})
+	return nil
+}
+
+// Moves the credits of blocks whose coinbase has matured to the miners' owed balances. If a block was orphaned, its
+// credits are dropped, and the payouts it included are owed again. Returns true if any block matured.
+func (p *Pool) processMaturedBlocks() bool {
+	tip := p.dag.FullTip
+	pending := []poolBlock{}
+	for _, b := range p.blocks {
+		if tip.Height < b.height+p.dag.consensus.getCoinbaseMaturity(b.height) {
+			pending = append(pending, b)
+			continue
+		}
+
+		// A block which is missing from the DAG failed to ingest, and is treated as orphaned.
+		inChain := false
+		block, err := p.dag.GetBlockByHash(b.hash)
+		if err == ErrBlockNotFound {
+			err = nil
+		} else if err == nil {
+			inChain, err = p.dag.isInChain(tip, block)
+		}
+		if err != nil {
+			p.log.Printf("Failed to check block is in chain: block=%x err=%s\n", b.hash, err)
+			pending = append(pending, b)
+			continue
+		}
+
+		for miner, credit := range b.credits {
+			stats := p.getMinerStats(miner)
+			stats.Immature -= credit
+			if inChain {
+				stats.Owed += credit
+			}
+		}
+		if !inChain {
+			p.log.Printf("Block orphaned: block=%x\n", b.hash)
+			for miner, amount := range b.payouts {
+				stats := p.getMinerStats(miner)
+				stats.Owed += amount
+				stats.Paid -= amount
+			}
+		}
+	}
+	matured := len(pending) != len(p.blocks)
+	p.blocks = pending
+	return matured
+}
+
+// Creates the transfers paying out the miners' owed credits which are not reserved by another template, for
+// inclusion in a new template, and reserves them. Returns the transfers, and the amount paid to each miner. Must be
+// called with the mutex held.
+func (p *Pool) reservePayouts() (BlockBody, map[[65]byte]uint64) {
+	matured := p.processMaturedBlocks()
+
+	wallet := p.miner.CoinbaseWallet
+	txs := BlockBody{}
+	payouts := make(map[[65]byte]uint64)
+	for _, miner := range p.getMinerKeys() {
+		stats := p.miners[miner]
+		if stats.Owed <= p.reserved[miner] {
+			continue
+		}
+		amount := stats.Owed - p.reserved[miner]
+		if amount < p.MinPayout {
+			continue
+		}
+		tx := MakeTransferTx(wallet.PubkeyBytes(), miner, amount, 0, p.payoutNonce, wallet)
+		p.payoutNonce++
+		p.reserved[miner] += amount
+		payouts[miner] = amount
+		txs = append(txs, tx)
+	}
+
+	if matured || 0 < len(txs) {
+		p.save()
+	}
+	return txs, payouts
+}
+
+// Releases the credits reserved for a template's payouts. Must be called with the mutex held.
+func (p *Pool) releasePayouts(payouts map[[65]byte]uint64) {
+	for miner, amount := range payouts {
+		p.reserved[miner] -= min(amount, p.reserved[miner])
+		if p.reserved[miner] == 0 {
+			delete(p.reserved, miner)
+		}
+	}
+}
+
+// Saves the pool's accounting to the database, so miners' balances survive a restart. Must be called with the mutex
+// held.
+func (p *Pool) save() {
+	store := PoolStore{
+		Shares:      p.shares,
+		Blocks:      []PoolBlockRecord{},
+		Miners:      []PoolMinerStats{},
+		PayoutNonce: p.payoutNonce,
+	}
+	for _, b := range p.blocks {
+		store.Blocks = append(store.Blocks, PoolBlockRecord{
+			Hash:    b.hash,
+			Height:  b.height,
+			Credits: encodePoolAmounts(b.credits),
+			Payouts: encodePoolAmounts(b.payouts),
+		})
+	}
+	for _, miner := range p.getMinerKeys() {
+		store.Miners = append(store.Miners, *p.miners[miner])
+	}
+
+	err := SaveDataStore(p.dag.db, "pool", store)
+	if err != nil {
+		p.log.Printf("Failed to save pool store: %s\n", err)
+	}
+}
+
+// Loads the pool's accounting from the database.
+func (p *Pool) load() error {
+	store, err := LoadDataStore[PoolStore](p.dag.db, "pool")
+	if err != nil {
+		return err
+	}
+
+	blocks := []poolBlock{}
+	for _, record := range store.Blocks {
+		credits, err := decodePoolAmounts(record.Credits)
+		if err != nil {
+			return err
+		}
+		payouts, err := decodePoolAmounts(record.Payouts)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, poolBlock{
+			hash:    record.Hash,
+			height:  record.Height,
+			credits: credits,
+			payouts: payouts,
+		})
+	}
+	miners := make(map[[65]byte]*PoolMinerStats)
+	for _, stats := range store.Miners {
+		miner, err := decodePoolMiner(stats.Miner)
+		if err != nil {
+			return err
+		}
+		miners[miner] = &stats
+	}
+
+	if store.Shares != nil {
+		p.shares = store.Shares
+	}
+	p.blocks = blocks
+	p.miners = miners
+	p.payoutNonce = store.PayoutNonce
+	return nil
+}
+
+func encodePoolAmounts(amounts map[[65]byte]uint64) map[string]uint64 {
+	encoded := make(map[string]uint64)
+	for miner, amount := range amounts {
+		encoded[hex.EncodeToString(miner[:])] = amount
+	}
+	return encoded
+}
+
+func decodePoolAmounts(encoded map[string]uint64) (map[[65]byte]uint64, error) {
+	amounts := make(map[[65]byte]uint64)
+	for minerStr, amount := range encoded {
+		miner, err := decodePoolMiner(minerStr)
+		if err != nil {
+			return nil, err
+		}
+		amounts[miner] = amount
+	}
+	return amounts, nil
+}
+
+func decodePoolMiner(minerStr string) ([65]byte, error) {
+	miner := [65]byte{}
+	minerBuf, err := hex.DecodeString(minerStr)
+	if err != nil || len(minerBuf) != 65 {
+		return miner, fmt.Errorf("Invalid miner: %s", minerStr)
+	}
+	copy(miner[:], minerBuf)
+	return miner, nil
+}
+
+// Gets the stats for all miners, sorted by their account.
+func (p *Pool) GetStats() []PoolMinerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Estimate each miner's hashrate from the work of their recent shares.
+	now := Timestamp()
+	recentWork := make(map[[65]byte]*big.Int)
+	for _, share := range p.shares {
+		if now-share.Timestamp < poolHashrateWindowMillis {
+			if _, ok := recentWork[share.Miner]; !ok {
+				recentWork[share.Miner] = big.NewInt(0)
+			}
+			recentWork[share.Miner].Add(recentWork[share.Miner], &share.Work)
+		}
+	}
+
+	stats := []PoolMinerStats{}
+	for _, miner := range p.getMinerKeys() {
+		minerStats := *p.miners[miner]
+		if work, ok := recentWork[miner]; ok {
+			hashes, _ := new(big.Float).SetInt(work).Float64()
+			minerStats.Hashrate = hashes / (poolHashrateWindowMillis / 1000)
+		}
+		stats = append(stats, minerStats)
+	}
+	return stats
+}
+
+func (p *Pool) getMinerStats(miner [65]byte) *PoolMinerStats {
+	stats, ok := p.miners[miner]
+	if !ok {
+		stats = &PoolMinerStats{Miner: hex.EncodeToString(miner[:])}
+		p.miners[miner] = stats
+	}
+	return stats
+}
+
+func (p *Pool) getMinerKeys() [][65]byte {
+	keys := [][65]byte{}
+	for miner := range p.miners {
+		keys = append(keys, miner)
+	}
+	slices.SortFunc(keys, func(a, b [65]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return keys
+}
+
+func (p *Pool) recordInvalidShare(miner [65]byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.getMinerStats(miner).InvalidShares++
+}
+
+// Handler for /poolapi/getwork
+func (p *Pool) getWorkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.GetWork())
+}
+
+// Handler for /poolapi/submitshare
+func (p *Pool) submitShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var msg SubmitShareMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+
+	minerBuf, err := hex.DecodeString(msg.Miner)
+	if err != nil || len(minerBuf) != 65 {
+		http.Error(w, fmt.Sprintf("Invalid miner: %s", msg.Miner), http.StatusBadRequest)
+		return
+	}
+	miner := [65]byte{}
+	copy(miner[:], minerBuf)
+
+	nonceBuf, err := hex.DecodeString(msg.Nonce)
+	if err != nil || len(nonceBuf) != 32 {
+		http.Error(w, fmt.Sprintf("Invalid nonce: %s", msg.Nonce), http.StatusBadRequest)
+		return
+	}
+	nonce := [32]byte{}
+	copy(nonce[:], nonceBuf)
+
+	hash, isBlock, err := p.SubmitShare(msg.WorkId, nonce, miner)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to submit share: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SubmitShareReply{
+		Type:      "submitshare_reply",
+		ShareHash: Bytes32ToHexString(hash),
+		IsBlock:   isBlock,
+	})
+}
+
+// Handler for /poolapi/stats
+func (p *Pool) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PoolStatsReply{
+		Type:   "pool_stats_reply",
+		Miners: p.GetStats(),
+	})
+}
+
+// PoolClient is a client for the pool server, used by miners.
+type PoolClient struct {
+	url string
+	log *log.Logger
+}
+
+func NewPoolClient(url string) *PoolClient {
+	return &PoolClient{
+		url: url,
+		log: NewLogger("pool-client", ""),
+	}
+}
+
+// Requests a block template to mine on. Returns the work ID, the block header, the network target, and the share
+// target.
+func (c *PoolClient) GetWork() (string, BlockHeader, big.Int, big.Int, error) {
+	res, err := c.send("getwork", GetWorkMessage{Type: "getwork"})
+	if err != nil {
+		return "", BlockHeader{}, big.Int{}, big.Int{}, err
+	}
+
+	var reply GetWorkReply
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return "", BlockHeader{}, big.Int{}, big.Int{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	target := Bytes32ToBigInt(HexStringToBytes32(reply.Target))
+	shareTarget := Bytes32ToBigInt(HexStringToBytes32(reply.ShareTarget))
+	return reply.WorkId, reply.Header, target, shareTarget, nil
+}
+
+// Submits a share, credited to the miner's account. Returns whether the share solved a block.
+func (c *PoolClient) SubmitShare(workId string, nonce [32]byte, miner [65]byte) (bool, error) {
+	res, err := c.send("submitshare", SubmitShareMessage{
+		Type:   "submitshare",
+		WorkId: workId,
+		Nonce:  Bytes32ToHexString(nonce),
+		Miner:  hex.EncodeToString(miner[:]),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	var reply SubmitShareReply
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return false, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	return reply.IsBlock, nil
+}
+
+// Gets the stats for all of the pool's miners.
+func (c *PoolClient) GetStats() ([]PoolMinerStats, error) {
+	res, err := c.send("stats", NetworkMessage{Type: "pool_stats"})
+	if err != nil {
+		return nil, err
+	}
+
+	var reply PoolStatsReply
+	if err := json.Unmarshal(res, &reply); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	return reply.Miners, nil
+}
+
+func (c *PoolClient) send(method string, message any) ([]byte, error) {
+	return sendJSON(fmt.Sprintf("%s/poolapi/%s", c.url, method), message, c.log)
+}
@@ -0,0 +1,333 @@
+package nakamoto
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPoolForTest(t *testing.T) (*Pool, *BlockDAG) {
+	miner, dag := newMinerForTest(t)
+
+	pool := NewPool(dag, miner, "127.0.0.1", getRandomPort())
+	pool.ShareTargetMultiplier = 4
+	pool.OnBlockSolution = func(block RawBlock) error {
+		return dag.IngestBlock(block)
+	}
+	return pool, dag
+}
+
+func newPoolMinerAccount(t *testing.T) [65]byte {
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	return wallet.PubkeyBytes()
+}
+
+func TestPoolSharesAndPayouts(t *testing.T) {
+	assert := assert.New(t)
+	pool, dag := newPoolForTest(t)
+	port := pool.server.Addr[len("127.0.0.1:"):]
+	go pool.Start()
+	t.Cleanup(pool.Stop)
+	time.Sleep(100 * time.Millisecond)
+	client := NewPoolClient(fmt.Sprintf("http://127.0.0.1:%s", port))
+
+	minerA := newPoolMinerAccount(t)
+	minerB := newPoolMinerAccount(t)
+
+	// Miner B submits a share which doesn't solve the block.
+	for {
+		workId, header, target, shareTarget, err := client.GetWork()
+		assert.Nil(err)
+		nonce, hash := solveHeaderForTest(header, shareTarget)
+		if VerifyPOW(hash, target) {
+			continue
+		}
+		_, err = client.SubmitShare(workId, nonce, minerB)
+		assert.Nil(err)
+		break
+	}
+
+	// Both miners submit shares until one of them finds a block.
+	found := false
+	for i := 0; !found; i++ {
+		miner := minerA
+		if i%2 == 1 {
+			miner = minerB
+		}
+
+		workId, header, target, shareTarget, err := client.GetWork()
+		assert.Nil(err)
+		assert.Equal(1, new(big.Int).Mul(&target, big.NewInt(4)).Cmp(new(big.Int).Sub(&shareTarget, big.NewInt(1))))
+
+		nonce, _ := solveHeaderForTest(header, shareTarget)
+		found, err = client.SubmitShare(workId, nonce, miner)
+		assert.Nil(err)
+	}
+	assert.Equal(uint64(1), dag.FullTip.Height)
+
+	// The block reward is split between the miners.
+	stats, err := client.GetStats()
+	assert.Nil(err)
+	assert.Equal(2, len(stats))
+	reward := GetBlockReward(0)
+	totalCredited := uint64(0)
+	for _, minerStats := range stats {
+		assert.Less(uint64(0), minerStats.Shares)
+		assert.Less(uint64(0), minerStats.Immature)
+		assert.Less(0.0, minerStats.Hashrate)
+		totalCredited += minerStats.Immature
+	}
+	assert.Equal(reward, totalCredited)
+	assert.Equal(uint64(1), stats[0].BlocksFound+stats[1].BlocksFound)
+
+	// Coinbase maturity is disabled, so the next template pays the miners out.
+	work := pool.GetWork()
+	template, _ := pool.templates.get(work.WorkId)
+	payouts := template.puzzle.block.Transactions[1:]
+	assert.Equal(2, len(payouts))
+	for _, tx := range payouts {
+		assert.Equal(pool.miner.CoinbaseWallet.PubkeyBytes(), tx.FromPubkey)
+	}
+	assert.Equal(reward, payouts[0].Amount+payouts[1].Amount)
+
+	// Mine the payout block.
+	for {
+		nonce, hash := solveHeaderForTest(work.Header, template.shareTarget)
+		_, isBlock, err := pool.SubmitShare(work.WorkId, nonce, minerA)
+		assert.Nil(err)
+		if isBlock {
+			assert.Equal(hash, dag.FullTip.Hash)
+			break
+		}
+	}
+	for _, minerStats := range pool.GetStats() {
+		assert.Equal(uint64(0), minerStats.Owed)
+		assert.Less(uint64(0), minerStats.Paid)
+	}
+}
+
+func TestPoolRejectsInvalidShares(t *testing.T) {
+	assert := assert.New(t)
+	pool, _ := newPoolForTest(t)
+	miner := newPoolMinerAccount(t)
+
+	// Unknown work.
+	_, _, err := pool.SubmitShare("abcd", [32]byte{}, miner)
+	assert.ErrorContains(err, "Unknown or expired work")
+
+	// A nonce that doesn't meet the share target.
+	work := pool.GetWork()
+	template, _ := pool.templates.get(work.WorkId)
+	maxTarget := new(big.Int).Lsh(big.NewInt(1), 256)
+	badNonce, _ := solveHeaderForTest(work.Header, *maxTarget)
+	header := work.Header
+	for {
+		header.Nonce = badNonce
+		h := header.BlockHash(testHasher)
+		if !VerifyPOW(h, template.shareTarget) {
+			break
+		}
+		incrementNonce(&badNonce)
+	}
+	_, _, err = pool.SubmitShare(work.WorkId, badNonce, miner)
+	assert.ErrorContains(err, "Nonce does not solve the share target")
+
+	// A duplicate share. Use a share which doesn't also solve the block, so the template isn't removed.
+	var nonce [32]byte
+	for {
+		var hash [32]byte
+		nonce, hash = solveHeaderForTest(work.Header, template.shareTarget)
+		if !VerifyPOW(hash, template.puzzle.target) {
+			break
+		}
+	}
+	_, isBlock, err := pool.SubmitShare(work.WorkId, nonce, miner)
+	assert.Nil(err)
+	assert.False(isBlock)
+	_, _, err = pool.SubmitShare(work.WorkId, nonce, miner)
+	assert.ErrorContains(err, "Duplicate share")
+
+	stats := pool.GetStats()
+	assert.Equal(1, len(stats))
+	assert.Equal(uint64(1), stats[0].Shares)
+	assert.Equal(uint64(3), stats[0].InvalidShares)
+}
+
+func TestPoolPPLNSCredits(t *testing.T) {
+	assert := assert.New(t)
+	pool, dag := newPoolForTest(t)
+	pool.PPLNSWindow = 3
+	minerA := newPoolMinerAccount(t)
+	minerB := newPoolMinerAccount(t)
+	minerC := newPoolMinerAccount(t)
+
+	// Only the last N shares are credited. Miner C's share falls outside the window.
+	work := big.NewInt(100)
+	for _, miner := range [][65]byte{minerC, minerA, minerA, minerB} {
+		pool.shares = append(pool.shares, PoolShare{Miner: miner, Work: *work})
+		if pool.PPLNSWindow < len(pool.shares) {
+			pool.shares = pool.shares[len(pool.shares)-pool.PPLNSWindow:]
+		}
+	}
+
+	w := pool.GetWork()
+	template, _ := pool.templates.get(w.WorkId)
+	block := *template.puzzle.block
+	block.Transactions[0].Amount = 100
+	err := pool.creditBlock(block, template, minerB)
+	assert.Nil(err)
+
+	// Shares are weighted by work, and the rounding remainder goes to the finder.
+	stats := pool.miners
+	assert.Equal(uint64(66), stats[minerA].Immature)
+	assert.Equal(uint64(34), stats[minerB].Immature)
+	assert.Equal(uint64(1), stats[minerB].BlocksFound)
+	_, ok := stats[minerC]
+	assert.False(ok)
+
+	// The block was never ingested, so once it matures it's treated as orphaned and the credits are dropped.
+	pool.blocks[0].payouts = map[[65]byte]uint64{minerC: 10}
+	pool.getMinerStats(minerC).Paid = 10
+	dag.FullTip.Height = 1
+	pool.processMaturedBlocks()
+	assert.Equal(0, len(pool.blocks))
+	assert.Equal(uint64(0), stats[minerA].Immature)
+	assert.Equal(uint64(0), stats[minerA].Owed)
+
+	// The orphaned block's payouts are owed again.
+	assert.Equal(uint64(10), stats[minerC].Owed)
+	assert.Equal(uint64(0), stats[minerC].Paid)
+}
+
+// Gets a new template from the pool, and its payout transactions.
+func getPoolTemplateForTest(pool *Pool) (*poolTemplate, []RawTransaction) {
+	work := pool.GetWork()
+	template, _ := pool.templates.get(work.WorkId)
+	return template, template.puzzle.block.Transactions[1:]
+}
+
+func TestPoolReservesPayouts(t *testing.T) {
+	assert := assert.New(t)
+	pool, _ := newPoolForTest(t)
+	pool.templates.max = 1
+	miner := newPoolMinerAccount(t)
+	pool.getMinerStats(miner).Owed = 10
+
+	// The first template pays out the owed credits, reserving them.
+	template1, first := getPoolTemplateForTest(pool)
+	assert.Equal(1, len(first))
+	assert.Equal(uint64(10), first[0].Amount)
+	assert.Equal(map[[65]byte]uint64{miner: 10}, template1.payouts)
+	assert.Equal(uint64(10), pool.reserved[miner])
+
+	// The next template doesn't pay them again, even if it is built on a different parent. Adding it evicts the first
+	// template, releasing its reservation.
+	template2, second := getPoolTemplateForTest(pool)
+	assert.Equal(0, len(second))
+	assert.Empty(template2.payouts)
+	assert.Empty(pool.reserved)
+
+	// So the next template pays them, with a distinct transaction.
+	_, third := getPoolTemplateForTest(pool)
+	assert.Equal(1, len(third))
+	assert.Equal(first[0].Amount, third[0].Amount)
+	assert.NotEqual(first[0].Nonce, third[0].Nonce)
+	assert.NotEqual(first[0].Hash(), third[0].Hash())
+
+	// Credits owed on top of the reservation are paid by the next template.
+	pool.mutex.Lock()
+	pool.getMinerStats(miner).Owed = 15
+	pool.mutex.Unlock()
+	template4, fourth := getPoolTemplateForTest(pool)
+	assert.Equal(1, len(fourth))
+	assert.Equal(uint64(5), fourth[0].Amount)
+	assert.Equal(map[[65]byte]uint64{miner: 5}, template4.payouts)
+}
+
+func TestPoolMinerDoesNotIncludePayouts(t *testing.T) {
+	assert := assert.New(t)
+	pool, _ := newPoolForTest(t)
+	miner := newPoolMinerAccount(t)
+	pool.getMinerStats(miner).Owed = 10
+
+	// Only the pool's templates pay out its miners, so payouts are always tracked by a template.
+	puzzle := pool.miner.MakeNewPuzzle()
+	assert.Equal(1, len(puzzle.block.Transactions))
+	assert.Empty(pool.reserved)
+}
+
+func TestPoolIncludesMinerBlockBody(t *testing.T) {
+	assert := assert.New(t)
+	miner, dag := newMinerForTest(t)
+	wallets := getTestingWallets(t)
+	tx := MakeTransferTx(miner.CoinbaseWallet.PubkeyBytes(), wallets[1].PubkeyBytes(), 5, 0, 0, miner.CoinbaseWallet)
+	miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{tx}
+	}
+
+	pool := NewPool(dag, miner, "127.0.0.1", getRandomPort())
+	minerA := newPoolMinerAccount(t)
+	pool.getMinerStats(minerA).Owed = 10
+
+	// The template pays out the pool's miners, followed by the miner's block body.
+	work := pool.GetWork()
+	template, _ := pool.templates.get(work.WorkId)
+	txs := template.puzzle.block.Transactions[1:]
+	assert.Equal(2, len(txs))
+	assert.Equal(minerA, txs[0].ToPubkey)
+	assert.Equal(tx.Hash(), txs[1].Hash())
+
+	// Only the payouts are recorded as payouts, though both transfers are from the pool's wallet.
+	assert.Equal(map[[65]byte]uint64{minerA: 10}, template.payouts)
+}
+
+func TestPoolPersistsAccounting(t *testing.T) {
+	assert := assert.New(t)
+	pool, dag := newPoolForTest(t)
+	minerA := newPoolMinerAccount(t)
+	minerB := newPoolMinerAccount(t)
+
+	// Miner A has a share in the window, an immature credit and an owed balance, and miner B was paid.
+	for {
+		work := pool.GetWork()
+		template, _ := pool.templates.get(work.WorkId)
+		nonce, hash := solveHeaderForTest(work.Header, template.shareTarget)
+		if VerifyPOW(hash, template.puzzle.target) {
+			continue
+		}
+		_, _, err := pool.SubmitShare(work.WorkId, nonce, minerA)
+		assert.Nil(err)
+		break
+	}
+	pool.mutex.Lock()
+	pool.getMinerStats(minerA).Owed = 10
+	pool.getMinerStats(minerB).Paid = 20
+	pool.blocks = append(pool.blocks, poolBlock{
+		hash:    [32]byte{1},
+		height:  5,
+		credits: map[[65]byte]uint64{minerA: 30},
+		payouts: map[[65]byte]uint64{minerB: 20},
+	})
+	pool.mutex.Unlock()
+	_, payouts := getPoolTemplateForTest(pool)
+	assert.Equal(1, len(payouts))
+
+	// A new pool on the same database picks up where the last one left off.
+	pool2 := NewPool(dag, NewMiner(*dag, pool.miner.CoinbaseWallet), "127.0.0.1", getRandomPort())
+	assert.Equal(pool.shares, pool2.shares)
+	assert.Equal(pool.blocks, pool2.blocks)
+	assert.Equal(pool.payoutNonce, pool2.payoutNonce)
+	assert.Equal(pool.GetStats(), pool2.GetStats())
+
+	// And doesn't reuse the nonces of earlier payouts.
+	_, payouts2 := getPoolTemplateForTest(pool2)
+	assert.Equal(1, len(payouts2))
+	assert.NotEqual(payouts[0].Hash(), payouts2[0].Hash())
+}
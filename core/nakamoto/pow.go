@@ -3,11 +3,13 @@ package nakamoto
 import (
 	"fmt"
 	"math/big"
+
+	"github.com/liamzebedee/tinychain-go/core"
 )
 
 var powLogger = NewLogger("pow", "")
 
-// Verifies a proof-of-work solution.
+// Verifies a proof-of-work solution, where the block hash was computed using the consensus hash function.
 func VerifyPOW(blockhash [32]byte, target big.Int) bool {
 	powLogger.Printf("VerifyPOW target: %s\n", target.String())
 
@@ -15,8 +17,8 @@ func VerifyPOW(blockhash [32]byte, target big.Int) bool {
 	return hash.Cmp(&target) == -1
 }
 
-// Solves a proof-of-work puzzle.
-func SolvePOW(b RawBlock, startNonce big.Int, target big.Int, maxIterations uint64) (big.Int, error) {
+// Solves a proof-of-work puzzle, using the consensus hash function.
+func SolvePOW(hasher core.Hasher, b RawBlock, startNonce big.Int, target big.Int, maxIterations uint64) (big.Int, error) {
 	powLogger.Printf("SolvePOW target: %s\n", target.String())
 
 	block := b
@@ -36,7 +38,7 @@ func SolvePOW(b RawBlock, startNonce big.Int, target big.Int, maxIterations uint
 		block.SetNonce(nonce)
 
 		// Hash.
-		h := block.Hash()
+		h := block.Hash(hasher)
 		hash := new(big.Int).SetBytes(h[:])
 
 		// Check solution: hash < target.
@@ -0,0 +1,104 @@
+package nakamoto
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// POW proofs.
+//
+// A POW proof is a Groth16 proof that a block header's Poseidon hash is below a target. Verifying it does not require
+// hashing the header, which is the first step towards syncing the chain from a single recursive proof.
+//
+// The circuit's public inputs are:
+//
+//	[block hash, target, header chunk 0, ..., header chunk n]
+//
+// where the header chunks are the header bytes packed into field elements, as absorbed by core.HashPoseidon. The
+// verifier recomputes the chunks from the header it has, so a proof cannot be replayed for a different header.
+
+// The largest target the circuit can prove against. The comparison hash < target is done over 253-bit integers, which
+// fit in the field without wrapping.
+var maxPOWProofTarget = new(big.Int).Lsh(big.NewInt(1), 252)
+
+type POWProof struct {
+	BlockHash [32]byte           `json:"block_hash"`
+	Proof     *core.Groth16Proof `json:"proof"`
+}
+
+// Builds the POW circuit for a header and target.
+func NewPOWCircuit(header BlockHeader, target big.Int) (*core.Circuit, error) {
+	if maxPOWProofTarget.Cmp(&target) < 0 {
+		return nil, fmt.Errorf("Target is too large to prove.")
+	}
+
+	headerBytes := header.Bytes()
+	blockHash := core.HashPoseidon(headerBytes)
+
+	c := core.NewCircuit()
+
+	// Public inputs.
+	hash := c.PublicInput(new(big.Int).SetBytes(blockHash[:]))
+	targetSignal := c.PublicInput(&target)
+	chunks := []core.Signal{}
+	for _, chunk := range core.PoseidonChunks(headerBytes) {
+		chunks = append(chunks, c.PublicInput(chunk))
+	}
+
+	// 1. The block hash is the Poseidon hash of the header.
+	c.AssertEqual(core.PoseidonHashCircuit(c, uint64(len(headerBytes)), chunks), hash)
+
+	// 2. The block hash is below the target.
+	// As target <= 2^252, this holds iff d = (target - 1 - hash) + 2^252 has bit 252 set. Constraining the hash to 252
+	// bits keeps d within 253 bits, so it cannot wrap around the field.
+	c.ToBits(hash, 252)
+	d := c.AddConst(c.Sub(c.AddConst(targetSignal, big.NewInt(-1)), hash), maxPOWProofTarget)
+	dBits := c.ToBits(d, 253)
+	c.AssertEqual(dBits[252], c.Const(big.NewInt(1)))
+
+	return c, nil
+}
+
+// Generates the proving and verifying keys for the POW circuit.
+func SetupPOWCircuit() (*core.Groth16ProvingKey, *core.Groth16VerifyingKey, error) {
+	// The circuit structure does not depend on the header, so any header will do.
+	c, err := NewPOWCircuit(BlockHeader{}, *maxPOWProofTarget)
+	if err != nil {
+		return nil, nil, err
+	}
+	return core.Groth16Setup(c)
+}
+
+// Proves the header's POW solution is valid for the target.
+func ProvePOW(pk *core.Groth16ProvingKey, header BlockHeader, target big.Int) (POWProof, error) {
+	c, err := NewPOWCircuit(header, target)
+	if err != nil {
+		return POWProof{}, err
+	}
+
+	proof, _, err := core.Groth16Prove(pk, c)
+	if err != nil {
+		return POWProof{}, err
+	}
+
+	return POWProof{
+		BlockHash: core.HashPoseidon(header.Bytes()),
+		Proof:     proof,
+	}, nil
+}
+
+// Verifies a POW proof for a header and target.
+func VerifyPOWProof(vk *core.Groth16VerifyingKey, header BlockHeader, target big.Int, proof POWProof) bool {
+	if maxPOWProofTarget.Cmp(&target) < 0 {
+		return false
+	}
+
+	public := []*big.Int{
+		new(big.Int).SetBytes(proof.BlockHash[:]),
+		&target,
+	}
+	public = append(public, core.PoseidonChunks(header.Bytes())...)
+	return core.Groth16Verify(vk, proof.Proof, public)
+}
@@ -0,0 +1,84 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPOWProof(t *testing.T) {
+	assert := assert.New(t)
+
+	pk, vk, err := SetupPOWCircuit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mine a block on a Poseidon network.
+	dag, conf, _ := newPoseidonBlockdag(t)
+	raw := mineBlockWithCoinbaseNonce(t, &dag, &dag.FullTip, 1)
+	header := raw.ToBlockHeader()
+	target := conf.GenesisDifficulty
+
+	proof, err := ProvePOW(pk, header, target)
+	assert.Nil(err)
+	assert.Equal(raw.Hash(dag.GetHasher()), proof.BlockHash)
+	assert.True(VerifyPOWProof(vk, header, target, proof))
+
+	// The proof is bound to the header.
+	otherHeader := header
+	otherHeader.Timestamp += 1
+	assert.False(VerifyPOWProof(vk, otherHeader, target, proof))
+
+	// And to the target.
+	assert.False(VerifyPOWProof(vk, header, *big.NewInt(1), proof))
+
+	// And to the block hash.
+	forged := proof
+	forged.BlockHash = [32]byte{}
+	assert.False(VerifyPOWProof(vk, header, target, forged))
+
+	// A header which does not meet the target cannot be proven.
+	hash := raw.Hash(dag.GetHasher())
+	_, err = ProvePOW(pk, header, *new(big.Int).SetBytes(hash[:]))
+	assert.Error(err)
+
+	// Targets above 2^252 are not supported by the circuit.
+	_, err = ProvePOW(pk, header, *new(big.Int).Lsh(big.NewInt(1), 253))
+	assert.Equal("Target is too large to prove.", err.Error())
+}
+
+func TestDagIngestHeaderWithPOWProof(t *testing.T) {
+	assert := assert.New(t)
+
+	pk, vk, err := SetupPOWCircuit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dag, conf, _ := newPoseidonBlockdag(t)
+	raw := mineBlockWithCoinbaseNonce(t, &dag, &dag.FullTip, 1)
+	header := raw.ToBlockHeader()
+	proof, err := ProvePOW(pk, header, conf.GenesisDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid proof is rejected.
+	otherHeader := header
+	otherHeader.Timestamp += 1
+	err = dag.IngestHeaderWithPOWProof(otherHeader, proof, vk)
+	assert.Equal("POW solution is invalid.", err.Error())
+
+	// A valid proof is accepted in place of the POW.
+	err = dag.IngestHeaderWithPOWProof(header, proof, vk)
+	assert.Nil(err)
+	assert.Equal(raw.Hash(dag.GetHasher()), dag.HeadersTip.Hash)
+	assert.Equal(uint64(1), dag.HeadersTip.Height)
+
+	// POW proofs are only accepted on Poseidon networks.
+	sha256Dag, _, _, _ := newBlockdag()
+	err = sha256Dag.IngestHeaderWithPOWProof(header, proof, vk)
+	assert.Equal("POW proofs require the poseidon hash function.", err.Error())
+}
@@ -1,13 +1,14 @@
 package nakamoto
 
 import (
+	"database/sql"
 	"fmt"
+	"maps"
 	"math/big"
 	"testing"
 	"time"
 
 	"github.com/liamzebedee/tinychain-go/core"
-	"github.com/triplewz/poseidon"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,7 +20,7 @@ func TestPOWProofOfWorkSolver(t *testing.T) {
 	target := new(big.Int)
 	target.SetString("0000ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
 
-	solution, err := SolvePOW(genesis_block, *nonce, *target, 1000000)
+	solution, err := SolvePOW(testHasher, genesis_block, *nonce, *target, 1000000)
 	if err != nil {
 		t.Fatalf("Failed to solve proof of work")
 	}
@@ -38,8 +39,8 @@ func TestPOWBuildChainOfBlocks(t *testing.T) {
 	target.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
 
 	for {
-		fmt.Printf("Mining block %x\n", curr_block.Hash())
-		solution, err := SolvePOW(curr_block, *new(big.Int), *target, 100000000000)
+		fmt.Printf("Mining block %x\n", curr_block.Hash(testHasher))
+		solution, err := SolvePOW(testHasher, curr_block, *new(big.Int), *target, 100000000000)
 		if err != nil {
 			assert.Nil(t, err)
 		}
@@ -54,7 +55,7 @@ func TestPOWBuildChainOfBlocks(t *testing.T) {
 		// Create a new block.
 		timestamp := uint64(0)
 		curr_block = RawBlock{
-			ParentHash:      curr_block.Hash(),
+			ParentHash:      curr_block.Hash(testHasher),
 			Timestamp:       timestamp,
 			NumTransactions: 0,
 			Transactions:    []RawTransaction{},
@@ -85,8 +86,8 @@ func TestPOWBuildChainOfBlocks(t *testing.T) {
 // 	chain := make([]RawBlock, 0)
 // 	curr_block := RawBlock{}
 // 	for {
-// 		fmt.Printf("Mining block %x\n", curr_block.Hash())
-// 		solution, err := SolvePOW(curr_block, *new(big.Int), difficulty, 100000000000)
+// 		fmt.Printf("Mining block %x\n", curr_block.Hash(testHasher))
+// 		solution, err := SolvePOW(testHasher, curr_block, *new(big.Int), difficulty, 100000000000)
 // 		if err != nil {
 // 			t.Fatalf("Failed to solve proof of work")
 // 		}
@@ -101,7 +102,7 @@ func TestPOWBuildChainOfBlocks(t *testing.T) {
 
 // 		// Create a new block.
 // 		curr_block = RawBlock{
-// 			ParentHash: curr_block.Hash(),
+// 			ParentHash: curr_block.Hash(testHasher),
 // 			Timestamp: 0,
 // 			NumTransactions: 0,
 // 			Transactions: []RawTransaction{},
@@ -155,7 +156,7 @@ func TestCalculateWork(t *testing.T) {
 
 	// Solve 30 blocks, adjust difficulty every 10.
 	for i := 0; i < 30; i++ {
-		solution, err := SolvePOW(block_template, *new(big.Int), *diff_target, 100000000000)
+		solution, err := SolvePOW(testHasher, block_template, *new(big.Int), *diff_target, 100000000000)
 		if err != nil {
 			t.Fatalf("Failed to solve proof of work")
 		}
@@ -165,7 +166,7 @@ func TestCalculateWork(t *testing.T) {
 
 		// Setup next block.
 		block_template = RawBlock{
-			ParentHash: block_template.Hash(),
+			ParentHash: block_template.Hash(testHasher),
 			Timestamp:  0,
 		}
 
@@ -179,52 +180,68 @@ func TestCalculateWork(t *testing.T) {
 	}
 }
 
-// Poseidon is a ZK-friendly hash function.
-//
-// This is a benchmark from Starkware's original prover, ethSTARK, which was research done for the Ethereum Foundation.
-// https://eprint.iacr.org/2021/582.pdf
-//
-// 1. Operating-System: Linux 5.3.0-51-generic x86_64.
-// 2. CPU: Intel(R) Core(TM) i7-7700K @ 4.20GHz (4 cores, 2 threads per core).
-// 3. RAM: 16GB DDR4 (8GB × 2, Speed: 2667 MHz)
-// 4. STARK bits of security: 80 bits.
-// 5. Hash function used: Rescue (another ZK-friendly hash function).
-//
-// Proving:
-// - Number of hashes: 12,288
-// - Prove time: 1s
-// Verification:
-// - Proof size: ~40kB
-// - Verify time: 1.9mS
-//
-// We note these benchmarks are similar to the Poseidon paper's libsnark implementation.
-// Field: BN254
-// Proofing system: groth16
-// https://eprint.iacr.org/2019/458.pdf
-// Prove time: 43.1ms
-// Proof size: 200 bytes (3 field elements, 252 bits each, ~3*8 bytes, 24 bytes)
-// Verify time: 1.2ms
-//
-// Interestingly, you can use a ZK proof of revealing a hash preimage as a digital signature.
-// How does this compare to digital signatures?
-func TestPoseidonHashFunction(t *testing.T) {
-	// poseidon hash with 3 input elements and 1 output element.
-	input := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
-
-	// generate round constants for poseidon hash.
-	// width=len(input)+1.
-	cons, _ := poseidon.GenPoseidonConstants(4)
-
-	// use OptimizedStatic hash mode.
-	h1, _ := poseidon.Hash(input, cons, poseidon.OptimizedStatic)
-	// use OptimizedDynamic hash mode.
-	h2, _ := poseidon.Hash(input, cons, poseidon.OptimizedDynamic)
-	// use Correct hash mode.
-	h3, _ := poseidon.Hash(input, cons, poseidon.Correct)
-
-	t.Logf("Poseidon hash with OptimizedStatic: %x", h1)
-	t.Logf("Poseidon hash with OptimizedDynamic: %x", h2)
-	t.Logf("Poseidon hash with Correct: %x", h3)
+func TestPOWPoseidonHasher(t *testing.T) {
+	assert := assert.New(t)
+
+	// Launch a network which uses Poseidon, from config alone, alongside a SHA256 network.
+	sha256Dag, _, _, sha256GenesisBlock := newBlockdag()
+	sha256GenesisHash := sha256GenesisBlock.Hash(testHasher)
+	dag, conf, db := newPoseidonBlockdag(t)
+	hasher := dag.GetHasher()
+
+	// The genesis block is hashed with Poseidon.
+	genesisBlock := GetRawGenesisBlockFromConfig(conf)
+	assert.Equal(core.HashPoseidon(genesisBlock.Envelope()), genesisBlock.Hash(hasher))
+	assert.NotEqual(sha256GenesisHash, genesisBlock.Hash(hasher))
+	assert.Equal(genesisBlock.Hash(hasher), dag.FullTip.Hash)
+
+	// Mine and ingest blocks.
+	parent := &dag.FullTip
+	for height := uint64(1); height <= 2; height++ {
+		raw := mineBlockWithCoinbaseNonce(t, &dag, parent, height)
+		assert.Equal(core.HashPoseidon(raw.Envelope()), raw.Hash(hasher))
+		assert.True(VerifyPOW(raw.Hash(hasher), conf.GenesisDifficulty))
+
+		err := dag.IngestBlock(raw)
+		assert.Nil(err)
+
+		parent, err = dag.GetBlockByHash(raw.Hash(hasher))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(height, parent.Height)
+	}
+	assert.Equal(parent.Hash, dag.FullTip.Hash)
+
+	// The SHA256 network is unaffected.
+	raw := mineBlockWithCoinbaseNonce(t, &sha256Dag, &sha256Dag.FullTip, 1)
+	assert.Equal(core.HashSHA2(raw.Envelope()), raw.Hash(sha256Dag.GetHasher()))
+	assert.Nil(sha256Dag.IngestBlock(raw))
+	assert.Equal(raw.Hash(testHasher), sha256Dag.FullTip.Hash)
+
+	// An unknown hash function is rejected.
+	conf.HashFunction = "md5"
+	_, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	assert.Error(err)
+}
+
+// Creates a block DAG for a network which uses the Poseidon hash function.
+func newPoseidonBlockdag(t *testing.T) (BlockDAG, ConsensusConfig, *sql.DB) {
+	_, conf, _, _ := newBlockdag()
+	conf.HashFunction = core.HashFunctionPoseidon
+	conf.Upgrades = maps.Clone(conf.Upgrades)
+	conf.Upgrades[UpgradeHashFunction] = 0
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	dag, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dag, conf, db
 }
 
 // 213.833µs
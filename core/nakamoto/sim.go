@@ -0,0 +1,412 @@
+package nakamoto
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand"
+	"sync"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The simulator runs many nodes in one process, over an in-memory network, with a virtual clock and seeded randomness.
+// Given the same seed and script, a simulation runs identically every time, which lets us reproducibly test reorgs,
+// selfish mining and sync convergence.
+//
+// Time only advances when the simulation runs its next scheduled event. Mining is simulated as a Poisson process: a
+// node with hashrate H finds a block on a target T after an exponentially-distributed delay with mean work(T)/H,
+// after which the block's proof-of-work is solved for real so other nodes can validate it.
+//
+// Gossip messages (new blocks and transactions) are delivered after a random delay, in order on each link, or dropped.
+// Request/reply messages (such as those used for sync) are delivered immediately, or fail. Nodes in different
+// partitions cannot communicate.
+//
+// The simulated nodes are real nodes, so the simulation inherits their limitations. Nodes do not yet fetch the
+// missing parents of a gossiped block, so a block which arrives before its parent is dropped, and sides of a healed
+// partition only converge when a node syncs.
+
+// VirtualClock is a simulated clock, which advances only when the events scheduled on it are run.
+type VirtualClock struct {
+	now    uint64
+	seq    uint64
+	events simEventQueue
+}
+
+type simEvent struct {
+	time uint64
+	seq  uint64
+	fn   func()
+}
+
+// A priority queue of events, ordered by time, and then by the order they were scheduled in.
+type simEventQueue []*simEvent
+
+func (q simEventQueue) Len() int { return len(q) }
+func (q simEventQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time < q[j].time
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simEventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simEventQueue) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simEventQueue) Pop() any {
+	old := *q
+	event := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return event
+}
+
+func NewVirtualClock(start uint64) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Gets the current time, in milliseconds.
+func (c *VirtualClock) Now() uint64 {
+	return c.now
+}
+
+// Schedules fn to run after a delay, in milliseconds.
+func (c *VirtualClock) Schedule(delay uint64, fn func()) {
+	c.ScheduleAt(c.now+delay, fn)
+}
+
+// Schedules fn to run at a time, in milliseconds. Events scheduled in the past run at the current time.
+func (c *VirtualClock) ScheduleAt(time uint64, fn func()) {
+	if time < c.now {
+		time = c.now
+	}
+	c.seq++
+	heap.Push(&c.events, &simEvent{time: time, seq: c.seq, fn: fn})
+}
+
+// Runs the next event, advancing the clock to its time. Returns false if there are no events.
+func (c *VirtualClock) Step() bool {
+	if len(c.events) == 0 {
+		return false
+	}
+	event := heap.Pop(&c.events).(*simEvent)
+	c.now = event.time
+	event.fn()
+	return true
+}
+
+// Runs all events scheduled up to and including a time, and advances the clock to it.
+func (c *VirtualClock) RunUntil(time uint64) {
+	for 0 < len(c.events) && c.events[0].time <= time {
+		c.Step()
+	}
+	if c.now < time {
+		c.now = time
+	}
+}
+
+// A Simulation of a network of nodes.
+type Simulation struct {
+	Clock     *VirtualClock
+	Consensus ConsensusConfig
+	Nodes     []*SimNode
+
+	// The range of delays for gossip messages, in milliseconds.
+	MinDelayMillis uint64
+	MaxDelayMillis uint64
+
+	// The probability a message is dropped.
+	DropRate float64
+
+	// A log of the simulation's events, which is identical between runs with the same seed.
+	Trace []string
+
+	rand      *rand.Rand
+	randMutex sync.Mutex
+
+	// The partition each node is in, by address. Nil when the network is not partitioned.
+	partitions map[string]int
+
+	// The time the last message on each link is delivered, to keep delivery in order.
+	lastDelivery map[[2]string]uint64
+
+	log *log.Logger
+}
+
+// A SimNode is a node in a simulation.
+type SimNode struct {
+	*Node
+	Addr string
+
+	// The node's hashrate, in hashes per second. Zero disables mining.
+	hashrate float64
+
+	// Incremented when the hashrate changes, to cancel the pending block find.
+	miningEpoch uint64
+
+	// Whether the node withholds the blocks it mines (selfish mining), until ReleaseWithheld is called.
+	Withhold bool
+	withheld []RawBlock
+
+	sim *Simulation
+}
+
+// Creates a new simulation, where all randomness is derived from the seed. The clock starts at the genesis block's
+// timestamp.
+func NewSimulation(seed int64, consensus ConsensusConfig) *Simulation {
+	return &Simulation{
+		Clock:          NewVirtualClock(0),
+		Consensus:      consensus,
+		Nodes:          []*SimNode{},
+		MinDelayMillis: 50,
+		MaxDelayMillis: 200,
+		Trace:          []string{},
+		rand:           rand.New(rand.NewSource(seed)),
+		lastDelivery:   make(map[[2]string]uint64),
+		log:            NewLogger("sim", ""),
+	}
+}
+
+// A state machine which accepts all transactions, as the nodes maintain their own state.
+type simStateMachine struct{}
+
+func (m *simStateMachine) VerifyTx(tx RawTransaction) error {
+	return nil
+}
+
+// Adds a node with the given hashrate, connected to all other nodes.
+func (s *Simulation) AddNode(hashrate float64) (*SimNode, error) {
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // :memory: only
+
+	dag, err := NewBlockDAGFromDB(db, &simStateMachine{}, s.Consensus)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the clock at genesis.
+	if len(s.Nodes) == 0 && s.Clock.Now() < dag.FullTip.Timestamp {
+		s.Clock.now = dag.FullTip.Timestamp
+	}
+
+	// Derive the miner's wallet from the seed.
+	prvkey := s.randBytes(32)
+	wallet, err := core.WalletFromPrivateKey(hex.EncodeToString(prvkey))
+	if err != nil {
+		return nil, err
+	}
+
+	addr := fmt.Sprintf("sim://node%d", len(s.Nodes))
+	miner := NewMiner(dag, wallet)
+	miner.GetTimestamp = s.Clock.Now
+	peer := NewPeerCoreWithTransport(NewPeerConfig(addr, "0", []string{}), &simTransport{sim: s, from: addr})
+
+	node := &SimNode{
+		Node:     NewNode(&dag, miner, peer),
+		Addr:     addr,
+		hashrate: hashrate,
+		sim:      s,
+	}
+
+	// Connect to all other nodes.
+	for _, other := range s.Nodes {
+		node.Peer.peers = append(node.Peer.peers, Peer{Addr: other.Addr, LastSeen: s.Clock.Now(), WireProtocolVersion: WIRE_PROTOCOL_VERSION})
+		other.Peer.peers = append(other.Peer.peers, Peer{Addr: addr, LastSeen: s.Clock.Now(), WireProtocolVersion: WIRE_PROTOCOL_VERSION})
+	}
+	s.Nodes = append(s.Nodes, node)
+
+	node.scheduleMining()
+	return node, nil
+}
+
+// Partitions the network into groups. Nodes in different groups cannot communicate. Nodes not in any group are
+// isolated.
+func (s *Simulation) Partition(groups ...[]*SimNode) {
+	s.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			s.partitions[node.Addr] = i
+		}
+	}
+	s.trace("partition groups=%d", len(groups))
+}
+
+// Heals any partition.
+func (s *Simulation) Heal() {
+	s.partitions = nil
+	s.trace("heal")
+}
+
+// Runs the simulation for a duration, in milliseconds.
+func (s *Simulation) Run(durationMillis uint64) {
+	s.Clock.RunUntil(s.Clock.Now() + durationMillis)
+}
+
+func (s *Simulation) canReach(from string, to string) bool {
+	if s.partitions == nil {
+		return true
+	}
+	fromGroup, ok := s.partitions[from]
+	if !ok {
+		return false
+	}
+	toGroup, ok := s.partitions[to]
+	return ok && fromGroup == toGroup
+}
+
+func (s *Simulation) getNode(addr string) *SimNode {
+	for _, node := range s.Nodes {
+		if node.Addr == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// Requests may be sent concurrently (e.g. during sync), so access to the random source is synchronised.
+func (s *Simulation) randFloat64() float64 {
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	return s.rand.Float64()
+}
+
+func (s *Simulation) randInt63n(n int64) int64 {
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	return s.rand.Int63n(n)
+}
+
+func (s *Simulation) randExpFloat64() float64 {
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	return s.rand.ExpFloat64()
+}
+
+func (s *Simulation) randBytes(n int) []byte {
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	buf := make([]byte, n)
+	s.rand.Read(buf)
+	return buf
+}
+
+func (s *Simulation) trace(format string, args ...any) {
+	line := fmt.Sprintf("t=%d ", s.Clock.Now()) + fmt.Sprintf(format, args...)
+	s.Trace = append(s.Trace, line)
+	s.log.Println(line)
+}
+
+// Sets the node's hashrate, in hashes per second. Zero stops the node mining.
+func (n *SimNode) SetHashrate(hashrate float64) {
+	n.hashrate = hashrate
+	n.miningEpoch++
+	n.scheduleMining()
+}
+
+// Schedules the node's next block, after an exponentially-distributed delay with mean work(target)/hashrate.
+func (n *SimNode) scheduleMining() {
+	if n.hashrate <= 0 {
+		return
+	}
+
+	puzzle := n.Miner.MakeNewPuzzle()
+	expectedHashes, _ := new(big.Float).SetInt(CalculateWork(puzzle.target)).Float64()
+	delay := n.sim.randExpFloat64() * expectedHashes / n.hashrate * 1000
+
+	epoch := n.miningEpoch
+	n.sim.Clock.Schedule(uint64(delay), func() {
+		if epoch == n.miningEpoch {
+			n.mineBlock()
+		}
+	})
+}
+
+// Mines a block on the node's current tip, and schedules the next one.
+func (n *SimNode) mineBlock() {
+	puzzle := n.Miner.MakeNewPuzzle()
+	solution, err := SolvePOW(n.Dag.hasher, *puzzle.block, *big.NewInt(0), puzzle.target, 0)
+	if err != nil {
+		panic(err)
+	}
+	block := *puzzle.block
+	block.SetNonce(solution)
+	n.sim.trace("mined node=%s block=%s parent=%s withheld=%t", n.Addr, block.HashStr(n.Dag.hasher), Bytes32ToString(block.ParentHash), n.Withhold)
+
+	if n.Withhold {
+		err := n.Dag.IngestBlock(block)
+		if err != nil {
+			n.sim.log.Printf("Failed to ingest withheld block: %s\n", err)
+		}
+		n.withheld = append(n.withheld, block)
+	} else {
+		n.Miner.OnBlockSolution(block)
+	}
+
+	n.scheduleMining()
+}
+
+// Gossips the blocks the node has withheld, in the order they were mined.
+func (n *SimNode) ReleaseWithheld() {
+	n.sim.trace("release node=%s blocks=%d", n.Addr, len(n.withheld))
+	for _, block := range n.withheld {
+		n.Peer.GossipBlock(block)
+	}
+	n.withheld = nil
+}
+
+// Sends messages between simulated nodes.
+type simTransport struct {
+	sim  *Simulation
+	from string
+}
+
+func (t *simTransport) SendMessage(peer Peer, encoding WireEncoding, message []byte) ([]byte, error) {
+	s := t.sim
+	peerUrl := peer.Addr
+	to := s.getNode(peerUrl)
+	if to == nil {
+		return nil, fmt.Errorf("Unknown peer: %s", peerUrl)
+	}
+
+	messageType, err := PeekMessageType(encoding, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.canReach(t.from, peerUrl) {
+		return nil, fmt.Errorf("Peer unreachable: %s", peerUrl)
+	}
+	if s.DropRate > 0 && s.randFloat64() < s.DropRate {
+		s.trace("drop from=%s to=%s type=%s", t.from, peerUrl, messageType)
+		return nil, fmt.Errorf("Message dropped: %s", peerUrl)
+	}
+
+	// Gossip is delivered after a delay, in order on each link.
+	if messageType == "new_block" || messageType == "new_tx" {
+		delay := s.MinDelayMillis
+		if s.MinDelayMillis < s.MaxDelayMillis {
+			delay += uint64(s.randInt63n(int64(s.MaxDelayMillis - s.MinDelayMillis + 1)))
+		}
+		link := [2]string{t.from, peerUrl}
+		deliveryTime := max(s.Clock.Now()+delay, s.lastDelivery[link])
+		s.lastDelivery[link] = deliveryTime
+
+		from := t.from
+		s.Clock.ScheduleAt(deliveryTime, func() {
+			// Messages in flight are lost when the network is partitioned.
+			if !s.canReach(from, peerUrl) {
+				return
+			}
+			_, err := to.Peer.server.HandlePeerMessage(peer.session, message, encoding)
+			if err != nil {
+				s.log.Printf("Failed to handle message from=%s to=%s: %s\n", from, peerUrl, err)
+			}
+		})
+		return EncodeMessage(encoding, struct{}{})
+	}
+
+	// Requests are handled immediately.
+	return to.Peer.server.HandlePeerMessage(peer.session, message, encoding)
+}
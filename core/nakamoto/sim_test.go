@@ -0,0 +1,212 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSimConsensus() ConsensusConfig {
+	genesis_difficulty := new(big.Int)
+	genesis_difficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+
+	genesisBlockHash_, err := hex.DecodeString("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646")
+	if err != nil {
+		panic(err)
+	}
+	genesisBlockHash := [32]byte{}
+	copy(genesisBlockHash[:], genesisBlockHash_)
+
+	return ConsensusConfig{
+		EpochLengthBlocks:       10,
+		TargetEpochLengthMillis: 10 * 10_000, // 10s blocks
+		GenesisDifficulty:       *genesis_difficulty,
+		GenesisParentBlockHash:  genesisBlockHash,
+		MaxBlockSizeBytes:       2 * 1024 * 1024, // 2MB
+	}
+}
+
+// With a hashrate of 1.6 H/s per node at the genesis difficulty, each node mines a block every ~10s.
+const simTestHashrate = 1.6
+
+func newTestSimulation(t *testing.T, seed int64, hashrates ...float64) *Simulation {
+	sim := NewSimulation(seed, newSimConsensus())
+	for _, hashrate := range hashrates {
+		if _, err := sim.AddNode(hashrate); err != nil {
+			t.Fatalf("Failed to add node: %s", err)
+		}
+	}
+	return sim
+}
+
+func TestVirtualClock(t *testing.T) {
+	assert := assert.New(t)
+	clock := NewVirtualClock(100)
+
+	order := []int{}
+	clock.Schedule(20, func() { order = append(order, 2) })
+	clock.Schedule(10, func() { order = append(order, 1) })
+	clock.Schedule(20, func() { order = append(order, 3) })
+	clock.Schedule(50, func() { order = append(order, 4) })
+
+	clock.RunUntil(120)
+	assert.Equal([]int{1, 2, 3}, order)
+	assert.Equal(uint64(120), clock.Now())
+
+	// Events can schedule events.
+	clock.Schedule(0, func() {
+		clock.Schedule(5, func() { order = append(order, 5) })
+	})
+	clock.RunUntil(1000)
+	assert.Equal([]int{1, 2, 3, 5, 4}, order)
+	assert.Equal(uint64(1000), clock.Now())
+	assert.False(clock.Step())
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	assert := assert.New(t)
+
+	run := func(seed int64) ([]string, [][32]byte) {
+		sim := newTestSimulation(t, seed, simTestHashrate, simTestHashrate, simTestHashrate)
+		sim.DropRate = 0.05
+		sim.Run(120_000)
+
+		tips := [][32]byte{}
+		for _, node := range sim.Nodes {
+			tips = append(tips, node.Dag.FullTip.Hash)
+		}
+		return sim.Trace, tips
+	}
+
+	trace1, tips1 := run(42)
+	trace2, tips2 := run(42)
+	assert.Less(0, len(trace1))
+	assert.Equal(trace1, trace2)
+	assert.Equal(tips1, tips2)
+
+	trace3, _ := run(43)
+	assert.NotEqual(trace1, trace3)
+}
+
+func TestSimulationConverges(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 1, simTestHashrate, simTestHashrate, simTestHashrate)
+	sim.Run(300_000)
+
+	// Let in-flight gossip arrive.
+	for _, node := range sim.Nodes {
+		node.SetHashrate(0)
+	}
+	sim.Run(1_000)
+
+	tip := sim.Nodes[0].Dag.FullTip
+	assert.Less(uint64(5), tip.Height)
+	for _, node := range sim.Nodes {
+		assert.Equal(tip.Hash, node.Dag.FullTip.Hash)
+	}
+}
+
+func TestSimulationPartition(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 2, simTestHashrate, simTestHashrate, simTestHashrate, simTestHashrate)
+	a, b := sim.Nodes[:2], sim.Nodes[2:]
+
+	sim.Partition(a, b)
+	sim.Run(120_000)
+
+	// Each side of the partition agrees on its own chain, and the sides diverge.
+	assert.Equal(a[0].Dag.FullTip.Hash, a[1].Dag.FullTip.Hash)
+	assert.Equal(b[0].Dag.FullTip.Hash, b[1].Dag.FullTip.Hash)
+	assert.NotEqual(a[0].Dag.FullTip.Hash, b[0].Dag.FullTip.Hash)
+
+	// Blocks mined in one partition are never seen in the other.
+	_, err := b[0].Dag.GetBlockByHash(a[0].Dag.FullTip.Hash)
+	assert.Equal(ErrBlockNotFound, err)
+}
+
+func TestSimulationSelfishMining(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 3, 2*simTestHashrate, simTestHashrate)
+	selfish, honest := sim.Nodes[0], sim.Nodes[1]
+	selfish.Withhold = true
+
+	sim.Run(120_000)
+	assert.Less(0, len(selfish.withheld))
+	assert.NotEqual(selfish.Dag.FullTip.Hash, honest.Dag.FullTip.Hash)
+	assert.Less(honest.Dag.FullTip.AccumulatedWork.Cmp(&selfish.Dag.FullTip.AccumulatedWork), 0)
+
+	// When the selfish miner releases its heavier chain, the honest node reorgs onto it.
+	selfish.SetHashrate(0)
+	honest.SetHashrate(0)
+	selfish.ReleaseWithheld()
+	sim.Run(1_000)
+	assert.Equal(selfish.Dag.FullTip.Hash, honest.Dag.FullTip.Hash)
+}
+
+func TestSimulationHashrateShare(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 4, 3*simTestHashrate, simTestHashrate)
+	sim.Run(600_000)
+
+	// Count the blocks each node mined.
+	mined := map[string]int{}
+	for _, line := range sim.Trace {
+		for _, node := range sim.Nodes {
+			if strings.Contains(line, "mined node="+node.Addr+" ") {
+				mined[node.Addr]++
+			}
+		}
+	}
+	total := mined[sim.Nodes[0].Addr] + mined[sim.Nodes[1].Addr]
+	assert.Less(20, total)
+
+	// The node with 75% of the hashrate mines roughly 75% of the blocks.
+	share := float64(mined[sim.Nodes[0].Addr]) / float64(total)
+	assert.InDelta(0.75, share, 0.15)
+}
+
+func TestSimulationLateJoinerSync(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 5, simTestHashrate, simTestHashrate)
+	sim.Run(120_000)
+	for _, node := range sim.Nodes {
+		node.SetHashrate(0)
+	}
+	sim.Run(1_000)
+
+	// A new node joins, and syncs the chain from its peers over the simulated network.
+	joiner, err := sim.AddNode(0)
+	if err != nil {
+		t.Fatalf("Failed to add node: %s", err)
+	}
+	assert.Equal(uint64(0), joiner.Dag.FullTip.Height)
+
+	joiner.Sync()
+	tip, err := joiner.Dag.GetLatestHeadersTip()
+	assert.Nil(err)
+	assert.Equal(sim.Nodes[0].Dag.FullTip.Hash, tip.Hash)
+}
+
+func TestSimulationForkSync(t *testing.T) {
+	assert := assert.New(t)
+	sim := newTestSimulation(t, 6, 2*simTestHashrate, simTestHashrate)
+	heavy, light := sim.Nodes[0], sim.Nodes[1]
+
+	sim.Partition([]*SimNode{heavy}, []*SimNode{light})
+	sim.Run(120_000)
+	for _, node := range sim.Nodes {
+		node.SetHashrate(0)
+	}
+	sim.Heal()
+	sim.Run(1_000)
+	assert.NotEqual(heavy.Dag.FullTip.Hash, light.Dag.FullTip.Hash)
+
+	// The lighter side finds where the heavier chain forks from its own, and syncs the fork.
+	light.Sync()
+	tip, err := light.Dag.GetLatestHeadersTip()
+	assert.Nil(err)
+	assert.Equal(heavy.Dag.FullTip.Hash, tip.Hash)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/bits"
+	"slices"
 )
 
 var ErrInsufficientBalance = errors.New("insufficient balance")
@@ -12,12 +13,41 @@ var ErrToBalanceOverflow = errors.New("\"to\" balance overflow")
 var ErrMinerBalanceOverflow = errors.New("\"miner\" balance overflow")
 var ErrAmountPlusFeeOverflow = errors.New("(amount + fee) overflow")
 var ErrTxAlreadySequenced = errors.New("transaction already sequenced")
+var ErrImmatureCoinbaseSpend = errors.New("spends immature coinbase funds")
 
 var stateMachineLogger = NewLogger("state-machine", "")
 
+// A BlockStateError is returned when a block's transactions cannot be applied to the state.
+// It identifies the offending block, so that it can be marked invalid in the block DAG.
+type BlockStateError struct {
+	BlockHash [32]byte
+	TxIndex   int
+	Err       error
+}
+
+func (e *BlockStateError) Error() string {
+	if e.TxIndex < 0 {
+		return fmt.Sprintf("Error transitioning state machine: block=%x error=\"%s\"", e.BlockHash, e.Err)
+	}
+	return fmt.Sprintf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", e.BlockHash, e.TxIndex, e.Err)
+}
+
+func (e *BlockStateError) Unwrap() error {
+	return e.Err
+}
+
 type StateLeaf struct {
 	PubKey  [65]byte
 	Balance uint64
+
+	// Coinbase rewards credited to the account which have not yet matured.
+	ImmatureCredits []CoinbaseCredit
+}
+
+// A coinbase reward which cannot be spent until the chain reaches the maturity height.
+type CoinbaseCredit struct {
+	Amount         uint64
+	MaturityHeight uint64
 }
 
 // The input to the state transition function.
@@ -33,6 +63,12 @@ type StateMachineInput struct {
 
 	// Block reward.
 	BlockReward uint64
+
+	// The height of the block containing the transaction.
+	BlockHeight uint64
+
+	// The number of blocks before a coinbase reward can be spent. Zero disables the rule.
+	CoinbaseMaturity uint64
 }
 
 // The state machine is the core of the business logic for the Nakamoto blockchain.
@@ -46,17 +82,26 @@ type StateMachineInput struct {
 type StateMachine struct {
 	// The current state.
 	state map[[65]byte]uint64
+
+	// Immature coinbase credits for each account.
+	immature map[[65]byte][]CoinbaseCredit
 }
 
 func NewStateMachine(db *sql.DB) (*StateMachine, error) {
 	return &StateMachine{
-		state: make(map[[65]byte]uint64),
+		state:    make(map[[65]byte]uint64),
+		immature: make(map[[65]byte][]CoinbaseCredit),
 	}, nil
 }
 
 func (c *StateMachine) Apply(leafs []*StateLeaf) {
 	for _, leaf := range leafs {
 		c.state[leaf.PubKey] = leaf.Balance
+		if len(leaf.ImmatureCredits) == 0 {
+			delete(c.immature, leaf.PubKey)
+		} else {
+			c.immature[leaf.PubKey] = leaf.ImmatureCredits
+		}
 	}
 }
 
@@ -106,6 +151,10 @@ func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf
 	if tmpState[fromAcc] < (amount + fee) {
 		return nil, ErrInsufficientBalance
 	}
+	// Check the transfer does not spend immature coinbase rewards.
+	if tmpState[fromAcc]-c.GetImmatureBalance(fromAcc, input.BlockHeight) < (amount + fee) {
+		return nil, ErrImmatureCoinbaseSpend
+	}
 	// Deduct the coins from the `from` account balance.
 	tmpState[fromAcc] -= amount
 	tmpState[fromAcc] -= fee
@@ -134,8 +183,9 @@ func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf
 	leaves := []*StateLeaf{}
 	for acc, balance := range tmpState {
 		leaves = append(leaves, &StateLeaf{
-			PubKey:  acc,
-			Balance: balance,
+			PubKey:          acc,
+			Balance:         balance,
+			ImmatureCredits: c.getImmatureCredits(acc, input.BlockHeight),
 		})
 	}
 	stateMachineLogger.Printf("New leaves: %d leaves", len(leaves))
@@ -158,10 +208,20 @@ func (c *StateMachine) transitionCoinbase(input StateMachineInput) ([]*StateLeaf
 	// Add the coins to the `to` account balance.
 	toBalance += blockReward
 
+	// Lock the reward until it matures.
+	credits := c.getImmatureCredits(input.RawTransaction.ToPubkey, input.BlockHeight)
+	if 0 < input.CoinbaseMaturity {
+		credits = append(credits, CoinbaseCredit{
+			Amount:         blockReward,
+			MaturityHeight: input.BlockHeight + input.CoinbaseMaturity,
+		})
+	}
+
 	// Create the new state leaves.
 	toLeaf := &StateLeaf{
-		PubKey:  input.RawTransaction.ToPubkey,
-		Balance: toBalance,
+		PubKey:          input.RawTransaction.ToPubkey,
+		Balance:         toBalance,
+		ImmatureCredits: credits,
 	}
 	leaves := []*StateLeaf{
 		toLeaf,
@@ -173,6 +233,43 @@ func (c *StateMachine) GetBalance(account [65]byte) uint64 {
 	return c.state[account]
 }
 
+// Returns the amount of an account's balance which is locked in coinbase rewards that have not matured at the given height.
+func (c *StateMachine) GetImmatureBalance(account [65]byte, height uint64) uint64 {
+	total := uint64(0)
+	for _, credit := range c.immature[account] {
+		if height < credit.MaturityHeight {
+			total += credit.Amount
+		}
+	}
+	return total
+}
+
+// Returns the account's coinbase credits which have not matured at the given height.
+func (c *StateMachine) getImmatureCredits(account [65]byte, height uint64) []CoinbaseCredit {
+	credits := []CoinbaseCredit{}
+	for _, credit := range c.immature[account] {
+		if height < credit.MaturityHeight {
+			credits = append(credits, credit)
+		}
+	}
+	return credits
+}
+
+// Returns a copy of the state machine, which can be transitioned without modifying the original.
+func (c *StateMachine) Copy() *StateMachine {
+	copied := &StateMachine{
+		state:    make(map[[65]byte]uint64, len(c.state)),
+		immature: make(map[[65]byte][]CoinbaseCredit, len(c.immature)),
+	}
+	for account, balance := range c.state {
+		copied.state[account] = balance
+	}
+	for account, credits := range c.immature {
+		copied.immature[account] = slices.Clone(credits)
+	}
+	return copied
+}
+
 // Returns a list of modified accounts.
 func (c *StateMachine) GetStateSnapshot() []StateLeaf {
 	return nil
@@ -193,11 +290,16 @@ func RebuildState(dag *BlockDAG, stateMachine StateMachine, longestChainHashList
 		}
 
 		if len(*txs) == 0 {
-			return nil, fmt.Errorf("Block %x has no transactions", blockHash)
+			return nil, &BlockStateError{BlockHash: blockHash, TxIndex: -1, Err: errors.New("block has no transactions")}
 		}
 
 		// stateMachineLogger.Printf("Processing block %x with %d transactions", blockHash, len(*txs))
 
+		block, err := dag.GetBlockByHash(blockHash)
+		if err != nil {
+			return nil, err
+		}
+
 		// 2. Map transactions to state leaves through state machine transition function.
 		var stateMachineInput StateMachineInput
 		var minerPubkey [65]byte
@@ -217,12 +319,15 @@ func RebuildState(dag *BlockDAG, stateMachine StateMachine, longestChainHashList
 				IsCoinbase:     isCoinbase,
 				MinerPubkey:    minerPubkey,
 				BlockReward:    blockReward,
+
+				BlockHeight:      block.Height,
+				CoinbaseMaturity: dag.consensus.getCoinbaseMaturity(block.Height),
 			}
 
 			// Transition the state machine.
 			effects, err := stateMachine.Transition(stateMachineInput)
 			if err != nil {
-				return nil, fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", blockHash, i, err)
+				return nil, &BlockStateError{BlockHash: blockHash, TxIndex: i, Err: err}
 			}
 
 			// Apply the effects.
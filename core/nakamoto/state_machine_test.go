@@ -3,6 +3,7 @@ package nakamoto
 import (
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"math/big"
 	"testing"
 
@@ -64,7 +65,7 @@ func TestStateMachineIdea(t *testing.T) {
 	// Assert balances.
 	// Ingest some transactions and calculate the state.
 	tx0 := StateMachineInput{
-		RawTransaction: MakeTransferTx(wallets[0].PubkeyBytes(), wallets[0].PubkeyBytes(), 100, 0, &wallets[0]),
+		RawTransaction: MakeTransferTx(wallets[0].PubkeyBytes(), wallets[0].PubkeyBytes(), 100, 0, 0, &wallets[0]),
 		IsCoinbase:     true,
 		MinerPubkey:    [65]byte{},
 		BlockReward:    100,
@@ -81,7 +82,7 @@ func TestStateMachineIdea(t *testing.T) {
 
 	// Now transfer coins to another account.
 	tx1 := StateMachineInput{
-		RawTransaction: MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 50, 0, &wallets[0]),
+		RawTransaction: MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 50, 0, 0, &wallets[0]),
 		IsCoinbase:     false,
 		MinerPubkey:    [65]byte{},
 		BlockReward:    0,
@@ -523,7 +524,7 @@ func TestStateMachineTxAlreadySequenced(t *testing.T) {
 
 	// Now we send a transfer tx.
 	// First create the tx, then mine a block with it.
-	rawTx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 0, &wallets[0])
+	rawTx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 0, 0, &wallets[0])
 	miner.GetBlockBody = func() BlockBody {
 		return []RawTransaction{rawTx}
 	}
@@ -571,3 +572,128 @@ func TestStateMachineTxAlreadySequenced(t *testing.T) {
 	assert.Equal(t, "transaction already sequenced", err.Error())
 	assertIntEqual(t, 0, len(effects))
 }
+
+func TestStateMachineCoinbaseMaturity(t *testing.T) {
+	assert := assert.New(t)
+	db := newStateDB()
+	wallets := getTestingWallets(t)
+	stateMachine, err := NewStateMachine(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mint 100 coins at height 1, which mature at height 4.
+	coinbaseTx := StateMachineInput{
+		RawTransaction:   MakeTransferTx(wallets[0].PubkeyBytes(), wallets[0].PubkeyBytes(), 100, 0, 0, &wallets[0]),
+		IsCoinbase:       true,
+		MinerPubkey:      [65]byte{},
+		BlockReward:      100,
+		BlockHeight:      1,
+		CoinbaseMaturity: 3,
+	}
+	effects, err := stateMachine.Transition(coinbaseTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(100), stateMachine.GetBalance(wallets[0].PubkeyBytes()))
+	assert.Equal(uint64(100), stateMachine.GetImmatureBalance(wallets[0].PubkeyBytes(), 1))
+
+	// Spending before maturity fails.
+	transferTx := StateMachineInput{
+		RawTransaction:   MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 50, 0, 0, &wallets[0]),
+		IsCoinbase:       false,
+		MinerPubkey:      [65]byte{},
+		BlockReward:      0,
+		BlockHeight:      3,
+		CoinbaseMaturity: 3,
+	}
+	_, err = stateMachine.Transition(transferTx)
+	assert.Equal(ErrImmatureCoinbaseSpend, err)
+
+	// Spending more than the balance is still reported as an insufficient balance.
+	overspendTx := transferTx
+	overspendTx.RawTransaction = MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 150, 0, 0, &wallets[0])
+	_, err = stateMachine.Transition(overspendTx)
+	assert.Equal(ErrInsufficientBalance, err)
+
+	// Spending at the maturity height succeeds.
+	transferTx.BlockHeight = 4
+	effects, err = stateMachine.Transition(transferTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(50), stateMachine.GetBalance(wallets[0].PubkeyBytes()))
+	assert.Equal(uint64(50), stateMachine.GetBalance(wallets[1].PubkeyBytes()))
+	assert.Equal(uint64(0), stateMachine.GetImmatureBalance(wallets[0].PubkeyBytes(), 4))
+}
+
+func TestStateMachineRebuildRejectsImmatureCoinbaseSpend(t *testing.T) {
+	dag, _, _ := newBlockdagForStateMachine()
+	dag.consensus.CoinbaseMaturity = 5
+	dag.consensus.Upgrades = map[string]uint64{
+		UpgradeCoinbaseMaturity: 0,
+	}
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mine 3 blocks, then spend the first block's reward before it has matured.
+	miner.Start(3)
+	rawTx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 0, 0, &wallets[0])
+	miner.GetBlockBody = func() BlockBody {
+		return []RawTransaction{rawTx}
+	}
+	blocks := miner.Start(1)
+
+	state, err := NewStateMachine(dag.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longestChainHashList, err := dag.GetLongestChainHashList(dag.FullTip.Hash, dag.FullTip.Height)
+	if err != nil {
+		t.Fatalf("Failed to get longest chain hash list: %s\n", err)
+	}
+	_, err = RebuildState(&dag, *state, longestChainHashList)
+
+	var blockErr *BlockStateError
+	if !errors.As(err, &blockErr) {
+		t.Fatalf("Expected block state error, got: %v", err)
+	}
+	assert.Equal(t, blocks[0].Hash(testHasher), blockErr.BlockHash)
+	assert.Equal(t, 1, blockErr.TxIndex)
+	assert.ErrorIs(t, err, ErrImmatureCoinbaseSpend)
+
+	// Once the reward has matured, the same chain is valid.
+	dag.consensus.CoinbaseMaturity = 3
+	state, err = NewStateMachine(dag.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = RebuildState(&dag, *state, longestChainHashList)
+	if err != nil {
+		t.Fatalf("Failed to rebuild state: %s\n", err)
+	}
+	assertIntEqual(t, uint64(100), state.GetBalance(wallets[1].PubkeyBytes()))
+
+	// Before the upgrade activates, coinbase rewards can be spent immediately.
+	dag.consensus.CoinbaseMaturity = 5
+	dag.consensus.Upgrades = map[string]uint64{
+		UpgradeCoinbaseMaturity: 2,
+	}
+	state, err = NewStateMachine(dag.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = RebuildState(&dag, *state, longestChainHashList)
+	if err != nil {
+		t.Fatalf("Failed to rebuild state: %s\n", err)
+	}
+	assertIntEqual(t, uint64(100), state.GetBalance(wallets[1].PubkeyBytes()))
+}
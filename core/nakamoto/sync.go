@@ -3,6 +3,7 @@ package nakamoto
 import (
 	"fmt"
 	"math/big"
+	"slices"
 	"sync"
 
 	"github.com/liamzebedee/tinychain-go/core"
@@ -19,8 +20,31 @@ func (d downloadPeerImpl) String() string {
 }
 
 // DownloadPeerImpl performs one type of work: SyncGetBlockData.
+// Peers which fail to respond or send bad replies are penalised.
 func (d downloadPeerImpl) Work(item DownloadWorkItem) (DownloadWorkResult, error) {
-	return d.ourpeer.SyncGetBlockData(*d.peer, item.FromBlock, item.Heights, item.Headers, item.Bodies)
+	res, err := d.ourpeer.SyncGetBlockData(*d.peer, item.FromBlock, item.Heights, item.Headers, item.Bodies)
+	if err != nil {
+		d.ourpeer.reportRequestError(*d.peer, err)
+		return res, err
+	}
+	if err := validateSyncReply(item, res); err != nil {
+		d.ourpeer.ReportMisbehaviour(*d.peer, PeerPenaltyBadSyncReply, err.Error())
+		return res, err
+	}
+	return res, nil
+}
+
+// Checks a sync_get_data reply contains only the data requested. The headers and bodies are validated when they are
+// ingested.
+func validateSyncReply(item DownloadWorkItem, res DownloadWorkResult) error {
+	count := item.Heights.Count()
+	if count < len(res.Headers) || (!item.Headers && 0 < len(res.Headers)) {
+		return fmt.Errorf("Sync reply contains headers which were not requested.")
+	}
+	if count < len(res.Bodies) || (!item.Bodies && 0 < len(res.Bodies)) {
+		return fmt.Errorf("Sync reply contains bodies which were not requested.")
+	}
+	return nil
 }
 
 // Downloads block headers/bodies in parallel from a set of peers for a set of heights, relative to a base blockhash and height.
@@ -129,6 +153,18 @@ type SyncGetTipAtDepthReply struct {
 	Tip  [32]byte `json:"tip"`
 }
 
+// sync_get_fork_point
+// Finds the fork point between the sender's chain and the receiver's chain, using a block locator.
+type SyncGetForkPointMessage struct {
+	Type    string     `json:"type"`
+	Locator [][32]byte `json:"locator"`
+}
+
+type SyncGetForkPointReply struct {
+	Type      string   `json:"type"`
+	ForkPoint [32]byte `json:"forkPoint"`
+}
+
 // sync_get_data
 type SyncGetBlockDataMessage struct {
 	Type      string      `json:"type"`
@@ -147,7 +183,7 @@ type SyncGetBlockDataReply struct {
 // Verify the header chain we have received.
 // ie. A -> B -> C ... -> Z
 // We should have all the headers from A to Z.
-func orderValidateHeaders(root [32]byte, headers []BlockHeader) []BlockHeader {
+func orderValidateHeaders(hasher core.Hasher, root [32]byte, headers []BlockHeader) []BlockHeader {
 	// Verify the header chain we have received.
 	// ie. A -> B -> C ... -> Z
 	// We should have all the headers from A to Z.
@@ -165,7 +201,7 @@ func orderValidateHeaders(root [32]byte, headers []BlockHeader) []BlockHeader {
 		if next, ok := nextRefs[base]; ok {
 			node := headers[next]
 			chain = append(chain, node)
-			base = node.BlockHash()
+			base = node.BlockHash(hasher)
 		} else {
 			break
 		}
@@ -175,10 +211,14 @@ func orderValidateHeaders(root [32]byte, headers []BlockHeader) []BlockHeader {
 }
 
 func (n *Node) getPeerTips(baseBlock [32]byte, depth uint64, dir int) (map[[32]byte][]Peer, error) {
+	return n.getPeerTipsFrom(n.Peer.GetPeers(), baseBlock, depth, dir)
+}
+
+func (n *Node) getPeerTipsFrom(peers []Peer, baseBlock [32]byte, depth uint64, dir int) (map[[32]byte][]Peer, error) {
 	// NOTE: we only request their tip hash in order to bucket them.
 	peersTips := make(map[[32]byte][]Peer)
 
-	for _, peer := range n.Peer.peers {
+	for _, peer := range peers {
 		tip, err := n.Peer.SyncGetTipAtDepth(peer, baseBlock, depth, dir)
 		if err != nil {
 			// Skip. Peer will not be used for downloading.
@@ -217,9 +257,9 @@ func (n *Node) Sync() int {
 
 	// Greedily searches the block DAG from a tip hash, downloading headers in parallel from peers from all subbranches up to a depth.
 	// The depth is referred to as the "window size", and is a constant value of 2048 blocks.
-	search := func(currentTipHash [32]byte) int {
-		// 1. Get the tips from all our peers and bucket them.
-		peersTips, err := n.getPeerTips(currentTipHash, uint64(WINDOW_SIZE), 1)
+	search := func(currentTipHash [32]byte, peers []Peer) int {
+		// 1. Get the tips from the peers and bucket them.
+		peersTips, err := n.getPeerTipsFrom(peers, currentTipHash, uint64(WINDOW_SIZE), 1)
 		if err != nil {
 			n.syncLog.Printf("Failed to get peer tips: %s\n", err)
 			return 0
@@ -243,7 +283,7 @@ func (n *Node) Sync() int {
 
 			// 2c. Validate headers.
 			// Sanity-check: verify we have all the headers for the heights in order. TODO.
-			headers2 := orderValidateHeaders(currentTipHash, headers)
+			headers2 := orderValidateHeaders(n.Dag.hasher, currentTipHash, headers)
 
 			// 2d. Ingest headers.
 			for _, header := range headers2 {
@@ -258,6 +298,11 @@ func (n *Node) Sync() int {
 
 			n.syncLog.Printf("Downloaded %d headers\n", downloaded)
 
+			// Light nodes only sync headers.
+			if n.IsLight() {
+				continue
+			}
+
 			// Now get the bodies.
 			// Filter through missing bodies for headers.
 			heights2 := core.NewBitset(WINDOW_SIZE)
@@ -288,17 +333,21 @@ func (n *Node) Sync() int {
 		return downloaded
 	}
 
-	currentTip, err := n.Dag.GetLatestHeadersTip()
-	if err != nil {
-		n.syncLog.Printf("Failed to get latest tip: %s\n", err)
-		return 0
-	}
-
 	totalSynced := 0
 
 	for {
-		// Search for headers from current tip.
-		downloaded := search(currentTip.Hash)
+		currentTip, err := n.Dag.GetLatestHeadersTip()
+		if err != nil {
+			n.syncLog.Printf("Failed to get latest tip: %s\n", err)
+			break
+		}
+
+		// Find where each peer's chain forks from ours, and search for headers from there. Peers on our chain fork
+		// from our tip.
+		downloaded := 0
+		for forkPoint, peers := range n.sync_getForkPoints(currentTip.Hash) {
+			downloaded += search(forkPoint, peers)
+		}
 		totalSynced += downloaded
 
 		// Exit when there are no more headers to download.
@@ -336,7 +385,7 @@ func (n *Node) sync_getBestTipFromPeers() [32]byte {
 				syncLog.Printf("Failed to get tip from peer: %s\n", err)
 				return
 			}
-			syncLog.Printf("Got tip from peer: hash=%s\n", tip.BlockHashStr())
+			syncLog.Printf("Got tip from peer: hash=%s\n", tip.BlockHashStr(n.Dag.hasher))
 			tipsChan <- tip
 		}(peer)
 	}
@@ -375,7 +424,7 @@ func (n *Node) sync_getBestTipFromPeers() [32]byte {
 	bestTipHash := [32]byte{}
 
 	for _, tip := range tips {
-		hash := tip.BlockHash()
+		hash := tip.BlockHash(n.Dag.hasher)
 		// TODO embed difficulty into block header so we can verify POW.
 		work := CalculateWork(Bytes32ToBigInt(hash))
 
@@ -394,44 +443,33 @@ func (n *Node) sync_getBestTipFromPeers() [32]byte {
 	return bestTipHash
 }
 
-// Computes the common ancestor of our local canonical chain and a remote peer's canonical chain through an interactive binary search.
-// O(log N * query_size).
-func (n *Node) sync_computeCommonAncestorWithPeer(peer Peer, local_chainhashes *[][32]byte) [32]byte {
-	syncLog := NewLogger("node", "sync")
+// Finds the fork point between our chain and each peer's chain, using a block locator from our tip, in one round trip
+// per peer. Returns our peers bucketed by their fork point.
+func (n *Node) sync_getForkPoints(tipHash [32]byte) map[[32]byte][]Peer {
+	forkPoints := make(map[[32]byte][]Peer)
 
-	// 6a. Compute the common ancestor (interactive binary search).
-	// This is a classical binary search algorithm.
-	floor := 0
-	ceil := len(*local_chainhashes)
-	n_iterations := 0
-
-	for (floor + 1) < ceil {
-		guess_idx := (floor + ceil) / 2
-		guess_value := (*local_chainhashes)[guess_idx]
-
-		syncLog.Printf("Iteration %d: floor=%d, ceil=%d, guess_idx=%d, guess_value=%x", n_iterations, floor, ceil, guess_idx, guess_value)
-		n_iterations += 1
+	locator, err := n.Dag.GetBlockLocator(tipHash)
+	if err != nil {
+		n.syncLog.Printf("Failed to get block locator: %s\n", err)
+		return forkPoints
+	}
 
-		// Send our tip's blockhash
-		// Peer responds with "SEEN" or "NOT SEEN"
-		// If "SEEN", we move to the right half.
-		// If "NOT SEEN", we move to the left half.
-		has, err := n.Peer.HasBlock(peer, guess_value)
+	for _, peer := range n.Peer.GetPeers() {
+		forkPoint, err := n.Peer.SyncGetForkPoint(peer, locator)
 		if err != nil {
-			syncLog.Printf("Failed to get block from peer: %s\n", err)
+			// Skip. Peer will not be used for downloading.
+			n.syncLog.Printf("Failed to get fork point from peer: peer=%s err=%s\n", peer.Addr, err)
 			continue
 		}
-		if has {
-			// Move to the right half.
-			floor = guess_idx
-		} else {
-			// Move to the left half.
-			ceil = guess_idx
+
+		// Peers must reply with a block from our locator.
+		if !slices.Contains(locator, forkPoint) {
+			n.Peer.ReportMisbehaviour(peer, PeerPenaltyBadSyncReply, fmt.Sprintf("Fork point %x is not in our locator", forkPoint))
+			continue
 		}
+
+		forkPoints[forkPoint] = append(forkPoints[forkPoint], peer)
 	}
 
-	ancestor := (*local_chainhashes)[floor]
-	syncLog.Printf("Common ancestor: %x", ancestor)
-	syncLog.Printf("Found in %d iterations.", n_iterations)
-	return ancestor
+	return forkPoints
 }
@@ -301,7 +301,7 @@ func TestSyncScheduleDownloadWork1(t *testing.T) {
 	}
 	for i, result := range results {
 		for j, header := range result.Headers {
-			t.Logf("Header #%d-%d: %x (parent %x, nonce %x)", (i + 1), (j + 1), header.BlockHash(), header.ParentHash, header.Nonce)
+			t.Logf("Header #%d-%d: %x (parent %x, nonce %x)", (i + 1), (j + 1), header.BlockHash(testHasher), header.ParentHash, header.Nonce)
 		}
 	}
 
@@ -312,12 +312,12 @@ func TestSyncScheduleDownloadWork1(t *testing.T) {
 	for _, result := range results {
 		all_headers = append(all_headers, result.Headers...)
 	}
-	headers2 := orderValidateHeaders(tip3.Hash, all_headers)
+	headers2 := orderValidateHeaders(testHasher, tip3.Hash, all_headers)
 
 	// Now print header chain.
 	t.Logf("Ordering headers...")
 	for i, header := range headers2 {
-		t.Logf("Header #%d: %x", i+1, header.BlockHash())
+		t.Logf("Header #%d: %x", i+1, header.BlockHash(testHasher))
 	}
 
 	// Now ingest headers.
@@ -346,7 +346,7 @@ func TestSyncScheduleDownloadWork1(t *testing.T) {
 	}
 	for i, result := range results {
 		for j, body := range result.Bodies {
-			merkleRoot := GetMerkleRootForTxs(body)
+			merkleRoot := getWitnessMerkleRootForTxs(testHasher, body)
 			t.Logf("Body #%d-%d: %d (merkle_root=%x)", (i + 1), (j + 1), len(body), merkleRoot)
 		}
 	}
@@ -451,7 +451,7 @@ func TestSyncSyncDownloadDataHeaders(t *testing.T) {
 		t.Errorf("Error downloading headers: %s", err)
 	}
 
-	headers2 := orderValidateHeaders(node3.Dag.HeadersTip.Hash, headers)
+	headers2 := orderValidateHeaders(testHasher, node3.Dag.HeadersTip.Hash, headers)
 	t.Logf("Ordered headers length: %d", len(headers2))
 	for _, header := range headers2 {
 		err := node3.Dag.IngestHeader(header)
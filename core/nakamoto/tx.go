@@ -1,8 +1,10 @@
 package nakamoto
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/liamzebedee/tinychain-go/core"
 )
@@ -26,9 +28,10 @@ type Transaction struct {
 	Fee        uint64   `json:"fee"`
 	Nonce      uint64   `json:"nonce"`
 
-	Hash      [32]byte
-	Blockhash [32]byte
-	TxIndex   uint64
+	Hash        [32]byte
+	WitnessHash [32]byte
+	Blockhash   [32]byte
+	TxIndex     uint64
 }
 
 func (tx *Transaction) ToRawTransaction() RawTransaction {
@@ -70,6 +73,19 @@ func (tx *RawTransaction) Bytes() []byte {
 	return buf
 }
 
+// The size of a transaction's canonical encoding, including its signature.
+const RawTransactionSizeBytes = 1 + 64 + 65 + 65 + 8 + 8 + 8
+
+// Decodes a transaction from its canonical encoding, as returned by Bytes().
+func RawTransactionFromBytes(buf []byte) (RawTransaction, error) {
+	var tx RawTransaction
+	if len(buf) != RawTransactionSizeBytes {
+		return tx, fmt.Errorf("Invalid transaction length: %d", len(buf))
+	}
+	err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &tx)
+	return tx, err
+}
+
 func (tx *RawTransaction) Envelope() []byte {
 	buf := make([]byte, 0)
 	buf = append(buf, tx.Version)
@@ -91,14 +107,24 @@ func (tx *RawTransaction) Envelope() []byte {
 	return buf
 }
 
+// Returns the transaction ID, which is the hash of the envelope.
+// The signature is excluded, so that the ID cannot be changed without changing the transaction's contents.
 func (tx *RawTransaction) Hash() [32]byte {
 	// Hash the envelope.
+	h := sha256.New()
+	h.Write(tx.Envelope())
+	return sha256.Sum256(h.Sum(nil))
+}
+
+// Returns the witness hash, which is the hash of the full transaction including the signature.
+func (tx *RawTransaction) WitnessHash() [32]byte {
 	h := sha256.New()
 	h.Write(tx.Bytes())
 	return sha256.Sum256(h.Sum(nil))
 }
 
-func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, fee uint64, wallet *core.Wallet) RawTransaction {
+// Makes a signed transfer. The nonce distinguishes otherwise identical transfers, which would share a txid.
+func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, fee uint64, nonce uint64, wallet *core.Wallet) RawTransaction {
 	tx := RawTransaction{
 		Version:    1,
 		Sig:        [64]byte{},
@@ -106,7 +132,7 @@ func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, fee uint64, walle
 		ToPubkey:   to,
 		Amount:     amount,
 		Fee:        fee,
-		Nonce:      0,
+		Nonce:      nonce,
 	}
 	// Sign tx.
 	sig, err := wallet.Sign(tx.Envelope())
@@ -117,10 +143,35 @@ func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, fee uint64, walle
 	return tx
 }
 
-func GetMerkleRootForTxs(txs []RawTransaction) [32]byte {
-	envs := make([][]byte, 0)
+// A proof that a transaction was included in a block.
+// A light client holding only block headers can verify it against the header's transactions merkle root.
+type TxProof struct {
+	Tx          RawTransaction   `json:"tx"`
+	BlockHeader BlockHeader      `json:"block_header"`
+	Proof       core.MerkleProof `json:"proof"`
+}
+
+// Verifies the transaction is included in the block header's transactions merkle root. The leaves depend on the
+// block's height, see ConsensusConfig.verifyTxProof.
+func (p *TxProof) verify(h core.Hasher, witnessLeaves bool) bool {
+	leaf := getTxMerkleLeaf(p.Tx, witnessLeaves)
+	return core.VerifyMerkleProof(h, p.BlockHeader.TransactionsMerkleRoot, leaf, p.Proof)
+}
+
+// Gets the leaf of the transactions merkle tree for a transaction. Blocks before UpgradeWitnessMerkleLeaves used the
+// full transaction as the leaf, rather than its witness hash.
+func getTxMerkleLeaf(tx RawTransaction, witnessLeaves bool) []byte {
+	if !witnessLeaves {
+		return tx.Bytes()
+	}
+	witnessHash := tx.WitnessHash()
+	return witnessHash[:]
+}
+
+func getTxMerkleLeaves(txs []RawTransaction, witnessLeaves bool) [][]byte {
+	leaves := make([][]byte, 0)
 	for _, tx := range txs {
-		envs = append(envs, tx.Bytes())
+		leaves = append(leaves, getTxMerkleLeaf(tx, witnessLeaves))
 	}
-	return core.ComputeMerkleHash(envs)
+	return leaves
 }
@@ -0,0 +1,71 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Computes the transactions merkle root for a block on a network where UpgradeWitnessMerkleLeaves is active.
+func getWitnessMerkleRootForTxs(h core.Hasher, txs []RawTransaction) [32]byte {
+	return core.ComputeMerkleHash(h, getTxMerkleLeaves(txs, true))
+}
+
+// Computes the merkle proof for a transaction in a block on a network where UpgradeWitnessMerkleLeaves is active.
+func getWitnessMerkleProofForTx(h core.Hasher, txs []RawTransaction, index int) (core.MerkleProof, error) {
+	return core.ComputeMerkleProof(h, getTxMerkleLeaves(txs, true), index)
+}
+
+func TestTxHashExcludesSignature(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+
+	tx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 1, 0, &wallets[0])
+	txid := tx.Hash()
+	witnessHash := tx.WitnessHash()
+	merkleRoot := getWitnessMerkleRootForTxs(testHasher, []RawTransaction{tx})
+	assert.NotEqual(txid, witnessHash)
+
+	// Change the tx's signature.
+	resigned := tx
+	resigned.Sig[0] ^= 0xff
+	assert.NotEqual(tx.Sig, resigned.Sig)
+
+	// The txid is unchanged, while the witness hash and merkle root change.
+	assert.Equal(txid, resigned.Hash())
+	assert.NotEqual(witnessHash, resigned.WitnessHash())
+	assert.NotEqual(merkleRoot, getWitnessMerkleRootForTxs(testHasher, []RawTransaction{resigned}))
+}
+
+func TestDagRejectsHighSSignature(t *testing.T) {
+	assert := assert.New(t)
+	blockdag, _, _, genesisBlock := newBlockdag()
+
+	tx, err := newValidCoinbaseTx(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malleate the signature to its high-S form.
+	s := new(big.Int).SetBytes(tx.Sig[32:])
+	n, _ := new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+	highS := new(big.Int).Sub(n, s)
+	copy(tx.Sig[32:], PadBytes(highS.Bytes(), 32))
+
+	b := RawBlock{
+		ParentHash:             genesisBlock.Hash(testHasher),
+		Timestamp:              0,
+		NumTransactions:        1,
+		TransactionsMerkleRoot: [32]byte{},
+		Nonce:                  [32]byte{},
+		Transactions: []RawTransaction{
+			tx,
+		},
+	}
+	b.TransactionsMerkleRoot = getWitnessMerkleRootForTxs(testHasher, b.Transactions)
+
+	err = blockdag.IngestBlock(b)
+	assert.Equal("Transaction 0 is invalid: signature invalid.", err.Error())
+}
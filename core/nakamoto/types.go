@@ -59,9 +59,33 @@ type HeartbeatMesage struct {
 	ClientVersion       string `json:"clientVersion"`
 	WireProtocolVersion uint   `json:"wireProtocolVersion"`
 	ClientAddress       string `json:"clientAddress"`
-	PeerId              string `json:"peerId"` // TODO temporary fix.
-	// TODO add chain/network ID.
+	PeerId              string `json:"peerId"`
+	// The time the heartbeat was sent.
 	Time time.Time `json:"time"`
+
+	// The ID of the network the sender is on, derived from its genesis block hash.
+	NetworkId string `json:"networkId"`
+	// The oldest wire protocol version the sender supports.
+	MinWireProtocolVersion uint `json:"minWireProtocolVersion"`
+
+	// A random challenge, which the receiver signs in its reply to prove it owns its peer ID.
+	Challenge string `json:"challenge"`
+	// The signature over the challenge in the message being replied to.
+	Signature string `json:"signature"`
+}
+
+// peer_auth
+// Sent after a heartbeat, to prove we own our peer ID by signing the challenge in the peer's reply.
+type PeerAuthMessage struct {
+	Type      string `json:"type"` // "peer_auth"
+	PeerId    string `json:"peerId"`
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+type PeerAuthReply struct {
+	// A token which identifies us in later messages to the peer.
+	Session string `json:"session"`
 }
 
 // get_tip
@@ -95,17 +119,94 @@ type GetBlocksReply struct {
 
 // has_block
 type HasBlockMessage struct {
-	Type      string `json:"type"` // "have_block"
+	Type      string `json:"type"` // "has_block"
 	BlockHash string `json:"blockHash"`
 }
 
 type HasBlockReply struct {
-	Type string `json:"type"` // "have_block_reply"
+	Type string `json:"type"` // "has_block_reply"
 	Has  bool   `json:"has"`
 }
 
+// get_tx_proof
+type GetTxProofMessage struct {
+	Type   string `json:"type"` // "get_tx_proof"
+	TxHash string `json:"txHash"`
+}
+
+type GetTxProofReply struct {
+	Type    string  `json:"type"` // "get_tx_proof_reply"
+	TxProof TxProof `json:"txProof"`
+}
+
+// get_account_tx_proofs
+type GetAccountTxProofsMessage struct {
+	Type    string `json:"type"` // "get_account_tx_proofs"
+	Account string `json:"account"`
+	Offset  uint64 `json:"offset"`
+	Limit   uint64 `json:"limit"`
+}
+
+type GetAccountTxProofsReply struct {
+	Type     string    `json:"type"` // "get_account_tx_proofs_reply"
+	TxProofs []TxProof `json:"txProofs"`
+	// The offset of the next page, or 0 if there are no more proofs.
+	NextOffset uint64 `json:"nextOffset"`
+}
+
+// submit_builder_bid
+type SubmitBuilderBidMessage struct {
+	Type string     `json:"type"` // "submit_builder_bid"
+	Bid  BuilderBid `json:"bid"`
+}
+
 // gossip_peers
 type GossipPeersMessage struct {
 	Type  string   `json:"type"` // "gossip_peers"
 	Peers []string `json:"myPeers"`
 }
+
+// getwork
+type GetWorkMessage struct {
+	Type string `json:"type"` // "getwork"
+}
+
+type GetWorkReply struct {
+	Type        string      `json:"type"` // "getwork_reply"
+	WorkId      string      `json:"workId"`
+	Header      BlockHeader `json:"header"`
+	Target      string      `json:"target"`
+	ShareTarget string      `json:"shareTarget,omitempty"` // Only set by pools.
+}
+
+// submitwork
+type SubmitWorkMessage struct {
+	Type   string `json:"type"` // "submitwork"
+	WorkId string `json:"workId"`
+	Nonce  string `json:"nonce"`
+}
+
+type SubmitWorkReply struct {
+	Type      string `json:"type"` // "submitwork_reply"
+	BlockHash string `json:"blockHash"`
+}
+
+// submitshare
+type SubmitShareMessage struct {
+	Type   string `json:"type"` // "submitshare"
+	WorkId string `json:"workId"`
+	Nonce  string `json:"nonce"`
+	Miner  string `json:"miner"`
+}
+
+type SubmitShareReply struct {
+	Type      string `json:"type"` // "submitshare_reply"
+	ShareHash string `json:"shareHash"`
+	IsBlock   bool   `json:"isBlock"`
+}
+
+// pool_stats
+type PoolStatsReply struct {
+	Type   string           `json:"type"` // "pool_stats_reply"
+	Miners []PoolMinerStats `json:"miners"`
+}
@@ -0,0 +1,78 @@
+package nakamoto
+
+import (
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Consensus upgrades.
+//
+// A consensus upgrade is a named change to the validation rules, which activates at a block height configured per network
+// in ConsensusConfig.Upgrades. Blocks below the activation height are validated under the old rules, and blocks at or
+// above it under the new rules, so a running network can change its rules without restarting from a new genesis.
+//
+// Validation code should never check a height directly, but ask whether an upgrade is active:
+//
+//	if dag.consensus.IsUpgradeActive(UpgradeCoinbaseHeight, height) { ... }
+//
+// An upgrade which is not scheduled in a network's config is never active on that network.
+
+const (
+	// The coinbase tx nonce must equal the block height, making every coinbase txid unique.
+	UpgradeCoinbaseHeight = "coinbase_height"
+
+	// Coinbase rewards cannot be spent until ConsensusConfig.CoinbaseMaturity blocks have been built on top of them.
+	UpgradeCoinbaseMaturity = "coinbase_maturity"
+
+	// The leaves of the transactions merkle tree are the witness hashes of the transactions, rather than the full
+	// transactions.
+	UpgradeWitnessMerkleLeaves = "witness_merkle_leaves"
+
+	// Transaction signatures must have a low S value, as (r, N-s) is also a valid signature for the same transaction.
+	UpgradeLowS = "low_s"
+
+	// The network uses the hash function named by ConsensusConfig.HashFunction rather than SHA256. As the hash function
+	// determines the hash of every block, it can only be activated at genesis.
+	UpgradeHashFunction = "hash_function"
+)
+
+// Returns true if the named upgrade is active for a block at the given height.
+func (c *ConsensusConfig) IsUpgradeActive(name string, height uint64) bool {
+	activationHeight, ok := c.Upgrades[name]
+	if !ok {
+		return false
+	}
+	return activationHeight <= height
+}
+
+// Gets the number of blocks before the coinbase reward of a block at the given height can be spent.
+func (c *ConsensusConfig) getCoinbaseMaturity(height uint64) uint64 {
+	if !c.IsUpgradeActive(UpgradeCoinbaseMaturity, height) {
+		return 0
+	}
+	return c.CoinbaseMaturity
+}
+
+// Computes the transactions merkle root for a block at the given height.
+func (c *ConsensusConfig) getMerkleRootForTxs(h core.Hasher, height uint64, txs []RawTransaction) [32]byte {
+	witnessLeaves := c.IsUpgradeActive(UpgradeWitnessMerkleLeaves, height)
+	return core.ComputeMerkleHash(h, getTxMerkleLeaves(txs, witnessLeaves))
+}
+
+// Computes the merkle proof for the transaction at the given index in a block at the given height.
+func (c *ConsensusConfig) getMerkleProofForTx(h core.Hasher, height uint64, txs []RawTransaction, index int) (core.MerkleProof, error) {
+	witnessLeaves := c.IsUpgradeActive(UpgradeWitnessMerkleLeaves, height)
+	return core.ComputeMerkleProof(h, getTxMerkleLeaves(txs, witnessLeaves), index)
+}
+
+// Verifies a transaction proof for a block at the given height.
+func (c *ConsensusConfig) verifyTxProof(h core.Hasher, height uint64, proof TxProof) bool {
+	return proof.verify(h, c.IsUpgradeActive(UpgradeWitnessMerkleLeaves, height))
+}
+
+// Verifies a transaction's signature, for a block at the given height.
+func (c *ConsensusConfig) verifyTxSignature(height uint64, tx RawTransaction) bool {
+	if c.IsUpgradeActive(UpgradeLowS, height) {
+		return core.VerifySignature(tx.FromPubkey, tx.Sig[:], tx.Envelope())
+	}
+	return core.VerifySignatureAllowHighS(tx.FromPubkey, tx.Sig[:], tx.Envelope())
+}
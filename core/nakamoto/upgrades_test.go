@@ -0,0 +1,263 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUpgradeActive(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := ConsensusConfig{
+		Upgrades: map[string]uint64{
+			UpgradeCoinbaseHeight: 10,
+		},
+	}
+
+	assert.False(conf.IsUpgradeActive(UpgradeCoinbaseHeight, 0))
+	assert.False(conf.IsUpgradeActive(UpgradeCoinbaseHeight, 9))
+	assert.True(conf.IsUpgradeActive(UpgradeCoinbaseHeight, 10))
+	assert.True(conf.IsUpgradeActive(UpgradeCoinbaseHeight, 11))
+
+	// Unscheduled upgrades are never active.
+	assert.False(conf.IsUpgradeActive("unknown", 100))
+	assert.False((&ConsensusConfig{}).IsUpgradeActive(UpgradeCoinbaseHeight, 100))
+}
+
+func TestGetCoinbaseMaturity(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := ConsensusConfig{
+		CoinbaseMaturity: 100,
+		Upgrades: map[string]uint64{
+			UpgradeCoinbaseMaturity: 10,
+		},
+	}
+
+	// Coinbase rewards are spendable immediately until the upgrade activates.
+	assert.Equal(uint64(0), conf.getCoinbaseMaturity(9))
+	assert.Equal(uint64(100), conf.getCoinbaseMaturity(10))
+	assert.Equal(uint64(0), (&ConsensusConfig{CoinbaseMaturity: 100}).getCoinbaseMaturity(10))
+}
+
+// Mines a block on top of the parent, with a coinbase tx committing to the given nonce.
+func mineBlockWithCoinbaseNonce(t *testing.T, dag *BlockDAG, parent *Block, nonce uint64) RawBlock {
+	tx, err := newValidCoinbaseTx(t, nonce)
+	if err != nil {
+		t.Fatalf("Failed to create coinbase tx: %s", err)
+	}
+
+	raw := RawBlock{
+		ParentHash:             parent.Hash,
+		ParentTotalWork:        BigIntToBytes32(parent.AccumulatedWork),
+		Timestamp:              Timestamp(),
+		NumTransactions:        1,
+		TransactionsMerkleRoot: [32]byte{},
+		Nonce:                  [32]byte{},
+		Transactions: []RawTransaction{
+			tx,
+		},
+	}
+	raw.TransactionsMerkleRoot = dag.consensus.getMerkleRootForTxs(dag.GetHasher(), parent.Height+1, raw.Transactions)
+	solveBlockForTest(t, dag, &raw)
+
+	return raw
+}
+
+// Solves the POW for a block.
+func solveBlockForTest(t *testing.T, dag *BlockDAG, raw *RawBlock) {
+	epoch, err := dag.GetEpochForBlockHash(raw.ParentHash)
+	if err != nil {
+		t.Fatalf("Failed to get epoch for block hash: %s", err)
+	}
+	solution, err := SolvePOW(dag.GetHasher(), *raw, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	if err != nil {
+		t.Fatalf("Failed to solve POW: %s", err)
+	}
+	raw.SetNonce(solution)
+}
+
+func TestDagUpgradeCoinbaseHeightActivation(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, genesisBlock := newBlockdag()
+
+	// Activate the upgrade at height 3.
+	dag.consensus.Upgrades = map[string]uint64{
+		UpgradeCoinbaseHeight: 3,
+	}
+
+	// Before activation, a coinbase which does not commit to the height is accepted.
+	parent, err := dag.GetBlockByHash(genesisBlock.Hash(testHasher))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := uint64(1); height < 3; height++ {
+		raw := mineBlockWithCoinbaseNonce(t, &dag, parent, 0)
+		err = dag.IngestBlock(raw)
+		assert.Nil(err)
+
+		parent, err = dag.GetBlockByHash(raw.Hash(testHasher))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(height, parent.Height)
+	}
+
+	// From activation, the same coinbase is rejected.
+	raw := mineBlockWithCoinbaseNonce(t, &dag, parent, 0)
+	err = dag.IngestBlock(raw)
+	assert.Equal("Coinbase tx does not commit to block height.", err.Error())
+
+	// And a coinbase committing to the height is accepted.
+	raw = mineBlockWithCoinbaseNonce(t, &dag, parent, 3)
+	err = dag.IngestBlock(raw)
+	assert.Nil(err)
+	assert.Equal(raw.Hash(testHasher), dag.FullTip.Hash)
+}
+
+// Mines a block on top of the parent, with the transactions merkle root computed over either the witness hashes or the
+// full transactions.
+func mineBlockWithMerkleLeaves(t *testing.T, dag *BlockDAG, parent *Block, witnessLeaves bool) RawBlock {
+	tx, err := newValidCoinbaseTx(t, parent.Height+1)
+	if err != nil {
+		t.Fatalf("Failed to create coinbase tx: %s", err)
+	}
+
+	raw := RawBlock{
+		ParentHash:      parent.Hash,
+		ParentTotalWork: BigIntToBytes32(parent.AccumulatedWork),
+		Timestamp:       Timestamp(),
+		NumTransactions: 1,
+		Transactions: []RawTransaction{
+			tx,
+		},
+	}
+	raw.TransactionsMerkleRoot = core.ComputeMerkleHash(dag.GetHasher(), getTxMerkleLeaves(raw.Transactions, witnessLeaves))
+	solveBlockForTest(t, dag, &raw)
+
+	return raw
+}
+
+func TestDagUpgradeWitnessMerkleLeavesActivation(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, genesisBlock := newBlockdag()
+
+	// Activate the upgrade at height 2.
+	dag.consensus.Upgrades = map[string]uint64{
+		UpgradeWitnessMerkleLeaves: 2,
+	}
+	parent, err := dag.GetBlockByHash(genesisBlock.Hash(testHasher))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before activation, the leaves are the full transactions.
+	raw := mineBlockWithMerkleLeaves(t, &dag, parent, true)
+	assert.Equal(ErrInvalidTxsMerkleRoot, dag.IngestBlock(raw))
+	raw = mineBlockWithMerkleLeaves(t, &dag, parent, false)
+	assert.Nil(dag.IngestBlock(raw))
+
+	parent, err = dag.GetBlockByHash(raw.Hash(testHasher))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From activation, the leaves are the witness hashes.
+	raw = mineBlockWithMerkleLeaves(t, &dag, parent, false)
+	assert.Equal(ErrInvalidTxsMerkleRoot, dag.IngestBlock(raw))
+	raw = mineBlockWithMerkleLeaves(t, &dag, parent, true)
+	assert.Nil(dag.IngestBlock(raw))
+	assert.Equal(raw.Hash(testHasher), dag.FullTip.Hash)
+}
+
+func TestTxProofVerifyAcrossWitnessMerkleLeavesActivation(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConsensusConfig{
+		Upgrades: map[string]uint64{
+			UpgradeWitnessMerkleLeaves: 2,
+		},
+	}
+	wallets := getTestingWallets(t)
+	txs := []RawTransaction{
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 1, 0, &wallets[0]),
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 200, 1, 1, &wallets[0]),
+	}
+
+	for _, height := range []uint64{1, 2} {
+		proof, err := conf.getMerkleProofForTx(testHasher, height, txs, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txProof := TxProof{
+			Tx:          txs[1],
+			BlockHeader: BlockHeader{TransactionsMerkleRoot: conf.getMerkleRootForTxs(testHasher, height, txs)},
+			Proof:       proof,
+		}
+		assert.True(conf.verifyTxProof(testHasher, height, txProof))
+
+		// The proof is only valid for blocks using the same leaves.
+		otherHeight := 3 - height
+		assert.False(conf.verifyTxProof(testHasher, otherHeight, txProof))
+	}
+}
+
+// Malleates a transaction's signature to its high-S form, which is valid for the same transaction.
+func toHighSForTest(tx RawTransaction) RawTransaction {
+	s := new(big.Int).SetBytes(tx.Sig[32:])
+	n, _ := new(big.Int).SetString("ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551", 16)
+	highS := new(big.Int).Sub(n, s)
+	copy(tx.Sig[32:], PadBytes(highS.Bytes(), 32))
+	return tx
+}
+
+func TestUpgradeLowSActivation(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConsensusConfig{
+		Upgrades: map[string]uint64{
+			UpgradeLowS: 2,
+		},
+	}
+	tx, err := newValidCoinbaseTx(t, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	highSTx := toHighSForTest(tx)
+
+	// Before activation, high-S signatures are accepted.
+	assert.True(conf.verifyTxSignature(1, tx))
+	assert.True(conf.verifyTxSignature(1, highSTx))
+
+	// From activation, they are rejected.
+	assert.True(conf.verifyTxSignature(2, tx))
+	assert.False(conf.verifyTxSignature(2, highSTx))
+}
+
+func TestUpgradeHashFunctionOnlyAtGenesis(t *testing.T) {
+	assert := assert.New(t)
+	conf := ConsensusConfig{
+		HashFunction: core.HashFunctionPoseidon,
+	}
+
+	// The hash function must be activated by the upgrade.
+	_, err := conf.GetHasher()
+	assert.Equal("The poseidon hash function must be activated at genesis by the hash_function upgrade.", err.Error())
+
+	// At genesis.
+	conf.Upgrades = map[string]uint64{UpgradeHashFunction: 10}
+	_, err = conf.GetHasher()
+	assert.Error(err)
+
+	conf.Upgrades = map[string]uint64{UpgradeHashFunction: 0}
+	hasher, err := conf.GetHasher()
+	assert.Nil(err)
+	assert.Equal(core.PoseidonHasher{}, hasher)
+
+	// SHA256 does not need the upgrade.
+	conf = ConsensusConfig{}
+	hasher, err = conf.GetHasher()
+	assert.Nil(err)
+	assert.Equal(core.SHA256Hasher{}, hasher)
+}
@@ -0,0 +1,409 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// The binary wire encoding is a compact encoding for peer messages, which peers negotiate through the
+// WireProtocolVersion in their heartbeat. Peers which don't support it are sent JSON.
+//
+// A message is encoded into a frame: a uint32 length, followed by the message's fields in declaration order. Blocks,
+// block headers and transactions use their canonical encodings (Bytes()). Other values are encoded as follows:
+//
+//   - fixed-size byte arrays, e.g. [32]byte: raw bytes.
+//   - bool: 1 byte.
+//   - integers: 8 bytes, big-endian.
+//   - strings, byte slices: uvarint length, then raw bytes.
+//   - slices: uvarint length, then each element.
+//   - types implementing encoding.BinaryMarshaler, e.g. time.Time: uvarint length, then the marshalled bytes.
+//
+// Every peer message begins with its Type field, so the message type of a frame can be read without knowing its
+// struct (see PeekWireMessageType).
+
+// The first wire protocol version which supports the binary encoding.
+const WireProtocolVersionBinary = 2
+
+// The maximum size of a frame.
+const MaxWireFrameSizeBytes = 64 * 1024 * 1024
+
+// A WireEncoding is an encoding of peer messages.
+type WireEncoding int
+
+const (
+	WireEncodingJSON WireEncoding = iota
+	WireEncodingBinary
+)
+
+// The HTTP content type of the encoding.
+func (e WireEncoding) ContentType() string {
+	if e == WireEncodingBinary {
+		return "application/x-tinychain"
+	}
+	return "application/json"
+}
+
+// Gets the encoding for a HTTP content type.
+func WireEncodingFromContentType(contentType string) WireEncoding {
+	if contentType == WireEncodingBinary.ContentType() {
+		return WireEncodingBinary
+	}
+	return WireEncodingJSON
+}
+
+// A type encoded using its canonical encoding.
+type wireCanonicalType struct {
+	// The size of the encoding, or zero if it is variable-length.
+	size   int
+	encode func(v reflect.Value) []byte
+	decode func(buf []byte) (any, error)
+}
+
+var wireCanonicalTypes = map[reflect.Type]wireCanonicalType{
+	reflect.TypeOf(RawBlock{}): {
+		size:   0,
+		encode: func(v reflect.Value) []byte { b := v.Interface().(RawBlock); return b.Bytes() },
+		decode: func(buf []byte) (any, error) { return RawBlockFromBytes(buf) },
+	},
+	reflect.TypeOf(BlockHeader{}): {
+		size:   BlockHeaderSizeBytes,
+		encode: func(v reflect.Value) []byte { h := v.Interface().(BlockHeader); return h.Bytes() },
+		decode: func(buf []byte) (any, error) { return BlockHeaderFromBytes(buf) },
+	},
+	reflect.TypeOf(RawTransaction{}): {
+		size:   RawTransactionSizeBytes,
+		encode: func(v reflect.Value) []byte { tx := v.Interface().(RawTransaction); return tx.Bytes() },
+		decode: func(buf []byte) (any, error) { return RawTransactionFromBytes(buf) },
+	},
+}
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// Encodes a message into a binary frame.
+func EncodeWireMessage(msg any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, 4)) // length, written below.
+	if err := encodeWireValue(buf, reflect.ValueOf(msg)); err != nil {
+		return nil, err
+	}
+
+	frame := buf.Bytes()
+	if MaxWireFrameSizeBytes < len(frame)-4 {
+		return nil, fmt.Errorf("Message too large: %d bytes", len(frame)-4)
+	}
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+	return frame, nil
+}
+
+// Decodes a binary frame into a message, which must be a pointer.
+func DecodeWireMessage(frame []byte, msg any) error {
+	payload, err := readWireFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("Cannot decode into non-pointer %T", msg)
+	}
+
+	r := bytes.NewReader(payload)
+	if err := decodeWireValue(r, v.Elem()); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("Trailing bytes in message: %d", r.Len())
+	}
+	return nil
+}
+
+// Encodes a message.
+func EncodeMessage(encoding WireEncoding, msg any) ([]byte, error) {
+	if encoding == WireEncodingBinary {
+		return EncodeWireMessage(msg)
+	}
+	return json.Marshal(msg)
+}
+
+// Decodes a message, which must be a pointer.
+func DecodeMessage(encoding WireEncoding, data []byte, msg any) error {
+	if encoding == WireEncodingBinary {
+		return DecodeWireMessage(data, msg)
+	}
+	return json.Unmarshal(data, msg)
+}
+
+// Reads the type of an encoded message.
+func PeekMessageType(encoding WireEncoding, data []byte) (string, error) {
+	if encoding == WireEncodingBinary {
+		return PeekWireMessageType(data)
+	}
+	var msg NetworkMessage
+	err := json.Unmarshal(data, &msg)
+	return msg.Type, err
+}
+
+// Reads the message type of a binary frame, which is the message's first field.
+func PeekWireMessageType(frame []byte) (string, error) {
+	payload, err := readWireFrame(frame)
+	if err != nil {
+		return "", err
+	}
+	var messageType string
+	err = decodeWireValue(bytes.NewReader(payload), reflect.ValueOf(&messageType).Elem())
+	return messageType, err
+}
+
+// Checks the frame's length prefix, and returns its payload.
+func readWireFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 4 {
+		return nil, fmt.Errorf("Frame too short: %d bytes", len(frame))
+	}
+	length := binary.BigEndian.Uint32(frame[0:4])
+	if MaxWireFrameSizeBytes < length {
+		return nil, fmt.Errorf("Frame too large: %d bytes", length)
+	}
+	if uint32(len(frame)-4) != length {
+		return nil, fmt.Errorf("Frame length mismatch: header=%d actual=%d", length, len(frame)-4)
+	}
+	return frame[4:], nil
+}
+
+func encodeWireValue(buf *bytes.Buffer, v reflect.Value) error {
+	t := v.Type()
+
+	// Canonical encodings.
+	if canonical, ok := wireCanonicalTypes[t]; ok {
+		data := canonical.encode(v)
+		if canonical.size == 0 {
+			writeUvarint(buf, uint64(len(data)))
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	// Types with their own binary encoding.
+	if t.Implements(binaryMarshalerType) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		writeUvarint(buf, uint64(len(data)))
+		buf.Write(data)
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		binary.Write(buf, binary.BigEndian, v.Int())
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		binary.Write(buf, binary.BigEndian, v.Uint())
+	case reflect.Uint8:
+		buf.WriteByte(byte(v.Uint()))
+	case reflect.String:
+		writeUvarint(buf, uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				buf.WriteByte(byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeWireValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		writeUvarint(buf, uint64(v.Len()))
+		if t.Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeWireValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := encodeWireValue(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type for wire encoding: %s", t)
+	}
+	return nil
+}
+
+func decodeWireValue(r *bytes.Reader, v reflect.Value) error {
+	t := v.Type()
+
+	// Canonical encodings.
+	if canonical, ok := wireCanonicalTypes[t]; ok {
+		size := canonical.size
+		if size == 0 {
+			length, err := readWireLength(r)
+			if err != nil {
+				return err
+			}
+			size = length
+		}
+		data, err := readWireBytes(r, size)
+		if err != nil {
+			return err
+		}
+		decoded, err := canonical.decode(data)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(decoded))
+		return nil
+	}
+
+	// Types with their own binary encoding.
+	if reflect.PointerTo(t).Implements(binaryUnmarshalerType) {
+		length, err := readWireLength(r)
+		if err != nil {
+			return err
+		}
+		data, err := readWireBytes(r, length)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if err := binary.Read(r, binary.BigEndian, &i); err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var i uint64
+		if err := binary.Read(r, binary.BigEndian, &i); err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Uint8:
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(b))
+	case reflect.String:
+		length, err := readWireLength(r)
+		if err != nil {
+			return err
+		}
+		data, err := readWireBytes(r, length)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(data))
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			data, err := readWireBytes(r, v.Len())
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := decodeWireValue(r, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		length, err := readWireLength(r)
+		if err != nil {
+			return err
+		}
+		if length == 0 {
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			data, err := readWireBytes(r, length)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(data)
+			return nil
+		}
+		// Each element is at least one byte, which bounds the allocation by the message size.
+		if r.Len() < length {
+			return io.ErrUnexpectedEOF
+		}
+		slice := reflect.MakeSlice(t, length, length)
+		for i := 0; i < length; i++ {
+			if err := decodeWireValue(r, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := decodeWireValue(r, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported type for wire encoding: %s", t)
+	}
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	buf.Write(binary.AppendUvarint(nil, x))
+}
+
+// Reads a length, which must fit in the remaining bytes.
+func readWireLength(r *bytes.Reader) (int, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(r.Len()) < length {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(length), nil
+}
+
+func readWireBytes(r *bytes.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,232 @@
+package nakamoto
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWireBlock(t *testing.T) RawBlock {
+	wallets := getTestingWallets(t)
+	txs := []RawTransaction{
+		MakeCoinbaseTx(&wallets[0], 50, 1),
+		MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, 1, 0, &wallets[0]),
+	}
+	return RawBlock{
+		ParentHash:             [32]byte{1, 2, 3},
+		ParentTotalWork:        [32]byte{4},
+		Difficulty:             [32]byte{5},
+		Timestamp:              1234,
+		NumTransactions:        uint64(len(txs)),
+		TransactionsMerkleRoot: getWitnessMerkleRootForTxs(testHasher, txs),
+		Nonce:                  [32]byte{6},
+		Graffiti:               StringToBytes32("graffiti"),
+		Transactions:           txs,
+	}
+}
+
+func TestCanonicalDecoding(t *testing.T) {
+	assert := assert.New(t)
+	block := newTestWireBlock(t)
+
+	decoded, err := RawBlockFromBytes(block.Bytes())
+	assert.Nil(err)
+	assert.Equal(block, decoded)
+
+	header := block.ToBlockHeader()
+	decodedHeader, err := BlockHeaderFromBytes(header.Bytes())
+	assert.Nil(err)
+	assert.Equal(header, decodedHeader)
+
+	tx := block.Transactions[1]
+	decodedTx, err := RawTransactionFromBytes(tx.Bytes())
+	assert.Nil(err)
+	assert.Equal(tx, decodedTx)
+
+	// Truncated encodings are rejected.
+	_, err = RawBlockFromBytes(block.Bytes()[:BlockHeaderSizeBytes+1])
+	assert.NotNil(err)
+	_, err = BlockHeaderFromBytes(header.Bytes()[1:])
+	assert.NotNil(err)
+	_, err = RawTransactionFromBytes(tx.Bytes()[1:])
+	assert.NotNil(err)
+}
+
+func TestWireMessageRoundtrip(t *testing.T) {
+	assert := assert.New(t)
+	block := newTestWireBlock(t)
+	heights := core.NewBitset(16)
+	heights.Insert(3)
+
+	roundtrip := func(msg any, decoded any) {
+		frame, err := EncodeWireMessage(msg)
+		assert.Nil(err)
+		assert.Nil(DecodeWireMessage(frame, decoded))
+	}
+
+	newBlock := NewBlockMessage{Type: "new_block", RawBlock: block}
+	var newBlock2 NewBlockMessage
+	roundtrip(newBlock, &newBlock2)
+	assert.Equal(newBlock, newBlock2)
+
+	heartbeat := HeartbeatMesage{
+		Type:                "heartbeat",
+		TipHeight:           -1,
+		ClientVersion:       CLIENT_VERSION,
+		WireProtocolVersion: WIRE_PROTOCOL_VERSION,
+		ClientAddress:       "http://127.0.0.1:8080",
+		PeerId:              "peer",
+		Time:                time.UnixMilli(1700000000000).UTC(),
+	}
+	var heartbeat2 HeartbeatMesage
+	roundtrip(heartbeat, &heartbeat2)
+	assert.Equal(heartbeat, heartbeat2)
+
+	getData := SyncGetBlockDataMessage{Type: "sync_get_data", FromBlock: block.Hash(testHasher), Heights: *heights, Headers: true}
+	var getData2 SyncGetBlockDataMessage
+	roundtrip(getData, &getData2)
+	assert.Equal(getData, getData2)
+	assert.True(getData2.Heights.Contains(3))
+
+	data := SyncGetBlockDataReply{
+		Type:    "sync_get_data_reply",
+		Headers: []BlockHeader{block.ToBlockHeader(), block.ToBlockHeader()},
+		Bodies:  [][]RawTransaction{block.Transactions, {}},
+	}
+	var data2 SyncGetBlockDataReply
+	roundtrip(data, &data2)
+	assert.Equal(data.Headers, data2.Headers)
+	assert.Equal(data.Bodies[0], data2.Bodies[0])
+	assert.Equal(0, len(data2.Bodies[1]))
+
+	merkleProof, err := getWitnessMerkleProofForTx(testHasher, block.Transactions, 1)
+	assert.Nil(err)
+	proof := TxProof{Tx: block.Transactions[1], BlockHeader: block.ToBlockHeader(), Proof: merkleProof}
+	proofReply := GetTxProofReply{Type: "get_tx_proof_reply", TxProof: proof}
+	var proofReply2 GetTxProofReply
+	roundtrip(proofReply, &proofReply2)
+	assert.Equal(proofReply, proofReply2)
+	assert.True(proofReply2.TxProof.verify(testHasher, true))
+
+	gossip := GossipPeersMessage{Type: "gossip_peers", Peers: []string{"http://a", "http://b"}}
+	var gossip2 GossipPeersMessage
+	roundtrip(gossip, &gossip2)
+	assert.Equal(gossip, gossip2)
+
+	messageType, err := PeekWireMessageType(mustEncodeWireMessage(t, gossip))
+	assert.Nil(err)
+	assert.Equal("gossip_peers", messageType)
+}
+
+func mustEncodeWireMessage(t *testing.T, msg any) []byte {
+	frame, err := EncodeWireMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestWireMessageSize(t *testing.T) {
+	assert := assert.New(t)
+	block := newTestWireBlock(t)
+	msg := NewBlockMessage{Type: "new_block", RawBlock: block}
+
+	frame := mustEncodeWireMessage(t, msg)
+	jsonMsg, err := json.Marshal(msg)
+	assert.Nil(err)
+
+	// The frame is the canonical block encoding, plus the framing and message type.
+	assert.Equal(4+1+len("new_block")+2+len(block.Bytes()), len(frame))
+	assert.Less(3*len(frame), len(jsonMsg))
+}
+
+func TestWireMessageInvalidFrames(t *testing.T) {
+	assert := assert.New(t)
+	frame := mustEncodeWireMessage(t, NewBlockMessage{Type: "new_block", RawBlock: newTestWireBlock(t)})
+
+	var msg NewBlockMessage
+	assert.NotNil(DecodeWireMessage(frame[:3], &msg))
+	assert.NotNil(DecodeWireMessage(frame[:len(frame)-1], &msg))
+	assert.NotNil(DecodeWireMessage(append(frame, 0), &msg))
+
+	// A frame whose length prefix matches, but whose contents are truncated.
+	truncated := append([]byte{}, frame[:len(frame)-1]...)
+	truncated[3]--
+	assert.NotNil(DecodeWireMessage(truncated, &msg))
+
+	// Lengths larger than the message don't cause large allocations.
+	huge := mustEncodeWireMessage(t, GossipPeersMessage{Type: "gossip_peers"})
+	huge = append(huge[:len(huge)-1], 0xff, 0xff, 0xff, 0xff, 0x0f)
+	huge[3] += 4
+	var gossip GossipPeersMessage
+	assert.NotNil(DecodeWireMessage(huge, &gossip))
+}
+
+// A transport which delivers messages directly to peer servers, recording the encoding of each message.
+type recordingTransport struct {
+	servers   map[string]*PeerServer
+	encodings []WireEncoding
+	mutex     sync.Mutex
+}
+
+func (t *recordingTransport) SendMessage(peer Peer, encoding WireEncoding, message []byte) ([]byte, error) {
+	t.mutex.Lock()
+	t.encodings = append(t.encodings, encoding)
+	server, ok := t.servers[peer.Addr]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown peer: %s", peer.Addr)
+	}
+	return server.HandlePeerMessage(peer.session, message, encoding)
+}
+
+func TestWireEncodingNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	transport := &recordingTransport{servers: map[string]*PeerServer{}}
+	p1 := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "1", []string{}), transport)
+	p2 := NewPeerCoreWithTransport(NewPeerConfig("127.0.0.1", "2", []string{}), transport)
+	transport.servers["p2"] = p2.server
+
+	received := []RawBlock{}
+	p2.OnNewBlock = func(block RawBlock) error {
+		received = append(received, block)
+		return nil
+	}
+	block := newTestWireBlock(t)
+
+	// Old peers are sent JSON.
+	oldPeer := Peer{Addr: "p2", WireProtocolVersion: 1}
+	_, err := CallPeer[NewBlockMessage, struct{}](p1, oldPeer, NewBlockMessage{Type: "new_block", RawBlock: block})
+	assert.Nil(err)
+	assert.Equal([]WireEncoding{WireEncodingJSON}, transport.encodings)
+
+	// New peers are sent binary.
+	transport.encodings = nil
+	newPeer := Peer{Addr: "p2", WireProtocolVersion: WIRE_PROTOCOL_VERSION}
+	_, err = CallPeer[NewBlockMessage, struct{}](p1, newPeer, NewBlockMessage{Type: "new_block", RawBlock: block})
+	assert.Nil(err)
+	assert.Equal([]WireEncoding{WireEncodingBinary}, transport.encodings)
+	assert.Equal([]RawBlock{block, block}, received)
+
+	// Message types which only accept JSON fall back to it.
+	transport.encodings = nil
+	p2.server.RegisterMesageHandler("legacy", func(message []byte) (interface{}, error) {
+		return echoMessage{Type: "legacy_reply", Value: 1}, nil
+	})
+	reply, err := CallPeer[echoMessage, echoMessage](p1, newPeer, echoMessage{Type: "legacy"})
+	assert.Nil(err)
+	assert.Equal(1, reply.Value)
+	assert.Equal([]WireEncoding{WireEncodingBinary, WireEncodingJSON}, transport.encodings)
+
+	// Binary can be disabled.
+	transport.encodings = nil
+	p1.DisableBinaryWire = true
+	_, err = CallPeer[NewBlockMessage, struct{}](p1, newPeer, NewBlockMessage{Type: "new_block", RawBlock: block})
+	assert.Nil(err)
+	assert.Equal([]WireEncoding{WireEncodingJSON}, transport.encodings)
+}
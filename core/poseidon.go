@@ -0,0 +1,193 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+// Poseidon is a hash function designed to be cheap to prove inside a SNARK circuit.
+// https://eprint.iacr.org/2019/458.pdf
+//
+// We use the circomlib instance over the scalar field of BN254, as implemented by go-iden3-crypto. This is the field our
+// Groth16 prover works over, so the same hash can be computed natively by nodes and proven in a circuit (see
+// PoseidonHashCircuit).
+//
+// Parameters:
+//   - Width t=3 (2 inputs).
+//   - S-box x^5.
+//   - 8 full rounds, 57 partial rounds.
+const (
+	poseidonWidth         = 3
+	poseidonFullRounds    = 8
+	poseidonPartialRounds = 57
+)
+
+// Bytes are packed into 31-byte chunks, which always fit in the field.
+const PoseidonChunkSize = 31
+
+// The constants for computing Poseidon in a circuit.
+type poseidonParams struct {
+	c []*big.Int
+	s []*big.Int
+	m [][]*big.Int
+	p [][]*big.Int
+}
+
+var (
+	poseidonParamsOnce sync.Once
+	poseidonParamsInst *poseidonParams
+)
+
+func getPoseidonParams() *poseidonParams {
+	poseidonParamsOnce.Do(func() {
+		poseidonParamsInst = &poseidonParams{
+			c: parsePoseidonConsts(poseidonConstsStr.C),
+			s: parsePoseidonConsts(poseidonConstsStr.S),
+			m: make([][]*big.Int, poseidonWidth),
+			p: make([][]*big.Int, poseidonWidth),
+		}
+		for i := 0; i < poseidonWidth; i++ {
+			poseidonParamsInst.m[i] = parsePoseidonConsts(poseidonConstsStr.M[i])
+			poseidonParamsInst.p[i] = parsePoseidonConsts(poseidonConstsStr.P[i])
+		}
+	})
+	return poseidonParamsInst
+}
+
+func parsePoseidonConsts(strs []string) []*big.Int {
+	consts := make([]*big.Int, len(strs))
+	for i, str := range strs {
+		v, ok := new(big.Int).SetString(str, 16)
+		if !ok {
+			panic(fmt.Errorf("Invalid Poseidon constant: %s", str))
+		}
+		consts[i] = v
+	}
+	return consts
+}
+
+// Compresses two field elements into one.
+func poseidonCompress(a *big.Int, b *big.Int) *big.Int {
+	out, err := poseidon.Hash([]*big.Int{a, b})
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// Packs data into the field elements absorbed by HashPoseidon.
+func PoseidonChunks(data []byte) []*big.Int {
+	chunks := []*big.Int{}
+	for i := 0; i < len(data); i += PoseidonChunkSize {
+		end := i + PoseidonChunkSize
+		if len(data) < end {
+			end = len(data)
+		}
+		chunks = append(chunks, new(big.Int).SetBytes(data[i:end]))
+	}
+	return chunks
+}
+
+// Hashes data with Poseidon. The chunks are absorbed one at a time, starting from the data length.
+func HashPoseidon(data []byte) [32]byte {
+	state := new(big.Int).SetUint64(uint64(len(data)))
+	for _, chunk := range PoseidonChunks(data) {
+		state = poseidonCompress(state, chunk)
+	}
+
+	// Special case: hash the empty input, so it isn't the identity.
+	if len(data) == 0 {
+		state = poseidonCompress(state, new(big.Int))
+	}
+
+	var out [32]byte
+	state.FillBytes(out[:])
+	return out
+}
+
+// Computes HashPoseidon in a circuit, over the chunks of data of the given length.
+func PoseidonHashCircuit(c *Circuit, length uint64, chunks []Signal) Signal {
+	state := c.Const(new(big.Int).SetUint64(length))
+	for _, chunk := range chunks {
+		state = poseidonCompressCircuit(c, state, chunk)
+	}
+	if length == 0 {
+		state = poseidonCompressCircuit(c, state, c.Const(new(big.Int)))
+	}
+	return state
+}
+
+// Computes poseidonCompress in a circuit. This follows the optimized algorithm of go-iden3-crypto, where the partial
+// rounds only mix the first element of the state with a sparse matrix.
+func poseidonCompressCircuit(c *Circuit, a Signal, b Signal) Signal {
+	params := getPoseidonParams()
+	t := poseidonWidth
+
+	state := []Signal{c.Const(new(big.Int)), a, b}
+	ark := func(offset int) {
+		for i := 0; i < t; i++ {
+			state[i] = c.AddConst(state[i], params.c[offset+i])
+		}
+	}
+	exp5 := func(x Signal) Signal {
+		x2 := c.Mul(x, x)
+		x4 := c.Mul(x2, x2)
+		return c.Mul(x4, x)
+	}
+	exp5State := func() {
+		for i := 0; i < t; i++ {
+			state[i] = exp5(state[i])
+		}
+	}
+	// The linear layer is free, as it only combines the signals.
+	mix := func(m [][]*big.Int) {
+		mixed := make([]Signal, t)
+		for i := 0; i < t; i++ {
+			mixed[i] = c.Const(new(big.Int))
+			for j := 0; j < t; j++ {
+				mixed[i] = c.Add(mixed[i], c.MulConst(state[j], m[j][i]))
+			}
+		}
+		state = mixed
+	}
+
+	// First half of the full rounds.
+	ark(0)
+	for i := 0; i < poseidonFullRounds/2-1; i++ {
+		exp5State()
+		ark((i + 1) * t)
+		mix(params.m)
+	}
+	exp5State()
+	ark((poseidonFullRounds / 2) * t)
+	mix(params.p)
+
+	// Partial rounds.
+	for i := 0; i < poseidonPartialRounds; i++ {
+		state[0] = c.AddConst(exp5(state[0]), params.c[(poseidonFullRounds/2+1)*t+i])
+
+		s := params.s[(t*2-1)*i:]
+		state0 := c.Const(new(big.Int))
+		for j := 0; j < t; j++ {
+			state0 = c.Add(state0, c.MulConst(state[j], s[j]))
+		}
+		for k := 1; k < t; k++ {
+			state[k] = c.Add(state[k], c.MulConst(state[0], s[t+k-1]))
+		}
+		state[0] = state0
+	}
+
+	// Second half of the full rounds.
+	for i := 0; i < poseidonFullRounds/2-1; i++ {
+		exp5State()
+		ark((poseidonFullRounds/2+1)*t + poseidonPartialRounds + i*t)
+		mix(params.m)
+	}
+	exp5State()
+	mix(params.m)
+
+	return state[0]
+}
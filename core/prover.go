@@ -1,11 +1,388 @@
 package core
 
 import (
-	_ "github.com/vocdoni/go-snark/parsers"
-	_ "github.com/vocdoni/go-snark/prover"
-	_ "github.com/vocdoni/go-snark/verifier"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	bn256 "github.com/ethereum/go-ethereum/crypto/bn256/cloudflare"
+	"github.com/vocdoni/go-snark/prover"
+	"github.com/vocdoni/go-snark/types"
+	"github.com/vocdoni/go-snark/verifier"
 )
 
+// Groth16 zkSNARKs over BN254, using go-snark's prover and verifier.
+//
+// Circuits are written in Go against the Circuit type, which records the rank-1 constraint system (R1CS) and computes
+// the witness in a single pass. The proving and verifying keys are generated by Groth16Setup.
+
+type Groth16ProvingKey = types.Pk
+type Groth16VerifyingKey = types.Vk
+type Groth16Proof = types.Proof
+
+// The order of the scalar field of BN254. All circuit arithmetic is done modulo this.
+var FieldModulus = types.R
+
+// A linear combination of circuit variables, mapping the variable index to its coefficient.
+type LinearCombination map[int]*big.Int
+
+// A value in a circuit, expressed as a linear combination of the circuit variables.
+type Signal struct {
+	lc    LinearCombination
+	Value *big.Int
+}
+
+// A rank-1 constraint: A * B = C.
+type Constraint struct {
+	A LinearCombination
+	B LinearCombination
+	C LinearCombination
+}
+
+// An arithmetic circuit in R1CS form, along with its witness.
+//
+// Variable 0 is the constant one, followed by the public variables, followed by the private variables. The structure of
+// the circuit must not depend on the witness values, so the same code can build the circuit for setup and for proving.
+type Circuit struct {
+	NPublic     int
+	Constraints []Constraint
+	Witness     []*big.Int
+
+	hasPrivate bool
+}
+
+func NewCircuit() *Circuit {
+	return &Circuit{
+		Witness: []*big.Int{big.NewInt(1)},
+	}
+}
+
+func fieldMod(v *big.Int) *big.Int {
+	return new(big.Int).Mod(v, FieldModulus)
+}
+
+func (c *Circuit) newVariable(value *big.Int) Signal {
+	c.Witness = append(c.Witness, fieldMod(value))
+	index := len(c.Witness) - 1
+	return Signal{
+		lc:    LinearCombination{index: big.NewInt(1)},
+		Value: c.Witness[index],
+	}
+}
+
+// Allocates a public input. All public inputs must be allocated before any private variables.
+func (c *Circuit) PublicInput(value *big.Int) Signal {
+	if c.hasPrivate {
+		panic("Public inputs must be allocated before private variables.")
+	}
+	c.NPublic += 1
+	return c.newVariable(value)
+}
+
+// Allocates a private input.
+func (c *Circuit) PrivateInput(value *big.Int) Signal {
+	c.hasPrivate = true
+	return c.newVariable(value)
+}
+
+// Gets the values of the public inputs.
+func (c *Circuit) PublicSignals() []*big.Int {
+	return c.Witness[1 : c.NPublic+1]
+}
+
+func (c *Circuit) Const(value *big.Int) Signal {
+	v := fieldMod(value)
+	return Signal{
+		lc:    LinearCombination{0: v},
+		Value: v,
+	}
+}
+
+func addLC(a LinearCombination, b LinearCombination, k *big.Int) LinearCombination {
+	out := LinearCombination{}
+	for i, coeff := range a {
+		out[i] = coeff
+	}
+	for i, coeff := range b {
+		sum := new(big.Int).Mul(coeff, k)
+		if prev, ok := out[i]; ok {
+			sum.Add(sum, prev)
+		}
+		sum.Mod(sum, FieldModulus)
+		if sum.Sign() == 0 {
+			delete(out, i)
+		} else {
+			out[i] = sum
+		}
+	}
+	return out
+}
+
+func (c *Circuit) Add(a Signal, b Signal) Signal {
+	return Signal{
+		lc:    addLC(a.lc, b.lc, big.NewInt(1)),
+		Value: fieldMod(new(big.Int).Add(a.Value, b.Value)),
+	}
+}
+
+func (c *Circuit) Sub(a Signal, b Signal) Signal {
+	return Signal{
+		lc:    addLC(a.lc, b.lc, big.NewInt(-1)),
+		Value: fieldMod(new(big.Int).Sub(a.Value, b.Value)),
+	}
+}
+
+func (c *Circuit) AddConst(a Signal, k *big.Int) Signal {
+	return c.Add(a, c.Const(k))
+}
+
+func (c *Circuit) MulConst(a Signal, k *big.Int) Signal {
+	return Signal{
+		lc:    addLC(LinearCombination{}, a.lc, k),
+		Value: fieldMod(new(big.Int).Mul(a.Value, k)),
+	}
+}
+
+// Multiplies two signals. This costs one constraint.
+func (c *Circuit) Mul(a Signal, b Signal) Signal {
+	out := c.PrivateInput(new(big.Int).Mul(a.Value, b.Value))
+	c.Constraints = append(c.Constraints, Constraint{A: a.lc, B: b.lc, C: out.lc})
+	return out
+}
+
+func (c *Circuit) AssertEqual(a Signal, b Signal) {
+	c.Constraints = append(c.Constraints, Constraint{
+		A: c.Sub(a, b).lc,
+		B: LinearCombination{0: big.NewInt(1)},
+		C: LinearCombination{},
+	})
+}
+
+func (c *Circuit) AssertBoolean(a Signal) {
+	c.Constraints = append(c.Constraints, Constraint{
+		A: a.lc,
+		B: c.AddConst(a, big.NewInt(-1)).lc,
+		C: LinearCombination{},
+	})
+}
+
+// Decomposes a signal into n bits, little-endian. This also constrains the signal to be less than 2^n.
+func (c *Circuit) ToBits(a Signal, n int) []Signal {
+	bits := make([]Signal, n)
+	sum := c.Const(new(big.Int))
+	for i := 0; i < n; i++ {
+		bits[i] = c.PrivateInput(big.NewInt(int64(a.Value.Bit(i))))
+		c.AssertBoolean(bits[i])
+		sum = c.Add(sum, c.MulConst(bits[i], new(big.Int).Lsh(big.NewInt(1), uint(i))))
+	}
+	c.AssertEqual(sum, a)
+	return bits
+}
+
+func (lc LinearCombination) eval(witness []*big.Int) *big.Int {
+	sum := new(big.Int)
+	for i, coeff := range lc {
+		sum.Add(sum, new(big.Int).Mul(coeff, witness[i]))
+	}
+	return sum.Mod(sum, FieldModulus)
+}
+
+// Checks the witness satisfies every constraint.
+func (c *Circuit) Check() error {
+	for i, constraint := range c.Constraints {
+		a := constraint.A.eval(c.Witness)
+		b := constraint.B.eval(c.Witness)
+		ab := fieldMod(new(big.Int).Mul(a, b))
+		if ab.Cmp(constraint.C.eval(c.Witness)) != 0 {
+			return fmt.Errorf("Constraint %d is not satisfied.", i)
+		}
+	}
+	return nil
+}
+
+func randFieldElement() (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, FieldModulus)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
+
+// Gets the primitive root of unity for a domain of size 2^bits, as used by go-snark's FFT.
+func rootOfUnity(bits int) *big.Int {
+	// R-1 = 2^s * rem.
+	rem := new(big.Int).Sub(FieldModulus, big.NewInt(1))
+	s := 0
+	for rem.Bit(0) == 0 {
+		s++
+		rem.Rsh(rem, 1)
+	}
+	w := new(big.Int).Exp(big.NewInt(5), rem, FieldModulus)
+	for i := s; bits < i; i-- {
+		w.Mul(w, w).Mod(w, FieldModulus)
+	}
+	return w
+}
+
+// Generates the Groth16 proving and verifying keys for a circuit.
+//
+// NOTE: This is a single-party setup. Whoever runs it learns the toxic waste and can forge proofs, so it is only
+// suitable for development. A production network would need a multi-party ceremony.
+func Groth16Setup(c *Circuit) (*Groth16ProvingKey, *Groth16VerifyingKey, error) {
+	nVars := len(c.Witness)
+	nConstraints := len(c.Constraints)
+
+	// The domain includes an extra constraint for each public input, which makes their polynomials linearly independent.
+	domainSize := 1
+	bits := 0
+	for domainSize < nConstraints+c.NPublic+1 {
+		domainSize *= 2
+		bits += 1
+	}
+
+	// The QAP polynomials, in evaluation form over the domain.
+	polsA := make([]map[int]*big.Int, nVars)
+	polsB := make([]map[int]*big.Int, nVars)
+	polsC := make([]map[int]*big.Int, nVars)
+	for i := 0; i < nVars; i++ {
+		polsA[i] = make(map[int]*big.Int)
+		polsB[i] = make(map[int]*big.Int)
+		polsC[i] = make(map[int]*big.Int)
+	}
+	for j, constraint := range c.Constraints {
+		for i, coeff := range constraint.A {
+			polsA[i][j] = coeff
+		}
+		for i, coeff := range constraint.B {
+			polsB[i][j] = coeff
+		}
+		for i, coeff := range constraint.C {
+			polsC[i][j] = coeff
+		}
+	}
+	for i := 0; i <= c.NPublic; i++ {
+		polsA[i][nConstraints+i] = big.NewInt(1)
+	}
+
+	// Toxic waste.
+	toxic := make([]*big.Int, 5)
+	for i := range toxic {
+		k, err := randFieldElement()
+		if err != nil {
+			return nil, nil, err
+		}
+		toxic[i] = k
+	}
+	t, alpha, beta, gamma, delta := toxic[0], toxic[1], toxic[2], toxic[3], toxic[4]
+
+	mod := func(v *big.Int) *big.Int { return v.Mod(v, FieldModulus) }
+	inv := func(v *big.Int) *big.Int { return new(big.Int).ModInverse(v, FieldModulus) }
+
+	// Evaluate the Lagrange basis at t.
+	// L_j(t) = w^j * (t^m - 1) / (m * (t - w^j))
+	w := rootOfUnity(bits)
+	m := big.NewInt(int64(domainSize))
+	zt := mod(new(big.Int).Sub(new(big.Int).Exp(t, m, FieldModulus), big.NewInt(1)))
+	lagrange := make([]*big.Int, domainSize)
+	wj := big.NewInt(1)
+	for j := 0; j < domainSize; j++ {
+		denom := mod(new(big.Int).Mul(m, mod(new(big.Int).Sub(t, wj))))
+		lagrange[j] = mod(new(big.Int).Mul(mod(new(big.Int).Mul(wj, zt)), inv(denom)))
+		wj = mod(new(big.Int).Mul(wj, w))
+	}
+	evalAt := func(pol map[int]*big.Int) *big.Int {
+		sum := new(big.Int)
+		for j, coeff := range pol {
+			sum.Add(sum, new(big.Int).Mul(coeff, lagrange[j]))
+		}
+		return mod(sum)
+	}
+
+	pk := &Groth16ProvingKey{
+		A:          make([]*bn256.G1, nVars),
+		B1:         make([]*bn256.G1, nVars),
+		B2:         make([]*bn256.G2, nVars),
+		C:          make([]*bn256.G1, nVars),
+		NVars:      nVars,
+		NPublic:    c.NPublic,
+		VkAlpha1:   new(bn256.G1).ScalarBaseMult(alpha),
+		VkBeta1:    new(bn256.G1).ScalarBaseMult(beta),
+		VkDelta1:   new(bn256.G1).ScalarBaseMult(delta),
+		VkBeta2:    new(bn256.G2).ScalarBaseMult(beta),
+		VkDelta2:   new(bn256.G2).ScalarBaseMult(delta),
+		HExps:      make([]*bn256.G1, domainSize),
+		DomainSize: domainSize,
+		PolsA:      polsA,
+		PolsB:      polsB,
+	}
+	vk := &Groth16VerifyingKey{
+		Alpha: new(bn256.G1).ScalarBaseMult(alpha),
+		Beta:  new(bn256.G2).ScalarBaseMult(beta),
+		Gamma: new(bn256.G2).ScalarBaseMult(gamma),
+		Delta: new(bn256.G2).ScalarBaseMult(delta),
+		IC:    make([]*bn256.G1, c.NPublic+1),
+	}
+
+	gammaInv := inv(gamma)
+	deltaInv := inv(delta)
+	for i := 0; i < nVars; i++ {
+		a := evalAt(polsA[i])
+		b := evalAt(polsB[i])
+		pk.A[i] = new(bn256.G1).ScalarBaseMult(a)
+		pk.B1[i] = new(bn256.G1).ScalarBaseMult(b)
+		pk.B2[i] = new(bn256.G2).ScalarBaseMult(b)
+
+		// beta*A(t) + alpha*B(t) + C(t)
+		k := new(big.Int).Mul(beta, a)
+		k.Add(k, new(big.Int).Mul(alpha, b))
+		k.Add(k, evalAt(polsC[i]))
+		mod(k)
+
+		if i <= c.NPublic {
+			vk.IC[i] = new(bn256.G1).ScalarBaseMult(mod(k.Mul(k, gammaInv)))
+			pk.C[i] = new(bn256.G1).ScalarBaseMult(new(big.Int))
+		} else {
+			pk.C[i] = new(bn256.G1).ScalarBaseMult(mod(k.Mul(k, deltaInv)))
+		}
+	}
+
+	// t^i * Z(t) / delta
+	ti := mod(new(big.Int).Mul(zt, deltaInv))
+	for i := 0; i < domainSize; i++ {
+		pk.HExps[i] = new(bn256.G1).ScalarBaseMult(ti)
+		ti = mod(new(big.Int).Mul(ti, t))
+	}
+
+	return pk, vk, nil
+}
+
+// Proves the circuit is satisfied by its witness. Returns the proof and the public inputs.
+func Groth16Prove(pk *Groth16ProvingKey, c *Circuit) (*Groth16Proof, []*big.Int, error) {
+	if pk.NVars != len(c.Witness) || pk.NPublic != c.NPublic {
+		return nil, nil, fmt.Errorf("Proving key does not match the circuit.")
+	}
+	err := c.Check()
+	if err != nil {
+		return nil, nil, err
+	}
+	return prover.GenerateProof(pk, c.Witness)
+}
+
+// Verifies a proof against the public inputs.
+func Groth16Verify(vk *Groth16VerifyingKey, proof *Groth16Proof, public []*big.Int) bool {
+	if proof == nil || proof.A == nil || proof.B == nil || proof.C == nil {
+		return false
+	}
+	if len(public)+1 != len(vk.IC) {
+		return false
+	}
+	return verifier.Verify(vk, proof, public)
+}
+
 // Recursion
 // - https://hackmd.io/@soowon/gkr?utm_source=preview-mode&utm_medium=rec
 // - https://github.com/Consensys/gnark/blob/v0.9.1/std/recursion/groth16/verifier.go
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Proves knowledge of x such that x^3 + x + 5 = out.
+func newCubicCircuit(x int64) *Circuit {
+	c := NewCircuit()
+	value := big.NewInt(x*x*x + x + 5)
+	out := c.PublicInput(value)
+
+	xs := c.PrivateInput(big.NewInt(x))
+	x2 := c.Mul(xs, xs)
+	x3 := c.Mul(x2, xs)
+	sum := c.AddConst(c.Add(x3, xs), big.NewInt(5))
+	c.AssertEqual(sum, out)
+	return c
+}
+
+func TestCircuitCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCubicCircuit(3)
+	assert.Equal(1, c.NPublic)
+	assert.Equal([]*big.Int{big.NewInt(35)}, c.PublicSignals())
+	assert.Nil(c.Check())
+
+	// Tamper with the witness.
+	c.Witness[2] = big.NewInt(4)
+	assert.Error(c.Check())
+}
+
+func TestCircuitToBits(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCircuit()
+	a := c.PrivateInput(big.NewInt(0b1011))
+	bits := c.ToBits(a, 4)
+	assert.Nil(c.Check())
+	values := []int64{}
+	for _, bit := range bits {
+		values = append(values, bit.Value.Int64())
+	}
+	assert.Equal([]int64{1, 1, 0, 1}, values)
+
+	// A value which does not fit in n bits cannot be decomposed.
+	c = NewCircuit()
+	a = c.PrivateInput(big.NewInt(0b10000))
+	c.ToBits(a, 4)
+	assert.Error(c.Check())
+}
+
+func TestGroth16ProveAndVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	setupCircuit := newCubicCircuit(0)
+	pk, vk, err := Groth16Setup(setupCircuit)
+	assert.Nil(err)
+
+	c := newCubicCircuit(3)
+	proof, public, err := Groth16Prove(pk, c)
+	assert.Nil(err)
+	assert.Equal([]*big.Int{big.NewInt(35)}, public)
+
+	assert.True(Groth16Verify(vk, proof, public))
+
+	// Wrong public inputs.
+	assert.False(Groth16Verify(vk, proof, []*big.Int{big.NewInt(36)}))
+	assert.False(Groth16Verify(vk, proof, []*big.Int{}))
+
+	// A proof from a different setup.
+	_, vk2, err := Groth16Setup(setupCircuit)
+	assert.Nil(err)
+	assert.False(Groth16Verify(vk2, proof, public))
+
+	// An unsatisfied circuit cannot be proven.
+	c = newCubicCircuit(3)
+	c.Witness[2] = big.NewInt(4)
+	_, _, err = Groth16Prove(pk, c)
+	assert.Error(err)
+}
+
+func TestPoseidonHashCircuit(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, data := range [][]byte{{}, []byte("tinychain"), make([]byte, 100)} {
+		c := NewCircuit()
+		chunks := []Signal{}
+		for _, chunk := range PoseidonChunks(data) {
+			chunks = append(chunks, c.PrivateInput(chunk))
+		}
+		out := PoseidonHashCircuit(c, uint64(len(data)), chunks)
+		assert.Nil(c.Check())
+
+		var h [32]byte
+		out.Value.FillBytes(h[:])
+		assert.Equal(HashPoseidon(data), h)
+	}
+}
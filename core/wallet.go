@@ -1,10 +1,12 @@
 package core
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/hex"
 	"fmt"
 	"math/big"
@@ -81,12 +83,24 @@ func padBytes(src []byte, length int) []byte {
 	return append(padding, src...)
 }
 
+// Signs a message. Signatures are deterministic (RFC 6979), so signing the same message twice gives the same signature.
+// Low-S normalization doesn't need this, but the simulator does, as it relies on the coinbases it signs, and so its
+// block hashes, being identical between runs with the same seed.
 func (w *Wallet) Sign(msg []byte) ([]byte, error) {
 	hash := sha256.Sum256(msg)
-	r, s, err := ecdsa.Sign(rand.Reader, w.prvkey, hash[:])
+	der, err := w.prvkey.Sign(nil, hash[:], crypto.SHA256)
 	if err != nil {
 		return nil, err
 	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	r, s := sig.R, sig.S
+	// Normalize to low-S, since (r, N-s) is also a valid signature for the same message.
+	if isHighS(s) {
+		s = new(big.Int).Sub(elliptic.P256().Params().N, s)
+	}
 	// Ensure r and s are padded to 32 bytes
 	rBytes := padBytes(r.Bytes(), 32)
 	sBytes := padBytes(s.Bytes(), 32)
@@ -98,7 +112,16 @@ func (w *Wallet) Sign(msg []byte) ([]byte, error) {
 }
 
 // Verifies an ECDSA signature for a message using the public key.
+// High-S signatures are rejected, as they are malleable.
 func VerifySignature(pubkeyBytes [65]byte, sig, msg []byte) bool {
+	if len(sig) == 64 && isHighS(new(big.Int).SetBytes(sig[32:])) {
+		return false
+	}
+	return VerifySignatureAllowHighS(pubkeyBytes, sig, msg)
+}
+
+// Verifies an ECDSA signature for a message using the public key, accepting high-S signatures.
+func VerifySignatureAllowHighS(pubkeyBytes [65]byte, sig, msg []byte) bool {
 	if len(sig) != 64 {
 		fmt.Printf("Invalid signature length: %d\n", len(sig)) // TODO
 		return false
@@ -106,8 +129,7 @@ func VerifySignature(pubkeyBytes [65]byte, sig, msg []byte) bool {
 
 	x, y := elliptic.Unmarshal(elliptic.P256(), pubkeyBytes[:])
 	if x == nil {
-		panic("Invalid public key") // TODO
-		// return false
+		return false
 	}
 	pubkey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 
@@ -117,3 +139,9 @@ func VerifySignature(pubkeyBytes [65]byte, sig, msg []byte) bool {
 
 	return ecdsa.Verify(pubkey, hash[:], r, s)
 }
+
+// Returns true if s is in the upper half of the curve order.
+func isHighS(s *big.Int) bool {
+	halfOrder := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	return s.Cmp(halfOrder) > 0
+}
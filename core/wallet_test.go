@@ -2,6 +2,7 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/hex"
 	"math/big"
@@ -132,3 +133,70 @@ func TestWalletSigningDeterminism(t *testing.T) {
 		}
 	}
 }
+
+func TestSignDeterministic(t *testing.T) {
+	assert := assert.New(t)
+	wallet, err := WalletFromPrivateKey("2053e3c0d239d12a554ef55895b89e5d044af7d09d8be9a8f6da22460f8260ca")
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %s", err)
+	}
+
+	msg := []byte("Gday, world!")
+	sig1, err := wallet.Sign(msg)
+	assert.Nil(err)
+	sig2, err := wallet.Sign(msg)
+	assert.Nil(err)
+	assert.Equal(sig1, sig2)
+
+	sig3, err := wallet.Sign([]byte("Gday, mate!"))
+	assert.Nil(err)
+	assert.NotEqual(sig1, sig3)
+}
+
+func TestSignLowS(t *testing.T) {
+	assert := assert.New(t)
+	wallet, err := WalletFromPrivateKey("2053e3c0d239d12a554ef55895b89e5d044af7d09d8be9a8f6da22460f8260ca")
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %s", err)
+	}
+
+	msg := []byte("Gday, world!")
+	for i := 0; i < 100; i++ {
+		sig, err := wallet.Sign(msg)
+		if err != nil {
+			t.Fatalf("Failed to sign message: %s", err)
+		}
+		s := new(big.Int).SetBytes(sig[32:])
+		assert.False(isHighS(s))
+	}
+}
+
+func TestVerifyRejectsHighS(t *testing.T) {
+	assert := assert.New(t)
+	wallet, err := WalletFromPrivateKey("2053e3c0d239d12a554ef55895b89e5d044af7d09d8be9a8f6da22460f8260ca")
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %s", err)
+	}
+
+	msg := []byte("Gday, world!")
+	sig, err := wallet.Sign(msg)
+	if err != nil {
+		t.Fatalf("Failed to sign message: %s", err)
+	}
+	assert.True(VerifySignature(wallet.PubkeyBytes(), sig, msg))
+
+	// Malleate the signature: (r, N-s) is valid ECDSA, but must be rejected.
+	s := new(big.Int).SetBytes(sig[32:])
+	highS := new(big.Int).Sub(elliptic.P256().Params().N, s)
+	malleated := append([]byte{}, sig[:32]...)
+	malleated = append(malleated, padBytes(highS.Bytes(), 32)...)
+
+	r := new(big.Int).SetBytes(sig[:32])
+	hash := sha256.Sum256(msg)
+	assert.True(ecdsa.Verify(wallet.Pubkey(), hash[:], r, highS))
+	assert.False(VerifySignature(wallet.PubkeyBytes(), malleated, msg))
+
+	// Unless high-S signatures are allowed.
+	assert.True(VerifySignatureAllowHighS(wallet.PubkeyBytes(), malleated, msg))
+	assert.True(VerifySignatureAllowHighS(wallet.PubkeyBytes(), sig, msg))
+}
@@ -380,7 +380,7 @@ func (expl *BlockExplorerServer) getAccount(w http.ResponseWriter, r *http.Reque
 
 	// Get all the transactions for an account.
 	db := expl.dag.GetDB()
-	rows, err := db.Query("SELECT hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version FROM transactions WHERE from_pubkey = ? OR to_pubkey = ?", accountPubkey[:], accountPubkey[:])
+	rows, err := db.Query("SELECT hash, witness_hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version FROM transactions WHERE from_pubkey = ? OR to_pubkey = ?", accountPubkey[:], accountPubkey[:])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -391,6 +391,7 @@ func (expl *BlockExplorerServer) getAccount(w http.ResponseWriter, r *http.Reque
 	for rows.Next() {
 		tx := nakamoto.Transaction{}
 		hash := []byte{}
+		witnessHash := []byte{}
 		sig := []byte{}
 		fromPubkey := []byte{}
 		toPubkey := []byte{}
@@ -399,13 +400,14 @@ func (expl *BlockExplorerServer) getAccount(w http.ResponseWriter, r *http.Reque
 		nonce := uint64(0)
 		version := 0 // TODO
 
-		err := rows.Scan(&hash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &version)
+		err := rows.Scan(&hash, &witnessHash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &version)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		copy(tx.Hash[:], hash)
+		copy(tx.WitnessHash[:], witnessHash)
 		copy(tx.Sig[:], sig)
 		copy(tx.FromPubkey[:], fromPubkey)
 		copy(tx.ToPubkey[:], toPubkey)
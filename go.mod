@@ -1,17 +1,18 @@
 module github.com/liamzebedee/tinychain-go
 
-go 1.22
+go 1.24
 
 // go 1.22.1
 
 require (
+	github.com/ethereum/go-ethereum v1.14.5
 	github.com/fatih/color v1.17.0
 	github.com/gorilla/mux v1.8.1
+	github.com/iden3/go-iden3-crypto v0.0.16
 	github.com/jackpal/bencode-go v1.0.2
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/pion/stun v0.6.1
 	github.com/stretchr/testify v1.9.0
-	github.com/triplewz/poseidon v0.0.1
 	github.com/urfave/cli/v2 v2.27.2
 	github.com/vocdoni/go-snark v0.0.0-20210614184457-1c2a880c9322
 	golang.org/x/text v0.16.0
@@ -20,14 +21,11 @@ require (
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/ethereum/go-ethereum v1.14.5 // indirect
-	github.com/iden3/go-iden3-crypto v0.0.16 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pion/dtls/v2 v2.2.11 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/transport/v2 v2.2.5 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rogpeppe/go-internal v1.10.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect